@@ -3,6 +3,7 @@ package api
 import (
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
@@ -10,6 +11,7 @@ import (
 	"p2p-chat/internal/chat"
 	"p2p-chat/internal/db"
 	"p2p-chat/internal/p2p"
+	"strconv"
 
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -24,19 +26,27 @@ type API struct {
 	privateChatManager  *chat.PrivateChatManager
 	groupChatManager    *chat.GroupChatManager
 	fileTransferManager *chat.FileTransferManager
+	contactManager      *chat.ContactManager
+	publisher           *p2p.UsernamePublisher
+	network             *p2p.NetworkMonitor
+	gater               *p2p.Gater
 	restPort            int
 	wsPort              int
 	staticFiles         embed.FS
 }
 
 // NewAPI creates a new API instance.
-func NewAPI(h host.Host, store *db.LevelDBStore, pcm *chat.PrivateChatManager, gcm *chat.GroupChatManager, ftm *chat.FileTransferManager, restPort, wsPort int, staticFiles embed.FS) *API {
+func NewAPI(h host.Host, store *db.LevelDBStore, pcm *chat.PrivateChatManager, gcm *chat.GroupChatManager, ftm *chat.FileTransferManager, cm *chat.ContactManager, publisher *p2p.UsernamePublisher, network *p2p.NetworkMonitor, gater *p2p.Gater, restPort, wsPort int, staticFiles embed.FS) *API {
 	return &API{
 		host:                h,
 		db:                  store,
 		privateChatManager:  pcm,
 		groupChatManager:    gcm,
 		fileTransferManager: ftm,
+		contactManager:      cm,
+		publisher:           publisher,
+		network:             network,
+		gater:               gater,
 		restPort:            restPort,
 		wsPort:              wsPort,
 		staticFiles:         staticFiles,
@@ -55,12 +65,50 @@ func (api *API) StartRestServer(port int) {
 
 	// API endpoints
 	http.HandleFunc("/api/ports", api.handleGetPorts)
+	http.HandleFunc("/api/username/status", api.handleGetUsernameStatus)
+	http.HandleFunc("/api/network", api.handleGetNetworkStatus)
+	http.HandleFunc("/acl", api.handleGetACL)
+	http.HandleFunc("/acl/block", api.handleACLAction)
+	http.HandleFunc("/acl/unblock", api.handleACLAction)
+	http.HandleFunc("/acl/allow", api.handleACLAction)
+	http.HandleFunc("/acl/disallow", api.handleACLAction)
+	http.HandleFunc("/acl/mode", api.handleSetACLMode)
 	http.HandleFunc("/peer/connect", api.handleConnectPeer)
 	http.HandleFunc("/peer/search", api.handleSearchPeer)
 	http.HandleFunc("/chat/private/send", api.handleSendPrivateMessage)
+	http.HandleFunc("/chat/private/read", api.handleMarkRead)
+	http.HandleFunc("/chat/private/history", api.handleGetHistory)
+	http.HandleFunc("/chat/private/thread", api.handleGetThread)
+	http.HandleFunc("/chat/private/react", api.handleReaction)
+	http.HandleFunc("/chat/private/unreact", api.handleReaction)
+	http.HandleFunc("/chat/private/edit", api.handleChangeMessage)
+	http.HandleFunc("/chat/private/delete", api.handleChangeMessage)
+	http.HandleFunc("/chat/private/timer", api.handleTimer)
+	http.HandleFunc("/search", api.handleSearch)
+	http.HandleFunc("/inbox", api.handleGetInbox)
+	http.HandleFunc("/inbox/read", api.handleInboxAction)
+	http.HandleFunc("/inbox/mute", api.handleInboxAction)
+	http.HandleFunc("/inbox/unmute", api.handleInboxAction)
+	http.HandleFunc("/inbox/archive", api.handleInboxAction)
+	http.HandleFunc("/inbox/unarchive", api.handleInboxAction)
+	http.HandleFunc("/outbox", api.handleGetOutbox)
+	http.HandleFunc("/outbox/cancel", api.handleOutboxAction)
+	http.HandleFunc("/outbox/resend", api.handleOutboxAction)
+	http.HandleFunc("/contact/list", api.handleListContacts)
+	http.HandleFunc("/contact/request", api.handleSendContactRequest)
+	http.HandleFunc("/contact/accept", api.handleContactAction)
+	http.HandleFunc("/contact/reject", api.handleContactAction)
+	http.HandleFunc("/contact/block", api.handleContactAction)
+	http.HandleFunc("/contact/remove", api.handleContactAction)
+	http.HandleFunc("/contact/quarantine", api.handleGetQuarantine)
 	http.HandleFunc("/group/create", api.handleCreateGroup)
 	http.HandleFunc("/group/add_member", api.handleAddMemberToGroup)
 	http.HandleFunc("/group/send_message", api.handleSendGroupMessage)
+	http.HandleFunc("/group/history", api.handleGetHistory)
+	http.HandleFunc("/group/thread", api.handleGetThread)
+	http.HandleFunc("/group/react", api.handleReaction)
+	http.HandleFunc("/group/unreact", api.handleReaction)
+	http.HandleFunc("/group/timer", api.handleTimer)
 	http.HandleFunc("/file/send", api.handleSendFile)
 
 	log.Printf("REST API server listening on :%d\n", port)
@@ -75,6 +123,113 @@ func (api *API) handleGetPorts(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (api *API) handleGetUsernameStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.publisher.Status())
+}
+
+func (api *API) handleGetNetworkStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.network.Status())
+}
+
+func (api *API) handleGetACL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"allow_list_only": api.gater.AllowListOnly(),
+		"blocked":         api.gater.BlockList(),
+		"allowed":         api.gater.AllowList(),
+	})
+}
+
+// handleACLAction adds or removes a peer from the block or allow list
+// depending on the request path.
+func (api *API) handleACLAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		PeerID string `json:"peer_id"`
+		Reason string `json:"reason"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	peerID, err := peer.Decode(req.PeerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid peer ID: %v", err), http.StatusBadRequest)
+		return
+	}
+	if peerID == api.host.ID() {
+		http.Error(w, "Cannot change access for our own peer ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/acl/block":
+		err = api.gater.Block(peerID, req.Reason)
+	case "/acl/unblock":
+		err = api.gater.Unblock(peerID)
+	case "/acl/allow":
+		err = api.gater.Allow(peerID, req.Reason)
+	case "/acl/disallow":
+		err = api.gater.Disallow(peerID)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update access control list: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+}
+
+func (api *API) handleSetACLMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		AllowListOnly bool `json:"allow_list_only"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := api.gater.SetAllowListOnly(req.AllowListOnly); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to set access control mode: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"allow_list_only": req.AllowListOnly})
+}
+
 func (api *API) handleConnectPeer(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -159,6 +314,7 @@ func (api *API) handleSendPrivateMessage(w http.ResponseWriter, r *http.Request)
 	var req struct {
 		PeerID  string `json:"peer_id"`
 		Message string `json:"message"`
+		ReplyTo string `json:"reply_to"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -167,14 +323,473 @@ func (api *API) handleSendPrivateMessage(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = api.privateChatManager.SendPrivateMessage(r.Context(), req.PeerID, req.Message)
+	msg, err := api.privateChatManager.SendPrivateMessage(r.Context(), req.PeerID, req.Message, req.ReplyTo)
+	if errors.Is(err, chat.ErrMessageNotFound) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to send private message: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	// Messages to unreachable peers wait in the outbox
+	if msg.Status == chat.MessagePending {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "queued", "message_id": msg.ID})
+		return
+	}
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "message sent"})
+	json.NewEncoder(w).Encode(map[string]string{"status": "message sent", "message_id": msg.ID})
+}
+
+func (api *API) handleGetOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries, err := api.privateChatManager.Outbox().List()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list outbox: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"outbox": entries})
+}
+
+func (api *API) handleOutboxAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		MessageID string `json:"message_id"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/outbox/cancel":
+		err = api.privateChatManager.Outbox().Cancel(req.MessageID)
+	case "/outbox/resend":
+		err = api.privateChatManager.Outbox().Resend(req.MessageID)
+	}
+	if errors.Is(err, chat.ErrNotQueued) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update outbox: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleSearch searches the chat history for the words in the q query
+// parameter, optionally within the conversation peer_id or group_id and
+// between the Unix times after and before.
+func (api *API) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	q := chat.SearchQuery{Query: params.Get("q"), PeerID: params.Get("peer_id"), GroupID: params.Get("group_id")}
+	for name, value := range map[string]*int64{"after": &q.After, "before": &q.Before} {
+		if s := params.Get(name); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("invalid query parameter '%s'", name), http.StatusBadRequest)
+				return
+			}
+			*value = n
+		}
+	}
+	if s := params.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid query parameter 'limit'", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+
+	results, total, err := chat.SearchMessages(api.db, q)
+	if errors.Is(err, chat.ErrInvalidQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to search messages: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"query": q.Query, "results": results, "total": total})
+}
+
+// handleGetInbox lists the conversations, sorted by the sort query parameter.
+// Archived conversations are left out unless archived is true, or all.
+func (api *API) handleGetInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	archived := new(bool)
+	switch r.URL.Query().Get("archived") {
+	case "", "false":
+	case "true":
+		*archived = true
+	case "all":
+		archived = nil
+	default:
+		http.Error(w, "invalid query parameter 'archived'", http.StatusBadRequest)
+		return
+	}
+
+	conversations, err := api.privateChatManager.Inbox().List(r.URL.Query().Get("sort"), archived)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"conversations": conversations})
+}
+
+// handleInboxAction marks a private chat or a group read, or changes its
+// flags, depending on the path. Marking a private chat read also sends the
+// peer a read receipt.
+func (api *API) handleInboxAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		PeerID  string `json:"peer_id"`
+		GroupID string `json:"group_id"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	inbox := api.privateChatManager.Inbox()
+	var conversation *chat.Conversation
+	switch r.URL.Path {
+	case "/inbox/read":
+		if req.PeerID == "" {
+			conversation, err = inbox.MarkGroupRead(req.GroupID)
+			break
+		}
+		if _, err = api.privateChatManager.MarkRead(r.Context(), req.PeerID, nil); err == nil {
+			conversation, err = inbox.Get(req.PeerID, "")
+		}
+	case "/inbox/mute":
+		conversation, err = inbox.SetMuted(req.PeerID, req.GroupID, true)
+	case "/inbox/unmute":
+		conversation, err = inbox.SetMuted(req.PeerID, req.GroupID, false)
+	case "/inbox/archive":
+		conversation, err = inbox.SetArchived(req.PeerID, req.GroupID, true)
+	case "/inbox/unarchive":
+		conversation, err = inbox.SetArchived(req.PeerID, req.GroupID, false)
+	}
+	if errors.Is(err, chat.ErrConversationNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update conversation: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"conversation": conversation})
+}
+
+func (api *API) handleMarkRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		PeerID     string   `json:"peer_id"`
+		MessageIDs []string `json:"message_ids"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	marked, err := api.privateChatManager.MarkRead(r.Context(), req.PeerID, req.MessageIDs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to mark messages read: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"marked": marked})
+}
+
+// handleChangeMessage edits or deletes a message we sent, depending on the path.
+func (api *API) handleChangeMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		PeerID    string `json:"peer_id"`
+		MessageID string `json:"message_id"`
+		Content   string `json:"content"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var msg *chat.PrivateMessage
+	switch r.URL.Path {
+	case "/chat/private/edit":
+		msg, err = api.privateChatManager.EditMessage(r.Context(), req.PeerID, req.MessageID, req.Content)
+	case "/chat/private/delete":
+		msg, err = api.privateChatManager.DeleteMessage(r.Context(), req.PeerID, req.MessageID)
+	}
+	switch {
+	case errors.Is(err, chat.ErrMessageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, chat.ErrNotEditable):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Failed to change message: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": msg})
+}
+
+// handleReaction adds or removes a reaction to a private or group message,
+// depending on the path.
+func (api *API) handleReaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		PeerID    string `json:"peer_id"`
+		GroupID   string `json:"group_id"`
+		MessageID string `json:"message_id"`
+		Emoji     string `json:"emoji"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var reactions map[string][]string
+	switch r.URL.Path {
+	case "/chat/private/react", "/chat/private/unreact":
+		add := r.URL.Path == "/chat/private/react"
+		reactions, err = api.privateChatManager.React(r.Context(), req.PeerID, req.MessageID, req.Emoji, add)
+	case "/group/react", "/group/unreact":
+		add := r.URL.Path == "/group/react"
+		reactions, err = api.groupChatManager.ReactGroup(r.Context(), req.GroupID, req.MessageID, req.Emoji, add)
+	}
+	if errors.Is(err, chat.ErrMessageNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update reaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message_id": req.MessageID, "reactions": reactions})
+}
+
+// handleTimer gets (GET) or sets (POST) the disappearing message timer of a
+// private chat or a group.
+func (api *API) handleTimer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PeerID  string `json:"peer_id"`
+		GroupID string `json:"group_id"`
+		TTL     int64  `json:"ttl"`
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		req.PeerID = r.URL.Query().Get("peer_id")
+		req.GroupID = r.URL.Query().Get("group_id")
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var timer *chat.DisappearingTimer
+	var err error
+	response := map[string]interface{}{}
+	switch r.URL.Path {
+	case "/chat/private/timer":
+		if r.Method == http.MethodGet {
+			timer, err = api.privateChatManager.GetTimer(req.PeerID)
+		} else {
+			timer, err = api.privateChatManager.SetTimer(r.Context(), req.PeerID, req.TTL)
+		}
+		response["peer_id"] = req.PeerID
+	case "/group/timer":
+		if r.Method == http.MethodGet {
+			timer, err = api.groupChatManager.GetGroupTimer(req.GroupID)
+		} else {
+			timer, err = api.groupChatManager.SetGroupTimer(r.Context(), req.GroupID, req.TTL)
+		}
+		response["group_id"] = req.GroupID
+	}
+	if errors.Is(err, chat.ErrInvalidTimer) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update timer: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response["timer"] = timer
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (api *API) handleListContacts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contacts, err := api.contactManager.ListContacts(r.URL.Query().Get("status"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list contacts: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"contacts": contacts})
+}
+
+func (api *API) handleSendContactRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		PeerID string `json:"peer_id"`
+		Note   string `json:"note"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	contact, err := api.contactManager.SendContactRequest(r.Context(), req.PeerID, req.Note)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to send contact request: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"contact": contact})
+}
+
+// handleContactAction accepts, rejects, blocks or removes a contact depending
+// on the request path.
+func (api *API) handleContactAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		PeerID string `json:"peer_id"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var contact *chat.Contact
+	switch r.URL.Path {
+	case "/contact/accept":
+		contact, err = api.contactManager.Accept(r.Context(), req.PeerID)
+	case "/contact/reject":
+		contact, err = api.contactManager.Reject(req.PeerID)
+	case "/contact/block":
+		contact, err = api.contactManager.Block(req.PeerID)
+	case "/contact/remove":
+		err = api.contactManager.Remove(req.PeerID)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update contact: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"contact": contact})
+}
+
+func (api *API) handleGetQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	peerID := r.URL.Query().Get("peer_id")
+	if peerID == "" {
+		http.Error(w, "Query parameter 'peer_id' is required", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := api.contactManager.GetQuarantinedMessages(peerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get quarantined messages: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"peer_id": peerID, "messages": messages})
 }
 
 func (api *API) handleCreateGroup(w http.ResponseWriter, r *http.Request) {
@@ -253,6 +868,7 @@ func (api *API) handleSendGroupMessage(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		GroupID string `json:"group_id"`
 		Message string `json:"message"`
+		ReplyTo string `json:"reply_to"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -261,14 +877,141 @@ func (api *API) handleSendGroupMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = api.groupChatManager.SendGroupMessage(r.Context(), req.GroupID, req.Message)
+	msg, err := api.groupChatManager.SendGroupMessage(r.Context(), req.GroupID, req.Message, req.ReplyTo)
+	if errors.Is(err, chat.ErrMessageNotFound) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to send group message: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "group message sent"})
+	json.NewEncoder(w).Encode(map[string]string{"status": "group message sent", "message_id": msg.ID})
+}
+
+// handleGetThread returns the thread of a private or group message,
+// depending on the path.
+func (api *API) handleGetThread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	messageID := r.URL.Query().Get("message_id")
+	if messageID == "" {
+		http.Error(w, "Query parameter 'message_id' is required", http.StatusBadRequest)
+		return
+	}
+
+	var response map[string]interface{}
+	var err error
+	switch r.URL.Path {
+	case "/chat/private/thread":
+		peerID := r.URL.Query().Get("peer_id")
+		if peerID == "" {
+			http.Error(w, "Query parameter 'peer_id' is required", http.StatusBadRequest)
+			return
+		}
+		var thread []*chat.PrivateMessage
+		thread, err = api.privateChatManager.GetThread(peerID, messageID)
+		response = map[string]interface{}{"peer_id": peerID, "thread": thread}
+	case "/group/thread":
+		groupID := r.URL.Query().Get("group_id")
+		if groupID == "" {
+			http.Error(w, "Query parameter 'group_id' is required", http.StatusBadRequest)
+			return
+		}
+		var thread []*chat.GroupMessage
+		thread, err = api.groupChatManager.GetGroupThread(groupID, messageID)
+		response = map[string]interface{}{"group_id": groupID, "thread": thread}
+	}
+	if errors.Is(err, chat.ErrMessageNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get thread: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleGetHistory returns a page of the history of a private chat or a
+// group, depending on the path.
+func (api *API) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := historyQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var response map[string]interface{}
+	var more bool
+	switch r.URL.Path {
+	case "/chat/private/history":
+		peerID := r.URL.Query().Get("peer_id")
+		if peerID == "" {
+			http.Error(w, "Query parameter 'peer_id' is required", http.StatusBadRequest)
+			return
+		}
+		var history []*chat.PrivateMessage
+		history, more, err = api.privateChatManager.GetChatHistoryPage(peerID, q)
+		response = map[string]interface{}{"peer_id": peerID, "history": history}
+	case "/group/history":
+		groupID := r.URL.Query().Get("group_id")
+		if groupID == "" {
+			http.Error(w, "Query parameter 'group_id' is required", http.StatusBadRequest)
+			return
+		}
+		var history []*chat.GroupMessage
+		history, more, err = api.groupChatManager.GetGroupHistoryPage(groupID, q)
+		response = map[string]interface{}{"group_id": groupID, "history": history}
+	}
+	if errors.Is(err, chat.ErrMessageNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get history: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response["has_more"] = more
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// historyQuery reads the page of a history a request asks for from its
+// before, after, before_time, after_time and limit query parameters.
+func historyQuery(r *http.Request) (chat.HistoryQuery, error) {
+	params := r.URL.Query()
+	q := chat.HistoryQuery{Before: params.Get("before"), After: params.Get("after")}
+	for name, value := range map[string]*int64{"before_time": &q.BeforeTime, "after_time": &q.AfterTime} {
+		if s := params.Get(name); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("invalid query parameter '%s'", name)
+			}
+			*value = n
+		}
+	}
+	if s := params.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, errors.New("invalid query parameter 'limit'")
+		}
+		q.Limit = n
+	}
+	return q, nil
 }
 
 func (api *API) handleSendFile(w http.ResponseWriter, r *http.Request) {
@@ -1,11 +1,13 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"p2p-chat/internal/chat"
 	"p2p-chat/internal/db"
+	"p2p-chat/internal/p2p"
 	"sync"
 	"time"
 
@@ -27,29 +29,35 @@ type WebSocketAPI struct {
 	privateChatManager  *chat.PrivateChatManager
 	groupChatManager    *chat.GroupChatManager
 	fileTransferManager *chat.FileTransferManager
+	contactManager      *chat.ContactManager
+	publisher           *p2p.UsernamePublisher
+	network             *p2p.NetworkMonitor
 	clients             map[*websocket.Conn]bool
 	clientsMutex        sync.RWMutex
-	bootstrapPeer       string
+	bootstrapper        *p2p.Bootstrapper
 }
 
 // NewWebSocketAPI creates a new WebSocketAPI instance.
-func NewWebSocketAPI(h host.Host, store *db.LevelDBStore, pcm *chat.PrivateChatManager, gcm *chat.GroupChatManager, ftm *chat.FileTransferManager, bootstrapPeer string) *WebSocketAPI {
+func NewWebSocketAPI(h host.Host, store *db.LevelDBStore, pcm *chat.PrivateChatManager, gcm *chat.GroupChatManager, ftm *chat.FileTransferManager, publisher *p2p.UsernamePublisher, network *p2p.NetworkMonitor, bootstrapper *p2p.Bootstrapper) *WebSocketAPI {
 	return &WebSocketAPI{
 		host:                h,
 		db:                  store,
 		privateChatManager:  pcm,
 		groupChatManager:    gcm,
 		fileTransferManager: ftm,
+		publisher:           publisher,
+		network:             network,
 		clients:             make(map[*websocket.Conn]bool),
-		bootstrapPeer:       bootstrapPeer,
+		bootstrapper:        bootstrapper,
 	}
 }
 
-// SetManagers sets the chat and file transfer managers for the WebSocket API.
-func (wsapi *WebSocketAPI) SetManagers(pcm *chat.PrivateChatManager, gcm *chat.GroupChatManager, ftm *chat.FileTransferManager) {
+// SetManagers sets the chat, file transfer and contact managers for the WebSocket API.
+func (wsapi *WebSocketAPI) SetManagers(pcm *chat.PrivateChatManager, gcm *chat.GroupChatManager, ftm *chat.FileTransferManager, cm *chat.ContactManager) {
 	wsapi.privateChatManager = pcm
 	wsapi.groupChatManager = gcm
 	wsapi.fileTransferManager = ftm
+	wsapi.contactManager = cm
 }
 
 // StartWebSocketServer starts the WebSocket server.
@@ -116,6 +124,36 @@ func (wsapi *WebSocketAPI) handleWebSocketMessage(conn *websocket.Conn, msg map[
 		wsapi.handleGetReceivedFiles(conn)
 	case "get_chat_history":
 		wsapi.handleGetChatHistory(conn, msg)
+	case "add_reaction", "remove_reaction":
+		wsapi.handleReaction(conn, msgType, msg)
+	case "get_thread":
+		wsapi.handleGetThread(conn, msg)
+	case "get_timer", "set_timer":
+		wsapi.handleTimer(conn, msgType, msg)
+	case "mark_read":
+		wsapi.handleMarkRead(conn, msg)
+	case "edit_message", "delete_message":
+		wsapi.handleChangeMessage(conn, msgType, msg)
+	case "search":
+		wsapi.handleSearch(conn, msg)
+	case "get_inbox":
+		wsapi.handleGetInbox(conn, msg)
+	case "read_conversation", "mute_conversation", "unmute_conversation", "archive_conversation", "unarchive_conversation":
+		wsapi.handleInboxAction(conn, msgType, msg)
+	case "get_outbox":
+		wsapi.handleGetOutbox(conn)
+	case "cancel_queued", "resend_queued":
+		wsapi.handleOutboxAction(conn, msgType, msg)
+	case "get_username_status":
+		wsapi.handleGetUsernameStatus(conn)
+	case "get_network_status":
+		wsapi.handleGetNetworkStatus(conn)
+	case "get_contacts":
+		wsapi.handleGetContacts(conn, msg)
+	case "get_quarantine":
+		wsapi.handleGetQuarantine(conn, msg)
+	case "send_contact_request", "accept_contact", "reject_contact", "block_contact", "remove_contact":
+		wsapi.handleContactAction(conn, msgType, msg)
 	default:
 		wsapi.sendError(conn, fmt.Sprintf("Unknown message type: %s", msgType))
 	}
@@ -136,16 +174,13 @@ func (wsapi *WebSocketAPI) handleGetPeerInfo(conn *websocket.Conn) {
 func (wsapi *WebSocketAPI) handleGetConnectedPeers(conn *websocket.Conn) {
 	peers := wsapi.host.Network().Peers()
 	var peerList []string
-	var bootstrapPeerID peer.ID
-	if wsapi.bootstrapPeer != "" {
-		p, err := peer.AddrInfoFromString(wsapi.bootstrapPeer)
-		if err == nil {
-			bootstrapPeerID = p.ID
-		}
+	bootstrapPeerIDs := make(map[peer.ID]bool)
+	for _, p := range wsapi.bootstrapper.Peers() {
+		bootstrapPeerIDs[p.ID] = true
 	}
 
 	for _, peer := range peers {
-		if peer != bootstrapPeerID {
+		if !bootstrapPeerIDs[peer] {
 			peerList = append(peerList, peer.String())
 		}
 	}
@@ -206,27 +241,472 @@ func (wsapi *WebSocketAPI) handleGetReceivedFiles(conn *websocket.Conn) {
 	}
 }
 
+// handleGetChatHistory returns a page of the history of the chat with
+// peer_id, or of the group group_id, selected by the optional before, after,
+// before_time, after_time and limit fields. The cursors are echoed, so
+// clients can tell older pages from newer ones.
 func (wsapi *WebSocketAPI) handleGetChatHistory(conn *websocket.Conn, msg map[string]interface{}) {
+	q := chat.HistoryQuery{}
+	q.Before, _ = msg["before"].(string)
+	q.After, _ = msg["after"].(string)
+	if value, ok := msg["before_time"].(float64); ok {
+		q.BeforeTime = int64(value)
+	}
+	if value, ok := msg["after_time"].(float64); ok {
+		q.AfterTime = int64(value)
+	}
+	if value, ok := msg["limit"].(float64); ok {
+		q.Limit = int(value)
+	}
+
+	response := map[string]interface{}{
+		"type":   "chat_history",
+		"before": q.Before,
+		"after":  q.After,
+	}
+	var more bool
+	var err error
+	if groupID, ok := msg["group_id"].(string); ok {
+		var history []*chat.GroupMessage
+		history, more, err = wsapi.groupChatManager.GetGroupHistoryPage(groupID, q)
+		response["group_id"] = groupID
+		response["history"] = history
+	} else if peerID, ok := msg["peer_id"].(string); ok {
+		var history []*chat.PrivateMessage
+		history, more, err = wsapi.privateChatManager.GetChatHistoryPage(peerID, q)
+		response["peer_id"] = peerID
+		response["history"] = history
+	} else {
+		wsapi.sendError(conn, "Invalid message format: missing 'peer_id' or 'group_id' field")
+		return
+	}
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to get chat history: %v", err))
+		return
+	}
+
+	response["has_more"] = more
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send chat history: %v\n", err)
+	}
+}
+
+// handleReaction adds or removes a reaction to a message in the chat with
+// peer_id, or in the group group_id. The result reaches all connected
+// clients as a reaction_updated event.
+func (wsapi *WebSocketAPI) handleReaction(conn *websocket.Conn, action string, msg map[string]interface{}) {
+	messageID, ok := msg["message_id"].(string)
+	if !ok {
+		wsapi.sendError(conn, "Invalid message format: missing 'message_id' field")
+		return
+	}
+	emoji, ok := msg["emoji"].(string)
+	if !ok {
+		wsapi.sendError(conn, "Invalid message format: missing 'emoji' field")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	add := action == "add_reaction"
+	var err error
+	if groupID, ok := msg["group_id"].(string); ok {
+		_, err = wsapi.groupChatManager.ReactGroup(ctx, groupID, messageID, emoji, add)
+	} else if peerID, ok := msg["peer_id"].(string); ok {
+		_, err = wsapi.privateChatManager.React(ctx, peerID, messageID, emoji, add)
+	} else {
+		wsapi.sendError(conn, "Invalid message format: missing 'peer_id' or 'group_id' field")
+		return
+	}
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to update reaction: %v", err))
+	}
+}
+
+// handleTimer returns the disappearing message timer of the chat with
+// peer_id, or of the group group_id, after setting it to ttl for set_timer.
+func (wsapi *WebSocketAPI) handleTimer(conn *websocket.Conn, action string, msg map[string]interface{}) {
+	var ttl int64
+	if action == "set_timer" {
+		value, ok := msg["ttl"].(float64)
+		if !ok {
+			wsapi.sendError(conn, "Invalid message format: missing 'ttl' field")
+			return
+		}
+		ttl = int64(value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	response := map[string]interface{}{"type": "timer"}
+	var timer *chat.DisappearingTimer
+	var err error
+	if groupID, ok := msg["group_id"].(string); ok {
+		if action == "set_timer" {
+			timer, err = wsapi.groupChatManager.SetGroupTimer(ctx, groupID, ttl)
+		} else {
+			timer, err = wsapi.groupChatManager.GetGroupTimer(groupID)
+		}
+		response["group_id"] = groupID
+	} else if peerID, ok := msg["peer_id"].(string); ok {
+		if action == "set_timer" {
+			timer, err = wsapi.privateChatManager.SetTimer(ctx, peerID, ttl)
+		} else {
+			timer, err = wsapi.privateChatManager.GetTimer(peerID)
+		}
+		response["peer_id"] = peerID
+	} else {
+		wsapi.sendError(conn, "Invalid message format: missing 'peer_id' or 'group_id' field")
+		return
+	}
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to update timer: %v", err))
+		return
+	}
+
+	response["timer"] = timer
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send timer: %v\n", err)
+	}
+}
+
+// handleGetThread returns the thread of a message in the chat with peer_id,
+// or in the group group_id.
+func (wsapi *WebSocketAPI) handleGetThread(conn *websocket.Conn, msg map[string]interface{}) {
+	messageID, ok := msg["message_id"].(string)
+	if !ok {
+		wsapi.sendError(conn, "Invalid message format: missing 'message_id' field")
+		return
+	}
+
+	response := map[string]interface{}{
+		"type":       "thread",
+		"message_id": messageID,
+	}
+	if groupID, ok := msg["group_id"].(string); ok {
+		thread, err := wsapi.groupChatManager.GetGroupThread(groupID, messageID)
+		if err != nil {
+			wsapi.sendError(conn, fmt.Sprintf("Failed to get thread: %v", err))
+			return
+		}
+		response["group_id"] = groupID
+		response["thread"] = thread
+	} else if peerID, ok := msg["peer_id"].(string); ok {
+		thread, err := wsapi.privateChatManager.GetThread(peerID, messageID)
+		if err != nil {
+			wsapi.sendError(conn, fmt.Sprintf("Failed to get thread: %v", err))
+			return
+		}
+		response["peer_id"] = peerID
+		response["thread"] = thread
+	} else {
+		wsapi.sendError(conn, "Invalid message format: missing 'peer_id' or 'group_id' field")
+		return
+	}
+
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send thread: %v\n", err)
+	}
+}
+
+// handleMarkRead marks messages from a peer read. Each change is pushed to
+// all clients as a message_status event.
+func (wsapi *WebSocketAPI) handleMarkRead(conn *websocket.Conn, msg map[string]interface{}) {
+	peerID, ok := msg["peer_id"].(string)
+	if !ok {
+		wsapi.sendError(conn, "Invalid message format: missing 'peer_id' field")
+		return
+	}
+
+	var messageIDs []string
+	if ids, ok := msg["message_ids"].([]interface{}); ok {
+		for _, id := range ids {
+			if s, ok := id.(string); ok {
+				messageIDs = append(messageIDs, s)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := wsapi.privateChatManager.MarkRead(ctx, peerID, messageIDs); err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to mark messages read: %v", err))
+	}
+}
+
+// handleChangeMessage edits or deletes a message we sent. The result reaches
+// all connected clients as a message_edited or message_deleted event.
+func (wsapi *WebSocketAPI) handleChangeMessage(conn *websocket.Conn, action string, msg map[string]interface{}) {
 	peerID, ok := msg["peer_id"].(string)
 	if !ok {
 		wsapi.sendError(conn, "Invalid message format: missing 'peer_id' field")
 		return
 	}
+	messageID, ok := msg["message_id"].(string)
+	if !ok {
+		wsapi.sendError(conn, "Invalid message format: missing 'message_id' field")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	history, err := wsapi.privateChatManager.GetChatHistory(peerID)
+	var err error
+	switch action {
+	case "edit_message":
+		content, ok := msg["content"].(string)
+		if !ok {
+			wsapi.sendError(conn, "Invalid message format: missing 'content' field")
+			return
+		}
+		_, err = wsapi.privateChatManager.EditMessage(ctx, peerID, messageID, content)
+	case "delete_message":
+		_, err = wsapi.privateChatManager.DeleteMessage(ctx, peerID, messageID)
+	}
 	if err != nil {
-		wsapi.sendError(conn, fmt.Sprintf("Failed to get chat history: %v", err))
+		wsapi.sendError(conn, fmt.Sprintf("Failed to change message: %v", err))
+	}
+}
+
+// handleSearch searches the chat history for the words in query, optionally
+// within the conversation peer_id or group_id and between the Unix times
+// after and before.
+func (wsapi *WebSocketAPI) handleSearch(conn *websocket.Conn, msg map[string]interface{}) {
+	query, ok := msg["query"].(string)
+	if !ok {
+		wsapi.sendError(conn, "Invalid message format: missing 'query' field")
+		return
+	}
+	q := chat.SearchQuery{Query: query}
+	q.PeerID, _ = msg["peer_id"].(string)
+	q.GroupID, _ = msg["group_id"].(string)
+	if value, ok := msg["after"].(float64); ok {
+		q.After = int64(value)
+	}
+	if value, ok := msg["before"].(float64); ok {
+		q.Before = int64(value)
+	}
+	if value, ok := msg["limit"].(float64); ok {
+		q.Limit = int(value)
+	}
+
+	results, total, err := chat.SearchMessages(wsapi.db, q)
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to search messages: %v", err))
 		return
 	}
 
 	response := map[string]interface{}{
-		"type":    "chat_history",
-		"peer_id": peerID,
-		"history": history,
+		"type":    "search_results",
+		"query":   query,
+		"results": results,
+		"total":   total,
 	}
 
 	if err := conn.WriteJSON(response); err != nil {
-		log.Printf("Failed to send chat history: %v\n", err)
+		log.Printf("Failed to send search results: %v\n", err)
+	}
+}
+
+// handleGetInbox lists the conversations, sorted by the optional sort field.
+// Archived conversations are left out unless archived is true, or "all".
+func (wsapi *WebSocketAPI) handleGetInbox(conn *websocket.Conn, msg map[string]interface{}) {
+	order, _ := msg["sort"].(string)
+	archived := new(bool)
+	switch value := msg["archived"].(type) {
+	case bool:
+		*archived = value
+	case string:
+		if value == "all" {
+			archived = nil
+		}
+	}
+
+	conversations, err := wsapi.privateChatManager.Inbox().List(order, archived)
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to list conversations: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"type":          "inbox",
+		"conversations": conversations,
+	}
+
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send inbox: %v\n", err)
+	}
+}
+
+// handleInboxAction marks the chat with peer_id, or the group group_id, read
+// or changes its flags. The outcome is pushed to all clients as a
+// conversation_updated event.
+func (wsapi *WebSocketAPI) handleInboxAction(conn *websocket.Conn, action string, msg map[string]interface{}) {
+	peerID, _ := msg["peer_id"].(string)
+	groupID, _ := msg["group_id"].(string)
+	if peerID == "" && groupID == "" {
+		wsapi.sendError(conn, "Invalid message format: missing 'peer_id' or 'group_id' field")
+		return
+	}
+
+	inbox := wsapi.privateChatManager.Inbox()
+	var err error
+	switch action {
+	case "read_conversation":
+		if peerID == "" {
+			_, err = inbox.MarkGroupRead(groupID)
+			break
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, err = wsapi.privateChatManager.MarkRead(ctx, peerID, nil)
+	case "mute_conversation":
+		_, err = inbox.SetMuted(peerID, groupID, true)
+	case "unmute_conversation":
+		_, err = inbox.SetMuted(peerID, groupID, false)
+	case "archive_conversation":
+		_, err = inbox.SetArchived(peerID, groupID, true)
+	case "unarchive_conversation":
+		_, err = inbox.SetArchived(peerID, groupID, false)
+	}
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to update conversation: %v", err))
+	}
+}
+
+func (wsapi *WebSocketAPI) handleGetOutbox(conn *websocket.Conn) {
+	entries, err := wsapi.privateChatManager.Outbox().List()
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to list outbox: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"type":   "outbox",
+		"outbox": entries,
+	}
+
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send outbox: %v\n", err)
+	}
+}
+
+// handleOutboxAction cancels or resends a queued message. The outcome is
+// pushed to all clients as a message_status event.
+func (wsapi *WebSocketAPI) handleOutboxAction(conn *websocket.Conn, action string, msg map[string]interface{}) {
+	messageID, ok := msg["message_id"].(string)
+	if !ok {
+		wsapi.sendError(conn, "Invalid message format: missing 'message_id' field")
+		return
+	}
+
+	var err error
+	switch action {
+	case "cancel_queued":
+		err = wsapi.privateChatManager.Outbox().Cancel(messageID)
+	case "resend_queued":
+		err = wsapi.privateChatManager.Outbox().Resend(messageID)
+	}
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to update outbox: %v", err))
+	}
+}
+
+func (wsapi *WebSocketAPI) handleGetUsernameStatus(conn *websocket.Conn) {
+	response := map[string]interface{}{
+		"type":   "username_status",
+		"status": wsapi.publisher.Status(),
+	}
+
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send username status: %v\n", err)
+	}
+}
+
+func (wsapi *WebSocketAPI) handleGetNetworkStatus(conn *websocket.Conn) {
+	response := map[string]interface{}{
+		"type":   "network_status",
+		"status": wsapi.network.Status(),
+	}
+
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send network status: %v\n", err)
+	}
+}
+
+func (wsapi *WebSocketAPI) handleGetContacts(conn *websocket.Conn, msg map[string]interface{}) {
+	status, _ := msg["status"].(string)
+	contacts, err := wsapi.contactManager.ListContacts(status)
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to list contacts: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"type":     "contacts",
+		"contacts": contacts,
+	}
+
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send contacts: %v\n", err)
+	}
+}
+
+func (wsapi *WebSocketAPI) handleGetQuarantine(conn *websocket.Conn, msg map[string]interface{}) {
+	peerID, ok := msg["peer_id"].(string)
+	if !ok {
+		wsapi.sendError(conn, "Invalid message format: missing 'peer_id' field")
+		return
+	}
+
+	messages, err := wsapi.contactManager.GetQuarantinedMessages(peerID)
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to get quarantined messages: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"type":     "quarantine",
+		"peer_id":  peerID,
+		"messages": messages,
+	}
+
+	if err := conn.WriteJSON(response); err != nil {
+		log.Printf("Failed to send quarantined messages: %v\n", err)
+	}
+}
+
+// handleContactAction runs a contact request action. The resulting change is
+// pushed to all clients as a contact_updated event.
+func (wsapi *WebSocketAPI) handleContactAction(conn *websocket.Conn, action string, msg map[string]interface{}) {
+	peerID, ok := msg["peer_id"].(string)
+	if !ok {
+		wsapi.sendError(conn, "Invalid message format: missing 'peer_id' field")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var err error
+	switch action {
+	case "send_contact_request":
+		note, _ := msg["note"].(string)
+		_, err = wsapi.contactManager.SendContactRequest(ctx, peerID, note)
+	case "accept_contact":
+		_, err = wsapi.contactManager.Accept(ctx, peerID)
+	case "reject_contact":
+		_, err = wsapi.contactManager.Reject(peerID)
+	case "block_contact":
+		_, err = wsapi.contactManager.Block(peerID)
+	case "remove_contact":
+		err = wsapi.contactManager.Remove(peerID)
+	}
+	if err != nil {
+		wsapi.sendError(conn, fmt.Sprintf("Failed to update contact: %v", err))
 	}
 }
 
@@ -270,3 +750,16 @@ func (wsapi *WebSocketAPI) NotifyNewMessage(senderID, message, messageType strin
 
 	wsapi.BroadcastMessage(notification)
 }
+
+// NotifyEvent notifies all clients about an event of the given type.
+func (wsapi *WebSocketAPI) NotifyEvent(eventType string, payload map[string]interface{}) {
+	notification := map[string]interface{}{
+		"type":      eventType,
+		"timestamp": time.Now().Unix(),
+	}
+	for k, v := range payload {
+		notification[k] = v
+	}
+
+	wsapi.BroadcastMessage(notification)
+}
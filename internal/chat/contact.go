@@ -0,0 +1,711 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"io"
+	"log"
+	"p2p-chat/internal/db"
+	"p2p-chat/internal/p2p"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContactProtocol is the legacy contact protocol, which sends bare JSON.
+// ContactProtocolV2 sends the same message as the payload of an Envelope.
+const (
+	ContactProtocol   = protocol.ID("/p2p-chat/contact/1.0.0")
+	ContactProtocolV2 = protocol.ID("/p2p-chat/contact/2.0.0")
+)
+
+// maxContactMessageSize bounds how much we read from a contact stream.
+const maxContactMessageSize = 4096
+
+// maxIntroNoteLength bounds the intro note attached to a contact request.
+const maxIntroNoteLength = 500
+
+// Quarantine limits per peer. Messages from a stranger beyond them are dropped.
+const (
+	maxQuarantinedMessages = 100
+	maxQuarantinedBytes    = 256 * 1024
+)
+
+// Contact statuses.
+const (
+	// ContactPending is an incoming request waiting for our decision.
+	ContactPending = "pending"
+	// ContactRequested is a request we sent that was not answered yet.
+	ContactRequested = "requested"
+	ContactAccepted  = "accepted"
+	ContactRejected  = "rejected"
+	ContactBlocked   = "blocked"
+)
+
+// Contact message types sent over ContactProtocol.
+const (
+	contactRequest = "request"
+	contactAccept  = "accept"
+)
+
+// ErrContactNotFound is returned for peers we have no contact record for.
+var ErrContactNotFound = errors.New("contact not found")
+
+// Contact is our relationship with another peer.
+type Contact struct {
+	PeerID    string `json:"peer_id"`
+	Status    string `json:"status"`
+	Note      string `json:"note,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+type contactMessage struct {
+	Type string `json:"type"`
+	Note string `json:"note,omitempty"`
+}
+
+type contactResponse struct {
+	Status string `json:"status"`
+}
+
+// ContactManager tracks contact requests and decides whose private messages
+// are delivered. Messages from peers that are not accepted contacts are held
+// in quarantine until their request is accepted.
+type ContactManager struct {
+	host     host.Host
+	db       *db.LevelDBStore
+	notifier Notifier
+	gater    *p2p.Gater
+	inbox    *Inbox
+	mutex    sync.Mutex
+}
+
+// NewContactManager creates a new ContactManager. Blocking a contact also
+// blocks it at the connection layer through gater. Released quarantined
+// messages are added to inbox.
+func NewContactManager(h host.Host, store *db.LevelDBStore, notifier Notifier, gater *p2p.Gater, inbox *Inbox) *ContactManager {
+	return &ContactManager{
+		host:     h,
+		db:       store,
+		notifier: notifier,
+		gater:    gater,
+		inbox:    inbox,
+	}
+}
+
+// HandleContactStream handles contact requests and acceptances from other peers.
+func (cm *ContactManager) HandleContactStream(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+
+	var env *Envelope
+	var data []byte
+	var err error
+	if s.Protocol() == ContactProtocolV2 {
+		env, err = readEnvelopeFrom(s)
+		if err == nil && env.Type != EnvelopeContact {
+			err = fmt.Errorf("unexpected %s envelope", env.Type)
+		}
+		if env != nil {
+			data = env.Payload
+		}
+	} else {
+		data, err = io.ReadAll(io.LimitReader(s, maxContactMessageSize))
+	}
+	if err != nil {
+		log.Printf("Error reading from contact stream: %v\n", err)
+		return
+	}
+	var msg contactMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("Invalid contact message from %s: %v\n", remote.String(), err)
+		return
+	}
+
+	var status string
+	switch msg.Type {
+	case contactRequest:
+		status, err = cm.receiveRequest(remote, truncateNote(msg.Note))
+	case contactAccept:
+		status, err = cm.receiveAccept(remote)
+	default:
+		log.Printf("Unknown contact message type %q from %s\n", msg.Type, remote.String())
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to handle contact %s from %s: %v\n", msg.Type, remote.String(), err)
+		return
+	}
+
+	if env != nil {
+		writeResponse(s, env, status)
+		return
+	}
+	resp, _ := json.Marshal(contactResponse{Status: status})
+	s.Write(resp)
+}
+
+// receiveRequest records an incoming request and returns the status to
+// report back. Blocked peers are told their request is pending.
+func (cm *ContactManager) receiveRequest(peerID peer.ID, note string) (string, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	contact, err := cm.getContact(peerID)
+	if err != nil && !errors.Is(err, ErrContactNotFound) {
+		return "", err
+	}
+
+	switch {
+	case contact != nil && contact.Status == ContactBlocked:
+		return ContactPending, nil
+	case contact != nil && contact.Status == ContactAccepted:
+		return ContactAccepted, nil
+	case contact != nil && contact.Status == ContactRequested:
+		// Both sides asked each other, no need to wait for a decision
+		contact.Status = ContactAccepted
+		if err := cm.saveContact(contact); err != nil {
+			return "", err
+		}
+		if err := cm.releaseQuarantine(peerID); err != nil {
+			return "", err
+		}
+		return ContactAccepted, nil
+	}
+
+	if contact == nil {
+		contact = &Contact{PeerID: peerID.String(), CreatedAt: time.Now().Unix()}
+	}
+	contact.Status = ContactPending
+	contact.Note = note
+	if err := cm.saveContact(contact); err != nil {
+		return "", err
+	}
+	log.Printf("Contact request from %s\n", peerID.String())
+	if cm.notifier != nil {
+		cm.notifier.NotifyEvent("contact_request", map[string]interface{}{"contact": contact})
+	}
+	return ContactPending, nil
+}
+
+// receiveAccept marks a peer we sent a request to as accepted.
+func (cm *ContactManager) receiveAccept(peerID peer.ID) (string, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	contact, err := cm.getContact(peerID)
+	if errors.Is(err, ErrContactNotFound) {
+		// We never asked; ignore unsolicited acceptances
+		return "", errors.New("no contact request was sent")
+	}
+	if err != nil {
+		return "", err
+	}
+	if contact.Status != ContactRequested && contact.Status != ContactAccepted {
+		return contact.Status, nil
+	}
+	contact.Status = ContactAccepted
+	if err := cm.saveContact(contact); err != nil {
+		return "", err
+	}
+	log.Printf("Contact request accepted by %s\n", peerID.String())
+	return ContactAccepted, nil
+}
+
+// SendContactRequest asks peerID to accept us as a contact. Messages we send
+// to them are quarantined on their side until they do.
+func (cm *ContactManager) SendContactRequest(ctx context.Context, peerIDStr, note string) (*Contact, error) {
+	peerID, err := cm.decodePeer(peerIDStr)
+	if err != nil {
+		return nil, err
+	}
+	if len(note) > maxIntroNoteLength {
+		return nil, fmt.Errorf("intro note is longer than %d bytes", maxIntroNoteLength)
+	}
+
+	// A pending request from them is answered by accepting it
+	contact, err := cm.GetContact(peerID)
+	if err == nil && contact.Status == ContactPending {
+		return cm.Accept(ctx, peerIDStr)
+	}
+	if err == nil && contact.Status == ContactBlocked {
+		return nil, errors.New("peer is blocked")
+	}
+
+	contact, err = cm.setStatus(peerID, ContactRequested, func(c *Contact) bool {
+		return c.Status != ContactAccepted && c.Status != ContactBlocked
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := cm.send(ctx, peerID, contactMessage{Type: contactRequest, Note: note})
+	if err != nil {
+		return contact, err
+	}
+	if status == ContactAccepted {
+		return cm.setStatus(peerID, ContactAccepted, func(c *Contact) bool {
+			return c.Status == ContactRequested
+		})
+	}
+	return contact, nil
+}
+
+// Accept accepts a pending contact request, moves the peer's quarantined
+// messages into the chat history and lets the peer know.
+func (cm *ContactManager) Accept(ctx context.Context, peerIDStr string) (*Contact, error) {
+	peerID, err := cm.decodePeer(peerIDStr)
+	if err != nil {
+		return nil, err
+	}
+
+	cm.mutex.Lock()
+	contact, err := cm.getContact(peerID)
+	if errors.Is(err, ErrContactNotFound) {
+		contact = &Contact{PeerID: peerID.String(), CreatedAt: time.Now().Unix()}
+	} else if err != nil {
+		cm.mutex.Unlock()
+		return nil, err
+	}
+	contact.Status = ContactAccepted
+	err = cm.saveContact(contact)
+	if err == nil {
+		err = cm.releaseQuarantine(peerID)
+	}
+	cm.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := cm.send(ctx, peerID, contactMessage{Type: contactAccept}); err != nil {
+		// They will learn about it from our first message
+		log.Printf("Failed to notify %s of accepted contact request: %v\n", peerID.String(), err)
+	}
+	return contact, nil
+}
+
+// Reject declines a contact request and discards the peer's quarantined
+// messages. The peer may send a new request later.
+func (cm *ContactManager) Reject(peerIDStr string) (*Contact, error) {
+	peerID, err := cm.decodePeer(peerIDStr)
+	if err != nil {
+		return nil, err
+	}
+	contact, err := cm.setStatus(peerID, ContactRejected, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := cm.deleteQuarantine(peerID); err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+// Block drops all further requests and messages from a peer.
+func (cm *ContactManager) Block(peerIDStr string) (*Contact, error) {
+	peerID, err := cm.decodePeer(peerIDStr)
+	if err != nil {
+		return nil, err
+	}
+	contact, err := cm.setStatus(peerID, ContactBlocked, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := cm.deleteQuarantine(peerID); err != nil {
+		return nil, err
+	}
+	if err := cm.gater.Block(peerID, "blocked contact"); err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+// Remove forgets a contact, which also unblocks it.
+func (cm *ContactManager) Remove(peerIDStr string) error {
+	peerID, err := cm.decodePeer(peerIDStr)
+	if err != nil {
+		return err
+	}
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	contact, err := cm.getContact(peerID)
+	if errors.Is(err, ErrContactNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if contact.Status == ContactBlocked {
+		if err := cm.gater.Unblock(peerID); err != nil {
+			return err
+		}
+	}
+	if err := cm.db.Delete(contactKey(peerID)); err != nil {
+		return fmt.Errorf("failed to delete contact: %w", err)
+	}
+	if cm.notifier != nil {
+		cm.notifier.NotifyEvent("contact_removed", map[string]interface{}{"peer_id": peerID.String()})
+	}
+	return nil
+}
+
+// GetContact returns the contact record for a peer.
+func (cm *ContactManager) GetContact(peerID peer.ID) (*Contact, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	return cm.getContact(peerID)
+}
+
+// IsContact reports whether peerID is an accepted contact or a peer we sent
+// a request to.
+func (cm *ContactManager) IsContact(peerID peer.ID) bool {
+	contact, err := cm.GetContact(peerID)
+	if err != nil {
+		return false
+	}
+	return contact.Status == ContactAccepted || contact.Status == ContactRequested
+}
+
+// ListContacts returns all contacts, optionally only those with the given
+// status, most recently updated first.
+func (cm *ContactManager) ListContacts(status string) ([]*Contact, error) {
+	iter := cm.db.NewIteratorWithPrefix([]byte("contacts/"))
+	defer iter.Release()
+
+	contacts := []*Contact{}
+	for iter.Next() {
+		var contact Contact
+		if err := json.Unmarshal(iter.Value(), &contact); err != nil {
+			log.Printf("Failed to unmarshal contact: %v", err)
+			continue
+		}
+		if status != "" && contact.Status != status {
+			continue
+		}
+		contacts = append(contacts, &contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].UpdatedAt > contacts[j].UpdatedAt
+	})
+	return contacts, iter.Error()
+}
+
+// GetQuarantinedMessages returns the messages held back from a peer whose
+// contact request has not been accepted yet.
+func (cm *ContactManager) GetQuarantinedMessages(peerIDStr string) ([]*PrivateMessage, error) {
+	iter := cm.db.NewIteratorWithPrefix([]byte(fmt.Sprintf("quarantine/%s/", peerIDStr)))
+	defer iter.Release()
+
+	messages := []*PrivateMessage{}
+	for iter.Next() {
+		var msg PrivateMessage
+		if err := json.Unmarshal(iter.Value(), &msg); err != nil {
+			log.Printf("Failed to unmarshal message: %v", err)
+			continue
+		}
+		messages = append(messages, &msg)
+	}
+	return messages, iter.Error()
+}
+
+// admit decides what happens to a private message received from peerID. It
+// returns true if the message can be delivered. Messages from peers that are
+// not contacts yet are quarantined and count as an implicit contact request;
+// messages from rejected or blocked peers are dropped.
+func (cm *ContactManager) admit(msg *PrivateMessage) (bool, error) {
+	peerID, err := peer.Decode(msg.SenderID)
+	if err != nil {
+		return false, err
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	contact, err := cm.getContact(peerID)
+	if err != nil && !errors.Is(err, ErrContactNotFound) {
+		return false, err
+	}
+
+	if contact != nil {
+		switch contact.Status {
+		case ContactAccepted:
+			return true, nil
+		case ContactRequested:
+			// They are answering our request, so they accepted it
+			contact.Status = ContactAccepted
+			return true, cm.saveContact(contact)
+		case ContactRejected, ContactBlocked:
+			return false, nil
+		}
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal message: %w", err)
+	}
+	count, size, err := cm.quarantineUsage(peerID)
+	if err != nil {
+		return false, err
+	}
+	if count >= maxQuarantinedMessages || size+len(data) > maxQuarantinedBytes {
+		log.Printf("Quarantine of non-contact %s is full, dropping message\n", peerID.String())
+		return false, nil
+	}
+	// Disappearing messages expire in quarantine too
+	batch := new(leveldb.Batch)
+	key := quarantineKey(peerID, msg.ID)
+	batch.Put(key, data)
+	if msg.ExpiresAt != 0 {
+		if err := scheduleExpiry(batch, msg.ExpiresAt, string(key), &expiryEntry{Keys: []string{string(key)}}); err != nil {
+			return false, err
+		}
+	}
+	if err := cm.db.WriteBatch(batch); err != nil {
+		return false, fmt.Errorf("failed to quarantine message: %w", err)
+	}
+	log.Printf("Quarantined message from non-contact %s\n", peerID.String())
+
+	if contact == nil {
+		contact = &Contact{
+			PeerID:    peerID.String(),
+			Status:    ContactPending,
+			CreatedAt: time.Now().Unix(),
+		}
+		if err := cm.saveContact(contact); err != nil {
+			return false, err
+		}
+		if cm.notifier != nil {
+			cm.notifier.NotifyEvent("contact_request", map[string]interface{}{"contact": contact})
+		}
+	}
+	return false, nil
+}
+
+// quarantineUsage returns the number and total size of the messages
+// quarantined from peerID.
+func (cm *ContactManager) quarantineUsage(peerID peer.ID) (int, int, error) {
+	iter := cm.db.NewIteratorWithPrefix([]byte(fmt.Sprintf("quarantine/%s/", peerID.String())))
+	defer iter.Release()
+
+	count, size := 0, 0
+	for iter.Next() {
+		count++
+		size += len(iter.Value())
+	}
+	return count, size, iter.Error()
+}
+
+// markRequested records that we started a conversation with a peer that is
+// not a contact yet, so their reply is treated as accepting it.
+func (cm *ContactManager) markRequested(peerID peer.ID) error {
+	_, err := cm.setStatus(peerID, ContactRequested, func(c *Contact) bool {
+		return c.Status == "" || c.Status == ContactRejected
+	})
+	return err
+}
+
+// setStatus updates the status of a contact, creating it if needed. If
+// allowed is not nil, the update only happens when it returns true.
+func (cm *ContactManager) setStatus(peerID peer.ID, status string, allowed func(*Contact) bool) (*Contact, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	contact, err := cm.getContact(peerID)
+	if errors.Is(err, ErrContactNotFound) {
+		contact = &Contact{PeerID: peerID.String(), CreatedAt: time.Now().Unix()}
+	} else if err != nil {
+		return nil, err
+	}
+	if allowed != nil && !allowed(contact) {
+		return contact, nil
+	}
+	contact.Status = status
+	if err := cm.saveContact(contact); err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+func (cm *ContactManager) send(ctx context.Context, peerID peer.ID, msg contactMessage) (string, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal contact message: %w", err)
+	}
+
+	s, isV2, err := newStream(ctx, cm.host, peerID, ContactProtocolV2, ContactProtocol)
+	if err != nil {
+		return "", fmt.Errorf("failed to open contact stream: %w", err)
+	}
+	defer s.Close()
+
+	if isV2 {
+		err = WriteEnvelope(s, NewEnvelope(EnvelopeContact, cm.host.ID(), privateConversationID(cm.host.ID(), peerID), data))
+	} else {
+		_, err = s.Write(data)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write to contact stream: %w", err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		return "", fmt.Errorf("failed to close contact stream: %w", err)
+	}
+
+	if isV2 {
+		status, err := readResponse(s)
+		if err != nil {
+			return "", fmt.Errorf("failed to read contact response: %w", err)
+		}
+		return status, nil
+	}
+	respData, err := io.ReadAll(io.LimitReader(s, maxContactMessageSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read contact response: %w", err)
+	}
+	var resp contactResponse
+	if err := json.Unmarshal(respData, &resp); err != nil {
+		return "", fmt.Errorf("invalid contact response: %w", err)
+	}
+	return resp.Status, nil
+}
+
+// releaseQuarantine moves quarantined messages from peerID into the chat
+// history and notifies the frontend about them. The peer gets a delivered
+// receipt for them, sent by the outbox once it is connected. Callers hold
+// cm.mutex.
+func (cm *ContactManager) releaseQuarantine(peerID peer.ID) error {
+	iter := cm.db.NewIteratorWithPrefix([]byte(fmt.Sprintf("quarantine/%s/", peerID.String())))
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	var released []*PrivateMessage
+	for iter.Next() {
+		var msg PrivateMessage
+		if err := json.Unmarshal(iter.Value(), &msg); err != nil {
+			log.Printf("Failed to unmarshal message: %v", err)
+			continue
+		}
+		// Messages quarantined before messages had an HLC get one now
+		if msg.HLC == "" {
+			msg.HLC = legacyHLC(msg.ID, msg.Timestamp).String()
+		}
+		if err := putPrivateMessage(batch, cm.host.ID(), &msg); err != nil {
+			return err
+		}
+		putWords(batch, privateMessageKey(peerID.String(), msg.HLC, msg.ID), tokenize(msg.Content))
+		batch.Delete(append([]byte(nil), iter.Key()...))
+		released = append(released, &msg)
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if len(released) > 0 {
+		ids := make([]string, 0, len(released))
+		for _, msg := range released {
+			ids = append(ids, msg.ID)
+		}
+		queueReceipt(batch, peerID.String(), receipt{Status: MessageDelivered, MessageIDs: ids})
+	}
+	if err := cm.db.WriteBatch(batch); err != nil {
+		return fmt.Errorf("failed to release quarantined messages: %w", err)
+	}
+	for _, msg := range released {
+		cm.inbox.addPrivateMessage(peerID.String(), msg)
+	}
+
+	if cm.notifier != nil {
+		for _, msg := range released {
+			cm.notifier.NotifyNewMessage(msg.SenderID, msg.Content, "private")
+		}
+	}
+	return nil
+}
+
+func (cm *ContactManager) deleteQuarantine(peerID peer.ID) error {
+	iter := cm.db.NewIteratorWithPrefix([]byte(fmt.Sprintf("quarantine/%s/", peerID.String())))
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return cm.db.WriteBatch(batch)
+}
+
+func (cm *ContactManager) getContact(peerID peer.ID) (*Contact, error) {
+	exists, err := cm.db.Has(contactKey(peerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contact: %w", err)
+	}
+	if !exists {
+		return nil, ErrContactNotFound
+	}
+	data, err := cm.db.Get(contactKey(peerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read contact: %w", err)
+	}
+	var contact Contact
+	if err := json.Unmarshal(data, &contact); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal contact: %w", err)
+	}
+	return &contact, nil
+}
+
+// saveContact stores a contact and tells the frontend about the change.
+// Callers hold cm.mutex.
+func (cm *ContactManager) saveContact(contact *Contact) error {
+	contact.UpdatedAt = time.Now().Unix()
+	data, err := json.Marshal(contact)
+	if err != nil {
+		return fmt.Errorf("failed to marshal contact: %w", err)
+	}
+	peerID, err := peer.Decode(contact.PeerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID: %w", err)
+	}
+	if err := cm.db.Put(contactKey(peerID), data); err != nil {
+		return fmt.Errorf("failed to store contact: %w", err)
+	}
+	if cm.notifier != nil {
+		cm.notifier.NotifyEvent("contact_updated", map[string]interface{}{"contact": contact})
+	}
+	return nil
+}
+
+func (cm *ContactManager) decodePeer(peerIDStr string) (peer.ID, error) {
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid peer ID: %w", err)
+	}
+	if peerID == cm.host.ID() {
+		return "", errors.New("cannot add ourselves as a contact")
+	}
+	return peerID, nil
+}
+
+func contactKey(peerID peer.ID) []byte {
+	return []byte(fmt.Sprintf("contacts/%s", peerID.String()))
+}
+
+func quarantineKey(peerID peer.ID, messageID string) []byte {
+	return []byte(fmt.Sprintf("quarantine/%s/%s", peerID.String(), messageID))
+}
+
+func truncateNote(note string) string {
+	if len(note) > maxIntroNoteLength {
+		return strings.ToValidUTF8(note[:maxIntroNoteLength], "")
+	}
+	return note
+}
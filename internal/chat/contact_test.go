@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"strings"
+	"testing"
+)
+
+func newTestContactManager(t *testing.T) *ContactManager {
+	t.Helper()
+	h, _ := newTestKeyManager(t, nil)
+	store := newTestStore(t)
+	inbox, err := NewInbox(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewContactManager(h, store, nil, nil, inbox)
+}
+
+// quarantine offers a message from sender and reports how many of the
+// sender's messages are quarantined afterwards.
+func quarantine(t *testing.T, cm *ContactManager, sender peer.ID, id, content string) int {
+	t.Helper()
+	delivered, err := cm.admit(&PrivateMessage{ID: id, SenderID: sender.String(), Content: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered {
+		t.Fatalf("message from a stranger delivered")
+	}
+	count, _, err := cm.quarantineUsage(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestQuarantineMessageCap(t *testing.T) {
+	cm := newTestContactManager(t)
+	_, stranger := newTestIdentity(t)
+	_, other := newTestIdentity(t)
+
+	for i := 0; i < maxQuarantinedMessages; i++ {
+		if n := quarantine(t, cm, stranger, fmt.Sprintf("%03d", i), "hello"); n != i+1 {
+			t.Fatalf("%d messages quarantined after %d", n, i+1)
+		}
+	}
+	if n := quarantine(t, cm, stranger, "over", "hello"); n != maxQuarantinedMessages {
+		t.Fatalf("%d messages quarantined, want the cap of %d", n, maxQuarantinedMessages)
+	}
+	// The cap is per peer
+	if n := quarantine(t, cm, other, "first", "hello"); n != 1 {
+		t.Fatalf("message from another stranger dropped")
+	}
+
+	// The first message made a contact request
+	contact, err := cm.getContact(stranger)
+	if err != nil || contact.Status != ContactPending {
+		t.Fatalf("contact = %+v, %v; want a pending request", contact, err)
+	}
+	// Rejecting it frees the quarantine
+	if _, err := cm.Reject(stranger.String()); err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := cm.GetQuarantinedMessages(stranger.String()); err != nil || len(messages) != 0 {
+		t.Fatalf("%d messages left in quarantine after rejecting, %v", len(messages), err)
+	}
+	if delivered, err := cm.admit(&PrivateMessage{ID: "after", SenderID: stranger.String(), Content: "hello"}); err != nil || delivered {
+		t.Fatalf("admit after rejecting = %v, %v", delivered, err)
+	}
+	if count, _, _ := cm.quarantineUsage(stranger); count != 0 {
+		t.Fatal("message from a rejected peer quarantined")
+	}
+
+	// Accepting moves the messages into the chat history
+	if _, err := cm.Accept(context.Background(), other.String()); err != nil {
+		t.Fatal(err)
+	}
+	if count, _, _ := cm.quarantineUsage(other); count != 0 {
+		t.Fatal("messages left in quarantine after accepting")
+	}
+	if found, _ := cm.db.Has([]byte(privateMessageIDKey(other.String(), "first"))); !found {
+		t.Fatal("released message missing from the chat history")
+	}
+}
+
+func TestQuarantineByteCap(t *testing.T) {
+	cm := newTestContactManager(t)
+	_, stranger := newTestIdentity(t)
+	large := strings.Repeat("x", maxQuarantinedBytes/3)
+
+	for i, want := range []int{1, 2, 2} {
+		if n := quarantine(t, cm, stranger, fmt.Sprintf("%d", i), large); n != want {
+			t.Fatalf("%d messages quarantined after %d, want %d", n, i+1, want)
+		}
+	}
+	_, size, err := cm.quarantineUsage(stranger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size > maxQuarantinedBytes {
+		t.Fatalf("%d bytes quarantined, over the cap of %d", size, maxQuarantinedBytes)
+	}
+	// A small message still fits
+	if n := quarantine(t, cm, stranger, "small", "hi"); n != 3 {
+		t.Fatalf("small message dropped with %d bytes quarantined", size)
+	}
+}
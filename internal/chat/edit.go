@@ -0,0 +1,266 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"log"
+	"time"
+)
+
+// Envelope types that change a private message after it was sent. Like
+// messages, they are encrypted and go through the outbox and mailboxes, so
+// they reach the peer in order after the message they refer to.
+const (
+	// EnvelopeEdit replaces the content of a message.
+	EnvelopeEdit = "edit"
+	// EnvelopeDelete deletes a message for everyone.
+	EnvelopeDelete = "delete"
+)
+
+const messageControlSignaturePrefix = "p2p-chat-message-control:"
+
+// ErrNotEditable is returned for messages that we did not send or that were deleted.
+var ErrNotEditable = errors.New("message cannot be changed")
+
+// MessageEdit is an earlier version of an edited message.
+type MessageEdit struct {
+	Content string `json:"content"`
+	// Timestamp is when this version was written.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// messageControl is the payload of edit and delete envelopes. It is signed
+// by the sender's libp2p identity and names the recipient, so it cannot be
+// replayed to another peer.
+type messageControl struct {
+	MessageID string `json:"message_id"`
+	Recipient string `json:"recipient"`
+	Content   string `json:"content,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	// HLC is the sender's clock at the change. Changes that cross on the way
+	// are applied in its order, which also orders changes made within the
+	// same second.
+	HLC       string `json:"hlc,omitempty"`
+	Signature []byte `json:"signature"`
+}
+
+func (c *messageControl) signingBytes(action string) []byte {
+	return []byte(fmt.Sprintf("%s%s:%s:%s:%d:%s:%s", messageControlSignaturePrefix, action, c.Recipient, c.MessageID, c.Timestamp, c.HLC, c.Content))
+}
+
+// hlc returns the time of the change, derived from its timestamp if the
+// sender did not include an HLC.
+func (c *messageControl) hlc() (HLC, error) {
+	if c.HLC == "" {
+		return HLC{Wall: c.Timestamp * int64(time.Second)}, nil
+	}
+	return parseHLC(c.HLC)
+}
+
+// editHLC returns the time of the latest edit of msg, derived from EditedAt
+// for messages edited before edits had an HLC.
+func (m *PrivateMessage) editHLC() HLC {
+	if t, err := parseHLC(m.EditHLC); err == nil {
+		return t
+	}
+	return HLC{Wall: m.EditedAt * int64(time.Second)}
+}
+
+// EditMessage replaces the content of a message we sent to a peer, keeping
+// the earlier version in its edit history, and sends the edit to the peer.
+func (pcm *PrivateChatManager) EditMessage(ctx context.Context, peerIDStr, messageID, content string) (*PrivateMessage, error) {
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID: %w", err)
+	}
+	if content == "" {
+		return nil, errors.New("message content is empty")
+	}
+
+	now := pcm.clock.Now()
+	msg, err := pcm.updateMessage(peerID, messageID, true, func(msg *PrivateMessage) bool {
+		return applyEdit(msg, content, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl := &messageControl{MessageID: messageID, Recipient: peerIDStr, Content: content, Timestamp: now.Unix(), HLC: now.String()}
+	if err := pcm.sendControl(ctx, peerID, EnvelopeEdit, ctrl); err != nil {
+		return nil, err
+	}
+	log.Printf("Edited message %s to %s\n", messageID, peerIDStr)
+	return msg, nil
+}
+
+// DeleteMessage deletes a message we sent to a peer for everyone: our copy
+// and the peer's are replaced by a tombstone without content or edit history.
+func (pcm *PrivateChatManager) DeleteMessage(ctx context.Context, peerIDStr, messageID string) (*PrivateMessage, error) {
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID: %w", err)
+	}
+
+	now := pcm.clock.Now()
+	msg, err := pcm.updateMessage(peerID, messageID, true, func(msg *PrivateMessage) bool {
+		return applyDelete(msg, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl := &messageControl{MessageID: messageID, Recipient: peerIDStr, Timestamp: now.Unix(), HLC: now.String()}
+	if err := pcm.sendControl(ctx, peerID, EnvelopeDelete, ctrl); err != nil {
+		return nil, err
+	}
+	log.Printf("Deleted message %s to %s\n", messageID, peerIDStr)
+	return msg, nil
+}
+
+// sendControl signs an edit or deletion and sends it to the peer, queueing
+// it in the outbox if the peer cannot be reached.
+func (pcm *PrivateChatManager) sendControl(ctx context.Context, peerID peer.ID, action string, ctrl *messageControl) error {
+	identity := pcm.host.Peerstore().PrivKey(pcm.host.ID())
+	if identity == nil {
+		return errors.New("host has no private key")
+	}
+	signature, err := identity.Sign(ctrl.signingBytes(action))
+	if err != nil {
+		return fmt.Errorf("failed to sign %s: %w", action, err)
+	}
+	ctrl.Signature = signature
+
+	data, err := json.Marshal(ctrl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", action, err)
+	}
+	_, err = pcm.send(ctx, peerID, &outgoingMessage{Type: action, ID: newMessageID(), Content: string(data)})
+	return err
+}
+
+// receiveControl applies an edit or deletion from sender to a message it
+// sent us.
+func (pcm *PrivateChatManager) receiveControl(sender peer.ID, action string, plaintext []byte) {
+	var ctrl messageControl
+	if err := json.Unmarshal(plaintext, &ctrl); err != nil {
+		log.Printf("Invalid %s from %s: %v\n", action, sender.String(), err)
+		return
+	}
+	if ctrl.Recipient != pcm.host.ID().String() || !validMessageID(ctrl.MessageID) {
+		log.Printf("Dropping invalid %s from %s\n", action, sender.String())
+		return
+	}
+	identity, err := sender.ExtractPublicKey()
+	if err != nil {
+		log.Printf("Failed to extract public key of %s: %v\n", sender.String(), err)
+		return
+	}
+	if ok, err := identity.Verify(ctrl.signingBytes(action), ctrl.Signature); err != nil || !ok {
+		log.Printf("Dropping %s with invalid signature from %s\n", action, sender.String())
+		return
+	}
+	at, err := ctrl.hlc()
+	if err != nil || !pcm.clock.Update(at) {
+		log.Printf("Dropping %s with invalid or future time from %s\n", action, sender.String())
+		return
+	}
+
+	_, err = pcm.updateMessage(sender, ctrl.MessageID, false, func(msg *PrivateMessage) bool {
+		return applyControl(msg, action, &ctrl, at)
+	})
+	if err != nil {
+		log.Printf("Failed to apply %s of message %s from %s: %v\n", action, ctrl.MessageID, sender.String(), err)
+	}
+}
+
+// updateMessage changes a message in the chat history with peerID and
+// notifies the frontend. isSent selects whether the message must be one we
+// sent or one we received. apply reports whether it changed the message.
+func (pcm *PrivateChatManager) updateMessage(peerID peer.ID, messageID string, isSent bool, apply func(*PrivateMessage) bool) (*PrivateMessage, error) {
+	pcm.mutex.Lock()
+	defer pcm.mutex.Unlock()
+
+	msg, err := pcm.getMessage(peerID.String(), messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.IsSent != isSent || msg.Deleted {
+		return nil, ErrNotEditable
+	}
+	if !apply(msg) {
+		return msg, nil
+	}
+	if err := pcm.storeMessage(msg); err != nil {
+		return nil, fmt.Errorf("failed to store message: %w", err)
+	}
+	pcm.inbox.privateMessageChanged(peerID.String(), msg)
+	pcm.notifyChange(peerID.String(), msg)
+	return msg, nil
+}
+
+// applyControl applies an edit or deletion made at the given time to a
+// message we received. Changes that crossed on the way are applied in the
+// order they were made, so both sides end up with the same content.
+func applyControl(msg *PrivateMessage, action string, ctrl *messageControl, at HLC) bool {
+	if !at.after(msg.editHLC()) {
+		return false
+	}
+	if action == EnvelopeDelete {
+		return applyDelete(msg, at)
+	}
+	if ctrl.Content == "" {
+		return false
+	}
+	if ctrl.Content == msg.Content {
+		// An edit back to the content we show still outdates earlier edits
+		msg.EditHLC = at.String()
+		return true
+	}
+	return applyEdit(msg, ctrl.Content, at)
+}
+
+func applyEdit(msg *PrivateMessage, content string, editedAt HLC) bool {
+	if content == msg.Content {
+		return false
+	}
+	written := msg.Timestamp
+	if msg.EditedAt != 0 {
+		written = msg.EditedAt
+	}
+	msg.Edits = append(msg.Edits, MessageEdit{Content: msg.Content, Timestamp: written})
+	msg.Content = content
+	msg.EditedAt = editedAt.Unix()
+	msg.EditHLC = editedAt.String()
+	return true
+}
+
+func applyDelete(msg *PrivateMessage, deletedAt HLC) bool {
+	msg.Content = ""
+	msg.Edits = nil
+	msg.Deleted = true
+	msg.DeletedAt = deletedAt.Unix()
+	return true
+}
+
+// notifyChange tells the frontend that a message was edited or deleted.
+func (pcm *PrivateChatManager) notifyChange(peerID string, msg *PrivateMessage) {
+	if pcm.notifier == nil {
+		return
+	}
+	if msg.Deleted {
+		pcm.notifier.NotifyEvent("message_deleted", map[string]interface{}{
+			"peer_id":    peerID,
+			"message_id": msg.ID,
+		})
+		return
+	}
+	pcm.notifier.NotifyEvent("message_edited", map[string]interface{}{
+		"peer_id":    peerID,
+		"message_id": msg.ID,
+		"content":    msg.Content,
+		"edited_at":  msg.EditedAt,
+	})
+}
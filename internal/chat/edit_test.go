@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyControlOrder(t *testing.T) {
+	now := time.Now().UnixNano()
+	type change struct {
+		action  string
+		content string
+		at      HLC
+	}
+	// Made within the same nanosecond, and back to an earlier content
+	edits := []change{
+		{EnvelopeEdit, "first", HLC{Wall: now}},
+		{EnvelopeEdit, "second", HLC{Wall: now, Logical: 1}},
+		{EnvelopeEdit, "first", HLC{Wall: now, Logical: 2}},
+	}
+
+	for _, order := range [][]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}} {
+		msg := &PrivateMessage{ID: "m", Content: "original", Timestamp: time.Now().Unix()}
+		for _, i := range order {
+			ctrl := &messageControl{MessageID: "m", Content: edits[i].content, Timestamp: edits[i].at.Unix(), HLC: edits[i].at.String()}
+			applyControl(msg, edits[i].action, ctrl, edits[i].at)
+		}
+		if msg.Content != "first" {
+			t.Fatalf("edits applied in order %v leave %q, want the latest edit", order, msg.Content)
+		}
+	}
+
+	// A deletion is final, and an edit made before it changes nothing
+	msg := &PrivateMessage{ID: "m", Content: "original"}
+	deleted := HLC{Wall: now}
+	applyControl(msg, EnvelopeDelete, &messageControl{MessageID: "m"}, deleted)
+	if !msg.Deleted || msg.Content != "" || msg.DeletedAt != deleted.Unix() {
+		t.Fatalf("message not deleted: %+v", msg)
+	}
+}
+
+func TestMessageControlHLC(t *testing.T) {
+	// Peers that do not send an HLC are ordered by their timestamp
+	legacy := &messageControl{Timestamp: 100}
+	if at, err := legacy.hlc(); err != nil || at != (HLC{Wall: 100 * int64(time.Second)}) {
+		t.Fatalf("hlc = %v, %v", at, err)
+	}
+	if _, err := (&messageControl{HLC: "bogus"}).hlc(); err == nil {
+		t.Fatal("invalid HLC accepted")
+	}
+
+	// A change signed with one HLC does not verify with another
+	ctrl := &messageControl{MessageID: "m", Recipient: "peer", Content: "x", Timestamp: 1, HLC: HLC{Wall: 1}.String()}
+	signed := string(ctrl.signingBytes(EnvelopeEdit))
+	ctrl.HLC = HLC{Wall: 2}.String()
+	if string(ctrl.signingBytes(EnvelopeEdit)) == signed {
+		t.Fatal("HLC is not signed")
+	}
+}
@@ -0,0 +1,226 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-msgio"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvelopeVersion is the version of the envelope format we write. Envelopes
+// with a higher version are rejected.
+const EnvelopeVersion = 1
+
+// maxEnvelopeSize bounds the size of a single envelope on the wire.
+const maxEnvelopeSize = 256 * 1024
+
+// maxEnvelopeIDLength bounds message IDs, which end up in database keys.
+const maxEnvelopeIDLength = 64
+
+// Envelope types.
+const (
+	EnvelopePrivateMessage = "private_message"
+	EnvelopeGroupMessage   = "group_message"
+	EnvelopeFile           = "file"
+	EnvelopeContact        = "contact"
+	// EnvelopeResponse answers another envelope on the same stream.
+	EnvelopeResponse = "response"
+)
+
+// Envelope is the unit of the /2.0.0 chat protocols. Each envelope is sent
+// as a varint length prefix followed by its JSON encoding, so messages are
+// never truncated or merged by stream reads.
+type Envelope struct {
+	Version        int    `json:"version"`
+	ID             string `json:"id"`
+	Type           string `json:"type"`
+	Timestamp      int64  `json:"timestamp"`
+	Sender         string `json:"sender"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	// ReplyTo is the ID of the message this one replies to.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// HLC is the hybrid logical clock timestamp of private and group
+	// messages, which orders them the same way on every peer.
+	HLC string `json:"hlc,omitempty"`
+	// TTL is how many seconds a disappearing message is kept after it was
+	// received.
+	TTL     int64  `json:"ttl,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// messageBody is the payload of private and group messages. For private
+// messages it is encrypted before it goes into the envelope.
+type messageBody struct {
+	Content string `json:"content"`
+}
+
+// envelopeResponse is the payload of an EnvelopeResponse.
+type envelopeResponse struct {
+	Status string `json:"status"`
+}
+
+// NewEnvelope creates an envelope with a new message ID and the current time.
+func NewEnvelope(envelopeType string, sender peer.ID, conversationID string, payload []byte) *Envelope {
+	return &Envelope{
+		Version:        EnvelopeVersion,
+		ID:             newMessageID(),
+		Type:           envelopeType,
+		Timestamp:      time.Now().Unix(),
+		Sender:         sender.String(),
+		ConversationID: conversationID,
+		Payload:        payload,
+	}
+}
+
+// lastIDTime is the time of the last message ID we created.
+var (
+	lastIDTime  int64
+	lastIDMutex sync.Mutex
+)
+
+// newMessageID returns a globally unique message ID: the creation time in
+// nanoseconds as fixed-width hex, followed by 64 random bits. IDs created by
+// one node sort in the order they were created.
+func newMessageID() string {
+	lastIDMutex.Lock()
+	now := time.Now().UnixNano()
+	if now <= lastIDTime {
+		now = lastIDTime + 1
+	}
+	lastIDTime = now
+	lastIDMutex.Unlock()
+
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%016x%x", uint64(now), suffix)
+}
+
+// WriteEnvelope writes env to w with a length prefix.
+func WriteEnvelope(w io.Writer, env *Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+	if len(data) > maxEnvelopeSize {
+		return fmt.Errorf("envelope of %d bytes exceeds the limit of %d bytes", len(data), maxEnvelopeSize)
+	}
+	if err := msgio.NewVarintWriter(w).WriteMsg(data); err != nil {
+		return fmt.Errorf("failed to write envelope: %w", err)
+	}
+	return nil
+}
+
+// ReadEnvelope reads one length-prefixed envelope from r and checks that it
+// is well formed.
+func ReadEnvelope(r io.Reader) (*Envelope, error) {
+	reader := msgio.NewVarintReaderSize(r, maxEnvelopeSize)
+	data, err := reader.ReadMsg()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read envelope: %w", err)
+	}
+	defer reader.ReleaseMsg(data)
+	return decodeEnvelope(data)
+}
+
+// decodeEnvelope parses the JSON encoding of an envelope and checks that it
+// is well formed.
+func decodeEnvelope(data []byte) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal envelope: %w", err)
+	}
+	switch {
+	case env.Version < 1 || env.Version > EnvelopeVersion:
+		return nil, fmt.Errorf("unsupported envelope version %d", env.Version)
+	case !validMessageID(env.ID):
+		return nil, errors.New("invalid envelope ID")
+	case env.ReplyTo != "" && !validMessageID(env.ReplyTo):
+		return nil, errors.New("invalid reply_to message ID")
+	case env.HLC != "" && len(env.HLC) != hlcLength:
+		return nil, errors.New("invalid HLC")
+	case env.TTL < 0 || env.TTL > maxTimerTTL:
+		return nil, errors.New("invalid message TTL")
+	case env.Type == "":
+		return nil, errors.New("envelope has no type")
+	}
+	return &env, nil
+}
+
+// validMessageID reports whether id can be used as a message ID. IDs end up
+// in database keys, so they are bounded and may not contain "/".
+func validMessageID(id string) bool {
+	return id != "" && len(id) <= maxEnvelopeIDLength && !strings.Contains(id, "/")
+}
+
+// readEnvelopeFrom reads an envelope from a stream and checks that it was
+// sent by the peer at the other end.
+func readEnvelopeFrom(s network.Stream) (*Envelope, error) {
+	env, err := ReadEnvelope(s)
+	if err != nil {
+		return nil, err
+	}
+	if env.Sender != s.Conn().RemotePeer().String() {
+		return nil, fmt.Errorf("envelope sender %s does not match peer %s", env.Sender, s.Conn().RemotePeer().String())
+	}
+	return env, nil
+}
+
+// writeResponse answers req with status.
+func writeResponse(s network.Stream, req *Envelope, status string) error {
+	payload, err := json.Marshal(envelopeResponse{Status: status})
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return WriteEnvelope(s, NewEnvelope(EnvelopeResponse, s.Conn().LocalPeer(), req.ConversationID, payload))
+}
+
+// readResponse reads the response to an envelope we sent and returns its status.
+func readResponse(s network.Stream) (string, error) {
+	env, err := readEnvelopeFrom(s)
+	if err != nil {
+		return "", err
+	}
+	return responseStatus(env)
+}
+
+// responseStatus returns the status of a response envelope.
+func responseStatus(env *Envelope) (string, error) {
+	if env.Type != EnvelopeResponse {
+		return "", fmt.Errorf("unexpected %s envelope in response", env.Type)
+	}
+	var resp envelopeResponse
+	if err := json.Unmarshal(env.Payload, &resp); err != nil {
+		return "", fmt.Errorf("invalid response: %w", err)
+	}
+	return resp.Status, nil
+}
+
+// newStream opens a stream to peerID, preferring the envelope protocol and
+// falling back to the legacy one for older peers. It reports whether the
+// envelope protocol was negotiated.
+func newStream(ctx context.Context, h host.Host, peerID peer.ID, envelopeProtocol, legacyProtocol protocol.ID) (network.Stream, bool, error) {
+	s, err := h.NewStream(ctx, peerID, envelopeProtocol, legacyProtocol)
+	if err != nil {
+		return nil, false, err
+	}
+	return s, s.Protocol() == envelopeProtocol, nil
+}
+
+// privateConversationID is the conversation ID of the chat between two
+// peers. Both peers derive the same ID.
+func privateConversationID(a, b peer.ID) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a.String() + ":" + b.String()
+}
@@ -0,0 +1,495 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/syndtr/goleveldb/leveldb"
+	"log"
+	"os"
+	"p2p-chat/internal/db"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvelopeTimer changes the disappearing message timer of a conversation. In
+// private chats it is encrypted like a message; in groups it goes to every
+// member.
+const EnvelopeTimer = "timer"
+
+// Bounds of a disappearing message timer, in seconds. A timer of 0 turns
+// disappearing messages off.
+const (
+	minTimerTTL = 10
+	maxTimerTTL = 365 * 24 * 60 * 60
+)
+
+// purgeInterval is how often expired messages are purged.
+const purgeInterval = 5 * time.Second
+
+// ErrInvalidTimer is returned for timers outside minTimerTTL and maxTimerTTL.
+var ErrInvalidTimer = errors.New("invalid timer")
+
+// DisappearingTimer is the disappearing message timer of a conversation.
+// Both sides keep the change with the latest UpdatedAt, so they agree on the
+// timer whatever order changes arrive in.
+type DisappearingTimer struct {
+	// TTL is how many seconds new messages are kept; 0 keeps them forever.
+	TTL int64 `json:"ttl"`
+	// UpdatedAt is the Unix time in nanoseconds of the last change.
+	UpdatedAt int64  `json:"updated_at,omitempty"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+}
+
+// newer reports whether t wins over current. Changes made at the same time
+// are ordered by peer ID.
+func (t *DisappearingTimer) newer(current *DisappearingTimer) bool {
+	if t.UpdatedAt != current.UpdatedAt {
+		return t.UpdatedAt > current.UpdatedAt
+	}
+	return t.UpdatedBy > current.UpdatedBy
+}
+
+// ahead reports whether t was changed more than maxClockSkew ahead of our
+// clock. Such changes are rejected when received, but may have been stored
+// by earlier versions; they do not block later changes.
+func (t *DisappearingTimer) ahead() bool {
+	return t.UpdatedAt > time.Now().Add(maxClockSkew).UnixNano()
+}
+
+// timerChange is the payload of an EnvelopeTimer.
+type timerChange struct {
+	TTL       int64 `json:"ttl"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+func validTimerTTL(ttl int64) bool {
+	return ttl == 0 || (ttl >= minTimerTTL && ttl <= maxTimerTTL)
+}
+
+// timerStore keeps the disappearing message timers of conversations in
+// LevelDB under timers/private/<peer> and timers/group/<group>.
+type timerStore struct {
+	db    *db.LevelDBStore
+	mutex sync.Mutex
+}
+
+func privateTimerKey(peerID string) []byte {
+	return []byte(fmt.Sprintf("timers/private/%s", peerID))
+}
+
+func groupTimerKey(groupID string) []byte {
+	return []byte(fmt.Sprintf("timers/group/%s", groupID))
+}
+
+// get returns the timer stored under key. Conversations without one have
+// disappearing messages turned off.
+func (ts *timerStore) get(key []byte) (*DisappearingTimer, error) {
+	exists, err := ts.db.Has(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check timer: %w", err)
+	}
+	if !exists {
+		return &DisappearingTimer{}, nil
+	}
+	data, err := ts.db.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timer: %w", err)
+	}
+	var timer DisappearingTimer
+	if err := json.Unmarshal(data, &timer); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal timer: %w", err)
+	}
+	return &timer, nil
+}
+
+// ttl returns the TTL of the timer stored under key, or 0 if it cannot be read.
+func (ts *timerStore) ttl(key []byte) int64 {
+	timer, err := ts.get(key)
+	if err != nil {
+		log.Printf("%v\n", err)
+		return 0
+	}
+	return timer.TTL
+}
+
+// apply stores timer under key if it is newer than the current one. It
+// returns the resulting timer and whether its TTL changed.
+func (ts *timerStore) apply(key []byte, timer *DisappearingTimer) (*DisappearingTimer, bool, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	current, err := ts.get(key)
+	if err != nil {
+		return nil, false, err
+	}
+	return ts.put(key, current, timer)
+}
+
+// set stores a timer we set under key, like apply. Its UpdatedAt is moved
+// past the current timer's, so our change wins even if the clock of the peer
+// that made the current one runs ahead of ours.
+func (ts *timerStore) set(key []byte, timer *DisappearingTimer) (*DisappearingTimer, bool, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	current, err := ts.get(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if !current.ahead() && timer.UpdatedAt <= current.UpdatedAt {
+		timer.UpdatedAt = current.UpdatedAt + 1
+	}
+	return ts.put(key, current, timer)
+}
+
+// put stores timer under key in place of current if it wins over it.
+// Callers hold ts.mutex.
+func (ts *timerStore) put(key []byte, current, timer *DisappearingTimer) (*DisappearingTimer, bool, error) {
+	if !timer.newer(current) && !current.ahead() {
+		return current, false, nil
+	}
+	data, err := json.Marshal(timer)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal timer: %w", err)
+	}
+	if err := ts.db.Put(key, data); err != nil {
+		return nil, false, fmt.Errorf("failed to store timer: %w", err)
+	}
+	return timer, timer.TTL != current.TTL, nil
+}
+
+// parseTimerChange decodes a timer change from sender. Changes made more
+// than maxClockSkew ahead of our clock are rejected, so a peer cannot fix
+// the timer for good by claiming a time far in the future.
+func parseTimerChange(sender peer.ID, data []byte) (*DisappearingTimer, error) {
+	var change timerChange
+	if err := json.Unmarshal(data, &change); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal timer: %w", err)
+	}
+	if !validTimerTTL(change.TTL) {
+		return nil, ErrInvalidTimer
+	}
+	timer := &DisappearingTimer{TTL: change.TTL, UpdatedAt: change.UpdatedAt, UpdatedBy: sender.String()}
+	if timer.UpdatedAt <= 0 || timer.ahead() {
+		return nil, errors.New("invalid timer change time")
+	}
+	return timer, nil
+}
+
+// newTimerChange checks a timer set by us and creates it.
+func newTimerChange(self peer.ID, ttl int64) (*DisappearingTimer, error) {
+	if !validTimerTTL(ttl) {
+		return nil, fmt.Errorf("%w: must be 0 or between %d and %d seconds", ErrInvalidTimer, minTimerTTL, maxTimerTTL)
+	}
+	return &DisappearingTimer{TTL: ttl, UpdatedAt: time.Now().UnixNano(), UpdatedBy: self.String()}, nil
+}
+
+// timerPayload returns the payload of the EnvelopeTimer that sends timer.
+func timerPayload(timer *DisappearingTimer) ([]byte, error) {
+	payload, err := json.Marshal(timerChange{TTL: timer.TTL, UpdatedAt: timer.UpdatedAt})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal timer: %w", err)
+	}
+	return payload, nil
+}
+
+// GetTimer returns the disappearing message timer of the chat with a peer.
+func (pcm *PrivateChatManager) GetTimer(peerIDStr string) (*DisappearingTimer, error) {
+	if _, err := peer.Decode(peerIDStr); err != nil {
+		return nil, fmt.Errorf("invalid peer ID: %w", err)
+	}
+	return pcm.timers.get(privateTimerKey(peerIDStr))
+}
+
+// SetTimer sets the disappearing message timer of the chat with a peer and
+// sends it to the peer. Messages sent from then on expire ttl seconds after
+// they were sent or received; earlier messages are kept.
+func (pcm *PrivateChatManager) SetTimer(ctx context.Context, peerIDStr string, ttl int64) (*DisappearingTimer, error) {
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID: %w", err)
+	}
+	timer, err := newTimerChange(pcm.host.ID(), ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	timer, changed, err := pcm.timers.set(privateTimerKey(peerIDStr), timer)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return timer, nil
+	}
+	payload, err := timerPayload(timer)
+	if err != nil {
+		return nil, err
+	}
+	pcm.notifyTimer(peerIDStr, timer)
+
+	if _, err := pcm.send(ctx, peerID, &outgoingMessage{Type: EnvelopeTimer, ID: newMessageID(), Content: string(payload)}); err != nil {
+		return nil, err
+	}
+	log.Printf("Set disappearing message timer with %s to %ds\n", peerIDStr, ttl)
+	return timer, nil
+}
+
+// receiveTimer applies a timer change from sender to our chat with it.
+func (pcm *PrivateChatManager) receiveTimer(sender peer.ID, plaintext []byte) {
+	timer, err := parseTimerChange(sender, plaintext)
+	if err != nil {
+		log.Printf("Dropping timer from %s: %v\n", sender.String(), err)
+		return
+	}
+	timer, changed, err := pcm.timers.apply(privateTimerKey(sender.String()), timer)
+	if err != nil {
+		log.Printf("Failed to apply timer from %s: %v\n", sender.String(), err)
+		return
+	}
+	if changed {
+		pcm.notifyTimer(sender.String(), timer)
+	}
+}
+
+func (pcm *PrivateChatManager) notifyTimer(peerID string, timer *DisappearingTimer) {
+	if pcm.notifier != nil {
+		pcm.notifier.NotifyEvent("timer_updated", map[string]interface{}{
+			"peer_id": peerID,
+			"timer":   timer,
+		})
+	}
+}
+
+// GetGroupTimer returns the disappearing message timer of a group.
+func (gcm *GroupChatManager) GetGroupTimer(groupID string) (*DisappearingTimer, error) {
+	if _, err := gcm.GetGroup(groupID); err != nil {
+		return nil, err
+	}
+	return gcm.timers.get(groupTimerKey(groupID))
+}
+
+// SetGroupTimer sets the disappearing message timer of a group and sends it
+// to the members, like SetTimer does for private chats.
+func (gcm *GroupChatManager) SetGroupTimer(ctx context.Context, groupID string, ttl int64) (*DisappearingTimer, error) {
+	group, err := gcm.GetGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	timer, err := newTimerChange(gcm.host.ID(), ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	timer, changed, err := gcm.timers.set(groupTimerKey(groupID), timer)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return timer, nil
+	}
+	payload, err := timerPayload(timer)
+	if err != nil {
+		return nil, err
+	}
+	gcm.notifyTimer(groupID, timer)
+
+	gcm.sendToMembers(ctx, group, NewEnvelope(EnvelopeTimer, gcm.host.ID(), groupID, payload), "")
+	log.Printf("Set disappearing message timer of group %s to %ds\n", groupID, ttl)
+	return timer, nil
+}
+
+// receiveTimer applies a timer change from sender to a group.
+func (gcm *GroupChatManager) receiveTimer(sender peer.ID, env *Envelope) {
+	timer, err := parseTimerChange(sender, env.Payload)
+	if err == nil && (env.ConversationID == "" || strings.Contains(env.ConversationID, "/")) {
+		err = errors.New("invalid group ID")
+	}
+	if err != nil {
+		log.Printf("Dropping group timer from %s: %v\n", sender.String(), err)
+		return
+	}
+	timer, changed, err := gcm.timers.apply(groupTimerKey(env.ConversationID), timer)
+	if err != nil {
+		log.Printf("Failed to apply group timer from %s: %v\n", sender.String(), err)
+		return
+	}
+	if changed {
+		gcm.notifyTimer(env.ConversationID, timer)
+	}
+}
+
+func (gcm *GroupChatManager) notifyTimer(groupID string, timer *DisappearingTimer) {
+	if gcm.notifier != nil {
+		gcm.notifier.NotifyEvent("timer_updated", map[string]interface{}{
+			"group_id": groupID,
+			"timer":    timer,
+		})
+	}
+}
+
+// expiryEntry lists what goes when a message or file expires. Entries are
+// kept in LevelDB under expiry/<unix time>/<name>, so they sort by the time
+// they are due and survive restarts.
+type expiryEntry struct {
+	// PeerID or GroupID, with MessageID, name the expiring message for the
+	// frontend.
+	PeerID    string `json:"peer_id,omitempty"`
+	GroupID   string `json:"group_id,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	// Keys are the database records to delete.
+	Keys []string `json:"keys,omitempty"`
+	// File is the path of a received file to delete.
+	File string `json:"file,omitempty"`
+}
+
+func expiryKey(expiresAt int64, name string) []byte {
+	return []byte(fmt.Sprintf("expiry/%020d/%s", expiresAt, name))
+}
+
+// scheduleExpiry adds entry to batch, due at expiresAt. name makes the key
+// unique; scheduling the same name twice keeps a single entry.
+func scheduleExpiry(batch *leveldb.Batch, expiresAt int64, name string, entry *expiryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal expiry: %w", err)
+	}
+	batch.Put(expiryKey(expiresAt, name), data)
+	return nil
+}
+
+// privateExpiry is the expiry entry of a private message in the chat
+// between self and peerID, stored under key.
+func privateExpiry(self, peerID peer.ID, key string, msg *PrivateMessage) *expiryEntry {
+	entry := &expiryEntry{
+		PeerID:    peerID.String(),
+		MessageID: msg.ID,
+		Keys: []string{
+			key,
+			privateMessageIDKey(peerID.String(), msg.ID),
+			string(reactionKey(privateConversationID(self, peerID), msg.ID)),
+		},
+	}
+	if msg.ReplyTo != "" {
+		entry.Keys = append(entry.Keys, privateReplyKey(peerID.String(), msg.ReplyTo, msg.ID))
+	}
+	if msg.IsSent {
+		// Do not deliver a message that expired while it was queued
+		entry.Keys = append(entry.Keys, string(outboxKey(peerID.String(), msg.ID)))
+	}
+	return entry
+}
+
+// expiresAt returns when a message with the given TTL, stored at timestamp,
+// expires, or 0 if it does not.
+func expiresAt(timestamp, ttl int64) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return timestamp + ttl
+}
+
+// Purger deletes disappearing messages, and the files received with them,
+// once they expire.
+type Purger struct {
+	db       *db.LevelDBStore
+	notifier Notifier
+	inbox    *Inbox
+	search   *searchIndex
+}
+
+// NewPurger creates a new Purger that removes purged messages from inbox.
+func NewPurger(store *db.LevelDBStore, notifier Notifier, inbox *Inbox) *Purger {
+	return &Purger{db: store, notifier: notifier, inbox: inbox, search: &searchIndex{db: store}}
+}
+
+// Run purges expired messages until ctx is done. Messages that expired while
+// we were offline are purged right away.
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.purge(time.Now().Unix()); err != nil {
+			log.Printf("Failed to purge expired messages: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purge deletes everything due at or before now.
+func (p *Purger) purge(now int64) error {
+	iter := p.db.NewIteratorWithPrefix([]byte("expiry/"))
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	var expired []*expiryEntry
+	// The inbox needs the expired messages as they were stored
+	records := make(map[*expiryEntry][]byte)
+	for iter.Next() {
+		due, _, _ := strings.Cut(strings.TrimPrefix(string(iter.Key()), "expiry/"), "/")
+		at, err := strconv.ParseInt(due, 10, 64)
+		if err == nil && at > now {
+			break
+		}
+		batch.Delete(append([]byte(nil), iter.Key()...))
+
+		var entry expiryEntry
+		if err := json.Unmarshal(iter.Value(), &entry); err != nil {
+			log.Printf("Failed to unmarshal expiry: %v\n", err)
+			continue
+		}
+		if entry.MessageID != "" && len(entry.Keys) > 0 {
+			if record, err := p.db.Get([]byte(entry.Keys[0])); err == nil {
+				records[&entry] = record
+			}
+			if err := p.search.remove(batch, entry.Keys[0]); err != nil {
+				log.Printf("Failed to remove expired message from search index: %v\n", err)
+			}
+		}
+		for _, key := range entry.Keys {
+			batch.Delete([]byte(key))
+		}
+		if entry.File != "" {
+			if err := os.Remove(entry.File); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to delete expired file %s: %v\n", entry.File, err)
+			}
+		}
+		expired = append(expired, &entry)
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	if err := p.db.WriteBatch(batch); err != nil {
+		return fmt.Errorf("failed to delete expired messages: %w", err)
+	}
+
+	for _, entry := range expired {
+		if record, ok := records[entry]; ok {
+			p.inbox.expire(entry, record)
+		}
+		if entry.MessageID == "" || p.notifier == nil {
+			continue
+		}
+		payload := map[string]interface{}{"message_id": entry.MessageID}
+		if entry.GroupID != "" {
+			payload["group_id"] = entry.GroupID
+		} else {
+			payload["peer_id"] = entry.PeerID
+		}
+		p.notifier.NotifyEvent("message_expired", payload)
+	}
+	log.Printf("Purged %d expired messages and files\n", len(expired))
+	return nil
+}
@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"encoding/json"
+	"github.com/syndtr/goleveldb/leveldb"
+	"math"
+	"testing"
+	"time"
+)
+
+func timerPayloadAt(t *testing.T, ttl, updatedAt int64) []byte {
+	t.Helper()
+	data, err := json.Marshal(timerChange{TTL: ttl, UpdatedAt: updatedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseTimerChange(t *testing.T) {
+	_, sender := newTestIdentity(t)
+	now := time.Now()
+
+	timer, err := parseTimerChange(sender, timerPayloadAt(t, 60, now.Add(time.Minute).UnixNano()))
+	if err != nil {
+		t.Fatalf("change within the allowed skew rejected: %v", err)
+	}
+	if timer.UpdatedBy != sender.String() {
+		t.Fatalf("change attributed to %s, want the sender", timer.UpdatedBy)
+	}
+
+	for name, payload := range map[string][]byte{
+		"from the far future":  timerPayloadAt(t, 60, math.MaxInt64),
+		"beyond the skew":      timerPayloadAt(t, 60, now.Add(2*maxClockSkew).UnixNano()),
+		"without a time":       timerPayloadAt(t, 60, 0),
+		"with too short a TTL": timerPayloadAt(t, minTimerTTL-1, now.UnixNano()),
+		"with too long a TTL":  timerPayloadAt(t, maxTimerTTL+1, now.UnixNano()),
+	} {
+		if _, err := parseTimerChange(sender, payload); err == nil {
+			t.Errorf("change %s accepted", name)
+		}
+	}
+}
+
+func TestTimerStoreOrder(t *testing.T) {
+	ts := &timerStore{db: newTestStore(t)}
+	key := privateTimerKey("peer")
+	now := time.Now()
+
+	// A peer whose clock runs ahead sets the timer
+	ahead := &DisappearingTimer{TTL: 60, UpdatedAt: now.Add(time.Minute).UnixNano(), UpdatedBy: "peer"}
+	if _, changed, err := ts.apply(key, ahead); err != nil || !changed {
+		t.Fatalf("apply = %v, %v; want changed", changed, err)
+	}
+	// An older change loses
+	older := &DisappearingTimer{TTL: 120, UpdatedAt: now.UnixNano(), UpdatedBy: "peer"}
+	if timer, changed, err := ts.apply(key, older); err != nil || changed || timer.TTL != 60 {
+		t.Fatalf("older change applied: %+v, %v, %v", timer, changed, err)
+	}
+	// Our own change wins all the same, and is dated after the one it replaces
+	ours := &DisappearingTimer{TTL: 3600, UpdatedAt: now.UnixNano(), UpdatedBy: "self"}
+	timer, changed, err := ts.set(key, ours)
+	if err != nil || !changed || timer.TTL != 3600 {
+		t.Fatalf("set = %+v, %v, %v; want our timer", timer, changed, err)
+	}
+	if timer.UpdatedAt <= ahead.UpdatedAt {
+		t.Fatalf("our change is dated %d, not after %d", timer.UpdatedAt, ahead.UpdatedAt)
+	}
+	if ts.ttl(key) != 3600 {
+		t.Fatal("our timer was not stored")
+	}
+}
+
+func TestTimerStoreReplacesFutureTimer(t *testing.T) {
+	ts := &timerStore{db: newTestStore(t)}
+	key := groupTimerKey("group")
+
+	// Stored by a version that accepted any time
+	data, err := json.Marshal(&DisappearingTimer{TTL: 60, UpdatedAt: math.MaxInt64, UpdatedBy: "peer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.db.Put(key, data); err != nil {
+		t.Fatal(err)
+	}
+
+	change := &DisappearingTimer{TTL: 120, UpdatedAt: time.Now().UnixNano(), UpdatedBy: "peer"}
+	if timer, changed, err := ts.apply(key, change); err != nil || !changed || timer.TTL != 120 {
+		t.Fatalf("apply = %+v, %v, %v; want the change to replace the future timer", timer, changed, err)
+	}
+	if err := ts.db.Put(key, data); err != nil {
+		t.Fatal(err)
+	}
+	ours := &DisappearingTimer{TTL: 0, UpdatedAt: time.Now().UnixNano(), UpdatedBy: "self"}
+	if timer, changed, err := ts.set(key, ours); err != nil || !changed || timer.UpdatedAt == math.MaxInt64 {
+		t.Fatalf("set = %+v, %v, %v; want our timer", timer, changed, err)
+	}
+}
+
+func TestPurgeExpiredMessage(t *testing.T) {
+	store := newTestStore(t)
+	_, self := newTestIdentity(t)
+	_, other := newTestIdentity(t)
+	inbox, err := NewInbox(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPurger(store, nil, inbox)
+
+	now := time.Now()
+	msg := &PrivateMessage{
+		ID:        "reply",
+		SenderID:  other.String(),
+		Content:   "gone soon",
+		Timestamp: now.Unix(),
+		ReplyTo:   "root",
+		HLC:       HLC{Wall: now.UnixNano()}.String(),
+		TTL:       60,
+		ExpiresAt: now.Unix() + 60,
+	}
+	batch := new(leveldb.Batch)
+	if err := putPrivateMessage(batch, self, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{
+		privateMessageKey(other.String(), msg.HLC, msg.ID),
+		privateMessageIDKey(other.String(), msg.ID),
+		privateReplyKey(other.String(), msg.ReplyTo, msg.ID),
+	}
+
+	if err := p.purge(msg.ExpiresAt - 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if found, _ := store.Has([]byte(key)); !found {
+			t.Fatalf("%s purged before the message expired", key)
+		}
+	}
+
+	if err := p.purge(msg.ExpiresAt); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range append(keys, string(expiryKey(msg.ExpiresAt, keys[0]))) {
+		if found, _ := store.Has([]byte(key)); found {
+			t.Fatalf("%s left after the message expired", key)
+		}
+	}
+}
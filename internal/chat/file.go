@@ -2,25 +2,42 @@ package chat
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"p2p-chat/internal/db"
+	"time"
 )
 
-const FileTransferProtocol = protocol.ID("/p2p-chat/file/1.0.0")
+// FileTransferProtocol is the legacy file transfer protocol, which sends the
+// bare file name followed by the data. FileTransferProtocolV2 sends an
+// EnvelopeFile header carrying the name and size, then exactly that many bytes.
+const (
+	FileTransferProtocol   = protocol.ID("/p2p-chat/file/1.0.0")
+	FileTransferProtocolV2 = protocol.ID("/p2p-chat/file/2.0.0")
+)
+
+// fileHeader is the payload of an EnvelopeFile.
+type fileHeader struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
 
 // FileTransferManager handles file transfer operations.
 type FileTransferManager struct {
 	host      host.Host
 	db        *db.LevelDBStore
 	uploadDir string
+	timers    *timerStore
 }
 
 // NewFileTransferManager creates a new FileTransferManager.
@@ -34,48 +51,155 @@ func NewFileTransferManager(h host.Host, store *db.LevelDBStore, uploadDir strin
 		host:      h,
 		db:        store,
 		uploadDir: uploadDir,
+		timers:    &timerStore{db: store},
 	}
 }
 
-// HandleFileTransferStream sets up a stream handler for file transfers.
+// HandleFileTransferStream sets up a stream handler for file transfers. It
+// serves both FileTransferProtocolV2 and the legacy FileTransferProtocol.
 func (ftm *FileTransferManager) HandleFileTransferStream(s network.Stream) {
 	log.Printf("New file transfer stream from %s\n", s.Conn().RemotePeer().String())
+	defer s.Close()
+
+	if s.Protocol() == FileTransferProtocolV2 {
+		ftm.handleEnvelope(s)
+		return
+	}
 
 	// Read file metadata first (filename, size, etc.)
 	metadataBuf := make([]byte, 256)
 	n, err := s.Read(metadataBuf)
 	if err != nil {
 		log.Printf("Error reading file metadata: %v\n", err)
-		s.Close()
 		return
 	}
 
-	// TODO: Parse metadata (filename, size)
 	filename := string(metadataBuf[:n])
+	filePath, err := ftm.receiveFile(filename, s, -1)
+	if err != nil {
+		log.Printf("Error receiving file %s: %v\n", filename, err)
+		return
+	}
+	ftm.scheduleExpiry(s.Conn().RemotePeer(), filePath, 0)
+}
+
+// handleEnvelope receives a file sent over FileTransferProtocolV2.
+func (ftm *FileTransferManager) handleEnvelope(s network.Stream) {
+	env, err := readEnvelopeFrom(s)
+	if err != nil {
+		log.Printf("Error reading file header: %v\n", err)
+		return
+	}
+	var header fileHeader
+	if env.Type != EnvelopeFile || json.Unmarshal(env.Payload, &header) != nil || header.Size < 0 {
+		log.Printf("Dropping invalid %s envelope from %s\n", env.Type, s.Conn().RemotePeer().String())
+		return
+	}
+
+	filePath, err := ftm.receiveFile(header.Name, s, header.Size)
+	if err != nil {
+		log.Printf("Error receiving file %s: %v\n", header.Name, err)
+		return
+	}
+	ftm.scheduleExpiry(s.Conn().RemotePeer(), filePath, env.TTL)
+	writeResponse(s, env, responseOK)
+}
+
+// scheduleExpiry deletes a file received from sender once it expires, like
+// the disappearing messages of the chat. ttl is the TTL the file carries;
+// files without one follow our timer of the chat.
+func (ftm *FileTransferManager) scheduleExpiry(sender peer.ID, filePath string, ttl int64) {
+	if ttl == 0 {
+		ttl = ftm.timers.ttl(privateTimerKey(sender.String()))
+	}
+	if ttl == 0 {
+		return
+	}
+	filePath = absPath(filePath)
+
+	// Point from the file to its entry, so a file received later under the
+	// same name can cancel it
+	at := expiresAt(time.Now().Unix(), ttl)
+	name := "file/" + filePath
+	batch := new(leveldb.Batch)
+	err := scheduleExpiry(batch, at, name, &expiryEntry{File: filePath, Keys: []string{string(fileExpiryKey(filePath))}})
+	if err == nil {
+		batch.Put(fileExpiryKey(filePath), expiryKey(at, name))
+		err = ftm.db.WriteBatch(batch)
+	}
+	if err != nil {
+		log.Printf("Failed to schedule expiry of file %s: %v\n", filePath, err)
+	}
+}
+
+// cancelExpiry cancels the scheduled deletion of the file at filePath, which
+// is about to be replaced by a file that may not expire, or expire later.
+func (ftm *FileTransferManager) cancelExpiry(filePath string) error {
+	pointer := fileExpiryKey(absPath(filePath))
+	exists, err := ftm.db.Has(pointer)
+	if err != nil || !exists {
+		return err
+	}
+	key, err := ftm.db.Get(pointer)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(key)
+	batch.Delete(pointer)
+	return ftm.db.WriteBatch(batch)
+}
+
+// fileExpiryKey maps a received file to the key of the expiry entry that
+// deletes it.
+func fileExpiryKey(filePath string) []byte {
+	return []byte("expiryfiles/" + filePath)
+}
+
+// absPath returns the absolute form of filePath, as the purger may run from
+// another working directory after a restart.
+func absPath(filePath string) string {
+	if abs, err := filepath.Abs(filePath); err == nil {
+		return abs
+	}
+	return filePath
+}
+
+// receiveFile writes the file data read from r into the upload directory.
+// A negative size reads until the end of r.
+func (ftm *FileTransferManager) receiveFile(filename string, r io.Reader, size int64) (string, error) {
+	// Never let the sender pick a path outside the upload directory
+	filename = filepath.Base(filename)
+	if filename == "." || filename == ".." || filename == string(filepath.Separator) {
+		return "", errors.New("invalid file name")
+	}
 	log.Printf("Receiving file: %s\n", filename)
 
-	// Create file in upload directory
+	// Create file in upload directory. An earlier file of the same name must
+	// not take the new one with it when it expires.
 	filePath := filepath.Join(ftm.uploadDir, filename)
+	if err := ftm.cancelExpiry(filePath); err != nil {
+		return "", fmt.Errorf("failed to cancel expiry of %s: %w", filePath, err)
+	}
 	file, err := os.Create(filePath)
 	if err != nil {
-		log.Printf("Error creating file %s: %v\n", filePath, err)
-		s.Close()
-		return
+		return "", fmt.Errorf("failed to create file %s: %w", filePath, err)
 	}
 	defer file.Close()
 
 	// Copy file data from stream to file
-	_, err = io.Copy(file, s)
+	if size < 0 {
+		_, err = io.Copy(file, r)
+	} else {
+		_, err = io.CopyN(file, r, size)
+	}
 	if err != nil {
-		log.Printf("Error writing file data: %v\n", err)
-		s.Close()
-		return
+		return "", fmt.Errorf("failed to write file data: %w", err)
 	}
 
 	log.Printf("Successfully received file: %s\n", filePath)
-	s.Close()
-
 	// TODO: Store file transfer record in LevelDB
+	return filePath, nil
 }
 
 // SendFile sends a file to a peer.
@@ -99,25 +223,44 @@ func (ftm *FileTransferManager) SendFile(ctx context.Context, peerIDStr, filePat
 	}
 
 	// Open stream to peer
-	s, err := ftm.host.NewStream(ctx, peerID, FileTransferProtocol)
+	s, isV2, err := newStream(ctx, ftm.host, peerID, FileTransferProtocolV2, FileTransferProtocol)
 	if err != nil {
 		return fmt.Errorf("failed to open file transfer stream: %w", err)
 	}
 	defer s.Close()
 
-	// Send file metadata first (filename)
+	// Send file metadata first
 	filename := filepath.Base(filePath)
-	_, err = s.Write([]byte(filename))
+	if isV2 {
+		payload, err := json.Marshal(fileHeader{Name: filename, Size: fileInfo.Size()})
+		if err != nil {
+			return fmt.Errorf("failed to marshal file metadata: %w", err)
+		}
+		env := NewEnvelope(EnvelopeFile, ftm.host.ID(), privateConversationID(ftm.host.ID(), peerID), payload)
+		env.TTL = ftm.timers.ttl(privateTimerKey(peerIDStr))
+		err = WriteEnvelope(s, env)
+	} else {
+		_, err = s.Write([]byte(filename))
+	}
 	if err != nil {
 		return fmt.Errorf("failed to send file metadata: %w", err)
 	}
 
 	// Send file data
-	_, err = io.Copy(s, file)
+	_, err = io.CopyN(s, file, fileInfo.Size())
 	if err != nil {
 		return fmt.Errorf("failed to send file data: %w", err)
 	}
 
+	if isV2 {
+		if err := s.CloseWrite(); err != nil {
+			return fmt.Errorf("failed to close file transfer stream: %w", err)
+		}
+		if _, err := readResponse(s); err != nil {
+			return fmt.Errorf("peer did not confirm the file transfer: %w", err)
+		}
+	}
+
 	log.Printf("Successfully sent file %s (%d bytes) to %s\n", filename, fileInfo.Size(), peerID.String())
 
 	// TODO: Store file transfer record in LevelDB
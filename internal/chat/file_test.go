@@ -0,0 +1,49 @@
+package chat
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileExpiry(t *testing.T) {
+	store := newTestStore(t)
+	_, sender := newTestIdentity(t)
+	ftm := &FileTransferManager{db: store, uploadDir: t.TempDir(), timers: &timerStore{db: store}}
+	p := NewPurger(store, nil, nil)
+	later := time.Now().Unix() + 120
+
+	receive := func(name, content string, ttl int64) string {
+		t.Helper()
+		path, err := ftm.receiveFile(name, strings.NewReader(content), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ftm.scheduleExpiry(sender, path, ttl)
+		return path
+	}
+
+	// A disappearing file is deleted once it expires
+	expiring := receive("expiring.txt", "data", 60)
+	if err := p.purge(later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(expiring); !os.IsNotExist(err) {
+		t.Fatalf("expired file still exists: %v", err)
+	}
+
+	// A file that replaces it under the same name is kept
+	path := receive("replaced.txt", "old", 60)
+	receive("replaced.txt", "new", 0)
+	if err := p.purge(later); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("replacing file deleted when the earlier one expired: %v", err)
+	}
+	if string(data) != "new" {
+		t.Fatalf("file holds %q, want the new content", data)
+	}
+}
@@ -2,25 +2,66 @@ package chat
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
 	"io"
 	"log"
 	"p2p-chat/internal/db"
+	"strings"
 	"sync"
+	"time"
 )
 
-const GroupChatProtocol = protocol.ID("/p2p-chat/group/1.0.0")
+// GroupChatProtocol is the legacy group chat protocol, which sends
+// "[groupID] message" as plain text. GroupChatProtocolV2 uses an Envelope.
+const (
+	GroupChatProtocol   = protocol.ID("/p2p-chat/group/1.0.0")
+	GroupChatProtocolV2 = protocol.ID("/p2p-chat/group/2.0.0")
+)
+
+// maxGroupMessageSize bounds how much we read from a legacy group chat stream.
+const maxGroupMessageSize = 64 * 1024
 
 // GroupChatManager handles group chat operations.
 type GroupChatManager struct {
-	host   host.Host
-	db     *db.LevelDBStore
-	groups map[string]*Group
-	mutex  sync.RWMutex
+	host     host.Host
+	db       *db.LevelDBStore
+	notifier Notifier
+	groups    map[string]*Group
+	reactions *reactionStore
+	timers    *timerStore
+	clock     *Clock
+	inbox     *Inbox
+	search    *searchIndex
+	mutex     sync.RWMutex
+	// storeMutex makes checking for and storing a received message atomic.
+	storeMutex sync.Mutex
+}
+
+// GroupMessage represents a single group chat message.
+type GroupMessage struct {
+	ID        string `json:"id"`
+	GroupID   string `json:"group_id"`
+	SenderID  string `json:"sender_id"`
+	Content   string `json:"content"`
+	Timestamp int64  `json:"timestamp"`
+	IsSent    bool   `json:"is_sent"`
+	// ReplyTo is the ID of the message in the group this one replies to.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// HLC is the hybrid logical clock timestamp the sender assigned to the
+	// message. The group history is ordered by it.
+	HLC string `json:"hlc,omitempty"`
+	// TTL is set for disappearing messages, which are deleted at ExpiresAt.
+	TTL       int64 `json:"ttl,omitempty"`
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// Reactions maps each emoji to the peers that reacted with it. It is
+	// stored separately and filled in when the history is read.
+	Reactions map[string][]string `json:"reactions,omitempty"`
 }
 
 // Group represents a chat group.
@@ -32,11 +73,17 @@ type Group struct {
 }
 
 // NewGroupChatManager creates a new GroupChatManager.
-func NewGroupChatManager(h host.Host, store *db.LevelDBStore) *GroupChatManager {
+func NewGroupChatManager(h host.Host, store *db.LevelDBStore, notifier Notifier, clock *Clock, inbox *Inbox) *GroupChatManager {
 	return &GroupChatManager{
-		host:   h,
-		db:     store,
-		groups: make(map[string]*Group),
+		host:     h,
+		db:       store,
+		notifier: notifier,
+		groups:    make(map[string]*Group),
+		reactions: &reactionStore{db: store},
+		timers:    &timerStore{db: store},
+		clock:     clock,
+		inbox:     inbox,
+		search:    &searchIndex{db: store},
 	}
 }
 
@@ -57,6 +104,7 @@ func (gcm *GroupChatManager) CreateGroup(groupID, groupName string, adminID peer
 	}
 
 	gcm.groups[groupID] = group
+	gcm.inbox.addGroup(groupID, groupName)
 	log.Printf("Created group %s with admin %s\n", groupName, adminID.String())
 
 	// TODO: Store group info in LevelDB
@@ -110,64 +158,338 @@ func (gcm *GroupChatManager) RemoveMemberFromGroup(groupID string, memberID peer
 }
 
 // HandleGroupChatStream sets up a stream handler for group chat messages.
+// It serves both GroupChatProtocolV2 and the legacy GroupChatProtocol; each
+// stream carries a single message.
 func (gcm *GroupChatManager) HandleGroupChatStream(s network.Stream) {
-	log.Printf("New group chat stream from %s\n", s.Conn().RemotePeer().String())
+	remote := s.Conn().RemotePeer()
+	log.Printf("New group chat stream from %s\n", remote.String())
+	defer s.Close()
 
-	buf := make([]byte, 1024)
-	for {
-		n, err := s.Read(buf)
+	if s.Protocol() == GroupChatProtocolV2 {
+		env, err := readEnvelopeFrom(s)
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading from group chat stream: %v\n", err)
-			}
-			break
+			log.Printf("Error reading from group chat stream: %v\n", err)
+			return
+		}
+		switch env.Type {
+		case EnvelopeReaction:
+			writeResponse(s, env, responseOK)
+			gcm.receiveReaction(remote, env)
+			return
+		case EnvelopeTimer:
+			writeResponse(s, env, responseOK)
+			gcm.receiveTimer(remote, env)
+			return
 		}
-		// TODO: Parse group ID and message from the received data
-		fmt.Printf("Group message from %s: %s\n", s.Conn().RemotePeer().String(), string(buf[:n]))
-		// TODO: Store message in LevelDB
+		var body messageBody
+		if env.Type != EnvelopeGroupMessage || json.Unmarshal(env.Payload, &body) != nil {
+			log.Printf("Dropping invalid %s envelope from %s\n", env.Type, remote.String())
+			return
+		}
+		writeResponse(s, env, responseOK)
+		gcm.receiveMessage(remote, env, body.Content)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(s, maxGroupMessageSize))
+	if err != nil {
+		log.Printf("Error reading from group chat stream: %v\n", err)
+		return
+	}
+	// Legacy messages look like "[groupID] message"
+	text := string(data)
+	if !strings.HasPrefix(text, "[") {
+		log.Printf("Dropping malformed group message from %s\n", remote.String())
+		return
+	}
+	groupID, content, ok := strings.Cut(text[1:], "] ")
+	if !ok {
+		log.Printf("Dropping malformed group message from %s\n", remote.String())
+		return
+	}
+	gcm.receiveMessage(remote, &Envelope{ID: newMessageID(), ConversationID: groupID}, content)
+}
+
+// receiveMessage stores a group message we received in env and notifies the
+// frontend. Messages without a TTL follow our timer of the group.
+func (gcm *GroupChatManager) receiveMessage(sender peer.ID, env *Envelope, content string) {
+	// The group ID becomes part of a database key
+	groupID := env.ConversationID
+	if groupID == "" || strings.Contains(groupID, "/") {
+		log.Printf("Dropping group message from %s with invalid group ID %q\n", sender.String(), groupID)
+		return
+	}
+	ttl := env.TTL
+	if ttl == 0 {
+		ttl = gcm.timers.ttl(groupTimerKey(groupID))
+	}
+	msg := &GroupMessage{
+		ID:        env.ID,
+		GroupID:   groupID,
+		SenderID:  sender.String(),
+		Content:   content,
+		Timestamp: time.Now().Unix(),
+		ReplyTo:   env.ReplyTo,
+		HLC:       gcm.clock.stamp(sender.String(), env.HLC),
+		TTL:       ttl,
+	}
+	msg.ExpiresAt = expiresAt(msg.Timestamp, ttl)
+
+	// Retried messages are not stored again
+	gcm.storeMutex.Lock()
+	found, err := gcm.hasMessage(groupID, msg.ID)
+	if err == nil && !found {
+		err = gcm.storeMessage(msg)
+	}
+	gcm.storeMutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to store received group message: %v", err)
+	}
+	if found {
+		log.Printf("Dropping duplicate group message %s from %s\n", msg.ID, msg.SenderID)
+		return
+	}
+	if err == nil {
+		gcm.inbox.addGroupMessage(msg, gcm.groupName(groupID))
 	}
 
-	s.Close()
+	if gcm.notifier != nil {
+		gcm.notifier.NotifyNewMessage(msg.SenderID, msg.Content, "group")
+	}
+
+	fmt.Printf("Group message in %s from %s: %s\n", groupID, msg.SenderID, msg.Content)
 }
 
-// SendGroupMessage sends a message to all members of a group.
-func (gcm *GroupChatManager) SendGroupMessage(ctx context.Context, groupID, message string) error {
+// SendGroupMessage sends a message to all members of a group. replyTo
+// optionally names the message in the group that this one replies to.
+func (gcm *GroupChatManager) SendGroupMessage(ctx context.Context, groupID, message, replyTo string) (*GroupMessage, error) {
 	gcm.mutex.RLock()
 	group, exists := gcm.groups[groupID]
 	gcm.mutex.RUnlock()
 
 	if !exists {
-		return fmt.Errorf("group %s does not exist", groupID)
+		return nil, fmt.Errorf("group %s does not exist", groupID)
+	}
+	if replyTo != "" {
+		found, err := gcm.hasMessage(groupID, replyTo)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid reply_to: %w", ErrMessageNotFound)
+		}
+	}
+
+	payload, err := json.Marshal(messageBody{Content: message})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
 	}
+	env := NewEnvelope(EnvelopeGroupMessage, gcm.host.ID(), groupID, payload)
+	env.ReplyTo = replyTo
+	env.HLC = gcm.clock.Now().String()
+	env.TTL = gcm.timers.ttl(groupTimerKey(groupID))
+	gcm.sendToMembers(ctx, group, env, message)
+
+	log.Printf("Sent group message to group %s\n", groupID)
 
-	// Send message to all group members
-	for _, memberID := range group.Members {
+	msg := &GroupMessage{
+		ID:        env.ID,
+		GroupID:   groupID,
+		SenderID:  gcm.host.ID().String(),
+		Content:   message,
+		Timestamp: env.Timestamp,
+		IsSent:    true,
+		ReplyTo:   replyTo,
+		HLC:       env.HLC,
+		TTL:       env.TTL,
+		ExpiresAt: expiresAt(env.Timestamp, env.TTL),
+	}
+	if err := gcm.storeMessage(msg); err != nil {
+		log.Printf("Failed to store sent group message: %v", err)
+	} else {
+		gcm.inbox.addGroupMessage(msg, group.Name)
+	}
+	return msg, nil
+}
+
+// groupName returns the name of a group, or "" if we do not know it.
+func (gcm *GroupChatManager) groupName(groupID string) string {
+	gcm.mutex.RLock()
+	defer gcm.mutex.RUnlock()
+	if group, exists := gcm.groups[groupID]; exists {
+		return group.Name
+	}
+	return ""
+}
+
+// sendToMembers sends env to all members of a group. message is the text
+// sent to members on the legacy protocol.
+func (gcm *GroupChatManager) sendToMembers(ctx context.Context, group *Group, env *Envelope, message string) {
+	gcm.mutex.RLock()
+	members := append([]peer.ID(nil), group.Members...)
+	gcm.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, memberID := range members {
 		if memberID == gcm.host.ID() {
 			continue // Skip sending to self
 		}
 
+		wg.Add(1)
 		go func(peerID peer.ID) {
-			s, err := gcm.host.NewStream(ctx, peerID, GroupChatProtocol)
-			if err != nil {
-				log.Printf("Failed to open group chat stream to %s: %v\n", peerID.String(), err)
-				return
-			}
-			defer s.Close()
-
-			// TODO: Format message with group ID
-			formattedMessage := fmt.Sprintf("[%s] %s", groupID, message)
-			_, err = s.Write([]byte(formattedMessage))
-			if err != nil {
-				log.Printf("Failed to write to group chat stream to %s: %v\n", peerID.String(), err)
+			defer wg.Done()
+			if err := gcm.sendToMember(ctx, peerID, env, message); err != nil {
+				log.Printf("Failed to send group %s to %s: %v\n", env.Type, peerID.String(), err)
 			}
 		}(memberID)
 	}
+	wg.Wait()
+}
 
-	log.Printf("Sent group message to group %s\n", groupID)
-	// TODO: Store sent message in LevelDB
+func (gcm *GroupChatManager) sendToMember(ctx context.Context, peerID peer.ID, env *Envelope, message string) error {
+	s, isV2, err := newStream(ctx, gcm.host, peerID, GroupChatProtocolV2, GroupChatProtocol)
+	if err != nil {
+		return fmt.Errorf("failed to open group chat stream: %w", err)
+	}
+	defer s.Close()
+
+	if !isV2 {
+		// Legacy members only get messages
+		if env.Type != EnvelopeGroupMessage {
+			s.Reset()
+			return nil
+		}
+		_, err = s.Write([]byte(fmt.Sprintf("[%s] %s", env.ConversationID, message)))
+		return err
+	}
+	if err := WriteEnvelope(s, env); err != nil {
+		return err
+	}
+	if err := s.CloseWrite(); err != nil {
+		return fmt.Errorf("failed to close group chat stream: %w", err)
+	}
+	_, err = readResponse(s)
+	return err
+}
+
+// groupMessageKey is the key of a message in the history of groupID. Keys
+// start with the message's HLC, so the history iterates in causal order.
+func groupMessageKey(groupID, hlc, messageID string) string {
+	return fmt.Sprintf("chat/group/%s/%s-%s", groupID, hlc, messageID)
+}
+
+// groupMessageIDKey maps the ID of a message in the history of groupID to
+// its key.
+func groupMessageIDKey(groupID, messageID string) string {
+	return fmt.Sprintf("msgids/group/%s/%s", groupID, messageID)
+}
+
+// groupReplyKey maps a reply to parentID in the history of groupID to the
+// key of the reply.
+func groupReplyKey(groupID, parentID, messageID string) string {
+	return fmt.Sprintf("replies/group/%s/%s/%s", groupID, parentID, messageID)
+}
+
+// hasMessage reports whether a message is in the history of a group.
+func (gcm *GroupChatManager) hasMessage(groupID, messageID string) (bool, error) {
+	found, err := gcm.db.Has([]byte(groupMessageIDKey(groupID, messageID)))
+	if err != nil {
+		return false, fmt.Errorf("failed to check message: %w", err)
+	}
+	return found, nil
+}
+
+// messageKey returns the key of a message in the history of a group.
+func (gcm *GroupChatManager) messageKey(groupID, messageID string) ([]byte, error) {
+	idKey := []byte(groupMessageIDKey(groupID, messageID))
+	exists, err := gcm.db.Has(idKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check message: %w", err)
+	}
+	if !exists {
+		return nil, ErrMessageNotFound
+	}
+	key, err := gcm.db.Get(idKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message: %w", err)
+	}
+	return key, nil
+}
+
+// storeMessage stores a message in the group history, updates its entry in
+// the search index and, for disappearing messages, schedules its expiry.
+func (gcm *GroupChatManager) storeMessage(msg *GroupMessage) error {
+	batch := new(leveldb.Batch)
+	if err := putGroupMessage(batch, msg); err != nil {
+		return err
+	}
+	key := groupMessageKey(msg.GroupID, msg.HLC, msg.ID)
+	if err := gcm.search.update(batch, key, msg.Content); err != nil {
+		return err
+	}
+	return gcm.db.WriteBatch(batch)
+}
+
+// putGroupMessage adds a message in a group history to batch, like
+// putPrivateMessage does for private chats.
+func putGroupMessage(batch *leveldb.Batch, msg *GroupMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal group message: %w", err)
+	}
+	key := groupMessageKey(msg.GroupID, msg.HLC, msg.ID)
+	idKey := groupMessageIDKey(msg.GroupID, msg.ID)
+	batch.Put([]byte(key), data)
+	batch.Put([]byte(idKey), []byte(key))
+	if msg.ReplyTo != "" {
+		batch.Put([]byte(groupReplyKey(msg.GroupID, msg.ReplyTo, msg.ID)), []byte(key))
+	}
+	if msg.ExpiresAt != 0 {
+		entry := &expiryEntry{
+			GroupID:   msg.GroupID,
+			MessageID: msg.ID,
+			Keys:      []string{key, idKey, string(reactionKey(msg.GroupID, msg.ID))},
+		}
+		if msg.ReplyTo != "" {
+			entry.Keys = append(entry.Keys, groupReplyKey(msg.GroupID, msg.ReplyTo, msg.ID))
+		}
+		if err := scheduleExpiry(batch, msg.ExpiresAt, key, entry); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// GetGroupHistory retrieves the stored messages of a group.
+func (gcm *GroupChatManager) GetGroupHistory(groupID string) ([]*GroupMessage, error) {
+	iter := gcm.db.NewIteratorWithPrefix([]byte(fmt.Sprintf("chat/group/%s/", groupID)))
+	defer iter.Release()
+
+	var messages []*GroupMessage
+	for iter.Next() {
+		var msg GroupMessage
+		if err := json.Unmarshal(iter.Value(), &msg); err != nil {
+			log.Printf("Failed to unmarshal group message: %v", err)
+			continue
+		}
+		messages = append(messages, &msg)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if len(messages) > 0 {
+		reactions, err := gcm.reactions.list(groupID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get reactions: %w", err)
+		}
+		for _, msg := range messages {
+			msg.Reactions = reactions[msg.ID]
+		}
+	}
+	return messages, nil
+}
+
 // ListGroups returns a list of all groups.
 func (gcm *GroupChatManager) ListGroups() []*Group {
 	gcm.mutex.RLock()
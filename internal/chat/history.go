@@ -0,0 +1,167 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"log"
+	"p2p-chat/internal/db"
+	"time"
+)
+
+// Page sizes of chat histories.
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 500
+)
+
+// HistoryQuery selects a page of a chat or group history. Before and After
+// are IDs of messages the page stops at, which are not part of it.
+// BeforeTime and AfterTime bound the page by the Unix time at which messages
+// were sent: it holds messages sent at or after AfterTime and before
+// BeforeTime. Without an after bound, the page holds the newest messages
+// that match, so clients scroll back by passing the oldest message they
+// have as Before; with one, it holds the oldest, so clients catch up by
+// passing the newest message they have as After.
+type HistoryQuery struct {
+	Before     string
+	After      string
+	BeforeTime int64
+	AfterTime  int64
+	// Limit is the maximum number of messages, DefaultHistoryLimit if 0.
+	Limit int
+}
+
+// GetChatHistoryPage returns a page of the chat history with a peer, oldest
+// first, and whether more messages match beyond it.
+func (pcm *PrivateChatManager) GetChatHistoryPage(peerIDStr string, q HistoryQuery) ([]*PrivateMessage, bool, error) {
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid peer ID: %w", err)
+	}
+	prefix := fmt.Sprintf("chat/private/%s/", peerIDStr)
+	values, more, err := readHistoryPage(pcm.db, prefix, q, func(messageID string) ([]byte, error) {
+		return pcm.messageKey(peerIDStr, messageID)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	conversationID := privateConversationID(pcm.host.ID(), peerID)
+	messages := []*PrivateMessage{}
+	for _, value := range values {
+		var msg PrivateMessage
+		if err := json.Unmarshal(value, &msg); err != nil {
+			log.Printf("Failed to unmarshal message: %v", err)
+			continue
+		}
+		if msg.Reactions, err = pcm.reactions.get(conversationID, msg.ID); err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, &msg)
+	}
+	return messages, more, nil
+}
+
+// GetGroupHistoryPage returns a page of the history of a group, like
+// GetChatHistoryPage does for private chats.
+func (gcm *GroupChatManager) GetGroupHistoryPage(groupID string, q HistoryQuery) ([]*GroupMessage, bool, error) {
+	if _, err := gcm.GetGroup(groupID); err != nil {
+		return nil, false, err
+	}
+	prefix := fmt.Sprintf("chat/group/%s/", groupID)
+	values, more, err := readHistoryPage(gcm.db, prefix, q, func(messageID string) ([]byte, error) {
+		return gcm.messageKey(groupID, messageID)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	messages := []*GroupMessage{}
+	for _, value := range values {
+		var msg GroupMessage
+		if err := json.Unmarshal(value, &msg); err != nil {
+			log.Printf("Failed to unmarshal group message: %v", err)
+			continue
+		}
+		if msg.Reactions, err = gcm.reactions.get(groupID, msg.ID); err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, &msg)
+	}
+	return messages, more, nil
+}
+
+// readHistoryPage reads the values of the page of the history under prefix
+// that q selects, oldest first. Keys sort by HLC, so the page is a single
+// range scan. messageKey returns the key of a message by its ID.
+func readHistoryPage(store *db.LevelDBStore, prefix string, q HistoryQuery, messageKey func(string) ([]byte, error)) ([][]byte, bool, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		limit = MaxHistoryLimit
+	}
+
+	r := util.BytesPrefix([]byte(prefix))
+	raise := func(start []byte) {
+		if string(start) > string(r.Start) {
+			r.Start = start
+		}
+	}
+	lower := func(end []byte) {
+		if string(end) < string(r.Limit) {
+			r.Limit = end
+		}
+	}
+	if q.After != "" {
+		key, err := messageKey(q.After)
+		if err != nil {
+			return nil, false, err
+		}
+		raise(append(key, 0))
+	}
+	if q.Before != "" {
+		key, err := messageKey(q.Before)
+		if err != nil {
+			return nil, false, err
+		}
+		lower(key)
+	}
+	if q.AfterTime > 0 {
+		raise([]byte(prefix + HLC{Wall: q.AfterTime * int64(time.Second)}.String()))
+	}
+	if q.BeforeTime > 0 {
+		lower([]byte(prefix + HLC{Wall: q.BeforeTime * int64(time.Second)}.String()))
+	}
+
+	iter := store.NewIterator(r)
+	defer iter.Release()
+
+	// Read one message more than asked for to tell whether there are more
+	forward := q.After != "" || q.AfterTime > 0
+	var values [][]byte
+	ok := iter.Last()
+	if forward {
+		ok = iter.First()
+	}
+	for ; ok && len(values) <= limit; ok = forward && iter.Next() || !forward && iter.Prev() {
+		values = append(values, append([]byte(nil), iter.Value()...))
+	}
+	if err := iter.Error(); err != nil {
+		return nil, false, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	more := len(values) > limit
+	if more {
+		values = values[:limit]
+	}
+	if !forward {
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+	return values, more, nil
+}
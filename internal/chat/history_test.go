@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadHistoryPage(t *testing.T) {
+	store := newTestStore(t)
+	_, self := newTestIdentity(t)
+	_, other := newTestIdentity(t)
+	peerID := other.String()
+
+	// Ten messages, one a second
+	start := time.Now().Add(-time.Hour).Unix()
+	batch := new(leveldb.Batch)
+	for i := 0; i < 10; i++ {
+		sent := start + int64(i)
+		msg := &PrivateMessage{
+			ID:        fmt.Sprintf("m%d", i),
+			SenderID:  peerID,
+			Content:   "hello",
+			Timestamp: sent,
+			HLC:       HLC{Wall: sent * int64(time.Second)}.String(),
+		}
+		if err := putPrivateMessage(batch, self, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	messageKey := func(id string) ([]byte, error) {
+		key, err := store.Get([]byte(privateMessageIDKey(peerID, id)))
+		if err != nil {
+			return nil, ErrMessageNotFound
+		}
+		return key, nil
+	}
+
+	tests := []struct {
+		name string
+		q    HistoryQuery
+		want []string
+		more bool
+	}{
+		{"newest", HistoryQuery{Limit: 3}, []string{"m7", "m8", "m9"}, true},
+		{"all", HistoryQuery{}, []string{"m0", "m1", "m2", "m3", "m4", "m5", "m6", "m7", "m8", "m9"}, false},
+		{"before", HistoryQuery{Before: "m7", Limit: 3}, []string{"m4", "m5", "m6"}, true},
+		{"before the oldest", HistoryQuery{Before: "m2", Limit: 3}, []string{"m0", "m1"}, false},
+		{"after", HistoryQuery{After: "m2", Limit: 3}, []string{"m3", "m4", "m5"}, true},
+		{"after, up to the newest", HistoryQuery{After: "m6", Limit: 3}, []string{"m7", "m8", "m9"}, false},
+		{"between", HistoryQuery{After: "m1", Before: "m5"}, []string{"m2", "m3", "m4"}, false},
+		{"after a time", HistoryQuery{AfterTime: start + 5, Limit: 3}, []string{"m5", "m6", "m7"}, true},
+		{"before a time", HistoryQuery{BeforeTime: start + 5, Limit: 3}, []string{"m2", "m3", "m4"}, true},
+		{"between times", HistoryQuery{AfterTime: start + 2, BeforeTime: start + 4}, []string{"m2", "m3"}, false},
+		// The narrower of two bounds applies
+		{"after an ID and a time", HistoryQuery{After: "m5", AfterTime: start + 2, Limit: 2}, []string{"m6", "m7"}, true},
+		{"nothing", HistoryQuery{After: "m9"}, nil, false},
+	}
+	for _, tt := range tests {
+		values, more, err := readHistoryPage(store, fmt.Sprintf("chat/private/%s/", peerID), tt.q, messageKey)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var ids []string
+		for _, value := range values {
+			var msg PrivateMessage
+			if err := json.Unmarshal(value, &msg); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, msg.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.want) || more != tt.more {
+			t.Errorf("%s: page is %v, more=%v; want %v, more=%v", tt.name, ids, more, tt.want, tt.more)
+		}
+	}
+
+	if _, _, err := readHistoryPage(store, fmt.Sprintf("chat/private/%s/", peerID), HistoryQuery{Before: "unknown"}, messageKey); err == nil {
+		t.Fatal("page before an unknown message returned")
+	}
+}
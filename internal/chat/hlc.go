@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"p2p-chat/internal/db"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxClockSkew bounds how far ahead of our clock a peer's timestamp may be.
+// Later timestamps are not adopted, so a peer with a wrong clock cannot push
+// everyone's messages into the future.
+const maxClockSkew = 5 * time.Minute
+
+// hlcLength is the length of an encoded HLC.
+const hlcLength = 24
+
+// clockKey is where the clock keeps the last timestamp it issued.
+const clockKey = "clock/hlc"
+
+// HLC is a hybrid logical clock timestamp: the physical time in nanoseconds,
+// and a counter that orders events while the physical clock does not advance
+// or lags behind a peer's. An event always gets a later HLC than every event
+// its node sent or received before it, so ordering by HLC respects causality
+// even when clocks are skewed.
+type HLC struct {
+	Wall    int64
+	Logical uint32
+}
+
+// String encodes t as fixed-width hex, so encodings sort like the timestamps.
+func (t HLC) String() string {
+	return fmt.Sprintf("%016x%08x", uint64(t.Wall), t.Logical)
+}
+
+// Unix returns the physical time of t in seconds.
+func (t HLC) Unix() int64 {
+	return t.Wall / int64(time.Second)
+}
+
+// after reports whether t is later than u.
+func (t HLC) after(u HLC) bool {
+	return t.Wall > u.Wall || (t.Wall == u.Wall && t.Logical > u.Logical)
+}
+
+func parseHLC(s string) (HLC, error) {
+	if len(s) != hlcLength {
+		return HLC{}, errors.New("invalid HLC length")
+	}
+	wall, err := strconv.ParseUint(s[:16], 16, 64)
+	if err != nil || wall > math.MaxInt64 {
+		return HLC{}, errors.New("invalid HLC wall time")
+	}
+	logical, err := strconv.ParseUint(s[16:], 16, 32)
+	if err != nil {
+		return HLC{}, errors.New("invalid HLC counter")
+	}
+	return HLC{Wall: int64(wall), Logical: uint32(logical)}, nil
+}
+
+// legacyHLC derives the HLC of a message stored before messages had one.
+// Their IDs used to be the Unix time in nanoseconds at which the sender or
+// we created them, which is more precise than their timestamp.
+func legacyHLC(messageID string, timestamp int64) HLC {
+	if nanos, err := strconv.ParseInt(messageID, 10, 64); err == nil {
+		if diff := nanos/int64(time.Second) - timestamp; diff > -86400 && diff < 86400 {
+			return HLC{Wall: nanos}
+		}
+	}
+	return HLC{Wall: timestamp * int64(time.Second)}
+}
+
+// Clock is a hybrid logical clock. It persists the last timestamp it issued,
+// so it never goes back, even across restarts or when the system clock is
+// set back.
+type Clock struct {
+	db    *db.LevelDBStore
+	last  HLC
+	mutex sync.Mutex
+}
+
+// NewClock creates a Clock that continues from the timestamp stored in store.
+func NewClock(store *db.LevelDBStore) (*Clock, error) {
+	c := &Clock{db: store}
+	exists, err := store.Has([]byte(clockKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check clock: %w", err)
+	}
+	if exists {
+		data, err := store.Get([]byte(clockKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get clock: %w", err)
+		}
+		if err := json.Unmarshal(data, &c.last); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal clock: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Now returns the timestamp of a local event.
+func (c *Clock) Now() HLC {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.tick(HLC{})
+}
+
+// Update merges the timestamp of an event received from a peer, so that our
+// later events are ordered after it. It reports false, and leaves the clock
+// alone, if remote is too far ahead of our physical clock.
+func (c *Clock) Update(remote HLC) bool {
+	if remote.Wall > time.Now().Add(maxClockSkew).UnixNano() {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tick(remote)
+	return true
+}
+
+// stamp returns the HLC a message received with the encoded timestamp remote
+// is ordered by: its sender's, unless it is missing or unusable, in which
+// case the message gets a local timestamp.
+func (c *Clock) stamp(sender, remote string) string {
+	if remote != "" {
+		t, err := parseHLC(remote)
+		if err == nil && c.Update(t) {
+			return remote
+		}
+		log.Printf("Ignoring timestamp %q from %s: invalid or too far ahead\n", remote, sender)
+	}
+	return c.Now().String()
+}
+
+// tick advances the clock past last and remote. Callers hold c.mutex.
+func (c *Clock) tick(remote HLC) HLC {
+	next := c.last
+	if remote.after(next) {
+		next = remote
+	}
+	if now := time.Now().UnixNano(); now > next.Wall {
+		next = HLC{Wall: now}
+	} else {
+		next.Logical++
+	}
+	c.last = next
+
+	data, err := json.Marshal(next)
+	if err == nil {
+		err = c.db.Put([]byte(clockKey), data)
+	}
+	if err != nil {
+		log.Printf("Failed to store clock: %v\n", err)
+	}
+	return next
+}
@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHLCEncodingSorts(t *testing.T) {
+	times := []HLC{
+		{Wall: 0},
+		{Wall: 1},
+		{Wall: 1, Logical: 1},
+		{Wall: 1, Logical: 0xffff},
+		{Wall: 2},
+		{Wall: time.Now().UnixNano()},
+		{Wall: time.Now().UnixNano(), Logical: 0xffffffff},
+	}
+	for i := 1; i < len(times); i++ {
+		if !times[i].after(times[i-1]) || times[i].String() <= times[i-1].String() {
+			t.Fatalf("%v does not sort after %v", times[i], times[i-1])
+		}
+	}
+	for _, hlc := range times {
+		parsed, err := parseHLC(hlc.String())
+		if err != nil || parsed != hlc {
+			t.Fatalf("parseHLC(%q) = %v, %v", hlc.String(), parsed, err)
+		}
+	}
+	for _, s := range []string{"", "0000", "zzzzzzzzzzzzzzzz00000000", "ffffffffffffffff00000000"} {
+		if _, err := parseHLC(s); err == nil {
+			t.Fatalf("parseHLC(%q) accepted", s)
+		}
+	}
+}
+
+func TestClockMonotonic(t *testing.T) {
+	store := newTestStore(t)
+	clock, err := NewClock(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := clock.Now()
+	for i := 0; i < 1000; i++ {
+		next := clock.Now()
+		if !next.after(last) {
+			t.Fatalf("clock went from %v to %v", last, next)
+		}
+		last = next
+	}
+
+	// A peer slightly ahead pulls the clock forward
+	remote := HLC{Wall: time.Now().Add(time.Minute).UnixNano(), Logical: 7}
+	if !clock.Update(remote) {
+		t.Fatal("timestamp within the allowed skew rejected")
+	}
+	if next := clock.Now(); !next.after(remote) {
+		t.Fatalf("%v is not after the received %v", next, remote)
+	}
+
+	// One too far ahead is ignored
+	far := HLC{Wall: time.Now().Add(2 * maxClockSkew).UnixNano()}
+	if clock.Update(far) {
+		t.Fatal("timestamp beyond the allowed skew accepted")
+	}
+	if next := clock.Now(); next.after(far) {
+		t.Fatalf("clock jumped to %v", next)
+	}
+	if stamp := clock.stamp("peer", far.String()); stamp == far.String() {
+		t.Fatal("message kept a timestamp beyond the allowed skew")
+	}
+	if stamp := clock.stamp("peer", "invalid"); stamp == "invalid" {
+		t.Fatal("message kept an invalid timestamp")
+	}
+
+	// The clock continues where it left off after a restart
+	last = clock.Now()
+	restarted, err := NewClock(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := restarted.Now(); !next.after(last) {
+		t.Fatalf("restarted clock went from %v to %v", last, next)
+	}
+}
+
+func TestLegacyHLC(t *testing.T) {
+	now := time.Now()
+	nanos := now.UnixNano()
+	tests := []struct {
+		id        string
+		timestamp int64
+		want      HLC
+	}{
+		{strconv.FormatInt(nanos, 10), now.Unix(), HLC{Wall: nanos}},
+		{"not-a-time", now.Unix(), HLC{Wall: now.Unix() * int64(time.Second)}},
+		// IDs far from the timestamp are not times
+		{"42", now.Unix(), HLC{Wall: now.Unix() * int64(time.Second)}},
+	}
+	for _, tt := range tests {
+		if got := legacyHLC(tt.id, tt.timestamp); got != tt.want {
+			t.Errorf("legacyHLC(%q, %d) = %v, want %v", tt.id, tt.timestamp, got, tt.want)
+		}
+	}
+
+	// Legacy messages keep the order of their creation times
+	ids := []string{strconv.FormatInt(nanos+2, 10), strconv.FormatInt(nanos, 10), strconv.FormatInt(nanos+1, 10)}
+	var encoded []string
+	for _, id := range ids {
+		encoded = append(encoded, legacyHLC(id, now.Unix()).String()+"-"+id)
+	}
+	sort.Strings(encoded)
+	for i, want := range []string{ids[1], ids[2], ids[0]} {
+		if got := encoded[i][hlcLength+1:]; got != want {
+			t.Fatalf("message %d is %s, want %s", i, got, want)
+		}
+	}
+}
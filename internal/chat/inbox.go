@@ -0,0 +1,500 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"log"
+	"p2p-chat/internal/db"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inboxBuiltKey marks that the inbox was built from the chat history.
+const inboxBuiltKey = "meta/inbox"
+
+// previewLength is the number of characters of a message kept as preview.
+const previewLength = 100
+
+// Orders of the inbox.
+const (
+	SortRecent = "recent"
+	SortUnread = "unread"
+)
+
+// ErrConversationNotFound is returned for chats and groups without messages.
+var ErrConversationNotFound = errors.New("conversation not found")
+
+// Conversation is the inbox entry of a private chat or a group.
+type Conversation struct {
+	PeerID  string `json:"peer_id,omitempty"`
+	GroupID string `json:"group_id,omitempty"`
+	// Name is the name of a group, if we know it.
+	Name        string          `json:"name,omitempty"`
+	LastMessage *MessagePreview `json:"last_message,omitempty"`
+	// UpdatedAt is the Unix time of the last message, or of when the
+	// conversation was created.
+	UpdatedAt int64 `json:"updated_at"`
+	Unread    int   `json:"unread"`
+	Muted     bool  `json:"muted"`
+	Archived  bool  `json:"archived"`
+	// ReadHLC is the HLC of the last group message that was marked read.
+	// Group messages have no status, so this tells which ones are unread.
+	ReadHLC string `json:"read_hlc,omitempty"`
+}
+
+// MessagePreview is the start of the last message of a conversation.
+type MessagePreview struct {
+	ID        string `json:"id"`
+	SenderID  string `json:"sender_id"`
+	Content   string `json:"content"`
+	Timestamp int64  `json:"timestamp"`
+	HLC       string `json:"hlc"`
+	IsSent    bool   `json:"is_sent"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+// inboxMessage holds the fields of a stored private or group message the
+// inbox needs.
+type inboxMessage struct {
+	ID        string `json:"id"`
+	GroupID   string `json:"group_id"`
+	SenderID  string `json:"sender_id"`
+	Content   string `json:"content"`
+	Timestamp int64  `json:"timestamp"`
+	IsSent    bool   `json:"is_sent"`
+	Status    string `json:"status"`
+	HLC       string `json:"hlc"`
+	Deleted   bool   `json:"deleted"`
+}
+
+func (m *inboxMessage) preview() *MessagePreview {
+	content := m.Content
+	if runes := []rune(content); len(runes) > previewLength {
+		content = string(runes[:previewLength])
+	}
+	return &MessagePreview{
+		ID:        m.ID,
+		SenderID:  m.SenderID,
+		Content:   content,
+		Timestamp: m.Timestamp,
+		HLC:       m.HLC,
+		IsSent:    m.IsSent,
+		Deleted:   m.Deleted,
+	}
+}
+
+// unread reports whether m counts as unread in c.
+func (m *inboxMessage) unread(c *Conversation) bool {
+	if m.IsSent {
+		return false
+	}
+	if c.GroupID != "" {
+		return m.HLC > c.ReadHLC
+	}
+	return m.Status != MessageRead
+}
+
+// Inbox indexes the private chats and groups we have messages in, with
+// their last message, unread count and flags, under
+// inbox/<kind>/<conversation>. It is updated as messages are stored, read,
+// changed and purged, so listing conversations never reads the history, and
+// every change reaches the frontend as a conversation_updated event.
+type Inbox struct {
+	db       *db.LevelDBStore
+	notifier Notifier
+	mutex    sync.Mutex
+}
+
+// NewInbox creates the Inbox of the chat history in store. The first time,
+// it indexes the history written before there was an inbox; messages in it
+// count as unread if they are private messages that were not marked read.
+func NewInbox(store *db.LevelDBStore, notifier Notifier) (*Inbox, error) {
+	ib := &Inbox{db: store, notifier: notifier}
+	built, err := store.Has([]byte(inboxBuiltKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check inbox: %w", err)
+	}
+	if !built {
+		if err := ib.build(); err != nil {
+			return nil, err
+		}
+	}
+	return ib, nil
+}
+
+// build indexes the whole chat history. Messages are stored in HLC order, so
+// the last message read for a conversation is its last message.
+func (ib *Inbox) build() error {
+	conversations := make(map[string]*Conversation)
+	for _, kind := range []string{"private", "group"} {
+		prefix := fmt.Sprintf("chat/%s/", kind)
+		iter := ib.db.NewIteratorWithPrefix([]byte(prefix))
+		for iter.Next() {
+			id, _, _ := strings.Cut(strings.TrimPrefix(string(iter.Key()), prefix), "/")
+			var msg inboxMessage
+			if err := json.Unmarshal(iter.Value(), &msg); err != nil {
+				log.Printf("Failed to unmarshal message: %v", err)
+				continue
+			}
+			key := inboxKey(kind, id)
+			c, ok := conversations[key]
+			if !ok {
+				c = &Conversation{}
+				if kind == "group" {
+					c.GroupID = id
+				} else {
+					c.PeerID = id
+				}
+				conversations[key] = c
+			}
+			if kind == "group" {
+				// There is no telling which earlier group messages were read
+				c.ReadHLC = msg.HLC
+			} else if msg.unread(c) {
+				c.Unread++
+			}
+			c.LastMessage = msg.preview()
+			c.UpdatedAt = msg.Timestamp
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return fmt.Errorf("failed to build inbox: %w", err)
+		}
+	}
+
+	batch := new(leveldb.Batch)
+	for key, c := range conversations {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return fmt.Errorf("failed to marshal conversation: %w", err)
+		}
+		batch.Put([]byte(key), data)
+	}
+	batch.Put([]byte(inboxBuiltKey), []byte("1"))
+	if err := ib.db.WriteBatch(batch); err != nil {
+		return fmt.Errorf("failed to build inbox: %w", err)
+	}
+	if len(conversations) > 0 {
+		log.Printf("Built inbox of %d conversations\n", len(conversations))
+	}
+	return nil
+}
+
+// List returns the conversations, most recent first, or those with the
+// most unread messages first if order is SortUnread. archived selects
+// archived conversations; nil selects all.
+func (ib *Inbox) List(order string, archived *bool) ([]*Conversation, error) {
+	if order == "" {
+		order = SortRecent
+	}
+	if order != SortRecent && order != SortUnread {
+		return nil, fmt.Errorf("invalid sort order %q", order)
+	}
+
+	iter := ib.db.NewIteratorWithPrefix([]byte("inbox/"))
+	defer iter.Release()
+
+	conversations := []*Conversation{}
+	for iter.Next() {
+		var c Conversation
+		if err := json.Unmarshal(iter.Value(), &c); err != nil {
+			log.Printf("Failed to unmarshal conversation: %v", err)
+			continue
+		}
+		if archived == nil || c.Archived == *archived {
+			conversations = append(conversations, &c)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to list conversations: %w", err)
+	}
+
+	sort.SliceStable(conversations, func(i, j int) bool {
+		a, b := conversations[i], conversations[j]
+		if order == SortUnread && a.Unread != b.Unread {
+			return a.Unread > b.Unread
+		}
+		return a.UpdatedAt > b.UpdatedAt
+	})
+	return conversations, nil
+}
+
+// Get returns the conversation with peerID, or of the group groupID if
+// peerID is empty.
+func (ib *Inbox) Get(peerID, groupID string) (*Conversation, error) {
+	key, err := conversationKey(peerID, groupID)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ib.load(key)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, ErrConversationNotFound
+	}
+	return c, nil
+}
+
+// SetMuted mutes or unmutes a conversation. Muted conversations still count
+// unread messages; clients do not alert about them.
+func (ib *Inbox) SetMuted(peerID, groupID string, muted bool) (*Conversation, error) {
+	return ib.change(peerID, groupID, func(c *Conversation) bool {
+		changed := c.Muted != muted
+		c.Muted = muted
+		return changed
+	})
+}
+
+// SetArchived archives a conversation, or brings it back. Archived
+// conversations stay archived when new messages arrive.
+func (ib *Inbox) SetArchived(peerID, groupID string, archived bool) (*Conversation, error) {
+	return ib.change(peerID, groupID, func(c *Conversation) bool {
+		changed := c.Archived != archived
+		c.Archived = archived
+		return changed
+	})
+}
+
+// MarkGroupRead marks all messages in a group read. Private chats are marked
+// read with PrivateChatManager.MarkRead, which also tells the peer.
+func (ib *Inbox) MarkGroupRead(groupID string) (*Conversation, error) {
+	return ib.change("", groupID, func(c *Conversation) bool {
+		if c.LastMessage == nil || (c.Unread == 0 && c.ReadHLC >= c.LastMessage.HLC) {
+			return false
+		}
+		c.Unread = 0
+		c.ReadHLC = c.LastMessage.HLC
+		return true
+	})
+}
+
+// change applies fn to an existing conversation.
+func (ib *Inbox) change(peerID, groupID string, fn func(*Conversation) bool) (*Conversation, error) {
+	key, err := conversationKey(peerID, groupID)
+	if err != nil {
+		return nil, err
+	}
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+
+	c, err := ib.load(key)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, ErrConversationNotFound
+	}
+	if fn(c) {
+		if err := ib.save(key, c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// update applies fn to the conversation stored under key, creating it if
+// needed, and logs failures: the inbox is secondary to the history.
+func (ib *Inbox) update(key string, fn func(*Conversation) bool) {
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+
+	c, err := ib.load(key)
+	if err == nil && c == nil {
+		kind, id, _ := strings.Cut(strings.TrimPrefix(key, "inbox/"), "/")
+		c = &Conversation{UpdatedAt: time.Now().Unix()}
+		if kind == "group" {
+			c.GroupID = id
+		} else {
+			c.PeerID = id
+		}
+	}
+	if err == nil && fn(c) {
+		err = ib.save(key, c)
+	}
+	if err != nil {
+		log.Printf("Failed to update inbox: %v\n", err)
+	}
+}
+
+// addMessage records a new message in its conversation. name is the name of
+// the group, if known.
+func (ib *Inbox) addMessage(key string, msg *inboxMessage, name string) {
+	ib.update(key, func(c *Conversation) bool {
+		if name != "" {
+			c.Name = name
+		}
+		if msg.unread(c) {
+			c.Unread++
+		}
+		if c.LastMessage == nil || msg.HLC > c.LastMessage.HLC {
+			c.LastMessage = msg.preview()
+			c.UpdatedAt = msg.Timestamp
+		}
+		return true
+	})
+}
+
+func (ib *Inbox) addPrivateMessage(peerID string, msg *PrivateMessage) {
+	ib.addMessage(inboxKey("private", peerID), &inboxMessage{
+		ID:        msg.ID,
+		SenderID:  msg.SenderID,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+		IsSent:    msg.IsSent,
+		Status:    msg.Status,
+		HLC:       msg.HLC,
+	}, "")
+}
+
+func (ib *Inbox) addGroupMessage(msg *GroupMessage, name string) {
+	ib.addMessage(inboxKey("group", msg.GroupID), &inboxMessage{
+		ID:        msg.ID,
+		GroupID:   msg.GroupID,
+		SenderID:  msg.SenderID,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+		IsSent:    msg.IsSent,
+		HLC:       msg.HLC,
+	}, name)
+}
+
+// addGroup creates the conversation of a group we created.
+func (ib *Inbox) addGroup(groupID, name string) {
+	ib.update(inboxKey("group", groupID), func(c *Conversation) bool {
+		c.Name = name
+		return true
+	})
+}
+
+// privateMessageRead records that a received private message was marked read.
+func (ib *Inbox) privateMessageRead(peerID string) {
+	ib.update(inboxKey("private", peerID), func(c *Conversation) bool {
+		if c.Unread == 0 {
+			return false
+		}
+		c.Unread--
+		return true
+	})
+}
+
+// privateMessageChanged updates the preview of an edited or deleted private
+// message, if it is the last one of its chat.
+func (ib *Inbox) privateMessageChanged(peerID string, msg *PrivateMessage) {
+	ib.update(inboxKey("private", peerID), func(c *Conversation) bool {
+		if c.LastMessage == nil || c.LastMessage.ID != msg.ID {
+			return false
+		}
+		c.LastMessage = (&inboxMessage{
+			ID:        msg.ID,
+			SenderID:  msg.SenderID,
+			Content:   msg.Content,
+			Timestamp: msg.Timestamp,
+			IsSent:    msg.IsSent,
+			HLC:       msg.HLC,
+			Deleted:   msg.Deleted,
+		}).preview()
+		return true
+	})
+}
+
+// expire removes a purged message from its conversation. record is the
+// message as it was stored; if it was the last message, the one before it
+// takes its place.
+func (ib *Inbox) expire(entry *expiryEntry, record []byte) {
+	var msg inboxMessage
+	if err := json.Unmarshal(record, &msg); err != nil {
+		log.Printf("Failed to unmarshal expired message: %v\n", err)
+		return
+	}
+	kind, id, prefix := "private", entry.PeerID, fmt.Sprintf("chat/private/%s/", entry.PeerID)
+	if entry.GroupID != "" {
+		kind, id, prefix = "group", entry.GroupID, fmt.Sprintf("chat/group/%s/", entry.GroupID)
+	}
+	key := inboxKey(kind, id)
+
+	ib.mutex.Lock()
+	defer ib.mutex.Unlock()
+	c, err := ib.load(key)
+	if err != nil || c == nil {
+		return
+	}
+	if msg.unread(c) && c.Unread > 0 {
+		c.Unread--
+	}
+	if c.LastMessage != nil && c.LastMessage.ID == msg.ID {
+		c.LastMessage = nil
+		iter := ib.db.NewIterator(util.BytesPrefix([]byte(prefix)))
+		if iter.Last() {
+			var last inboxMessage
+			if err := json.Unmarshal(iter.Value(), &last); err == nil {
+				c.LastMessage = last.preview()
+				c.UpdatedAt = last.Timestamp
+			}
+		}
+		iter.Release()
+	}
+	if err := ib.save(key, c); err != nil {
+		log.Printf("Failed to update inbox: %v\n", err)
+	}
+}
+
+// load returns the conversation stored under key, or nil if there is none.
+func (ib *Inbox) load(key string) (*Conversation, error) {
+	exists, err := ib.db.Has([]byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check conversation: %w", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	data, err := ib.db.Get([]byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversation: %w", err)
+	}
+	var c Conversation
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal conversation: %w", err)
+	}
+	return &c, nil
+}
+
+// save stores c under key and notifies the frontend. Callers hold ib.mutex.
+func (ib *Inbox) save(key string, c *Conversation) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal conversation: %w", err)
+	}
+	if err := ib.db.Put([]byte(key), data); err != nil {
+		return fmt.Errorf("failed to store conversation: %w", err)
+	}
+	if ib.notifier != nil {
+		ib.notifier.NotifyEvent("conversation_updated", map[string]interface{}{"conversation": c})
+	}
+	return nil
+}
+
+func inboxKey(kind, id string) string {
+	return fmt.Sprintf("inbox/%s/%s", kind, id)
+}
+
+// conversationKey returns the inbox key of the chat with peerID, or of the
+// group groupID if peerID is empty.
+func conversationKey(peerID, groupID string) (string, error) {
+	if peerID != "" {
+		if _, err := peer.Decode(peerID); err != nil {
+			return "", fmt.Errorf("invalid peer ID: %w", err)
+		}
+		return inboxKey("private", peerID), nil
+	}
+	if groupID == "" || strings.Contains(groupID, "/") {
+		return "", fmt.Errorf("invalid group ID %q", groupID)
+	}
+	return inboxKey("group", groupID), nil
+}
@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInboxBuild(t *testing.T) {
+	store := newTestStore(t)
+	_, self := newTestIdentity(t)
+	_, other := newTestIdentity(t)
+	peerID := other.String()
+	now := time.Now()
+	hlc := func(i int) string {
+		return HLC{Wall: now.Add(time.Duration(i) * time.Second).UnixNano()}.String()
+	}
+
+	// History written before there was an inbox
+	long := strings.Repeat("é", previewLength+10)
+	batch := new(leveldb.Batch)
+	for _, msg := range []*PrivateMessage{
+		{ID: "read", SenderID: peerID, Content: "old", Timestamp: now.Unix(), Status: MessageRead, HLC: hlc(0)},
+		{ID: "unread", SenderID: peerID, Content: "new", Timestamp: now.Unix() + 1, HLC: hlc(1)},
+		{ID: "sent", SenderID: self.String(), RecipientID: peerID, Content: long, Timestamp: now.Unix() + 2, IsSent: true, HLC: hlc(2)},
+	} {
+		if err := putPrivateMessage(batch, self, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := putGroupMessage(batch, &GroupMessage{ID: "g", GroupID: "group", SenderID: peerID, Content: "hi", Timestamp: now.Unix(), HLC: hlc(3)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	ib, err := NewInbox(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat, err := ib.Get(peerID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.Unread != 1 || chat.LastMessage.ID != "sent" || chat.UpdatedAt != now.Unix()+2 {
+		t.Fatalf("chat built as %+v", chat)
+	}
+	if got := []rune(chat.LastMessage.Content); len(got) != previewLength {
+		t.Fatalf("preview has %d characters, want %d", len(got), previewLength)
+	}
+	// Earlier group messages count as read
+	group, err := ib.Get("", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Unread != 0 || group.ReadHLC != hlc(3) {
+		t.Fatalf("group built as %+v", group)
+	}
+}
+
+func TestInboxUpdates(t *testing.T) {
+	ib, err := NewInbox(newTestStore(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, alice := newTestIdentity(t)
+	_, bob := newTestIdentity(t)
+	now := time.Now()
+	received := func(sender, id string, i int) *PrivateMessage {
+		return &PrivateMessage{ID: id, SenderID: sender, Content: id, Timestamp: now.Unix() + int64(i), HLC: HLC{Wall: now.Add(time.Duration(i) * time.Second).UnixNano()}.String()}
+	}
+
+	ib.addPrivateMessage(alice.String(), received(alice.String(), "a2", 2))
+	// A message that arrives late counts, but does not replace the preview
+	ib.addPrivateMessage(alice.String(), received(alice.String(), "a1", 1))
+	ib.addPrivateMessage(bob.String(), received(bob.String(), "b1", 3))
+
+	chat, err := ib.Get(alice.String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat.Unread != 2 || chat.LastMessage.ID != "a2" {
+		t.Fatalf("chat is %+v, want 2 unread and a2 last", chat)
+	}
+
+	list := func(order string) []string {
+		t.Helper()
+		conversations, err := ib.List(order, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, c := range conversations {
+			ids = append(ids, c.PeerID+c.GroupID)
+		}
+		return ids
+	}
+	if got := list(SortRecent); len(got) != 2 || got[0] != bob.String() {
+		t.Fatalf("recent order is %v, want bob first", got)
+	}
+	if got := list(SortUnread); got[0] != alice.String() {
+		t.Fatalf("unread order is %v, want alice first", got)
+	}
+	if _, err := ib.List("name", nil); err == nil {
+		t.Fatal("invalid order accepted")
+	}
+
+	// Reading never takes the count below zero
+	for i := 0; i < 3; i++ {
+		ib.privateMessageRead(alice.String())
+	}
+	if chat, _ := ib.Get(alice.String(), ""); chat.Unread != 0 {
+		t.Fatalf("%d unread after reading everything", chat.Unread)
+	}
+
+	// Edits and deletions of the last message show in the preview
+	deleted := received(alice.String(), "a2", 2)
+	deleted.Content, deleted.Deleted = "", true
+	ib.privateMessageChanged(alice.String(), deleted)
+	if chat, _ := ib.Get(alice.String(), ""); !chat.LastMessage.Deleted || chat.LastMessage.Content != "" {
+		t.Fatalf("preview after deletion is %+v", chat.LastMessage)
+	}
+
+	// Archived conversations stay archived as messages arrive
+	if _, err := ib.SetArchived(bob.String(), "", true); err != nil {
+		t.Fatal(err)
+	}
+	ib.addPrivateMessage(bob.String(), received(bob.String(), "b2", 4))
+	archived := true
+	if conversations, err := ib.List(SortRecent, &archived); err != nil || len(conversations) != 1 || conversations[0].PeerID != bob.String() {
+		t.Fatalf("archived conversations are %v, %v", conversations, err)
+	}
+	if _, err := ib.SetMuted("", "unknown", true); err != ErrConversationNotFound {
+		t.Fatalf("muting an unknown group gave %v", err)
+	}
+
+	// Group messages are unread until the group is marked read
+	ib.addGroup("group", "friends")
+	ib.addGroupMessage(&GroupMessage{ID: "g1", GroupID: "group", SenderID: alice.String(), Content: "hi", Timestamp: now.Unix(), HLC: HLC{Wall: now.UnixNano()}.String()}, "")
+	group, err := ib.MarkGroupRead("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Name != "friends" || group.Unread != 0 || group.ReadHLC != group.LastMessage.HLC {
+		t.Fatalf("group after marking read is %+v", group)
+	}
+	ib.addGroupMessage(&GroupMessage{ID: "g2", GroupID: "group", SenderID: alice.String(), Content: "again", Timestamp: now.Unix() + 1, HLC: HLC{Wall: now.UnixNano() + 1}.String()}, "")
+	if group, _ := ib.Get("", "group"); group.Unread != 1 {
+		t.Fatalf("%d unread group messages, want 1", group.Unread)
+	}
+}
@@ -0,0 +1,282 @@
+package chat
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"io"
+	"log"
+	cryptoLocal "p2p-chat/internal/crypto"
+	"p2p-chat/internal/db"
+	"strings"
+	"sync"
+	"time"
+)
+
+const KeyExchangeProtocol = protocol.ID("/p2p-chat/keyexchange/1.0.0")
+
+// maxKeyBundleSize bounds how much we read from a key exchange stream.
+const maxKeyBundleSize = 8192
+
+const keyBundleSignaturePrefix = "p2p-chat-key-bundle:"
+
+// keyBundleRefreshInterval is how often we fetch the key bundle of a peer we
+// are talking to again, to pick up changes to its mailboxes.
+const keyBundleRefreshInterval = time.Hour
+
+// KeyBundle is a node's encryption public key, signed by its libp2p identity
+// so it can be tied to the peer ID it claims to belong to. It also lists the
+// mailboxes that hold messages for the node while it is offline.
+type KeyBundle struct {
+	PeerID    string   `json:"peer_id"`
+	PublicKey string   `json:"public_key"`
+	Mailboxes []string `json:"mailboxes,omitempty"`
+	Signature []byte   `json:"signature"`
+}
+
+func (b *KeyBundle) signingBytes() []byte {
+	data := keyBundleSignaturePrefix + b.PeerID + ":" + b.PublicKey
+	// Bundles without mailboxes sign the same bytes as before mailboxes existed
+	if len(b.Mailboxes) > 0 {
+		data += ":" + strings.Join(b.Mailboxes, ",")
+	}
+	return []byte(data)
+}
+
+// KeyManager publishes our encryption public key and fetches, verifies and
+// caches the public keys of other peers.
+type KeyManager struct {
+	host      host.Host
+	db        *db.LevelDBStore
+	privKey   *ecdsa.PrivateKey
+	bundle    *KeyBundle
+	mailboxes []peer.AddrInfo
+	keys      map[peer.ID]*ecdsa.PublicKey
+	refreshed map[peer.ID]time.Time
+	mutex     sync.RWMutex
+}
+
+// NewKeyManager creates a new KeyManager for the given encryption key.
+// mailboxes are the multiaddresses of the peers that hold messages for us,
+// advertised in our key bundle.
+func NewKeyManager(h host.Host, store *db.LevelDBStore, privKey *ecdsa.PrivateKey, mailboxes []string) (*KeyManager, error) {
+	pubHex, err := cryptoLocal.EncodePublicKey(&privKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+
+	if len(mailboxes) > maxMailboxes {
+		return nil, fmt.Errorf("at most %d mailboxes are supported", maxMailboxes)
+	}
+	var mailboxInfos []peer.AddrInfo
+	for _, addr := range mailboxes {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mailbox address %s: %w", addr, err)
+		}
+		mailboxInfos = append(mailboxInfos, *info)
+	}
+
+	bundle := &KeyBundle{
+		PeerID:    h.ID().String(),
+		PublicKey: pubHex,
+		Mailboxes: mailboxes,
+	}
+	identity := h.Peerstore().PrivKey(h.ID())
+	if identity == nil {
+		return nil, fmt.Errorf("host has no private key")
+	}
+	bundle.Signature, err = identity.Sign(bundle.signingBytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign key bundle: %w", err)
+	}
+
+	return &KeyManager{
+		host:      h,
+		db:        store,
+		privKey:   privKey,
+		bundle:    bundle,
+		mailboxes: mailboxInfos,
+		keys:      make(map[peer.ID]*ecdsa.PublicKey),
+		refreshed: make(map[peer.ID]time.Time),
+	}, nil
+}
+
+// Mailboxes returns the peers that hold messages for us.
+func (km *KeyManager) Mailboxes() []peer.AddrInfo {
+	return km.mailboxes
+}
+
+// PrivateKey returns our encryption private key.
+func (km *KeyManager) PrivateKey() *ecdsa.PrivateKey {
+	return km.privKey
+}
+
+// HandleKeyExchangeStream answers a key exchange request with our signed key bundle.
+func (km *KeyManager) HandleKeyExchangeStream(s network.Stream) {
+	defer s.Close()
+
+	data, err := json.Marshal(km.bundle)
+	if err != nil {
+		log.Printf("Failed to marshal key bundle: %v\n", err)
+		s.Reset()
+		return
+	}
+	if _, err := s.Write(data); err != nil {
+		log.Printf("Failed to send key bundle to %s: %v\n", s.Conn().RemotePeer().String(), err)
+	}
+}
+
+// PeerPublicKey returns the encryption public key of a peer, fetching it over
+// the key exchange protocol if it is not cached yet.
+func (km *KeyManager) PeerPublicKey(ctx context.Context, peerID peer.ID) (*ecdsa.PublicKey, error) {
+	km.mutex.RLock()
+	pub, ok := km.keys[peerID]
+	km.mutex.RUnlock()
+	if ok {
+		return pub, nil
+	}
+
+	// Check the persistent cache
+	if data, err := km.db.Get(peerKeyKey(peerID)); err == nil {
+		var bundle KeyBundle
+		if err := json.Unmarshal(data, &bundle); err == nil {
+			if pub, err := verifyKeyBundle(peerID, &bundle); err == nil {
+				km.cacheKey(peerID, pub)
+				return pub, nil
+			}
+		}
+		log.Printf("Discarding invalid cached key bundle for %s\n", peerID.String())
+	}
+
+	bundle, err := km.fetchKeyBundle(ctx, peerID)
+	if err != nil {
+		return nil, err
+	}
+	pub, err = verifyKeyBundle(peerID, bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(bundle)
+	if err == nil {
+		err = km.db.Put(peerKeyKey(peerID), data)
+	}
+	if err != nil {
+		log.Printf("Failed to store key bundle for %s: %v\n", peerID.String(), err)
+	}
+
+	km.cacheKey(peerID, pub)
+	return pub, nil
+}
+
+// PeerMailboxes returns the mailboxes listed in the cached key bundle of a peer.
+func (km *KeyManager) PeerMailboxes(peerID peer.ID) []peer.AddrInfo {
+	data, err := km.db.Get(peerKeyKey(peerID))
+	if err != nil {
+		return nil
+	}
+	var bundle KeyBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil
+	}
+	if _, err := verifyKeyBundle(peerID, &bundle); err != nil {
+		return nil
+	}
+
+	var mailboxes []peer.AddrInfo
+	for _, addr := range bundle.Mailboxes {
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			log.Printf("Ignoring invalid mailbox address %s of %s: %v\n", addr, peerID.String(), err)
+			continue
+		}
+		mailboxes = append(mailboxes, *info)
+	}
+	return mailboxes
+}
+
+// RefreshKeyBundle fetches the key bundle of a reachable peer again if the
+// cached one is older than keyBundleRefreshInterval, so changes to its
+// mailboxes are picked up.
+func (km *KeyManager) RefreshKeyBundle(ctx context.Context, peerID peer.ID) error {
+	km.mutex.Lock()
+	if time.Since(km.refreshed[peerID]) < keyBundleRefreshInterval {
+		km.mutex.Unlock()
+		return nil
+	}
+	km.refreshed[peerID] = time.Now()
+	km.mutex.Unlock()
+
+	bundle, err := km.fetchKeyBundle(ctx, peerID)
+	if err != nil {
+		return err
+	}
+	pub, err := verifyKeyBundle(peerID, bundle)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key bundle: %w", err)
+	}
+	if err := km.db.Put(peerKeyKey(peerID), data); err != nil {
+		return fmt.Errorf("failed to store key bundle: %w", err)
+	}
+	km.cacheKey(peerID, pub)
+	return nil
+}
+
+func (km *KeyManager) cacheKey(peerID peer.ID, pub *ecdsa.PublicKey) {
+	km.mutex.Lock()
+	km.keys[peerID] = pub
+	km.mutex.Unlock()
+}
+
+func (km *KeyManager) fetchKeyBundle(ctx context.Context, peerID peer.ID) (*KeyBundle, error) {
+	s, err := km.host.NewStream(ctx, peerID, KeyExchangeProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key exchange stream: %w", err)
+	}
+	defer s.Close()
+
+	data, err := io.ReadAll(io.LimitReader(s, maxKeyBundleSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key bundle: %w", err)
+	}
+
+	var bundle KeyBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("failed to parse key bundle: %w", err)
+	}
+	return &bundle, nil
+}
+
+// verifyKeyBundle checks that bundle was signed by the identity behind peerID.
+func verifyKeyBundle(peerID peer.ID, bundle *KeyBundle) (*ecdsa.PublicKey, error) {
+	if bundle.PeerID != peerID.String() {
+		return nil, fmt.Errorf("key bundle is for %s, expected %s", bundle.PeerID, peerID.String())
+	}
+	identity, err := peerID.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract public key from peer ID: %w", err)
+	}
+	ok, err := identity.Verify(bundle.signingBytes(), bundle.Signature)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("invalid key bundle signature from %s", peerID.String())
+	}
+	pub, err := cryptoLocal.DecodePublicKey(bundle.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	return pub, nil
+}
+
+func peerKeyKey(peerID peer.ID) []byte {
+	return []byte(fmt.Sprintf("peerkeys/%s", peerID.String()))
+}
@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	cryptoLocal "p2p-chat/internal/crypto"
+	"testing"
+	"time"
+)
+
+// newTestKeyManager creates a KeyManager on a host that does not listen.
+func newTestKeyManager(t *testing.T, mailboxes []string) (host.Host, *KeyManager) {
+	t.Helper()
+	identity, _ := newTestIdentity(t)
+	h, err := libp2p.New(libp2p.Identity(identity), libp2p.NoListenAddrs)
+	if err != nil {
+		t.Fatalf("failed to create host: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	priv, err := cryptoLocal.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("failed to generate encryption key: %v", err)
+	}
+	km, err := NewKeyManager(h, newTestStore(t), priv, mailboxes)
+	if err != nil {
+		t.Fatalf("failed to create key manager: %v", err)
+	}
+	return h, km
+}
+
+func TestKeyBundleSignature(t *testing.T) {
+	_, mailboxID := newTestIdentity(t)
+	mailbox := fmt.Sprintf("/ip4/127.0.0.1/tcp/4001/p2p/%s", mailboxID)
+	_, other := newTestKeyManager(t, nil)
+
+	for _, mailboxes := range [][]string{nil, {mailbox}} {
+		h, km := newTestKeyManager(t, mailboxes)
+		bundle := *km.bundle
+
+		pub, err := verifyKeyBundle(h.ID(), &bundle)
+		if err != nil {
+			t.Fatalf("valid bundle with mailboxes %v rejected: %v", mailboxes, err)
+		}
+		if !pub.Equal(&km.privKey.PublicKey) {
+			t.Fatal("bundle verified with the wrong public key")
+		}
+
+		tampered := map[string]func(b *KeyBundle){
+			"public key": func(b *KeyBundle) { b.PublicKey = other.bundle.PublicKey },
+			"mailboxes":  func(b *KeyBundle) { b.Mailboxes = append(b.Mailboxes, mailbox) },
+			"peer ID":    func(b *KeyBundle) { b.PeerID = other.bundle.PeerID },
+			"signature":  func(b *KeyBundle) { b.Signature = other.bundle.Signature },
+		}
+		if len(mailboxes) > 0 {
+			tampered["removed mailboxes"] = func(b *KeyBundle) { b.Mailboxes = nil }
+		}
+		for name, tamper := range tampered {
+			b := bundle
+			b.Mailboxes = append([]string(nil), bundle.Mailboxes...)
+			tamper(&b)
+			if _, err := verifyKeyBundle(h.ID(), &b); err == nil {
+				t.Fatalf("bundle with tampered %s accepted", name)
+			}
+		}
+	}
+}
+
+func TestKeyBundleLegacySigningBytes(t *testing.T) {
+	b := &KeyBundle{PeerID: "peer", PublicKey: "key"}
+	if got, want := string(b.signingBytes()), keyBundleSignaturePrefix+"peer:key"; got != want {
+		t.Fatalf("bundle without mailboxes signs %q, want %q", got, want)
+	}
+}
+
+func TestPeerPublicKeyCache(t *testing.T) {
+	_, km := newTestKeyManager(t, nil)
+	remoteHost, remote := newTestKeyManager(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// A valid cached bundle is used without asking the peer
+	data, err := json.Marshal(remote.bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := km.db.Put(peerKeyKey(remoteHost.ID()), data); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := km.PeerPublicKey(ctx, remoteHost.ID())
+	if err != nil {
+		t.Fatalf("cached bundle not used: %v", err)
+	}
+	if !pub.Equal(&remote.privKey.PublicKey) {
+		t.Fatal("cached bundle returned the wrong public key")
+	}
+
+	// A tampered one is discarded, and the unreachable peer is asked again
+	_, other := newTestKeyManager(t, nil)
+	tampered := *remote.bundle
+	tampered.PublicKey = other.bundle.PublicKey
+	if data, err = json.Marshal(&tampered); err != nil {
+		t.Fatal(err)
+	}
+	if err := km.db.Put(peerKeyKey(remoteHost.ID()), data); err != nil {
+		t.Fatal(err)
+	}
+	delete(km.keys, remoteHost.ID())
+	if _, err := km.PeerPublicKey(ctx, remoteHost.ID()); err == nil {
+		t.Fatal("tampered cached bundle accepted")
+	}
+}
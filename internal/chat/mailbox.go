@@ -0,0 +1,789 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"log"
+	"p2p-chat/internal/db"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MailboxProtocol lets peers leave messages for a peer that is offline with
+// a mailbox, an always-on peer the recipient designated, and lets the
+// recipient fetch them later.
+const MailboxProtocol = protocol.ID("/p2p-chat/mailbox/1.0.0")
+
+// Mailbox envelope types.
+const (
+	// EnvelopeMailboxRegister asks the mailbox to hold messages for the sender.
+	EnvelopeMailboxRegister = "mailbox_register"
+	// EnvelopeMailboxDeposit leaves an encrypted private message envelope for a recipient.
+	EnvelopeMailboxDeposit = "mailbox_deposit"
+	// EnvelopeMailboxFetch asks for the messages held for the sender, after
+	// a given one; the mailbox answers with an EnvelopeMailboxItems.
+	EnvelopeMailboxFetch = "mailbox_fetch"
+	EnvelopeMailboxItems = "mailbox_items"
+	// EnvelopeMailboxAck removes fetched messages from the mailbox.
+	EnvelopeMailboxAck = "mailbox_ack"
+)
+
+// Mailbox response statuses, besides responseOK.
+const (
+	mailboxUnknownRecipient = "unknown_recipient"
+	mailboxQuotaExceeded    = "quota_exceeded"
+	mailboxNotAllowed       = "not_allowed"
+)
+
+const (
+	// DefaultMailboxQuota is the default number of messages a mailbox holds per recipient.
+	DefaultMailboxQuota = 1000
+	// DefaultMailboxSenderQuota is the default number of messages a mailbox
+	// holds from one sender for one recipient.
+	DefaultMailboxSenderQuota = 100
+	// DefaultMailboxMaxRecipients is the default number of recipients a
+	// mailbox holds messages for.
+	DefaultMailboxMaxRecipients = 100
+	// DefaultMailboxTTL is how long a mailbox holds a message by default.
+	DefaultMailboxTTL = 7 * 24 * time.Hour
+	// maxMailboxBytes bounds the size of all messages held for one recipient.
+	maxMailboxBytes = 16 * 1024 * 1024
+	// maxMailboxSenderBytes bounds the size of the messages held from one
+	// sender for one recipient.
+	maxMailboxSenderBytes = 2 * 1024 * 1024
+	// maxMailboxTotalBytes bounds the size of all messages a mailbox holds.
+	maxMailboxTotalBytes = 1024 * 1024 * 1024
+	// mailboxRegistrationTTL is how long a registration lasts without the
+	// recipient checking its mailbox.
+	mailboxRegistrationTTL = 30 * 24 * time.Hour
+	// mailboxBatchSize bounds the size of the messages returned by one fetch.
+	mailboxBatchSize = 128 * 1024
+	// mailboxPurgeInterval is how often expired messages are deleted.
+	mailboxPurgeInterval = 10 * time.Minute
+	// mailboxPollInterval is how often a recipient checks its mailboxes.
+	mailboxPollInterval = time.Minute
+	// mailboxTimeout bounds a single exchange with a mailbox.
+	mailboxTimeout = 30 * time.Second
+	// maxMailboxes bounds how many mailboxes a node advertises.
+	maxMailboxes = 4
+	// mailboxRetryPeriod is how long a recipient retries a message it cannot
+	// decrypt before it tells the sender the message failed.
+	mailboxRetryPeriod = 24 * time.Hour
+)
+
+// MailboxItem is a message held in a mailbox.
+type MailboxItem struct {
+	ID        string `json:"id"`
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+	// Envelope is the JSON encoding of the private message envelope.
+	Envelope  []byte `json:"envelope"`
+	StoredAt  int64  `json:"stored_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type mailboxRegistration struct {
+	PeerID       string `json:"peer_id"`
+	RegisteredAt int64  `json:"registered_at"`
+}
+
+type mailboxDeposit struct {
+	Recipient string `json:"recipient"`
+	Envelope  []byte `json:"envelope"`
+}
+
+type mailboxFetch struct {
+	// After is the ID of the last message of the previous batch.
+	After string `json:"after,omitempty"`
+}
+
+type mailboxItems struct {
+	Items []*MailboxItem `json:"items"`
+	// More is set when further messages are waiting after this batch.
+	More bool `json:"more"`
+}
+
+type mailboxAck struct {
+	IDs []string `json:"ids"`
+}
+
+// MailboxConfig configures a MailboxService. Zero values select the defaults.
+type MailboxConfig struct {
+	// Quota is the number of messages held per recipient.
+	Quota int
+	// SenderQuota is the number of messages held from one sender for one
+	// recipient, so a single sender cannot fill a mailbox.
+	SenderQuota int
+	// MaxRecipients is the number of peers that can be registered at once.
+	MaxRecipients int
+	TTL           time.Duration
+	// Allowed tells whether a peer may register. Without it, nobody can.
+	Allowed func(peer.ID) bool
+}
+
+// MailboxService holds messages for peers that registered with it. Only
+// peers Allowed may register, and at most MaxRecipients at once. Each
+// recipient gets at most Quota messages and maxMailboxBytes, each sender at
+// most SenderQuota messages and maxMailboxSenderBytes of them, and all
+// recipients together maxMailboxTotalBytes. Messages are deleted when the
+// recipient acknowledges them or after the TTL.
+type MailboxService struct {
+	db     *db.LevelDBStore
+	config MailboxConfig
+	// size is the total size of the messages held.
+	size  int
+	mutex sync.Mutex
+}
+
+// NewMailboxService creates a MailboxService storing messages in store.
+func NewMailboxService(store *db.LevelDBStore, config MailboxConfig) (*MailboxService, error) {
+	if config.Quota <= 0 {
+		config.Quota = DefaultMailboxQuota
+	}
+	if config.SenderQuota <= 0 {
+		config.SenderQuota = DefaultMailboxSenderQuota
+	}
+	if config.MaxRecipients <= 0 {
+		config.MaxRecipients = DefaultMailboxMaxRecipients
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultMailboxTTL
+	}
+	ms := &MailboxService{
+		db:     store,
+		config: config,
+	}
+
+	iter := store.NewIteratorWithPrefix([]byte("mailbox/items/"))
+	defer iter.Release()
+	for iter.Next() {
+		ms.size += len(iter.Value())
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to read mailbox: %w", err)
+	}
+	return ms, nil
+}
+
+// Run deletes expired messages and registrations until ctx is done.
+func (ms *MailboxService) Run(ctx context.Context) {
+	ticker := time.NewTicker(mailboxPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := ms.purge(); err != nil {
+			log.Printf("Failed to purge mailboxes: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// HandleMailboxStream answers a single mailbox request.
+func (ms *MailboxService) HandleMailboxStream(s network.Stream) {
+	defer s.Close()
+	remote := s.Conn().RemotePeer()
+
+	env, err := readEnvelopeFrom(s)
+	if err != nil {
+		log.Printf("Error reading from mailbox stream: %v\n", err)
+		return
+	}
+
+	switch env.Type {
+	case EnvelopeMailboxRegister:
+		var status string
+		status, err = ms.register(remote)
+		if err == nil {
+			err = writeResponse(s, env, status)
+		}
+	case EnvelopeMailboxDeposit:
+		var deposit mailboxDeposit
+		if err := json.Unmarshal(env.Payload, &deposit); err != nil {
+			log.Printf("Invalid mailbox deposit from %s: %v\n", remote.String(), err)
+			return
+		}
+		var status string
+		status, err = ms.deposit(remote, &deposit)
+		if err == nil {
+			err = writeResponse(s, env, status)
+		}
+	case EnvelopeMailboxFetch:
+		var fetch mailboxFetch
+		if len(env.Payload) > 0 {
+			if err := json.Unmarshal(env.Payload, &fetch); err != nil {
+				log.Printf("Invalid mailbox fetch from %s: %v\n", remote.String(), err)
+				return
+			}
+		}
+		var items *mailboxItems
+		items, err = ms.fetch(remote, fetch.After)
+		if errors.Is(err, errMailboxNotAllowed) {
+			err = writeResponse(s, env, mailboxNotAllowed)
+		} else if err == nil {
+			var payload []byte
+			payload, err = json.Marshal(items)
+			if err == nil {
+				err = WriteEnvelope(s, NewEnvelope(EnvelopeMailboxItems, s.Conn().LocalPeer(), env.ConversationID, payload))
+			}
+		}
+	case EnvelopeMailboxAck:
+		var ack mailboxAck
+		if err := json.Unmarshal(env.Payload, &ack); err != nil {
+			log.Printf("Invalid mailbox ack from %s: %v\n", remote.String(), err)
+			return
+		}
+		err = ms.ack(remote, ack.IDs)
+		if err == nil {
+			err = writeResponse(s, env, responseOK)
+		}
+	default:
+		log.Printf("Unknown mailbox request %q from %s\n", env.Type, remote.String())
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to handle %s from %s: %v\n", env.Type, remote.String(), err)
+	}
+}
+
+// errMailboxNotAllowed is returned for peers that may not register.
+var errMailboxNotAllowed = errors.New("peer may not use this mailbox")
+
+// register registers or renews peerID and returns the status to report back.
+func (ms *MailboxService) register(peerID peer.ID) (string, error) {
+	if !ms.allowed(peerID) {
+		log.Printf("Refused mailbox registration from %s\n", peerID.String())
+		return mailboxNotAllowed, nil
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	registered, err := ms.db.Has(mailboxRegistrationKey(peerID.String()))
+	if err != nil {
+		return "", fmt.Errorf("failed to check mailbox registration: %w", err)
+	}
+	if !registered {
+		count, err := ms.registrations()
+		if err != nil {
+			return "", err
+		}
+		if count >= ms.config.MaxRecipients {
+			log.Printf("Mailbox is full, refused registration from %s\n", peerID.String())
+			return mailboxQuotaExceeded, nil
+		}
+	}
+
+	data, err := json.Marshal(mailboxRegistration{PeerID: peerID.String(), RegisteredAt: time.Now().Unix()})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal mailbox registration: %w", err)
+	}
+	if err := ms.db.Put(mailboxRegistrationKey(peerID.String()), data); err != nil {
+		return "", fmt.Errorf("failed to store mailbox registration: %w", err)
+	}
+	return responseOK, nil
+}
+
+// allowed reports whether peerID may register and receive messages.
+func (ms *MailboxService) allowed(peerID peer.ID) bool {
+	return ms.config.Allowed != nil && ms.config.Allowed(peerID)
+}
+
+// registrations returns the number of registered peers. Callers hold ms.mutex.
+func (ms *MailboxService) registrations() (int, error) {
+	iter := ms.db.NewIteratorWithPrefix([]byte("mailbox/registrations/"))
+	defer iter.Release()
+
+	count := 0
+	for iter.Next() {
+		count++
+	}
+	return count, iter.Error()
+}
+
+func (ms *MailboxService) deposit(sender peer.ID, deposit *mailboxDeposit) (string, error) {
+	// The envelope must be a private message from the depositor itself
+	env, err := decodeEnvelope(deposit.Envelope)
+	if err != nil || !isPrivateEnvelope(env.Type) || env.Sender != sender.String() {
+		log.Printf("Refused invalid mailbox deposit from %s\n", sender.String())
+		return "", errors.New("invalid envelope")
+	}
+	recipient, err := peer.Decode(deposit.Recipient)
+	if err != nil || !ms.allowed(recipient) {
+		return mailboxUnknownRecipient, nil
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	registered, err := ms.db.Has(mailboxRegistrationKey(deposit.Recipient))
+	if err != nil {
+		return "", fmt.Errorf("failed to check mailbox registration: %w", err)
+	}
+	if !registered {
+		return mailboxUnknownRecipient, nil
+	}
+
+	now := time.Now()
+	item := &MailboxItem{
+		ID:        newMessageID(),
+		Sender:    sender.String(),
+		Recipient: deposit.Recipient,
+		Envelope:  deposit.Envelope,
+		StoredAt:  now.Unix(),
+		ExpiresAt: now.Add(ms.config.TTL).Unix(),
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal mailbox item: %w", err)
+	}
+
+	usage, err := ms.usage(deposit.Recipient, item.Sender)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case usage.count >= ms.config.Quota || usage.size+len(data) > maxMailboxBytes:
+		log.Printf("Mailbox of %s is full, refused message from %s\n", deposit.Recipient, sender.String())
+		return mailboxQuotaExceeded, nil
+	case usage.senderCount >= ms.config.SenderQuota || usage.senderSize+len(data) > maxMailboxSenderBytes:
+		log.Printf("Refused message from %s for %s: sender quota exceeded\n", sender.String(), deposit.Recipient)
+		return mailboxQuotaExceeded, nil
+	case ms.size+len(data) > maxMailboxTotalBytes:
+		log.Printf("Mailbox storage is full, refused message from %s\n", sender.String())
+		return mailboxQuotaExceeded, nil
+	}
+
+	if err := ms.db.Put(mailboxItemKey(item.Recipient, item.ID), data); err != nil {
+		return "", fmt.Errorf("failed to store mailbox item: %w", err)
+	}
+	ms.size += len(data)
+	log.Printf("Holding message from %s for %s\n", sender.String(), deposit.Recipient)
+	return responseOK, nil
+}
+
+// mailboxUsage is the number and size of the messages held for a recipient,
+// in total and from one sender.
+type mailboxUsage struct {
+	count, size             int
+	senderCount, senderSize int
+}
+
+// usage returns the messages held for recipient, and of them those from sender.
+func (ms *MailboxService) usage(recipient, sender string) (*mailboxUsage, error) {
+	iter := ms.db.NewIteratorWithPrefix([]byte(fmt.Sprintf("mailbox/items/%s/", recipient)))
+	defer iter.Release()
+
+	usage := &mailboxUsage{}
+	for iter.Next() {
+		usage.count++
+		usage.size += len(iter.Value())
+		var item MailboxItem
+		if err := json.Unmarshal(iter.Value(), &item); err == nil && item.Sender == sender {
+			usage.senderCount++
+			usage.senderSize += len(iter.Value())
+		}
+	}
+	return usage, iter.Error()
+}
+
+// fetch returns the oldest messages held for recipient after the message
+// with ID after, if given, and renews its registration.
+func (ms *MailboxService) fetch(recipient peer.ID, after string) (*mailboxItems, error) {
+	status, err := ms.register(recipient)
+	if err != nil {
+		return nil, err
+	}
+	if status == mailboxNotAllowed {
+		return nil, errMailboxNotAllowed
+	}
+
+	iter := ms.db.NewIteratorWithPrefix([]byte(fmt.Sprintf("mailbox/items/%s/", recipient.String())))
+	defer iter.Release()
+
+	result := &mailboxItems{Items: []*MailboxItem{}}
+	size := 0
+	now := time.Now().Unix()
+	// IDs sort by time, so the messages after a given one follow its key
+	ok := iter.Next()
+	if after != "" {
+		ok = iter.Seek(append(mailboxItemKey(recipient.String(), after), 0))
+	}
+	for ; ok; ok = iter.Next() {
+		var item MailboxItem
+		if err := json.Unmarshal(iter.Value(), &item); err != nil {
+			log.Printf("Failed to unmarshal mailbox item: %v", err)
+			continue
+		}
+		if item.ExpiresAt <= now {
+			continue
+		}
+		if len(result.Items) > 0 && size+len(item.Envelope) > mailboxBatchSize {
+			result.More = true
+			break
+		}
+		size += len(item.Envelope)
+		result.Items = append(result.Items, &item)
+	}
+	return result, iter.Error()
+}
+
+func (ms *MailboxService) ack(recipient peer.ID, ids []string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	batch := new(leveldb.Batch)
+	size := 0
+	for _, id := range ids {
+		key := mailboxItemKey(recipient.String(), id)
+		data, err := ms.db.Get(key)
+		if err != nil {
+			// Acknowledged before, or expired
+			continue
+		}
+		size += len(data)
+		batch.Delete(key)
+	}
+	if err := ms.db.WriteBatch(batch); err != nil {
+		return fmt.Errorf("failed to delete mailbox items: %w", err)
+	}
+	ms.size -= size
+	return nil
+}
+
+// purge deletes expired messages and registrations that were not renewed,
+// and the messages held for peers that are no longer allowed.
+func (ms *MailboxService) purge() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := time.Now()
+	batch := new(leveldb.Batch)
+	size := 0
+
+	iter := ms.db.NewIteratorWithPrefix([]byte("mailbox/items/"))
+	for iter.Next() {
+		var item MailboxItem
+		err := json.Unmarshal(iter.Value(), &item)
+		if err == nil && item.ExpiresAt > now.Unix() {
+			recipient, err := peer.Decode(item.Recipient)
+			if err == nil && ms.allowed(recipient) {
+				continue
+			}
+		}
+		batch.Delete(append([]byte(nil), iter.Key()...))
+		size += len(iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	iter = ms.db.NewIteratorWithPrefix([]byte("mailbox/registrations/"))
+	for iter.Next() {
+		var reg mailboxRegistration
+		if err := json.Unmarshal(iter.Value(), &reg); err != nil || time.Unix(reg.RegisteredAt, 0).Add(mailboxRegistrationTTL).Before(now) {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	if batch.Len() == 0 {
+		return nil
+	}
+	log.Printf("Purging %d expired mailbox entries\n", batch.Len())
+	if err := ms.db.WriteBatch(batch); err != nil {
+		return err
+	}
+	ms.size -= size
+	return nil
+}
+
+func mailboxRegistrationKey(peerID string) []byte {
+	return []byte(fmt.Sprintf("mailbox/registrations/%s", peerID))
+}
+
+func mailboxItemKey(recipient, id string) []byte {
+	return []byte(fmt.Sprintf("mailbox/items/%s/%s", recipient, id))
+}
+
+// mailboxRetryKey holds when we first failed to decrypt a mailbox item.
+func mailboxRetryKey(id string) []byte {
+	return []byte(fmt.Sprintf("mailboxretry/%s", id))
+}
+
+// RunMailboxes registers with our mailboxes and collects the messages held
+// there, every mailboxPollInterval and whenever we connect to a mailbox.
+func (pcm *PrivateChatManager) RunMailboxes(ctx context.Context) {
+	mailboxes := pcm.sessions.keys.Mailboxes()
+	if len(mailboxes) == 0 {
+		return
+	}
+
+	wake := make(chan struct{}, 1)
+	notifee := &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			for _, mailbox := range mailboxes {
+				if mailbox.ID == conn.RemotePeer() {
+					select {
+					case wake <- struct{}{}:
+					default:
+					}
+				}
+			}
+		},
+	}
+	pcm.host.Network().Notify(notifee)
+	defer pcm.host.Network().StopNotify(notifee)
+
+	ticker := time.NewTicker(mailboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, mailbox := range mailboxes {
+			if err := pcm.checkMailbox(ctx, mailbox); err != nil {
+				log.Printf("Failed to check mailbox %s: %v\n", mailbox.ID.String(), err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// checkMailbox registers with a mailbox and delivers the messages held there.
+// Messages are removed from the mailbox once they were applied or turned out
+// to be invalid; messages that cannot be decrypted yet stay there to be
+// retried on a later check.
+func (pcm *PrivateChatManager) checkMailbox(ctx context.Context, mailbox peer.AddrInfo) error {
+	ctx, cancel := context.WithTimeout(ctx, mailboxTimeout)
+	defer cancel()
+
+	resp, err := mailboxRequest(ctx, pcm.host, mailbox, EnvelopeMailboxRegister, nil)
+	if err != nil {
+		return err
+	}
+	if status, err := responseStatus(resp); err != nil {
+		return err
+	} else if status != responseOK {
+		return fmt.Errorf("mailbox refused registration: %s", status)
+	}
+
+	after := ""
+	for {
+		resp, err := mailboxRequest(ctx, pcm.host, mailbox, EnvelopeMailboxFetch, mailboxFetch{After: after})
+		if err != nil {
+			return err
+		}
+		if resp.Type != EnvelopeMailboxItems {
+			return fmt.Errorf("unexpected %s envelope in response", resp.Type)
+		}
+		var items mailboxItems
+		if err := json.Unmarshal(resp.Payload, &items); err != nil {
+			return fmt.Errorf("invalid mailbox items: %w", err)
+		}
+		// Mailboxes that ignore the position send the same batch again
+		if len(items.Items) == 0 || (after != "" && items.Items[0].ID <= after) {
+			return nil
+		}
+
+		var ids []string
+		delivered := make(map[peer.ID][]string)
+		for _, item := range items.Items {
+			after = item.ID
+			sender, messageID, ok, err := pcm.receiveMailboxItem(ctx, item)
+			if err != nil && pcm.retryMailboxItem(item, err) {
+				continue
+			}
+			ids = append(ids, item.ID)
+			if ok {
+				delivered[sender] = append(delivered[sender], messageID)
+			}
+		}
+		if len(ids) > 0 {
+			if _, err := mailboxRequest(ctx, pcm.host, mailbox, EnvelopeMailboxAck, mailboxAck{IDs: ids}); err != nil {
+				return err
+			}
+			batch := new(leveldb.Batch)
+			for _, id := range ids {
+				batch.Delete(mailboxRetryKey(id))
+			}
+			if err := pcm.db.WriteBatch(batch); err != nil {
+				log.Printf("Failed to delete mailbox retries: %v\n", err)
+			}
+			log.Printf("Collected %d messages from mailbox %s\n", len(ids), mailbox.ID.String())
+		}
+
+		// Let the senders know, now or once they are back online
+		for sender, messageIDs := range delivered {
+			go func(sender peer.ID, messageIDs []string) {
+				ctx, cancel := context.WithTimeout(context.Background(), mailboxTimeout)
+				defer cancel()
+				pcm.deliverReceipt(ctx, sender, receipt{Status: MessageDelivered, MessageIDs: messageIDs})
+			}(sender, messageIDs)
+		}
+
+		if !items.More {
+			return nil
+		}
+	}
+}
+
+// retryMailboxItem records that item could not be decrypted and reports
+// whether to leave it in the mailbox for another try. We may be missing the
+// sender's key bundle while it is offline, or our session may be out of step
+// with the sender's. After mailboxRetryPeriod, or once the mailbox is about
+// to drop the item, we give up and the sender is told the message failed.
+func (pcm *PrivateChatManager) retryMailboxItem(item *MailboxItem, cause error) bool {
+	now := time.Now()
+	firstFailure := now
+	if data, err := pcm.db.Get(mailboxRetryKey(item.ID)); err == nil {
+		if t, err := strconv.ParseInt(string(data), 10, 64); err == nil {
+			firstFailure = time.Unix(t, 0)
+		}
+	} else if err := pcm.db.Put(mailboxRetryKey(item.ID), []byte(strconv.FormatInt(now.Unix(), 10))); err != nil {
+		log.Printf("Failed to store mailbox retry: %v\n", err)
+	}
+	if now.Sub(firstFailure) < mailboxRetryPeriod && now.Add(mailboxPollInterval).Unix() < item.ExpiresAt {
+		log.Printf("Keeping mailbox message from %s to retry: %v\n", item.Sender, cause)
+		return true
+	}
+
+	log.Printf("Giving up on mailbox message from %s: %v\n", item.Sender, cause)
+	env, err := decodeEnvelope(item.Envelope)
+	if err != nil || env.Type != EnvelopePrivateMessage {
+		return false
+	}
+	sender, err := peer.Decode(env.Sender)
+	if err != nil {
+		return false
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailboxTimeout)
+		defer cancel()
+		pcm.deliverReceipt(ctx, sender, receipt{Status: MessageFailed, MessageIDs: []string{env.ID}})
+	}()
+	return false
+}
+
+// receiveMailboxItem decrypts and applies a message, edit, deletion or
+// reaction collected from a mailbox. It reports the sender and message ID if
+// a message went into the history, and an error if the item could not be
+// decrypted. Invalid items are dropped without an error.
+func (pcm *PrivateChatManager) receiveMailboxItem(ctx context.Context, item *MailboxItem) (peer.ID, string, bool, error) {
+	env, err := decodeEnvelope(item.Envelope)
+	if err != nil || !isPrivateEnvelope(env.Type) || env.Sender != item.Sender {
+		log.Printf("Dropping invalid mailbox message from %s\n", item.Sender)
+		return "", "", false, nil
+	}
+	sender, err := peer.Decode(env.Sender)
+	if err != nil {
+		return "", "", false, nil
+	}
+
+	// The ratchet authenticates the sender, so the mailbox cannot forge messages
+	plaintext, err := pcm.sessions.Decrypt(ctx, sender, env.Payload)
+	if err != nil {
+		return "", "", false, err
+	}
+	if env.Type != EnvelopePrivateMessage {
+		pcm.receiveUpdate(sender, env.Type, plaintext)
+		return "", "", false, nil
+	}
+	var body messageBody
+	if err := json.Unmarshal(plaintext, &body); err != nil {
+		log.Printf("Invalid mailbox message from %s: %v\n", sender.String(), err)
+		return "", "", false, nil
+	}
+	if !pcm.receiveMessage(sender, env, body.Content) {
+		return "", "", false, nil
+	}
+	return sender, env.ID, true, nil
+}
+
+// depositMessage encrypts a private message envelope for peerID and leaves
+// it in the first of the peer's mailboxes that accepts it.
+func (pcm *PrivateChatManager) depositMessage(ctx context.Context, peerID peer.ID, mailboxes []peer.AddrInfo, out *outgoingMessage) error {
+	plaintext, err := privatePlaintext(out)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := pcm.sessions.Encrypt(ctx, peerID, plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt message: %w", err)
+	}
+	data, err := json.Marshal(pcm.privateEnvelope(peerID, out, ciphertext))
+	if err != nil {
+		return fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+
+	deposit := mailboxDeposit{Recipient: peerID.String(), Envelope: data}
+	err = errors.New("no mailbox accepted the message")
+	for _, mailbox := range mailboxes {
+		if mailbox.ID == pcm.host.ID() {
+			continue
+		}
+		mailboxCtx, cancel := context.WithTimeout(ctx, mailboxTimeout)
+		resp, rerr := mailboxRequest(mailboxCtx, pcm.host, mailbox, EnvelopeMailboxDeposit, deposit)
+		cancel()
+		if rerr == nil {
+			var status string
+			if status, rerr = responseStatus(resp); rerr == nil && status != responseOK {
+				rerr = fmt.Errorf("mailbox refused the message: %s", status)
+			}
+		}
+		if rerr != nil {
+			log.Printf("Failed to deposit message for %s with mailbox %s: %v\n", peerID.String(), mailbox.ID.String(), rerr)
+			err = rerr
+			continue
+		}
+		log.Printf("Left message %s for %s with mailbox %s\n", out.ID, peerID.String(), mailbox.ID.String())
+		return nil
+	}
+	return err
+}
+
+// mailboxRequest sends a request to a mailbox and returns its answer.
+func mailboxRequest(ctx context.Context, h host.Host, mailbox peer.AddrInfo, envelopeType string, request interface{}) (*Envelope, error) {
+	var payload []byte
+	if request != nil {
+		var err error
+		if payload, err = json.Marshal(request); err != nil {
+			return nil, fmt.Errorf("failed to marshal mailbox request: %w", err)
+		}
+	}
+
+	if err := h.Connect(ctx, mailbox); err != nil {
+		return nil, fmt.Errorf("failed to connect to mailbox: %w", err)
+	}
+	s, err := h.NewStream(ctx, mailbox.ID, MailboxProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mailbox stream: %w", err)
+	}
+	defer s.Close()
+
+	if err := WriteEnvelope(s, NewEnvelope(envelopeType, h.ID(), "", payload)); err != nil {
+		return nil, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		return nil, fmt.Errorf("failed to close mailbox stream: %w", err)
+	}
+	return readEnvelopeFrom(s)
+}
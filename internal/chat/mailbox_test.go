@@ -0,0 +1,169 @@
+package chat
+
+import (
+	"encoding/json"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"testing"
+)
+
+func newTestMailbox(t *testing.T, config MailboxConfig) *MailboxService {
+	t.Helper()
+	ms, err := NewMailboxService(newTestStore(t), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+// mailboxEnvelope returns a deposit of a private message from sender.
+func mailboxEnvelope(t *testing.T, sender, recipient peer.ID) *mailboxDeposit {
+	t.Helper()
+	data, err := json.Marshal(NewEnvelope(EnvelopePrivateMessage, sender, "", []byte(`"ciphertext"`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mailboxDeposit{Recipient: recipient.String(), Envelope: data}
+}
+
+func TestMailboxRegistration(t *testing.T) {
+	_, first := newTestIdentity(t)
+	_, second := newTestIdentity(t)
+	_, stranger := newTestIdentity(t)
+	ms := newTestMailbox(t, MailboxConfig{
+		MaxRecipients: 1,
+		Allowed:       func(p peer.ID) bool { return p != stranger },
+	})
+
+	for _, tt := range []struct {
+		peer peer.ID
+		want string
+	}{
+		{stranger, mailboxNotAllowed},
+		{first, responseOK},
+		// Renewing does not count against the limit
+		{first, responseOK},
+		{second, mailboxQuotaExceeded},
+	} {
+		if status, err := ms.register(tt.peer); err != nil || status != tt.want {
+			t.Fatalf("register = %q, %v; want %q", status, err, tt.want)
+		}
+	}
+	if _, err := ms.fetch(stranger, ""); err != errMailboxNotAllowed {
+		t.Fatalf("fetch by a peer not allowed gave %v", err)
+	}
+
+	// Nobody may register without an Allowed function
+	if status, _ := newTestMailbox(t, MailboxConfig{}).register(first); status != mailboxNotAllowed {
+		t.Fatalf("register without Allowed = %q", status)
+	}
+}
+
+func TestMailboxQuotas(t *testing.T) {
+	_, recipient := newTestIdentity(t)
+	_, unregistered := newTestIdentity(t)
+	_, alice := newTestIdentity(t)
+	_, bob := newTestIdentity(t)
+	ms := newTestMailbox(t, MailboxConfig{
+		Quota:       3,
+		SenderQuota: 2,
+		Allowed:     func(peer.ID) bool { return true },
+	})
+	if _, err := ms.register(recipient); err != nil {
+		t.Fatal(err)
+	}
+
+	deposit := func(sender, to peer.ID, want string) {
+		t.Helper()
+		status, err := ms.deposit(sender, mailboxEnvelope(t, sender, to))
+		if err != nil || status != want {
+			t.Fatalf("deposit from %s = %q, %v; want %q", sender, status, err, want)
+		}
+	}
+	deposit(alice, unregistered, mailboxUnknownRecipient)
+	deposit(alice, recipient, responseOK)
+	deposit(alice, recipient, responseOK)
+	// One sender cannot fill the mailbox
+	deposit(alice, recipient, mailboxQuotaExceeded)
+	deposit(bob, recipient, responseOK)
+	// The recipient's quota is reached
+	deposit(bob, recipient, mailboxQuotaExceeded)
+
+	// Only the depositor's own private messages are held
+	if _, err := ms.deposit(bob, mailboxEnvelope(t, alice, recipient)); err == nil {
+		t.Fatal("deposit of another sender's envelope accepted")
+	}
+}
+
+func TestMailboxAck(t *testing.T) {
+	store := newTestStore(t)
+	_, recipient := newTestIdentity(t)
+	_, sender := newTestIdentity(t)
+	allowed := true
+	ms, err := NewMailboxService(store, MailboxConfig{Allowed: func(peer.ID) bool { return allowed }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.register(recipient); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if status, err := ms.deposit(sender, mailboxEnvelope(t, sender, recipient)); err != nil || status != responseOK {
+			t.Fatalf("deposit = %q, %v", status, err)
+		}
+	}
+
+	items, err := ms.fetch(recipient, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items.Items) != 3 || items.More {
+		t.Fatalf("fetched %d items, more=%v; want 3", len(items.Items), items.More)
+	}
+	rest, err := ms.fetch(recipient, items.Items[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest.Items) != 2 || rest.Items[0].ID != items.Items[1].ID {
+		t.Fatal("fetch after the first item did not return the others in order")
+	}
+
+	// Acknowledged items are gone, and acknowledging them again changes nothing
+	ids := []string{items.Items[0].ID, items.Items[1].ID}
+	for i := 0; i < 2; i++ {
+		if err := ms.ack(recipient, ids); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another peer cannot acknowledge the recipient's items
+	if err := ms.ack(sender, []string{items.Items[2].ID}); err != nil {
+		t.Fatal(err)
+	}
+	items, err = ms.fetch(recipient, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items.Items) != 1 {
+		t.Fatalf("%d items left after the ack, want 1", len(items.Items))
+	}
+
+	// The size accounting matches what is stored
+	reloaded, err := NewMailboxService(store, MailboxConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms.size != reloaded.size || ms.size == 0 {
+		t.Fatalf("mailbox size is %d, stored items take %d", ms.size, reloaded.size)
+	}
+
+	// Items held for peers no longer allowed are purged
+	allowed = false
+	if err := ms.purge(); err != nil {
+		t.Fatal(err)
+	}
+	if ms.size != 0 {
+		t.Fatalf("mailbox size is %d after purging everything", ms.size)
+	}
+	if usage, err := ms.usage(recipient.String(), sender.String()); err != nil || usage.count != 0 {
+		t.Fatalf("usage after purge = %+v, %v", usage, err)
+	}
+}
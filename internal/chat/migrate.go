@@ -0,0 +1,149 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/syndtr/goleveldb/leveldb"
+	"log"
+	"p2p-chat/internal/db"
+	"strings"
+)
+
+// messageLayoutKey records the version of the layout of chat history keys.
+const messageLayoutKey = "meta/message_layout"
+
+// messageLayoutVersion is the current layout: messages are stored under
+// chat/<kind>/<conversation>/<hlc>-<id>, with their IDs mapped to their keys
+// under msgids/ and replies indexed under replies/.
+const messageLayoutVersion = "3"
+
+// MigrateMessageKeys moves chat history stored under
+// chat/<kind>/<conversation>/<id>, by earlier versions, to the current key
+// layout, and indexes the replies of messages that were already in it.
+// Messages get an HLC derived from their ID and timestamp. self is our peer
+// ID. It does nothing once the database was migrated.
+func MigrateMessageKeys(store *db.LevelDBStore, self peer.ID) error {
+	exists, err := store.Has([]byte(messageLayoutKey))
+	if err != nil {
+		return fmt.Errorf("failed to check message layout: %w", err)
+	}
+	if exists {
+		version, err := store.Get([]byte(messageLayoutKey))
+		if err != nil {
+			return fmt.Errorf("failed to get message layout: %w", err)
+		}
+		if string(version) == messageLayoutVersion {
+			return nil
+		}
+	}
+
+	batch := new(leveldb.Batch)
+	migrated := 0
+	err = migratePrefix(store, batch, "chat/private/", func(data []byte) error {
+		var msg PrivateMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		msg.HLC = legacyHLC(msg.ID, msg.Timestamp).String()
+		migrated++
+		return putPrivateMessage(batch, self, &msg)
+	})
+	if err != nil {
+		return err
+	}
+	err = migratePrefix(store, batch, "chat/group/", func(data []byte) error {
+		var msg GroupMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return err
+		}
+		msg.HLC = legacyHLC(msg.ID, msg.Timestamp).String()
+		migrated++
+		return putGroupMessage(batch, &msg)
+	})
+	if err != nil {
+		return err
+	}
+	if err := indexReplies(store, batch); err != nil {
+		return err
+	}
+
+	batch.Put([]byte(messageLayoutKey), []byte(messageLayoutVersion))
+	if err := store.WriteBatch(batch); err != nil {
+		return fmt.Errorf("failed to migrate messages: %w", err)
+	}
+	if migrated > 0 {
+		log.Printf("Migrated %d messages to the new key layout\n", migrated)
+	}
+	return nil
+}
+
+// migratePrefix calls migrate for every message under prefix that is still
+// stored under its bare ID, and deletes its old key in batch.
+func migratePrefix(store *db.LevelDBStore, batch *leveldb.Batch, prefix string, migrate func([]byte) error) error {
+	iter := store.NewIteratorWithPrefix([]byte(prefix))
+	defer iter.Release()
+
+	for iter.Next() {
+		_, name, _ := strings.Cut(strings.TrimPrefix(string(iter.Key()), prefix), "/")
+		if hasHLC(name) {
+			continue
+		}
+		if err := migrate(iter.Value()); err != nil {
+			log.Printf("Failed to migrate message %s: %v\n", iter.Key(), err)
+			continue
+		}
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("failed to migrate messages: %w", err)
+	}
+	return nil
+}
+
+// indexReplies adds the replies index entries of the messages in store that
+// are already in the HLC key layout to batch. Messages migrated from older
+// layouts are indexed as they are stored again.
+func indexReplies(store *db.LevelDBStore, batch *leveldb.Batch) error {
+	iter := store.NewIteratorWithPrefix([]byte("chat/"))
+	defer iter.Release()
+
+	for iter.Next() {
+		kind, rest, _ := strings.Cut(strings.TrimPrefix(string(iter.Key()), "chat/"), "/")
+		conversation, name, _ := strings.Cut(rest, "/")
+		if !hasHLC(name) {
+			continue
+		}
+		var msg struct {
+			ID      string `json:"id"`
+			ReplyTo string `json:"reply_to"`
+		}
+		if err := json.Unmarshal(iter.Value(), &msg); err != nil {
+			log.Printf("Failed to unmarshal message %s: %v\n", iter.Key(), err)
+			continue
+		}
+		if msg.ReplyTo == "" {
+			continue
+		}
+		key := privateReplyKey(conversation, msg.ReplyTo, msg.ID)
+		if kind == "group" {
+			key = groupReplyKey(conversation, msg.ReplyTo, msg.ID)
+		}
+		batch.Put([]byte(key), append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("failed to index replies: %w", err)
+	}
+	return nil
+}
+
+// hasHLC reports whether name, the last part of a chat history key, is in
+// the <hlc>-<id> form of the current layout.
+func hasHLC(name string) bool {
+	hlc, _, ok := strings.Cut(name, "-")
+	if !ok {
+		return false
+	}
+	_, err := parseHLC(hlc)
+	return err == nil
+}
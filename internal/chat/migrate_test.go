@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"p2p-chat/internal/db"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putJSON stores v under key.
+func putJSON(t *testing.T, store *db.LevelDBStore, key string, v interface{}) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put([]byte(key), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// historyIDs returns the IDs of the messages under prefix, in key order.
+func historyIDs(t *testing.T, store *db.LevelDBStore, prefix string) []string {
+	t.Helper()
+	iter := store.NewIteratorWithPrefix([]byte(prefix))
+	defer iter.Release()
+
+	var ids []string
+	for iter.Next() {
+		var msg struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(iter.Value(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestMigrateMessageKeys(t *testing.T) {
+	store := newTestStore(t)
+	_, self := newTestIdentity(t)
+	_, other := newTestIdentity(t)
+	peerID := other.String()
+	groupID := "group"
+
+	// Version 1 stored messages under their IDs, which do not sort by time
+	start := time.Now().Add(-time.Hour)
+	first := strconv.FormatInt(start.Add(10*time.Second).UnixNano(), 10)
+	reply := strconv.FormatInt(start.Add(20*time.Second).UnixNano(), 10)
+	private := []*PrivateMessage{
+		{ID: first, SenderID: peerID, RecipientID: self.String(), Content: "first", Timestamp: start.Add(10 * time.Second).Unix()},
+		{ID: reply, SenderID: self.String(), RecipientID: peerID, Content: "reply", Timestamp: start.Add(20 * time.Second).Unix(), IsSent: true, ReplyTo: first},
+		{ID: "legacy", SenderID: peerID, RecipientID: self.String(), Content: "oldest", Timestamp: start.Unix()},
+	}
+	for _, msg := range private {
+		putJSON(t, store, fmt.Sprintf("chat/private/%s/%s", peerID, msg.ID), msg)
+	}
+	putJSON(t, store, fmt.Sprintf("chat/group/%s/%s", groupID, first), &GroupMessage{ID: first, GroupID: groupID, SenderID: peerID, Content: "group", Timestamp: start.Unix()})
+
+	// Version 2 already stored this one by HLC, but did not index replies
+	groupReply := &GroupMessage{ID: "later", GroupID: groupID, SenderID: peerID, Content: "group reply", Timestamp: time.Now().Unix(), ReplyTo: first, HLC: HLC{Wall: time.Now().UnixNano()}.String()}
+	putJSON(t, store, groupMessageKey(groupID, groupReply.HLC, groupReply.ID), groupReply)
+	if err := store.Put([]byte(messageLayoutKey), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateMessageKeys(store, self); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.Join(historyIDs(t, store, fmt.Sprintf("chat/private/%s/", peerID)), ","), "legacy,"+first+","+reply; got != want {
+		t.Fatalf("private history is %s, want %s", got, want)
+	}
+	if got, want := strings.Join(historyIDs(t, store, fmt.Sprintf("chat/group/%s/", groupID)), ","), first+",later"; got != want {
+		t.Fatalf("group history is %s, want %s", got, want)
+	}
+	for _, key := range []string{
+		fmt.Sprintf("chat/private/%s/%s", peerID, first),
+		fmt.Sprintf("chat/group/%s/%s", groupID, first),
+	} {
+		if found, _ := store.Has([]byte(key)); found {
+			t.Fatalf("old key %s still stored", key)
+		}
+	}
+	for _, key := range []string{
+		privateMessageIDKey(peerID, "legacy"),
+		privateReplyKey(peerID, first, reply),
+		groupMessageIDKey(groupID, first),
+		groupReplyKey(groupID, first, "later"),
+	} {
+		if found, _ := store.Has([]byte(key)); !found {
+			t.Fatalf("%s missing after migration", key)
+		}
+	}
+
+	// Threads are read from the replies index
+	messageKey := func(id string) ([]byte, error) {
+		key, err := store.Get([]byte(privateMessageIDKey(peerID, id)))
+		if err != nil {
+			return nil, ErrMessageNotFound
+		}
+		return key, nil
+	}
+	repliesPrefix := func(id string) string {
+		return privateReplyKey(peerID, id, "")
+	}
+	for _, id := range []string{first, reply} {
+		values, err := readThread(store, id, messageKey, repliesPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 2 {
+			t.Fatalf("thread of %s has %d messages, want 2", id, len(values))
+		}
+	}
+
+	// Migrating again changes nothing, and the layout is current
+	if err := MigrateMessageKeys(store, self); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMessageLayout(store); err != nil {
+		t.Fatal(err)
+	}
+	if got := historyIDs(t, store, fmt.Sprintf("chat/private/%s/", peerID)); len(got) != len(private) {
+		t.Fatalf("%d private messages after migrating again, want %d", len(got), len(private))
+	}
+}
@@ -3,4 +3,6 @@ package chat
 // Notifier is an interface for sending notifications.
 type Notifier interface {
 	NotifyNewMessage(senderID, message, messageType string)
+	// NotifyEvent sends an event of the given type with payload to the frontend.
+	NotifyEvent(eventType string, payload map[string]interface{})
 }
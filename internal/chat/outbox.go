@@ -0,0 +1,377 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"log"
+	"p2p-chat/internal/db"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// outboxPollInterval is how often the outbox looks for messages due for a retry.
+	outboxPollInterval = 5 * time.Second
+	// outboxMinBackoff and outboxMaxBackoff bound the delay between retries,
+	// which doubles after every failed attempt.
+	outboxMinBackoff = 5 * time.Second
+	outboxMaxBackoff = time.Hour
+	// outboxMaxAge is how long a message is retried before it is marked failed.
+	outboxMaxAge = 7 * 24 * time.Hour
+	// outboxConnectDelay is how long after a peer connects its queued
+	// messages are retried.
+	outboxConnectDelay = 2 * time.Second
+	// outboxSendTimeout bounds a single delivery attempt.
+	outboxSendTimeout = 30 * time.Second
+)
+
+// ErrNotQueued is returned for messages that are not in the outbox.
+var ErrNotQueued = errors.New("message is not in the outbox")
+
+// OutboxEntry is a private message, or an edit or deletion of one, waiting
+// to be delivered.
+type OutboxEntry struct {
+	MessageID string `json:"message_id"`
+	PeerID    string `json:"peer_id"`
+	// Type is the envelope type; entries without one are private messages.
+	Type        string `json:"type,omitempty"`
+	ReplyTo     string `json:"reply_to,omitempty"`
+	HLC         string `json:"hlc,omitempty"`
+	TTL         int64  `json:"ttl,omitempty"`
+	Content     string `json:"content"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"last_error,omitempty"`
+	NextAttempt int64  `json:"next_attempt"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+// Outbox stores private messages that could not be delivered and retries
+// them with exponential backoff, and right away when the peer connects.
+// Entries are kept in LevelDB under outbox/<peer>/<message>, so they survive
+// restarts. It also sends the receipts that could not be sent once their
+// peer is connected.
+type Outbox struct {
+	host   host.Host
+	db     *db.LevelDBStore
+	pcm    *PrivateChatManager
+	forced map[peer.ID]bool
+	wake   chan struct{}
+	mutex  sync.Mutex
+}
+
+func newOutbox(h host.Host, store *db.LevelDBStore, pcm *PrivateChatManager) *Outbox {
+	return &Outbox{
+		host:   h,
+		db:     store,
+		pcm:    pcm,
+		forced: make(map[peer.ID]bool),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Run retries queued messages until ctx is done.
+func (ob *Outbox) Run(ctx context.Context) {
+	notifee := &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			// Give the peer a moment to finish identify; a node that just
+			// started may not have registered its handlers yet
+			peerID := conn.RemotePeer()
+			time.AfterFunc(outboxConnectDelay, func() {
+				ob.trigger(peerID)
+			})
+		},
+	}
+	ob.host.Network().Notify(notifee)
+	defer ob.host.Network().StopNotify(notifee)
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		ob.flush(ctx)
+		ob.pcm.flushReceipts(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-ob.wake:
+		}
+	}
+}
+
+// List returns the queued messages, oldest first.
+func (ob *Outbox) List() ([]*OutboxEntry, error) {
+	iter := ob.db.NewIteratorWithPrefix([]byte("outbox/"))
+	defer iter.Release()
+
+	entries := []*OutboxEntry{}
+	for iter.Next() {
+		var entry OutboxEntry
+		if err := json.Unmarshal(iter.Value(), &entry); err != nil {
+			log.Printf("Failed to unmarshal outbox entry: %v", err)
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to list outbox: %w", err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].MessageID < entries[j].MessageID
+	})
+	return entries, nil
+}
+
+// Cancel removes a message from the outbox and marks it failed.
+func (ob *Outbox) Cancel(messageID string) error {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	entry, err := ob.find(messageID)
+	if err != nil {
+		return err
+	}
+	if err := ob.db.Delete(outboxKey(entry.PeerID, entry.MessageID)); err != nil {
+		return fmt.Errorf("failed to delete outbox entry: %w", err)
+	}
+	ob.setStatus(entry, MessageFailed)
+	log.Printf("Cancelled queued message %s to %s\n", entry.MessageID, entry.PeerID)
+	return nil
+}
+
+// Resend retries a queued message right away, along with the messages queued
+// before it for the same peer.
+func (ob *Outbox) Resend(messageID string) error {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	entry, err := ob.find(messageID)
+	if err != nil {
+		return err
+	}
+	peerID, err := peer.Decode(entry.PeerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID in outbox entry: %w", err)
+	}
+	ob.forced[peerID] = true
+	ob.signal()
+	return nil
+}
+
+// enqueue adds an envelope that could not be sent yet. cause is the error of
+// the first attempt, if there was one.
+func (ob *Outbox) enqueue(peerID peer.ID, out *outgoingMessage, cause error) error {
+	entry := &OutboxEntry{
+		MessageID: out.ID,
+		PeerID:    peerID.String(),
+		Content:   out.Content,
+		ReplyTo:   out.ReplyTo,
+		HLC:       out.HLC,
+		TTL:       out.TTL,
+		CreatedAt: time.Now().Unix(),
+	}
+	if out.Type != EnvelopePrivateMessage {
+		entry.Type = out.Type
+	}
+	if cause != nil {
+		entry.Attempts = 1
+		entry.LastError = cause.Error()
+	}
+	entry.NextAttempt = time.Now().Add(outboxBackoff(entry.Attempts)).Unix()
+
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+	return ob.save(entry)
+}
+
+// hasQueued reports whether messages to peerID are waiting in the outbox.
+// New messages to the peer then queue up behind them to keep their order.
+func (ob *Outbox) hasQueued(peerID peer.ID) bool {
+	iter := ob.db.NewIteratorWithPrefix([]byte(fmt.Sprintf("outbox/%s/", peerID.String())))
+	defer iter.Release()
+	return iter.Next()
+}
+
+// trigger retries the messages queued for peerID without waiting for their
+// backoff, and sends its pending receipts.
+func (ob *Outbox) trigger(peerID peer.ID) {
+	if ob.hasQueued(peerID) {
+		ob.mutex.Lock()
+		ob.forced[peerID] = true
+		ob.mutex.Unlock()
+	} else if !ob.pcm.hasPendingReceipts(peerID) {
+		return
+	}
+	ob.signal()
+}
+
+func (ob *Outbox) signal() {
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flush attempts every message that is due, one goroutine per peer so an
+// unreachable peer does not hold up the others.
+func (ob *Outbox) flush(ctx context.Context) {
+	entries, err := ob.List()
+	if err != nil {
+		log.Printf("%v\n", err)
+		return
+	}
+
+	ob.mutex.Lock()
+	forced := ob.forced
+	ob.forced = make(map[peer.ID]bool)
+	ob.mutex.Unlock()
+
+	// Messages to a peer go out in order, so they are all due once the
+	// oldest one is
+	now := time.Now()
+	due := make(map[string][]*OutboxEntry)
+	waiting := make(map[string]bool)
+	for _, entry := range entries {
+		peerID, err := peer.Decode(entry.PeerID)
+		if err != nil {
+			log.Printf("Invalid peer ID in outbox entry %s: %v\n", entry.MessageID, err)
+			continue
+		}
+		if waiting[entry.PeerID] {
+			continue
+		}
+		if forced[peerID] || entry.NextAttempt <= now.Unix() || len(due[entry.PeerID]) > 0 {
+			due[entry.PeerID] = append(due[entry.PeerID], entry)
+		} else {
+			waiting[entry.PeerID] = true
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, peerEntries := range due {
+		wg.Add(1)
+		go func(peerEntries []*OutboxEntry) {
+			defer wg.Done()
+			for _, entry := range peerEntries {
+				if !ob.attempt(ctx, entry) {
+					// Keep the order; later messages wait for this one
+					return
+				}
+			}
+		}(peerEntries)
+	}
+	wg.Wait()
+}
+
+// attempt sends a queued message once and reports whether it was delivered.
+func (ob *Outbox) attempt(ctx context.Context, entry *OutboxEntry) bool {
+	peerID, _ := peer.Decode(entry.PeerID)
+
+	sendCtx, cancel := context.WithTimeout(ctx, outboxSendTimeout)
+	status, err := ob.pcm.deliver(sendCtx, peerID, entry.outgoing())
+	cancel()
+
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	// The entry may have been cancelled while we were sending
+	current, ferr := ob.find(entry.MessageID)
+	if ferr != nil {
+		return err == nil
+	}
+
+	if err == nil {
+		if err := ob.db.Delete(outboxKey(current.PeerID, current.MessageID)); err != nil {
+			log.Printf("Failed to delete outbox entry: %v\n", err)
+		}
+		ob.setStatus(current, status)
+		log.Printf("Delivered queued message %s to %s after %d attempts\n", current.MessageID, current.PeerID, current.Attempts+1)
+		return true
+	}
+
+	current.Attempts++
+	current.LastError = err.Error()
+	if time.Since(time.Unix(current.CreatedAt, 0)) > outboxMaxAge {
+		log.Printf("Giving up on queued message %s to %s: %v\n", current.MessageID, current.PeerID, err)
+		if err := ob.db.Delete(outboxKey(current.PeerID, current.MessageID)); err != nil {
+			log.Printf("Failed to delete outbox entry: %v\n", err)
+		}
+		ob.setStatus(current, MessageFailed)
+		return false
+	}
+	current.NextAttempt = time.Now().Add(outboxBackoff(current.Attempts)).Unix()
+	if err := ob.save(current); err != nil {
+		log.Printf("%v\n", err)
+	}
+	return false
+}
+
+func (entry *OutboxEntry) outgoing() *outgoingMessage {
+	out := &outgoingMessage{Type: entry.Type, ID: entry.MessageID, Content: entry.Content, ReplyTo: entry.ReplyTo, HLC: entry.HLC, TTL: entry.TTL}
+	if out.Type == "" {
+		out.Type = EnvelopePrivateMessage
+	}
+	return out
+}
+
+// find looks up a queued message. Callers hold ob.mutex.
+func (ob *Outbox) find(messageID string) (*OutboxEntry, error) {
+	entries, err := ob.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.MessageID == messageID {
+			return entry, nil
+		}
+	}
+	return nil, ErrNotQueued
+}
+
+// save stores entry. Callers hold ob.mutex.
+func (ob *Outbox) save(entry *OutboxEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox entry: %w", err)
+	}
+	if err := ob.db.Put(outboxKey(entry.PeerID, entry.MessageID), data); err != nil {
+		return fmt.Errorf("failed to store outbox entry: %w", err)
+	}
+	return nil
+}
+
+func (ob *Outbox) setStatus(entry *OutboxEntry, status string) {
+	peerID, err := peer.Decode(entry.PeerID)
+	if err != nil {
+		return
+	}
+	if _, err := ob.pcm.setStatus(peerID, entry.MessageID, status, true); err != nil {
+		log.Printf("Failed to update message status: %v", err)
+	}
+}
+
+// outboxBackoff is the delay before the next attempt after the given number
+// of failed attempts.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts == 0 {
+		return 0
+	}
+	backoff := outboxMinBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+func outboxKey(peerID, messageID string) []byte {
+	return []byte(fmt.Sprintf("outbox/%s/%s", peerID, messageID))
+}
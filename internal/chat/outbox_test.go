@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestOutbox returns the outbox of a node that cannot reach any peer.
+func newTestOutbox(t *testing.T) *Outbox {
+	t.Helper()
+	h, km := newTestKeyManager(t, nil)
+	store := newTestStore(t)
+	clock, err := NewClock(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := NewInbox(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm := NewPrivateChatManager(h, store, nil, nil, NewSessionManager(store, km, h.ID()), nil, clock, inbox)
+	return pcm.Outbox()
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		0:    0,
+		1:    outboxMinBackoff,
+		2:    2 * outboxMinBackoff,
+		3:    4 * outboxMinBackoff,
+		1000: outboxMaxBackoff,
+	} {
+		if got := outboxBackoff(attempts); got != want {
+			t.Errorf("backoff after %d attempts is %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestOutboxOrder(t *testing.T) {
+	ob := newTestOutbox(t)
+	_, alice := newTestIdentity(t)
+	_, bob := newTestIdentity(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := ob.enqueue(alice, &outgoingMessage{Type: EnvelopePrivateMessage, ID: id, Content: id}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ob.enqueue(bob, &outgoingMessage{Type: EnvelopeEdit, ID: "4", Content: "edit"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !ob.hasQueued(alice) || !ob.hasQueued(bob) {
+		t.Fatal("queued messages not found")
+	}
+
+	attempts := func() map[string]int {
+		t.Helper()
+		entries, err := ob.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]int)
+		for _, entry := range entries {
+			counts[entry.MessageID] = entry.Attempts
+		}
+		return counts
+	}
+
+	// Each peer's oldest message is tried; the ones behind it wait, and an
+	// unreachable peer does not hold up the others
+	ob.flush(ctx)
+	if got := attempts(); got["1"] != 1 || got["2"] != 0 || got["3"] != 0 || got["4"] != 1 {
+		t.Fatalf("attempts after the first flush are %v", got)
+	}
+	entries, err := ob.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].NextAttempt <= time.Now().Unix() || entries[0].LastError == "" {
+		t.Fatalf("failed attempt not recorded: %+v", entries[0])
+	}
+	if entries[3].Type != EnvelopeEdit {
+		t.Fatalf("edit queued as %q", entries[3].Type)
+	}
+
+	// Nothing is retried before the backoff ends, unless a resend is asked for
+	ob.flush(ctx)
+	if got := attempts(); got["1"] != 1 || got["4"] != 1 {
+		t.Fatalf("attempts before the backoff ended are %v", got)
+	}
+	if err := ob.Resend("2"); err != nil {
+		t.Fatal(err)
+	}
+	ob.flush(ctx)
+	if got := attempts(); got["1"] != 2 || got["2"] != 0 || got["4"] != 1 {
+		t.Fatalf("attempts after a resend are %v", got)
+	}
+
+	if err := ob.Cancel("1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.Cancel("1"); err != ErrNotQueued {
+		t.Fatalf("cancelling twice gave %v, want ErrNotQueued", err)
+	}
+}
@@ -3,20 +3,40 @@ package chat
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/routing"
+	"github.com/syndtr/goleveldb/leveldb"
 	"io"
 	"log"
 	"p2p-chat/internal/db"
 	"p2p-chat/internal/p2p"
+	"sync"
 	"time"
 )
 
-const PrivateChatProtocol = protocol.ID("/p2p-chat/private/1.0.0")
+// PrivateChatProtocol is the legacy private chat protocol, which sends a
+// single ciphertext per stream. PrivateChatProtocolV2 wraps it in an Envelope.
+const (
+	PrivateChatProtocol   = protocol.ID("/p2p-chat/private/1.0.0")
+	PrivateChatProtocolV2 = protocol.ID("/p2p-chat/private/2.0.0")
+)
+
+// maxPrivateMessageSize bounds the size of an encrypted private message on the wire.
+const maxPrivateMessageSize = 64 * 1024
+
+// Responses sent back on a private chat stream once the message was processed.
+const (
+	responseOK    = "ok"
+	responseReset = "reset"
+)
+
+// ErrMessageNotFound is returned for messages missing from the chat history.
+var ErrMessageNotFound = errors.New("message not found")
 
 // PrivateMessage represents a single private chat message.
 type PrivateMessage struct {
@@ -26,6 +46,30 @@ type PrivateMessage struct {
 	Content   string `json:"content"`
 	Timestamp int64  `json:"timestamp"`
 	IsSent    bool   `json:"is_sent"`
+	// Status is one of MessagePending, MessageSent, MessageDelivered,
+	// MessageRead and MessageFailed.
+	Status string `json:"status,omitempty"`
+	// ReplyTo is the ID of the message in the same chat this one replies to.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// HLC is the hybrid logical clock timestamp the sender assigned to the
+	// message. The chat history is ordered by it.
+	HLC string `json:"hlc,omitempty"`
+	// EditedAt is set once the message was edited; Edits holds the earlier
+	// versions, oldest first. EditHLC is the sender's clock at the latest
+	// edit, which orders edits made within the same second.
+	EditedAt int64         `json:"edited_at,omitempty"`
+	EditHLC  string        `json:"edit_hlc,omitempty"`
+	Edits    []MessageEdit `json:"edits,omitempty"`
+	// Deleted marks a message deleted for everyone. Its content and edit
+	// history are gone.
+	Deleted   bool  `json:"deleted,omitempty"`
+	DeletedAt int64 `json:"deleted_at,omitempty"`
+	// TTL is set for disappearing messages, which are deleted at ExpiresAt.
+	TTL       int64 `json:"ttl,omitempty"`
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// Reactions maps each emoji to the peers that reacted with it. It is
+	// stored separately and filled in when the history is read.
+	Reactions map[string][]string `json:"reactions,omitempty"`
 }
 
 // PrivateChatManager handles private chat operations.
@@ -34,89 +78,250 @@ type PrivateChatManager struct {
 	db       *db.LevelDBStore
 	notifier Notifier
 	dht      routing.Routing
+	sessions *SessionManager
+	contacts  *ContactManager
+	outbox    *Outbox
+	reactions *reactionStore
+	timers    *timerStore
+	clock     *Clock
+	inbox     *Inbox
+	search    *searchIndex
+	mutex     sync.Mutex
 }
 
 // NewPrivateChatManager creates a new PrivateChatManager.
-func NewPrivateChatManager(h host.Host, store *db.LevelDBStore, notifier Notifier, dht routing.Routing) *PrivateChatManager {
-	return &PrivateChatManager{
+func NewPrivateChatManager(h host.Host, store *db.LevelDBStore, notifier Notifier, dht routing.Routing, sessions *SessionManager, contacts *ContactManager, clock *Clock, inbox *Inbox) *PrivateChatManager {
+	pcm := &PrivateChatManager{
 		host:     h,
 		db:       store,
 		notifier: notifier,
 		dht:      dht,
+		sessions: sessions,
+		contacts:  contacts,
+		reactions: &reactionStore{db: store},
+		timers:    &timerStore{db: store},
+		clock:     clock,
+		inbox:     inbox,
+		search:    &searchIndex{db: store},
 	}
+	pcm.outbox = newOutbox(h, store, pcm)
+	return pcm
+}
+
+// Outbox returns the queue of messages waiting for their recipient to come online.
+func (pcm *PrivateChatManager) Outbox() *Outbox {
+	return pcm.outbox
+}
+
+// Inbox returns the index of private chats and groups.
+func (pcm *PrivateChatManager) Inbox() *Inbox {
+	return pcm.inbox
 }
 
 // HandlePrivateChatStream sets up a stream handler for private chat messages.
+// It serves both PrivateChatProtocolV2 and the legacy PrivateChatProtocol.
 func (pcm *PrivateChatManager) HandlePrivateChatStream(s network.Stream) {
 	log.Printf("New private chat stream from %s\n", s.Conn().RemotePeer().String())
 	defer s.Close()
 
-	buf := make([]byte, 1024)
-	n, err := s.Read(buf)
+	if s.Protocol() == PrivateChatProtocolV2 {
+		pcm.handleEnvelope(s)
+		return
+	}
+
+	ciphertext, err := io.ReadAll(io.LimitReader(s, maxPrivateMessageSize))
 	if err != nil {
-		if err != io.EOF {
-			log.Printf("Error reading from private chat stream: %v\n", err)
-		}
+		log.Printf("Error reading from private chat stream: %v\n", err)
+		return
+	}
+	if len(ciphertext) == 0 {
+		return
+	}
+
+	plaintext, err := pcm.sessions.Decrypt(context.Background(), s.Conn().RemotePeer(), ciphertext)
+	if err != nil {
+		// Ask the sender to start over; our session state is missing or out of sync
+		log.Printf("Dropping private message from %s: %v\n", s.Conn().RemotePeer().String(), err)
+		s.Write([]byte(responseReset))
 		return
 	}
-	messageContent := string(buf[:n])
+	s.Write([]byte(responseOK))
+
+	pcm.receiveMessage(s.Conn().RemotePeer(), &Envelope{ID: newMessageID()}, string(plaintext))
+}
+
+// handleEnvelope reads a private message envelope from a v2 stream.
+func (pcm *PrivateChatManager) handleEnvelope(s network.Stream) {
+	remote := s.Conn().RemotePeer()
+	env, err := readEnvelopeFrom(s)
+	if err != nil {
+		log.Printf("Error reading from private chat stream: %v\n", err)
+		return
+	}
+	if env.Type == EnvelopeReceipt {
+		pcm.handleReceipt(s, env)
+		return
+	}
+	if !isPrivateEnvelope(env.Type) || len(env.Payload) > maxPrivateMessageSize {
+		log.Printf("Dropping invalid %s envelope from %s\n", env.Type, remote.String())
+		return
+	}
+
+	plaintext, err := pcm.sessions.Decrypt(context.Background(), remote, env.Payload)
+	if err != nil {
+		// Ask the sender to start over; our session state is missing or out of sync
+		log.Printf("Dropping private message from %s: %v\n", remote.String(), err)
+		writeResponse(s, env, responseReset)
+		return
+	}
+	if env.Type != EnvelopePrivateMessage {
+		pcm.receiveUpdate(remote, env.Type, plaintext)
+		writeResponse(s, env, responseOK)
+		return
+	}
+	var body messageBody
+	if err := json.Unmarshal(plaintext, &body); err != nil {
+		log.Printf("Invalid private message from %s: %v\n", remote.String(), err)
+		return
+	}
+
+	if pcm.receiveMessage(remote, env, body.Content) {
+		writeResponse(s, env, responseDelivered)
+	} else {
+		writeResponse(s, env, responseOK)
+	}
+}
+
+// receiveUpdate applies an envelope from sender that refers to an earlier
+// message or to the chat: an edit, a deletion, a reaction or a timer change.
+func (pcm *PrivateChatManager) receiveUpdate(sender peer.ID, envelopeType string, plaintext []byte) {
+	switch envelopeType {
+	case EnvelopeReaction:
+		pcm.receiveReaction(sender, plaintext)
+	case EnvelopeTimer:
+		pcm.receiveTimer(sender, plaintext)
+	default:
+		pcm.receiveControl(sender, envelopeType, plaintext)
+	}
+}
+
+// receiveMessage stores a message we received in env and notifies the
+// frontend, unless the sender is not a contact yet. It reports whether the
+// message is in the chat history. Messages without a TTL, from peers that do
+// not send one, follow our timer of the chat.
+func (pcm *PrivateChatManager) receiveMessage(sender peer.ID, env *Envelope, content string) bool {
+	ttl := env.TTL
+	if ttl == 0 {
+		ttl = pcm.timers.ttl(privateTimerKey(sender.String()))
+	}
 
 	// Store message in LevelDB
 	msg := &PrivateMessage{
-		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
-		SenderID:  s.Conn().RemotePeer().String(),
+		ID:        env.ID,
+		SenderID:  sender.String(),
 		RecipientID: pcm.host.ID().String(),
-		Content:   messageContent,
+		Content:   content,
 		Timestamp: time.Now().Unix(),
 		IsSent:    false, // This is a received message
+		Status:    MessageDelivered,
+		ReplyTo:   env.ReplyTo,
+		HLC:       pcm.clock.stamp(sender.String(), env.HLC),
+		TTL:       ttl,
+	}
+	msg.ExpiresAt = expiresAt(msg.Timestamp, ttl)
+
+	// Retries and mailbox copies of a message we already have are not stored again
+	pcm.mutex.Lock()
+	defer pcm.mutex.Unlock()
+	if _, err := pcm.getMessage(msg.SenderID, msg.ID); err == nil {
+		log.Printf("Dropping duplicate message %s from %s\n", msg.ID, msg.SenderID)
+		return true
 	}
+
+	// Only contacts get to write into our history
+	admitted, err := pcm.contacts.admit(msg)
+	if err != nil {
+		log.Printf("Failed to check contact status of %s: %v", msg.SenderID, err)
+		return false
+	}
+	if !admitted {
+		return false
+	}
+
 	err = pcm.storeMessage(msg)
 	if err != nil {
 		log.Printf("Failed to store received message: %v", err)
+		return false
 	}
+	pcm.inbox.addPrivateMessage(msg.SenderID, msg)
 
 	// Notify frontend via WebSocket
 	if pcm.notifier != nil {
 		pcm.notifier.NotifyNewMessage(msg.SenderID, msg.Content, "private")
 	}
 
-	fmt.Printf("Private message from %s: %s\n", s.Conn().RemotePeer().String(), messageContent)
+	fmt.Printf("Private message from %s: %s\n", msg.SenderID, msg.Content)
+	return true
 }
 
-// SendPrivateMessage sends an encrypted private message to a peer.
-func (pcm *PrivateChatManager) SendPrivateMessage(ctx context.Context, peerIDStr string, message string) error {
+// SendPrivateMessage sends an encrypted private message to a peer. If the
+// peer cannot be reached, the message is queued in the outbox and returned
+// with status MessagePending. replyTo optionally names the message in the
+// chat that this one replies to.
+func (pcm *PrivateChatManager) SendPrivateMessage(ctx context.Context, peerIDStr string, message string, replyTo string) (*PrivateMessage, error) {
 	peerID, err := peer.Decode(peerIDStr)
 	if err != nil {
-		return fmt.Errorf("invalid peer ID: %w", err)
+		return nil, fmt.Errorf("invalid peer ID: %w", err)
 	}
-
-	s, err := pcm.host.NewStream(ctx, peerID, PrivateChatProtocol)
-	if err != nil {
-		return fmt.Errorf("failed to open private chat stream: %w", err)
+	if replyTo != "" {
+		if _, err := pcm.getMessage(peerIDStr, replyTo); err != nil {
+			return nil, fmt.Errorf("invalid reply_to: %w", err)
+		}
 	}
-	defer s.Close()
 
-	_, err = s.Write([]byte(message))
-	if err != nil {
-		return fmt.Errorf("failed to write to private chat stream: %w", err)
+	if err := pcm.prepareContact(ctx, peerID); err != nil {
+		return nil, err
 	}
 
-	// Store sent message in LevelDB
+	// Store the message as pending first, so it shows up in the history
+	// even if sending fails
 	msg := &PrivateMessage{
-		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		ID:        newMessageID(),
 		SenderID:  pcm.host.ID().String(),
 		RecipientID: peerIDStr,
 		Content:   message,
 		Timestamp: time.Now().Unix(),
 		IsSent:    true,
+		Status:    MessagePending,
+		ReplyTo:   replyTo,
+		HLC:       pcm.clock.Now().String(),
+		TTL:       pcm.timers.ttl(privateTimerKey(peerIDStr)),
 	}
+	msg.ExpiresAt = expiresAt(msg.Timestamp, msg.TTL)
 	err = pcm.storeMessage(msg)
 	if err != nil {
 		log.Printf("Failed to store sent message: %v", err)
+	} else {
+		pcm.inbox.addPrivateMessage(peerIDStr, msg)
+	}
+	pcm.notifyStatus(peerIDStr, msg)
+
+	status, err := pcm.send(ctx, peerID, &outgoingMessage{Type: EnvelopePrivateMessage, ID: msg.ID, Content: message, ReplyTo: replyTo, HLC: msg.HLC, TTL: msg.TTL})
+	if err != nil {
+		pcm.setStatus(peerID, msg.ID, MessageFailed, true)
+		return nil, err
+	}
+	if status == MessagePending {
+		return msg, nil
+	}
+	if updated, err := pcm.setStatus(peerID, msg.ID, status, true); err != nil {
+		log.Printf("Failed to update message status: %v", err)
+	} else if updated != nil {
+		msg = updated
 	}
 
 	log.Printf("Sent private message to %s\n", peerID.String())
-	return nil
+	return msg, nil
 }
 
 // SendInitialMessage sends an initial message to a peer to start a chat.
@@ -126,34 +331,320 @@ func (pcm *PrivateChatManager) SendInitialMessage(ctx context.Context, peerIDStr
 		return fmt.Errorf("invalid peer ID: %w", err)
 	}
 
-	s, err := pcm.host.NewStream(ctx, peerID, PrivateChatProtocol)
-	if err != nil {
-		return fmt.Errorf("failed to open private chat stream: %w", err)
+	if err := pcm.prepareContact(ctx, peerID); err != nil {
+		return err
 	}
-	defer s.Close()
 
-	_, err = s.Write([]byte("Hello"))
+	_, err = pcm.writeEncrypted(ctx, peerID, &outgoingMessage{Type: EnvelopePrivateMessage, ID: newMessageID(), Content: "Hello"})
 	if err != nil {
-		return fmt.Errorf("failed to write to private chat stream: %w", err)
+		return err
 	}
 
 	log.Printf("Sent initial message to %s\n", peerID.String())
 	return nil
 }
 
+// prepareContact updates the contact status of a peer we are about to
+// message. Writing to a peer with a pending request accepts it; writing to a
+// stranger counts as asking them, so their reply is delivered.
+func (pcm *PrivateChatManager) prepareContact(ctx context.Context, peerID peer.ID) error {
+	contact, err := pcm.contacts.GetContact(peerID)
+	switch {
+	case errors.Is(err, ErrContactNotFound):
+		return pcm.contacts.markRequested(peerID)
+	case err != nil:
+		return err
+	case contact.Status == ContactBlocked:
+		return errors.New("peer is blocked")
+	case contact.Status == ContactPending:
+		_, err := pcm.contacts.Accept(ctx, peerID.String())
+		return err
+	case contact.Status == ContactRejected:
+		return pcm.contacts.markRequested(peerID)
+	}
+	return nil
+}
+
+// outgoingMessage is a private message envelope on its way to a peer: a
+// message, or an update to one or to the chat.
+type outgoingMessage struct {
+	Type    string
+	ID      string
+	Content string
+	ReplyTo string
+	HLC     string
+	TTL     int64
+}
+
+// send delivers a private message envelope to peerID, or queues it in the
+// outbox if the peer cannot be reached. Queued envelopes return
+// MessagePending; an error means the envelope could not be queued either.
+func (pcm *PrivateChatManager) send(ctx context.Context, peerID peer.ID, out *outgoingMessage) (string, error) {
+	// Queue behind earlier messages that are still waiting for the peer
+	if pcm.outbox.hasQueued(peerID) {
+		if err := pcm.outbox.enqueue(peerID, out, nil); err != nil {
+			return "", err
+		}
+		pcm.outbox.trigger(peerID)
+		return MessagePending, nil
+	}
+
+	status, err := pcm.deliver(ctx, peerID, out)
+	if err != nil {
+		log.Printf("Failed to send %s to %s, queueing it: %v\n", out.Type, peerID.String(), err)
+		if qerr := pcm.outbox.enqueue(peerID, out, err); qerr != nil {
+			return "", qerr
+		}
+		return MessagePending, nil
+	}
+	return status, nil
+}
 
+// deliver sends a private message envelope to peerID directly or, if the
+// peer cannot be reached, leaves it with one of the peer's mailboxes. It
+// returns the status of the message.
+func (pcm *PrivateChatManager) deliver(ctx context.Context, peerID peer.ID, out *outgoingMessage) (string, error) {
+	status, err := pcm.writeEncrypted(ctx, peerID, out)
+	if err == nil {
+		// Pick up changes to the peer's mailboxes now that it is online
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), mailboxTimeout)
+			defer cancel()
+			if err := pcm.sessions.keys.RefreshKeyBundle(ctx, peerID); err != nil {
+				log.Printf("Failed to refresh key bundle of %s: %v\n", peerID.String(), err)
+			}
+		}()
+		return status, nil
+	}
+
+	mailboxes := pcm.sessions.keys.PeerMailboxes(peerID)
+	if len(mailboxes) == 0 {
+		return "", err
+	}
+	log.Printf("Peer %s is unreachable, trying its mailboxes: %v\n", peerID.String(), err)
+	if derr := pcm.depositMessage(ctx, peerID, mailboxes, out); derr != nil {
+		return "", fmt.Errorf("%w; mailbox deposit failed: %v", err, derr)
+	}
+	return MessageSent, nil
+}
+
+// writeEncrypted encrypts content for peerID and sends it over a new
+// private chat stream. If the peer could not decrypt it because its session
+// state was lost, the session is restarted and the message sent once more.
+// It returns MessageDelivered if the peer confirmed it stored the message,
+// and MessageSent otherwise.
+func (pcm *PrivateChatManager) writeEncrypted(ctx context.Context, peerID peer.ID, out *outgoingMessage) (string, error) {
+	status, err := pcm.sendEncrypted(ctx, peerID, out)
+	if errors.Is(err, ErrNoSession) {
+		log.Printf("Peer %s reset our session, retrying with a new one\n", peerID.String())
+		if err := pcm.sessions.ResetSession(peerID); err != nil {
+			return "", fmt.Errorf("failed to reset session: %w", err)
+		}
+		status, err = pcm.sendEncrypted(ctx, peerID, out)
+	}
+	return status, err
+}
+
+func (pcm *PrivateChatManager) sendEncrypted(ctx context.Context, peerID peer.ID, out *outgoingMessage) (string, error) {
+	s, isV2, err := newStream(ctx, pcm.host, peerID, PrivateChatProtocolV2, PrivateChatProtocol)
+	if err != nil {
+		return "", fmt.Errorf("failed to open private chat stream: %w", err)
+	}
+	defer s.Close()
+
+	// Peers on the legacy protocol get the bare content, and cannot apply
+	// edits, deletions or reactions
+	plaintext := []byte(out.Content)
+	if isV2 {
+		plaintext, err = privatePlaintext(out)
+		if err != nil {
+			return "", err
+		}
+	} else if out.Type != EnvelopePrivateMessage {
+		log.Printf("Peer %s does not support %s messages, skipping\n", peerID.String(), out.Type)
+		s.Reset()
+		return MessageSent, nil
+	}
+	ciphertext, err := pcm.sessions.Encrypt(ctx, peerID, plaintext)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt message: %w", err)
+	}
+
+	if isV2 {
+		err = WriteEnvelope(s, pcm.privateEnvelope(peerID, out, ciphertext))
+	} else {
+		_, err = s.Write(ciphertext)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write to private chat stream: %w", err)
+	}
+	if err := s.CloseWrite(); err != nil {
+		return "", fmt.Errorf("failed to close private chat stream: %w", err)
+	}
+
+	var status string
+	if isV2 {
+		status, err = readResponse(s)
+	} else {
+		var response []byte
+		response, err = io.ReadAll(io.LimitReader(s, 16))
+		status = string(response)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read private chat response: %w", err)
+	}
+	switch status {
+	case responseReset:
+		return "", ErrNoSession
+	case responseDelivered:
+		return MessageDelivered, nil
+	}
+	return MessageSent, nil
+}
+
+// isPrivateEnvelope reports whether envelopeType is carried encrypted over
+// the private chat protocol.
+func isPrivateEnvelope(envelopeType string) bool {
+	switch envelopeType {
+	case EnvelopePrivateMessage, EnvelopeEdit, EnvelopeDelete, EnvelopeReaction, EnvelopeTimer:
+		return true
+	}
+	return false
+}
+
+// privatePlaintext is what gets encrypted into the payload of a private
+// envelope. Messages are wrapped in a messageBody; the content of other
+// envelopes already is their JSON encoding.
+func privatePlaintext(out *outgoingMessage) ([]byte, error) {
+	if out.Type != EnvelopePrivateMessage {
+		return []byte(out.Content), nil
+	}
+	plaintext, err := json.Marshal(messageBody{Content: out.Content})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return plaintext, nil
+}
+
+// privateEnvelope wraps the encrypted payload of out for peerID.
+func (pcm *PrivateChatManager) privateEnvelope(peerID peer.ID, out *outgoingMessage, ciphertext []byte) *Envelope {
+	env := NewEnvelope(out.Type, pcm.host.ID(), privateConversationID(pcm.host.ID(), peerID), ciphertext)
+	env.ID = out.ID
+	env.ReplyTo = out.ReplyTo
+	env.HLC = out.HLC
+	if env.HLC == "" {
+		env.HLC = pcm.clock.Now().String()
+	}
+	env.TTL = out.TTL
+	return env
+}
+
+// messageAD binds a ciphertext to its sender and recipient.
+func messageAD(sender, recipient peer.ID) []byte {
+	return []byte(sender.String() + ">" + recipient.String())
+}
+
+// privateMessageKey is the key of a message in the chat history with
+// peerID. Keys start with the message's HLC, so the history iterates in
+// causal order.
+func privateMessageKey(peerID, hlc, messageID string) string {
+	return fmt.Sprintf("chat/private/%s/%s-%s", peerID, hlc, messageID)
+}
+
+// privateMessageIDKey maps the ID of a message in the chat history with
+// peerID to its key.
+func privateMessageIDKey(peerID, messageID string) string {
+	return fmt.Sprintf("msgids/private/%s/%s", peerID, messageID)
+}
+
+// privateReplyKey maps a reply to parentID in the chat history with peerID
+// to the key of the reply, so threads are read without the whole history.
+func privateReplyKey(peerID, parentID, messageID string) string {
+	return fmt.Sprintf("replies/private/%s/%s/%s", peerID, parentID, messageID)
+}
+
+func (pcm *PrivateChatManager) getMessage(peerID, messageID string) (*PrivateMessage, error) {
+	key, err := pcm.messageKey(peerID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := pcm.db.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message: %w", err)
+	}
+	var msg PrivateMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	return &msg, nil
+}
+
+// messageKey returns the key of a message in the chat history with a peer.
+func (pcm *PrivateChatManager) messageKey(peerID, messageID string) ([]byte, error) {
+	idKey := []byte(privateMessageIDKey(peerID, messageID))
+	exists, err := pcm.db.Has(idKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check message: %w", err)
+	}
+	if !exists {
+		return nil, ErrMessageNotFound
+	}
+	key, err := pcm.db.Get(idKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message: %w", err)
+	}
+	return key, nil
+}
+
+// peerID returns the peer whose chat msg belongs to.
+func (msg *PrivateMessage) peerID() string {
+	if msg.IsSent {
+		return msg.RecipientID
+	}
+	return msg.SenderID
+}
+
+// storeMessage stores a message in the chat history, updates its entry in
+// the search index and, for disappearing messages, schedules its expiry.
 func (pcm *PrivateChatManager) storeMessage(msg *PrivateMessage) error {
-	key := fmt.Sprintf("chat/private/%s/%s", msg.RecipientID, msg.ID)
-	if !msg.IsSent {
-		key = fmt.Sprintf("chat/private/%s/%s", msg.SenderID, msg.ID)
+	batch := new(leveldb.Batch)
+	if err := putPrivateMessage(batch, pcm.host.ID(), msg); err != nil {
+		return err
+	}
+	key := privateMessageKey(msg.peerID(), msg.HLC, msg.ID)
+	if err := pcm.search.update(batch, key, msg.Content); err != nil {
+		return err
+	}
+	return pcm.db.WriteBatch(batch)
+}
+
+// putPrivateMessage adds a message in the chat history to batch, with the
+// mapping from its ID to its key, its entry in the replies index and, for
+// disappearing messages, its expiry.
+// self is our peer ID.
+func putPrivateMessage(batch *leveldb.Batch, self peer.ID, msg *PrivateMessage) error {
+	peerIDStr := msg.peerID()
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID: %w", err)
 	}
 
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
-
-	return pcm.db.Put([]byte(key), data)
+	key := privateMessageKey(peerIDStr, msg.HLC, msg.ID)
+	batch.Put([]byte(key), data)
+	batch.Put([]byte(privateMessageIDKey(peerIDStr, msg.ID)), []byte(key))
+	if msg.ReplyTo != "" {
+		batch.Put([]byte(privateReplyKey(peerIDStr, msg.ReplyTo, msg.ID)), []byte(key))
+	}
+	if msg.ExpiresAt != 0 {
+		if err := scheduleExpiry(batch, msg.ExpiresAt, key, privateExpiry(self, peerID, key, msg)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // GetChatHistory retrieves chat history for a specific peer.
@@ -172,8 +663,20 @@ func (pcm *PrivateChatManager) GetChatHistory(peerIDStr string) ([]*PrivateMessa
 		}
 		messages = append(messages, &msg)
 	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
 
-	return messages, iter.Error()
+	if peerID, err := peer.Decode(peerIDStr); err == nil && len(messages) > 0 {
+		reactions, err := pcm.reactions.list(privateConversationID(pcm.host.ID(), peerID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get reactions: %w", err)
+		}
+		for _, msg := range messages {
+			msg.Reactions = reactions[msg.ID]
+		}
+	}
+	return messages, nil
 }
 
 // SearchPeer searches for a peer by username.
@@ -0,0 +1,338 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"log"
+	"p2p-chat/internal/db"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvelopeReaction adds or removes an emoji reaction to a message. In private
+// chats it is encrypted like a message; in groups it goes to every member.
+const EnvelopeReaction = "reaction"
+
+// maxReactionLength bounds the size of a reaction, which is meant to be a
+// single emoji.
+const maxReactionLength = 32
+
+// reactionEvent adds or removes the reaction of one peer. Events are merged
+// per reactor and emoji: the one with the latest timestamp wins, and at
+// equal timestamps a removal wins, so peers end up with the same reactions
+// whatever order the events arrive in.
+type reactionEvent struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	Reactor   string `json:"reactor"`
+	Removed   bool   `json:"removed,omitempty"`
+	// Timestamp is the Unix time in nanoseconds at which the reactor made the change.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// reactionState is the stored reaction state of a message: the winning event
+// of each reactor and emoji, keyed by reactionEventKey.
+type reactionState struct {
+	Events map[string]*reactionEvent `json:"events"`
+}
+
+func reactionEventKey(reactor, emoji string) string {
+	return reactor + " " + emoji
+}
+
+// merge applies ev to the state. It reports whether ev won over the event
+// it replaces, and whether that changed the reactions.
+func (st *reactionState) merge(ev *reactionEvent) (bool, bool) {
+	key := reactionEventKey(ev.Reactor, ev.Emoji)
+	current, ok := st.Events[key]
+	if ok && (ev.Timestamp < current.Timestamp || (ev.Timestamp == current.Timestamp && (current.Removed || !ev.Removed))) {
+		return false, false
+	}
+	st.Events[key] = ev
+	if !ok {
+		return true, !ev.Removed
+	}
+	return true, current.Removed != ev.Removed
+}
+
+// summary maps each emoji to the sorted IDs of the peers that reacted with it.
+func (st *reactionState) summary() map[string][]string {
+	reactions := make(map[string][]string)
+	for _, ev := range st.Events {
+		if !ev.Removed {
+			reactions[ev.Emoji] = append(reactions[ev.Emoji], ev.Reactor)
+		}
+	}
+	for _, reactors := range reactions {
+		sort.Strings(reactors)
+	}
+	return reactions
+}
+
+// reactionStore keeps the reaction state of messages in LevelDB under
+// reactions/<conversation>/<message>.
+type reactionStore struct {
+	db    *db.LevelDBStore
+	mutex sync.Mutex
+}
+
+// apply merges ev into the reactions of its message in a conversation. It
+// returns the resulting reactions and whether they changed.
+func (rs *reactionStore) apply(conversationID string, ev *reactionEvent) (map[string][]string, bool, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	key := reactionKey(conversationID, ev.MessageID)
+	st := &reactionState{Events: make(map[string]*reactionEvent)}
+	exists, err := rs.db.Has(key)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to check reactions: %w", err)
+	}
+	if exists {
+		data, err := rs.db.Get(key)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get reactions: %w", err)
+		}
+		if err := json.Unmarshal(data, st); err != nil {
+			return nil, false, fmt.Errorf("failed to unmarshal reactions: %w", err)
+		}
+		if st.Events == nil {
+			st.Events = make(map[string]*reactionEvent)
+		}
+	}
+
+	accepted, changed := st.merge(ev)
+	if !accepted {
+		return st.summary(), false, nil
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal reactions: %w", err)
+	}
+	if err := rs.db.Put(key, data); err != nil {
+		return nil, false, fmt.Errorf("failed to store reactions: %w", err)
+	}
+	return st.summary(), changed, nil
+}
+
+// list returns the reactions of every message in a conversation that has
+// any, keyed by message ID.
+func (rs *reactionStore) list(conversationID string) (map[string]map[string][]string, error) {
+	prefix := fmt.Sprintf("reactions/%s/", conversationID)
+	iter := rs.db.NewIteratorWithPrefix([]byte(prefix))
+	defer iter.Release()
+
+	reactions := make(map[string]map[string][]string)
+	for iter.Next() {
+		var st reactionState
+		if err := json.Unmarshal(iter.Value(), &st); err != nil {
+			log.Printf("Failed to unmarshal reactions: %v", err)
+			continue
+		}
+		if summary := st.summary(); len(summary) > 0 {
+			reactions[strings.TrimPrefix(string(iter.Key()), prefix)] = summary
+		}
+	}
+	return reactions, iter.Error()
+}
+
+// get returns the reactions to a message in a conversation.
+func (rs *reactionStore) get(conversationID, messageID string) (map[string][]string, error) {
+	key := reactionKey(conversationID, messageID)
+	exists, err := rs.db.Has(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check reactions: %w", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	data, err := rs.db.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reactions: %w", err)
+	}
+	var st reactionState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reactions: %w", err)
+	}
+	if summary := st.summary(); len(summary) > 0 {
+		return summary, nil
+	}
+	return nil, nil
+}
+
+func reactionKey(conversationID, messageID string) []byte {
+	return []byte(fmt.Sprintf("reactions/%s/%s", conversationID, messageID))
+}
+
+// newReactionEvent checks a reaction made by us and creates its event.
+func newReactionEvent(reactor peer.ID, messageID, emoji string, add bool) (*reactionEvent, error) {
+	if emoji == "" || len(emoji) > maxReactionLength {
+		return nil, errors.New("invalid reaction")
+	}
+	return &reactionEvent{
+		MessageID: messageID,
+		Emoji:     emoji,
+		Reactor:   reactor.String(),
+		Removed:   !add,
+		Timestamp: time.Now().UnixNano(),
+	}, nil
+}
+
+// parseReactionEvent decodes a reaction event from sender. The reactor is
+// always the sender.
+func parseReactionEvent(sender peer.ID, data []byte) (*reactionEvent, error) {
+	var ev reactionEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reaction: %w", err)
+	}
+	if !validMessageID(ev.MessageID) || ev.Emoji == "" || len(ev.Emoji) > maxReactionLength {
+		return nil, errors.New("invalid reaction")
+	}
+	ev.Reactor = sender.String()
+	return &ev, nil
+}
+
+// React adds or removes our reaction to a message in the chat with a peer
+// and sends it to the peer. It returns the reactions of the message.
+func (pcm *PrivateChatManager) React(ctx context.Context, peerIDStr, messageID, emoji string, add bool) (map[string][]string, error) {
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID: %w", err)
+	}
+	if _, err := pcm.getMessage(peerIDStr, messageID); err != nil {
+		return nil, err
+	}
+	ev, err := newReactionEvent(pcm.host.ID(), messageID, emoji, add)
+	if err != nil {
+		return nil, err
+	}
+
+	reactions, changed, err := pcm.reactions.apply(privateConversationID(pcm.host.ID(), peerID), ev)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return reactions, nil
+	}
+	pcm.notifyReactions(peerIDStr, messageID, reactions)
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal reaction: %w", err)
+	}
+	if _, err := pcm.send(ctx, peerID, &outgoingMessage{Type: EnvelopeReaction, ID: newMessageID(), Content: string(data)}); err != nil {
+		return nil, err
+	}
+	return reactions, nil
+}
+
+// receiveReaction applies a reaction from sender to a message in our chat
+// with it.
+func (pcm *PrivateChatManager) receiveReaction(sender peer.ID, plaintext []byte) {
+	ev, err := parseReactionEvent(sender, plaintext)
+	if err != nil {
+		log.Printf("Dropping reaction from %s: %v\n", sender.String(), err)
+		return
+	}
+	if _, err := pcm.getMessage(sender.String(), ev.MessageID); err != nil {
+		log.Printf("Dropping reaction from %s to message %s: %v\n", sender.String(), ev.MessageID, err)
+		return
+	}
+
+	reactions, changed, err := pcm.reactions.apply(privateConversationID(pcm.host.ID(), sender), ev)
+	if err != nil {
+		log.Printf("Failed to apply reaction from %s: %v\n", sender.String(), err)
+		return
+	}
+	if changed {
+		pcm.notifyReactions(sender.String(), ev.MessageID, reactions)
+	}
+}
+
+func (pcm *PrivateChatManager) notifyReactions(peerID, messageID string, reactions map[string][]string) {
+	if pcm.notifier != nil {
+		pcm.notifier.NotifyEvent("reaction_updated", map[string]interface{}{
+			"peer_id":    peerID,
+			"message_id": messageID,
+			"reactions":  reactions,
+		})
+	}
+}
+
+// ReactGroup adds or removes our reaction to a message in a group and sends
+// it to the members. It returns the reactions of the message.
+func (gcm *GroupChatManager) ReactGroup(ctx context.Context, groupID, messageID, emoji string, add bool) (map[string][]string, error) {
+	group, err := gcm.GetGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	found, err := gcm.hasMessage(groupID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrMessageNotFound
+	}
+	ev, err := newReactionEvent(gcm.host.ID(), messageID, emoji, add)
+	if err != nil {
+		return nil, err
+	}
+
+	reactions, changed, err := gcm.reactions.apply(groupID, ev)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return reactions, nil
+	}
+	gcm.notifyReactions(groupID, messageID, reactions)
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal reaction: %w", err)
+	}
+	env := NewEnvelope(EnvelopeReaction, gcm.host.ID(), groupID, payload)
+	gcm.sendToMembers(ctx, group, env, "")
+	return reactions, nil
+}
+
+// receiveReaction applies a reaction from sender to a message in a group.
+func (gcm *GroupChatManager) receiveReaction(sender peer.ID, env *Envelope) {
+	ev, err := parseReactionEvent(sender, env.Payload)
+	if err == nil && (env.ConversationID == "" || strings.Contains(env.ConversationID, "/")) {
+		err = errors.New("invalid group ID")
+	}
+	if err != nil {
+		log.Printf("Dropping group reaction from %s: %v\n", sender.String(), err)
+		return
+	}
+	found, err := gcm.hasMessage(env.ConversationID, ev.MessageID)
+	if err != nil || !found {
+		log.Printf("Dropping group reaction from %s to unknown message %s\n", sender.String(), ev.MessageID)
+		return
+	}
+
+	reactions, changed, err := gcm.reactions.apply(env.ConversationID, ev)
+	if err != nil {
+		log.Printf("Failed to apply group reaction from %s: %v\n", sender.String(), err)
+		return
+	}
+	if changed {
+		gcm.notifyReactions(env.ConversationID, ev.MessageID, reactions)
+	}
+}
+
+func (gcm *GroupChatManager) notifyReactions(groupID, messageID string, reactions map[string][]string) {
+	if gcm.notifier != nil {
+		gcm.notifier.NotifyEvent("reaction_updated", map[string]interface{}{
+			"group_id":   groupID,
+			"message_id": messageID,
+			"reactions":  reactions,
+		})
+	}
+}
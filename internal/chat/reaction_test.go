@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+)
+
+// permutations returns every ordering of events.
+func permutations(events []*reactionEvent) [][]*reactionEvent {
+	if len(events) <= 1 {
+		return [][]*reactionEvent{events}
+	}
+	var orders [][]*reactionEvent
+	for i, ev := range events {
+		rest := append(append([]*reactionEvent(nil), events[:i]...), events[i+1:]...)
+		for _, order := range permutations(rest) {
+			orders = append(orders, append([]*reactionEvent{ev}, order...))
+		}
+	}
+	return orders
+}
+
+func TestReactionMergeConverges(t *testing.T) {
+	events := []*reactionEvent{
+		{MessageID: "m", Emoji: "👍", Reactor: "alice", Timestamp: 1},
+		{MessageID: "m", Emoji: "👍", Reactor: "alice", Timestamp: 2, Removed: true},
+		{MessageID: "m", Emoji: "👍", Reactor: "alice", Timestamp: 3},
+		{MessageID: "m", Emoji: "👍", Reactor: "bob", Timestamp: 2},
+		{MessageID: "m", Emoji: "🎉", Reactor: "bob", Timestamp: 5},
+		{MessageID: "m", Emoji: "🎉", Reactor: "bob", Timestamp: 4, Removed: true},
+	}
+	want := map[string][]string{"👍": {"alice", "bob"}, "🎉": {"bob"}}
+
+	for _, order := range permutations(events) {
+		st := &reactionState{Events: make(map[string]*reactionEvent)}
+		for _, ev := range order {
+			st.merge(ev)
+			// Duplicates change nothing
+			if accepted, changed := st.merge(ev); accepted || changed {
+				t.Fatalf("duplicate event %+v accepted", ev)
+			}
+		}
+		if got := st.summary(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("reactions are %v, want %v", got, want)
+		}
+	}
+}
+
+func TestReactionMergeRemovalWinsTies(t *testing.T) {
+	add := &reactionEvent{MessageID: "m", Emoji: "👍", Reactor: "alice", Timestamp: 1}
+	remove := &reactionEvent{MessageID: "m", Emoji: "👍", Reactor: "alice", Timestamp: 1, Removed: true}
+
+	for _, order := range [][]*reactionEvent{{add, remove}, {remove, add}} {
+		st := &reactionState{Events: make(map[string]*reactionEvent)}
+		for _, ev := range order {
+			st.merge(ev)
+		}
+		if got := st.summary(); len(got) != 0 {
+			t.Fatalf("reactions are %v after a removal at the same time", got)
+		}
+	}
+}
+
+func TestReactionStoreApply(t *testing.T) {
+	rs := &reactionStore{db: newTestStore(t)}
+	apply := func(ev *reactionEvent, wantChanged bool) map[string][]string {
+		t.Helper()
+		reactions, changed, err := rs.apply("conversation", ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != wantChanged {
+			t.Fatalf("applying %+v reported changed=%v, want %v", ev, changed, wantChanged)
+		}
+		return reactions
+	}
+
+	apply(&reactionEvent{MessageID: "m", Emoji: "👍", Reactor: "bob", Timestamp: 2}, true)
+	apply(&reactionEvent{MessageID: "m", Emoji: "👍", Reactor: "alice", Timestamp: 1}, true)
+	// An older removal loses to the stored addition
+	reactions := apply(&reactionEvent{MessageID: "m", Emoji: "👍", Reactor: "bob", Timestamp: 1, Removed: true}, false)
+	if want := map[string][]string{"👍": {"alice", "bob"}}; !reflect.DeepEqual(reactions, want) {
+		t.Fatalf("reactions are %v, want %v", reactions, want)
+	}
+
+	apply(&reactionEvent{MessageID: "m", Emoji: "👍", Reactor: "alice", Timestamp: 3, Removed: true}, true)
+	stored, err := rs.get("conversation", "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"👍": {"bob"}}; !reflect.DeepEqual(stored, want) {
+		t.Fatalf("stored reactions are %v, want %v", stored, want)
+	}
+	all, err := rs.list("conversation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || !reflect.DeepEqual(all["m"], stored) {
+		t.Fatalf("listed reactions are %v", all)
+	}
+}
@@ -0,0 +1,300 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/syndtr/goleveldb/leveldb"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Private message statuses. A sent message moves from pending to sent once
+// the peer accepted it, to delivered once the peer stored it in its chat
+// history, and to read once the peer's user saw it. Received messages are
+// delivered until they are marked read.
+const (
+	MessagePending   = "pending"
+	MessageSent      = "sent"
+	MessageDelivered = "delivered"
+	MessageRead      = "read"
+	MessageFailed    = "failed"
+)
+
+// EnvelopeReceipt reports the status of messages we received back to their sender.
+const EnvelopeReceipt = "receipt"
+
+// responseDelivered answers a private message that was stored in the chat
+// history. Messages from strangers are only answered with responseOK, since
+// they wait in quarantine.
+const responseDelivered = "delivered"
+
+// maxReceiptIDs bounds the number of message IDs sent in one receipt.
+const maxReceiptIDs = 500
+
+// statusOrder ranks the statuses a message moves through. A status never
+// goes back to a lower rank.
+var statusOrder = map[string]int{
+	MessagePending:   1,
+	MessageSent:      2,
+	MessageDelivered: 3,
+	MessageRead:      4,
+}
+
+// receipt is the payload of an EnvelopeReceipt. Its status is
+// MessageDelivered, MessageRead, or MessageFailed for messages left in a
+// mailbox that the recipient could not decrypt.
+type receipt struct {
+	Status     string   `json:"status"`
+	MessageIDs []string `json:"message_ids"`
+}
+
+// MarkRead marks messages received from a peer as read and sends a read
+// receipt for them. Without message IDs, all unread messages from the peer
+// are marked read.
+func (pcm *PrivateChatManager) MarkRead(ctx context.Context, peerIDStr string, messageIDs []string) ([]string, error) {
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID: %w", err)
+	}
+
+	if len(messageIDs) == 0 {
+		history, err := pcm.GetChatHistory(peerIDStr)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range history {
+			if !msg.IsSent && msg.Status != MessageRead {
+				messageIDs = append(messageIDs, msg.ID)
+			}
+		}
+	}
+
+	marked := []string{}
+	for _, id := range messageIDs {
+		msg, err := pcm.setStatus(peerID, id, MessageRead, false)
+		if err != nil {
+			return marked, err
+		}
+		if msg != nil {
+			marked = append(marked, id)
+		}
+	}
+	if len(marked) == 0 {
+		return marked, nil
+	}
+
+	pcm.deliverReceipt(ctx, peerID, receipt{Status: MessageRead, MessageIDs: marked})
+	return marked, nil
+}
+
+// deliverReceipt sends a receipt to peerID, or keeps it to send once the
+// peer is back if that fails.
+func (pcm *PrivateChatManager) deliverReceipt(ctx context.Context, peerID peer.ID, r receipt) {
+	err := pcm.sendReceipt(ctx, peerID, r)
+	if err == nil {
+		return
+	}
+	log.Printf("Failed to send %s receipt to %s, keeping it for later: %v\n", r.Status, peerID.String(), err)
+	batch := new(leveldb.Batch)
+	queueReceipt(batch, peerID.String(), r)
+	if err := pcm.db.WriteBatch(batch); err != nil {
+		log.Printf("Failed to store %s receipt: %v\n", r.Status, err)
+	}
+}
+
+// queueReceipt adds a receipt to send later to batch. Pending receipts are
+// kept under receipts/<peer>/<status>/<message>, with the time they were
+// queued. A read receipt replaces a pending delivered receipt.
+func queueReceipt(batch *leveldb.Batch, peerID string, r receipt) {
+	now := []byte(strconv.FormatInt(time.Now().Unix(), 10))
+	for _, id := range r.MessageIDs {
+		if r.Status == MessageRead {
+			batch.Delete(pendingReceiptKey(peerID, MessageDelivered, id))
+		}
+		batch.Put(pendingReceiptKey(peerID, r.Status, id), now)
+	}
+}
+
+// hasPendingReceipts reports whether receipts for peerID wait to be sent.
+func (pcm *PrivateChatManager) hasPendingReceipts(peerID peer.ID) bool {
+	iter := pcm.db.NewIteratorWithPrefix([]byte(fmt.Sprintf("receipts/%s/", peerID.String())))
+	defer iter.Release()
+	return iter.Next()
+}
+
+// flushReceipts sends the pending receipts of the peers we are connected to.
+// Receipts that are not sent within outboxMaxAge are dropped.
+func (pcm *PrivateChatManager) flushReceipts(ctx context.Context) {
+	iter := pcm.db.NewIteratorWithPrefix([]byte("receipts/"))
+	pending := make(map[string]map[string][]string)
+	var expired [][]byte
+	for iter.Next() {
+		parts := strings.SplitN(strings.TrimPrefix(string(iter.Key()), "receipts/"), "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		queuedAt, _ := strconv.ParseInt(string(iter.Value()), 10, 64)
+		if time.Since(time.Unix(queuedAt, 0)) > outboxMaxAge {
+			expired = append(expired, append([]byte(nil), iter.Key()...))
+			continue
+		}
+		if pending[parts[0]] == nil {
+			pending[parts[0]] = make(map[string][]string)
+		}
+		pending[parts[0]][parts[1]] = append(pending[parts[0]][parts[1]], parts[2])
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		log.Printf("Failed to read pending receipts: %v\n", err)
+		return
+	}
+	if len(expired) > 0 {
+		batch := new(leveldb.Batch)
+		for _, key := range expired {
+			batch.Delete(key)
+		}
+		if err := pcm.db.WriteBatch(batch); err != nil {
+			log.Printf("Failed to delete expired receipts: %v\n", err)
+		}
+	}
+
+	for peerIDStr, statuses := range pending {
+		peerID, err := peer.Decode(peerIDStr)
+		if err != nil || pcm.host.Network().Connectedness(peerID) != network.Connected {
+			continue
+		}
+		// Delivered receipts go first, so the status does not skip ahead
+		for _, status := range []string{MessageDelivered, MessageRead, MessageFailed} {
+			ids := statuses[status]
+			for len(ids) > 0 {
+				n := min(len(ids), maxReceiptIDs)
+				if err := pcm.sendPendingReceipt(ctx, peerID, receipt{Status: status, MessageIDs: ids[:n]}); err != nil {
+					log.Printf("Failed to send pending %s receipt to %s: %v\n", status, peerIDStr, err)
+					break
+				}
+				ids = ids[n:]
+			}
+		}
+	}
+}
+
+// sendPendingReceipt sends a pending receipt and deletes it once it was sent.
+func (pcm *PrivateChatManager) sendPendingReceipt(ctx context.Context, peerID peer.ID, r receipt) error {
+	ctx, cancel := context.WithTimeout(ctx, outboxSendTimeout)
+	defer cancel()
+	if err := pcm.sendReceipt(ctx, peerID, r); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for _, id := range r.MessageIDs {
+		batch.Delete(pendingReceiptKey(peerID.String(), r.Status, id))
+	}
+	return pcm.db.WriteBatch(batch)
+}
+
+func pendingReceiptKey(peerID, status, messageID string) []byte {
+	return []byte(fmt.Sprintf("receipts/%s/%s/%s", peerID, status, messageID))
+}
+
+func (pcm *PrivateChatManager) sendReceipt(ctx context.Context, peerID peer.ID, r receipt) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal receipt: %w", err)
+	}
+
+	s, isV2, err := newStream(ctx, pcm.host, peerID, PrivateChatProtocolV2, PrivateChatProtocol)
+	if err != nil {
+		return fmt.Errorf("failed to open private chat stream: %w", err)
+	}
+	defer s.Close()
+	if !isV2 {
+		// Legacy peers have no receipts
+		s.Reset()
+		return nil
+	}
+
+	if err := WriteEnvelope(s, NewEnvelope(EnvelopeReceipt, pcm.host.ID(), privateConversationID(pcm.host.ID(), peerID), payload)); err != nil {
+		return err
+	}
+	if err := s.CloseWrite(); err != nil {
+		return fmt.Errorf("failed to close private chat stream: %w", err)
+	}
+	_, err = readResponse(s)
+	return err
+}
+
+// handleReceipt applies a receipt from the peer to the messages we sent it.
+func (pcm *PrivateChatManager) handleReceipt(s network.Stream, env *Envelope) {
+	remote := s.Conn().RemotePeer()
+	var r receipt
+	if err := json.Unmarshal(env.Payload, &r); err != nil || (r.Status != MessageDelivered && r.Status != MessageRead && r.Status != MessageFailed) {
+		log.Printf("Dropping invalid receipt from %s\n", remote.String())
+		return
+	}
+
+	for _, id := range r.MessageIDs {
+		if strings.Contains(id, "/") {
+			continue
+		}
+		if _, err := pcm.setStatus(remote, id, r.Status, true); err != nil {
+			log.Printf("Failed to apply %s receipt from %s: %v\n", r.Status, remote.String(), err)
+		}
+	}
+	writeResponse(s, env, responseOK)
+}
+
+// setStatus moves a message in the chat history with peerID to status and
+// notifies the frontend with a message_status event. isSent selects whether
+// the message must be one we sent or one we received. It returns nil if the
+// message does not exist or already has the status or a later one.
+func (pcm *PrivateChatManager) setStatus(peerID peer.ID, messageID, status string, isSent bool) (*PrivateMessage, error) {
+	pcm.mutex.Lock()
+	defer pcm.mutex.Unlock()
+
+	msg, err := pcm.getMessage(peerID.String(), messageID)
+	if errors.Is(err, ErrMessageNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case msg.IsSent != isSent:
+		return nil, nil
+	case status == MessageFailed:
+		// Only a message still on its way can fail, or one left in a
+		// mailbox the peer could not decrypt
+		if msg.Status != MessagePending && msg.Status != MessageSent {
+			return nil, nil
+		}
+	case msg.Status != MessageFailed && statusOrder[status] <= statusOrder[msg.Status]:
+		// Failed messages may still turn out to have been delivered
+		return nil, nil
+	}
+
+	msg.Status = status
+	if err := pcm.storeMessage(msg); err != nil {
+		return nil, err
+	}
+	if status == MessageRead && !isSent {
+		pcm.inbox.privateMessageRead(peerID.String())
+	}
+	pcm.notifyStatus(peerID.String(), msg)
+	return msg, nil
+}
+
+func (pcm *PrivateChatManager) notifyStatus(peerID string, msg *PrivateMessage) {
+	if pcm.notifier != nil {
+		pcm.notifier.NotifyEvent("message_status", map[string]interface{}{
+			"peer_id":    peerID,
+			"message_id": msg.ID,
+			"status":     msg.Status,
+		})
+	}
+}
@@ -0,0 +1,463 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"html"
+	"log"
+	"p2p-chat/internal/db"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// searchIndexKey marks that the search index covers the whole chat history.
+const searchIndexKey = "meta/search_index"
+
+// Tokens are words of letters and digits, lowercased. Shorter words are not
+// indexed, longer ones only up to maxTokenLength.
+const (
+	minTokenLength = 2
+	maxTokenLength = 32
+)
+
+// Snippets show snippetLength characters of a message, starting up to
+// snippetContext characters before the first match.
+const (
+	snippetLength  = 160
+	snippetContext = 40
+)
+
+// Numbers of search results.
+const (
+	DefaultSearchLimit = 50
+	MaxSearchLimit     = 500
+)
+
+// reindexBatchSize is the number of messages indexed per write when the
+// index is rebuilt.
+const reindexBatchSize = 500
+
+// ErrInvalidQuery is returned for search queries without any word to look for.
+var ErrInvalidQuery = errors.New("query has no words to search for")
+
+// SearchQuery selects messages containing every word of Query, or a word
+// starting with it. PeerID or GroupID restrict the search to a conversation,
+// and After and Before to messages sent at or after After and before Before,
+// in Unix time.
+type SearchQuery struct {
+	Query   string
+	PeerID  string
+	GroupID string
+	After   int64
+	Before  int64
+	// Limit is the maximum number of results, DefaultSearchLimit if 0.
+	Limit int
+}
+
+// SearchResult is a message found by a search. Snippet is the part of the
+// message around the first match as HTML: matches are wrapped in <mark>, and
+// the rest is escaped.
+type SearchResult struct {
+	PeerID    string `json:"peer_id,omitempty"`
+	GroupID   string `json:"group_id,omitempty"`
+	MessageID string `json:"message_id"`
+	SenderID  string `json:"sender_id"`
+	Timestamp int64  `json:"timestamp"`
+	HLC       string `json:"hlc"`
+	Snippet   string `json:"snippet"`
+}
+
+// searchIndex is an inverted index of the chat history. For every word of a
+// message stored under chat/<kind>/<conversation>/<hlc>-<id>, there is an
+// empty entry under search/<word>/<kind>/<conversation>/<hlc>-<id>, and the
+// words of the message are listed under searchdocs/<message key>, so they can
+// be removed when it changes.
+type searchIndex struct {
+	db *db.LevelDBStore
+}
+
+// update indexes the content of the message stored under key in batch,
+// replacing the words it was indexed with before.
+func (si *searchIndex) update(batch *leveldb.Batch, key, content string) error {
+	old, err := si.words(key)
+	if err != nil {
+		return err
+	}
+	words := tokenize(content)
+	if strings.Join(old, " ") == strings.Join(words, " ") {
+		return nil
+	}
+
+	current := make(map[string]bool)
+	for _, word := range words {
+		current[word] = true
+	}
+	for _, word := range old {
+		if !current[word] {
+			batch.Delete(postingKey(word, key))
+		}
+	}
+	putWords(batch, key, words)
+	return nil
+}
+
+// remove drops the message stored under key from the index in batch.
+func (si *searchIndex) remove(batch *leveldb.Batch, key string) error {
+	words, err := si.words(key)
+	if err != nil {
+		return err
+	}
+	for _, word := range words {
+		batch.Delete(postingKey(word, key))
+	}
+	batch.Delete(searchDocKey(key))
+	return nil
+}
+
+// words returns the words the message stored under key is indexed with.
+func (si *searchIndex) words(key string) ([]string, error) {
+	docKey := searchDocKey(key)
+	exists, err := si.db.Has(docKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check search index: %w", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	data, err := si.db.Get(docKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get search index: %w", err)
+	}
+	var words []string
+	if err := json.Unmarshal(data, &words); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal search index: %w", err)
+	}
+	return words, nil
+}
+
+// putWords adds the entries of a message stored under key, which has the
+// given words, to batch.
+func putWords(batch *leveldb.Batch, key string, words []string) {
+	if len(words) == 0 {
+		batch.Delete(searchDocKey(key))
+		return
+	}
+	for _, word := range words {
+		batch.Put(postingKey(word, key), nil)
+	}
+	data, _ := json.Marshal(words)
+	batch.Put(searchDocKey(key), data)
+}
+
+func postingKey(word, key string) []byte {
+	return []byte("search/" + word + "/" + strings.TrimPrefix(key, "chat/"))
+}
+
+func searchDocKey(key string) []byte {
+	return []byte("searchdocs/" + key)
+}
+
+// SearchMessages returns the private and group messages in store that match
+// q, newest first, and the number of messages that match in total.
+func SearchMessages(store *db.LevelDBStore, q SearchQuery) ([]*SearchResult, int, error) {
+	terms := tokenize(q.Query)
+	if len(terms) == 0 {
+		return nil, 0, ErrInvalidQuery
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+
+	conversation := ""
+	if q.PeerID != "" {
+		conversation = "private/" + q.PeerID + "/"
+	} else if q.GroupID != "" {
+		conversation = "group/" + q.GroupID + "/"
+	}
+	var after, before string
+	if q.After > 0 {
+		after = HLC{Wall: q.After * int64(time.Second)}.String()
+	}
+	if q.Before > 0 {
+		before = HLC{Wall: q.Before * int64(time.Second)}.String()
+	}
+
+	// Messages are named by their key below chat/; each term narrows down
+	// the messages matching the terms before it
+	var matches map[string]bool
+	for _, term := range terms {
+		found := make(map[string]bool)
+		iter := store.NewIteratorWithPrefix([]byte("search/" + term))
+		for iter.Next() {
+			_, name, _ := strings.Cut(strings.TrimPrefix(string(iter.Key()), "search/"), "/")
+			if matches != nil && !matches[name] {
+				continue
+			}
+			if !strings.HasPrefix(name, conversation) {
+				continue
+			}
+			hlc := name[strings.LastIndex(name, "/")+1:]
+			if (after != "" && hlc < after) || (before != "" && hlc >= before) {
+				continue
+			}
+			found[name] = true
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, 0, fmt.Errorf("failed to search messages: %w", err)
+		}
+		matches = found
+	}
+
+	names := make([]string, 0, len(matches))
+	for name := range matches {
+		names = append(names, name)
+	}
+	// The HLC at the start of the last part of the name orders messages
+	sort.Slice(names, func(i, j int) bool {
+		return names[i][strings.LastIndex(names[i], "/")+1:] > names[j][strings.LastIndex(names[j], "/")+1:]
+	})
+
+	results := []*SearchResult{}
+	for _, name := range names {
+		if len(results) == limit {
+			break
+		}
+		data, err := store.Get([]byte("chat/" + name))
+		if err != nil {
+			// Purged since the search began
+			continue
+		}
+		var msg inboxMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("Failed to unmarshal message: %v", err)
+			continue
+		}
+		result := &SearchResult{
+			MessageID: msg.ID,
+			SenderID:  msg.SenderID,
+			Timestamp: msg.Timestamp,
+			HLC:       msg.HLC,
+			Snippet:   snippet(msg.Content, terms),
+		}
+		kind, rest, _ := strings.Cut(name, "/")
+		id, _, _ := strings.Cut(rest, "/")
+		if kind == "group" {
+			result.GroupID = id
+		} else {
+			result.PeerID = id
+		}
+		results = append(results, result)
+	}
+	return results, len(matches), nil
+}
+
+// BuildSearchIndex indexes the chat history in store, unless it is indexed
+// already.
+func BuildSearchIndex(store *db.LevelDBStore) error {
+	built, err := store.Has([]byte(searchIndexKey))
+	if err != nil {
+		return fmt.Errorf("failed to check search index: %w", err)
+	}
+	if built {
+		return nil
+	}
+	indexed, err := RebuildSearchIndex(store)
+	if err != nil {
+		return err
+	}
+	if indexed > 0 {
+		log.Printf("Indexed %d messages for search\n", indexed)
+	}
+	return nil
+}
+
+// RebuildSearchIndex drops the search index and indexes the chat history in
+// store again. It returns the number of messages indexed. The history must be
+// in the current key layout, which the node migrates it to on startup.
+func RebuildSearchIndex(store *db.LevelDBStore) (int, error) {
+	if err := checkMessageLayout(store); err != nil {
+		return 0, err
+	}
+	for _, prefix := range []string{"search/", "searchdocs/"} {
+		if err := deletePrefix(store, prefix); err != nil {
+			return 0, err
+		}
+	}
+
+	iter := store.NewIteratorWithPrefix([]byte("chat/"))
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	indexed := 0
+	for iter.Next() {
+		var msg inboxMessage
+		if err := json.Unmarshal(iter.Value(), &msg); err != nil {
+			log.Printf("Failed to unmarshal message %s: %v\n", iter.Key(), err)
+			continue
+		}
+		putWords(batch, string(iter.Key()), tokenize(msg.Content))
+		indexed++
+		if indexed%reindexBatchSize == 0 {
+			if err := store.WriteBatch(batch); err != nil {
+				return 0, fmt.Errorf("failed to write search index: %w", err)
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return 0, fmt.Errorf("failed to read chat history: %w", err)
+	}
+	batch.Put([]byte(searchIndexKey), []byte("1"))
+	if err := store.WriteBatch(batch); err != nil {
+		return 0, fmt.Errorf("failed to write search index: %w", err)
+	}
+	return indexed, nil
+}
+
+// checkMessageLayout fails if store has chat history in an earlier layout.
+func checkMessageLayout(store *db.LevelDBStore) error {
+	exists, err := store.Has([]byte(messageLayoutKey))
+	if err != nil {
+		return fmt.Errorf("failed to check message layout: %w", err)
+	}
+	if exists {
+		version, err := store.Get([]byte(messageLayoutKey))
+		if err != nil {
+			return fmt.Errorf("failed to get message layout: %w", err)
+		}
+		if string(version) == messageLayoutVersion {
+			return nil
+		}
+	}
+	iter := store.NewIteratorWithPrefix([]byte("chat/"))
+	defer iter.Release()
+	if iter.Next() {
+		return errors.New("chat history has not been migrated yet; start the node once first")
+	}
+	return iter.Error()
+}
+
+// deletePrefix deletes every key under prefix.
+func deletePrefix(store *db.LevelDBStore, prefix string) error {
+	iter := store.NewIteratorWithPrefix([]byte(prefix))
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := store.WriteBatch(batch); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", prefix, err)
+	}
+	return nil
+}
+
+// token is a word in a text, with the positions of its first and past its
+// last character.
+type token struct {
+	word       string
+	start, end int
+}
+
+// tokens splits text into words of letters and digits.
+func tokens(text []rune) []token {
+	var found []token
+	start := -1
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) && (unicode.IsLetter(text[i]) || unicode.IsDigit(text[i])) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			word := text[start:i]
+			if len(word) > maxTokenLength {
+				word = word[:maxTokenLength]
+			}
+			found = append(found, token{word: strings.ToLower(string(word)), start: start, end: i})
+			start = -1
+		}
+	}
+	return found
+}
+
+// tokenize returns the distinct words of text that are indexed, sorted.
+func tokenize(text string) []string {
+	seen := make(map[string]bool)
+	words := []string{}
+	for _, t := range tokens([]rune(text)) {
+		if len([]rune(t.word)) >= minTokenLength && !seen[t.word] {
+			seen[t.word] = true
+			words = append(words, t.word)
+		}
+	}
+	sort.Strings(words)
+	return words
+}
+
+// snippet returns the part of content around the first word that starts
+// with one of terms, as HTML with every such word in it wrapped in <mark>.
+func snippet(content string, terms []string) string {
+	text := []rune(content)
+	words := tokens(text)
+	var matches []token
+	for _, t := range words {
+		for _, term := range terms {
+			if strings.HasPrefix(t.word, term) {
+				matches = append(matches, t)
+				break
+			}
+		}
+	}
+
+	// Start at the first whole word in the context of the first match
+	start := 0
+	if len(matches) > 0 && matches[0].start > snippetContext {
+		start = matches[0].start
+		for _, t := range words {
+			if t.start >= matches[0].start-snippetContext {
+				start = t.start
+				break
+			}
+		}
+	}
+	end := start + snippetLength
+	if end > len(text) {
+		end = len(text)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m.start >= end {
+			break
+		}
+		if m.end > end {
+			m.end = end
+		}
+		b.WriteString(html.EscapeString(string(text[pos:m.start])))
+		b.WriteString("<mark>" + html.EscapeString(string(text[m.start:m.end])) + "</mark>")
+		pos = m.end
+	}
+	b.WriteString(html.EscapeString(string(text[pos:end])))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
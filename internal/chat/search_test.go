@@ -0,0 +1,194 @@
+package chat
+
+import (
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"p2p-chat/internal/db"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	long := strings.Repeat("x", maxTokenLength+5)
+	got := tokenize("Hello, hello WORLD! a 42 naïve_café " + long)
+	want := []string{"42", "café", "hello", "naïve", "world", long[:maxTokenLength]}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("tokenize = %q, want %q", got, want)
+	}
+	if got := tokenize("a . !"); len(got) != 0 {
+		t.Fatalf("tokenize = %q, want no words", got)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	tests := []struct {
+		content string
+		terms   []string
+		want    string
+	}{
+		{"Hello <b>world</b>", []string{"wor"}, "Hello &lt;b&gt;<mark>world</mark>&lt;/b&gt;"},
+		{"Hello hello", []string{"hello"}, "<mark>Hello</mark> <mark>hello</mark>"},
+		{"no match here", []string{"xyz"}, "no match here"},
+	}
+	for _, tt := range tests {
+		if got := snippet(tt.content, tt.terms); got != tt.want {
+			t.Errorf("snippet(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+
+	// Long messages are cut around the first match, at a word
+	before := strings.Repeat("word ", 30)
+	after := strings.Repeat(" tail", 60)
+	got := snippet(before+"needle"+after, []string{"needle"})
+	if !strings.HasPrefix(got, "…word ") || !strings.HasSuffix(got, "…") || !strings.Contains(got, "<mark>needle</mark>") {
+		t.Fatalf("snippet is %q", got)
+	}
+	if i := strings.Index(got, "<mark>"); len([]rune(got[:i])) > snippetContext+1 {
+		t.Fatalf("snippet starts %d characters before the match", len([]rune(got[:i])))
+	}
+}
+
+// indexMessages stores private messages from peerID, one a second from
+// start, and indexes them.
+func indexMessages(t *testing.T, store *db.LevelDBStore, peerID string, start time.Time, contents ...string) []string {
+	t.Helper()
+	_, self := newTestIdentity(t)
+	si := &searchIndex{db: store}
+	var keys []string
+	for i, content := range contents {
+		sent := start.Add(time.Duration(i) * time.Second)
+		msg := &PrivateMessage{ID: fmt.Sprintf("%s-%d", peerID[len(peerID)-4:], i), SenderID: peerID, Content: content, Timestamp: sent.Unix(), HLC: HLC{Wall: sent.UnixNano()}.String()}
+		batch := new(leveldb.Batch)
+		if err := putPrivateMessage(batch, self, msg); err != nil {
+			t.Fatal(err)
+		}
+		key := privateMessageKey(peerID, msg.HLC, msg.ID)
+		if err := si.update(batch, key, content); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.WriteBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func searchIDs(t *testing.T, store *db.LevelDBStore, q SearchQuery) ([]string, int) {
+	t.Helper()
+	results, total, err := SearchMessages(store, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, r := range results {
+		ids = append(ids, r.MessageID)
+	}
+	return ids, total
+}
+
+func TestSearchMessages(t *testing.T) {
+	store := newTestStore(t)
+	_, alice := newTestIdentity(t)
+	_, bob := newTestIdentity(t)
+	a, b := alice.String(), bob.String()
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	keys := indexMessages(t, store, a, start, "lunch at noon", "Lunch tomorrow?", "dinner")
+	indexMessages(t, store, b, start.Add(10*time.Second), "lunch with bob")
+	ai, bi := a[len(a)-4:], b[len(b)-4:]
+
+	tests := []struct {
+		name  string
+		q     SearchQuery
+		want  []string
+		total int
+	}{
+		{"newest first", SearchQuery{Query: "LUNCH"}, []string{bi + "-0", ai + "-1", ai + "-0"}, 3},
+		{"prefix", SearchQuery{Query: "din"}, []string{ai + "-2"}, 1},
+		{"every word", SearchQuery{Query: "lunch noon"}, []string{ai + "-0"}, 1},
+		{"in a chat", SearchQuery{Query: "lunch", PeerID: a}, []string{ai + "-1", ai + "-0"}, 2},
+		{"after", SearchQuery{Query: "lunch", After: start.Unix() + 1}, []string{bi + "-0", ai + "-1"}, 2},
+		{"before", SearchQuery{Query: "lunch", Before: start.Unix() + 1}, []string{ai + "-0"}, 1},
+		{"limited", SearchQuery{Query: "lunch", Limit: 1}, []string{bi + "-0"}, 3},
+		{"no match", SearchQuery{Query: "breakfast"}, nil, 0},
+	}
+	for _, tt := range tests {
+		ids, total := searchIDs(t, store, tt.q)
+		if !reflect.DeepEqual(ids, tt.want) || total != tt.total {
+			t.Errorf("%s: found %v of %d, want %v of %d", tt.name, ids, total, tt.want, tt.total)
+		}
+	}
+	if _, _, err := SearchMessages(store, SearchQuery{Query: "a !"}); err != ErrInvalidQuery {
+		t.Fatalf("query without words gave %v", err)
+	}
+
+	// Edits replace the words of a message, and removal drops them
+	si := &searchIndex{db: store}
+	batch := new(leveldb.Batch)
+	if err := si.update(batch, keys[0], "brunch at noon"); err != nil {
+		t.Fatal(err)
+	}
+	if err := si.remove(batch, keys[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := searchIDs(t, store, SearchQuery{Query: "lunch", PeerID: a}); !reflect.DeepEqual(ids, []string{ai + "-1"}) {
+		t.Fatalf("after the edit, lunch finds %v", ids)
+	}
+	if ids, _ := searchIDs(t, store, SearchQuery{Query: "brunch"}); !reflect.DeepEqual(ids, []string{ai + "-0"}) {
+		t.Fatalf("after the edit, brunch finds %v", ids)
+	}
+	if ids, _ := searchIDs(t, store, SearchQuery{Query: "dinner"}); len(ids) != 0 {
+		t.Fatalf("removed message still found: %v", ids)
+	}
+}
+
+func TestRebuildSearchIndex(t *testing.T) {
+	store := newTestStore(t)
+	_, alice := newTestIdentity(t)
+	indexMessages(t, store, alice.String(), time.Now(), "hello there", "general kenobi")
+
+	// Chat history in an earlier layout must be migrated first
+	if _, err := RebuildSearchIndex(store); err == nil {
+		t.Fatal("index rebuilt over an unmigrated history")
+	}
+	if err := store.Put([]byte(messageLayoutKey), []byte(messageLayoutVersion)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale entry, and a message that is not indexed
+	if err := store.Put(postingKey("stale", "chat/private/gone/x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := deletePrefix(store, "search/general"); err != nil {
+		t.Fatal(err)
+	}
+
+	indexed, err := RebuildSearchIndex(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 2 {
+		t.Fatalf("indexed %d messages, want 2", indexed)
+	}
+	if ids, _ := searchIDs(t, store, SearchQuery{Query: "general"}); len(ids) != 1 {
+		t.Fatalf("message missing from the rebuilt index: %v", ids)
+	}
+	if found, _ := store.Has(postingKey("stale", "chat/private/gone/x")); found {
+		t.Fatal("stale entry kept")
+	}
+	// Building does nothing once the index is built
+	if err := store.Put(postingKey("stale", "chat/private/gone/x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := BuildSearchIndex(store); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := store.Has(postingKey("stale", "chat/private/gone/x")); !found {
+		t.Fatal("built index rebuilt")
+	}
+}
@@ -0,0 +1,466 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"log"
+	cryptoLocal "p2p-chat/internal/crypto"
+	"p2p-chat/internal/db"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSkip is the largest gap in a single chain we derive keys across.
+	maxSkip = 1000
+	// maxStoredSkippedKeys bounds how many skipped-message keys a session keeps.
+	maxStoredSkippedKeys = 2000
+)
+
+// ErrNoSession is returned when a message cannot be decrypted with the
+// session we hold for its sender, for example because one side lost its state.
+var ErrNoSession = errors.New("no usable session for message")
+
+// ratchetHeader is sent in the clear alongside every ratchet message and is
+// authenticated as additional data.
+type ratchetHeader struct {
+	DH   []byte `json:"dh"`
+	PN   uint32 `json:"pn"`
+	N    uint32 `json:"n"`
+	Init []byte `json:"init,omitempty"`
+}
+
+// ratchetMessage is the wire format of a message encrypted by a session.
+type ratchetMessage struct {
+	Header     []byte `json:"header"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type skippedKey struct {
+	DH  []byte `json:"dh"`
+	N   uint32 `json:"n"`
+	Key []byte `json:"key"`
+}
+
+// sessionState is the persisted Double Ratchet state for one peer.
+type sessionState struct {
+	RootKey    []byte `json:"root_key"`
+	SendingKey []byte `json:"sending_key"`
+	RemoteKey  []byte `json:"remote_key,omitempty"`
+	SendChain  []byte `json:"send_chain,omitempty"`
+	RecvChain  []byte `json:"recv_chain,omitempty"`
+	SendN      uint32 `json:"send_n"`
+	RecvN      uint32 `json:"recv_n"`
+	PrevN      uint32 `json:"prev_n"`
+
+	Skipped []skippedKey `json:"skipped,omitempty"`
+
+	// BaseKey is the ephemeral key we started this session with. It is sent
+	// with every message until the peer replies, so the peer can set up its
+	// side of the session.
+	BaseKey []byte `json:"base_key,omitempty"`
+	// PeerBaseKey is the ephemeral key the peer started this session with.
+	PeerBaseKey []byte `json:"peer_base_key,omitempty"`
+
+	CreatedAt int64 `json:"created_at"`
+}
+
+// SessionManager maintains forward-secret Double Ratchet sessions with peers.
+// Sessions are bootstrapped from the long-term encryption keys of both sides
+// and then ratchet with fresh ephemeral keys on every round trip.
+type SessionManager struct {
+	db       *db.LevelDBStore
+	keys     *KeyManager
+	localID  peer.ID
+	sessions map[peer.ID]*sessionState
+	mutex    sync.Mutex
+}
+
+// NewSessionManager creates a new SessionManager.
+func NewSessionManager(store *db.LevelDBStore, keys *KeyManager, localID peer.ID) *SessionManager {
+	return &SessionManager{
+		db:       store,
+		keys:     keys,
+		localID:  localID,
+		sessions: make(map[peer.ID]*sessionState),
+	}
+}
+
+// Encrypt encrypts plaintext for peerID, starting a new session if needed.
+func (sm *SessionManager) Encrypt(ctx context.Context, peerID peer.ID, plaintext []byte) ([]byte, error) {
+	sm.mutex.Lock()
+	state, err := sm.loadSession(peerID)
+	sm.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch the peer's long-term key outside the lock if we need to start a session
+	var remote *ecdsa.PublicKey
+	if state == nil || state.SendChain == nil {
+		if remote, err = sm.keys.PeerPublicKey(ctx, peerID); err != nil {
+			return nil, fmt.Errorf("failed to get peer public key: %w", err)
+		}
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if state, err = sm.loadSession(peerID); err != nil {
+		return nil, err
+	}
+	if state == nil || state.SendChain == nil {
+		if remote == nil {
+			return nil, ErrNoSession
+		}
+		if state, err = sm.initiate(remote); err != nil {
+			return nil, err
+		}
+		log.Printf("Started new session with %s\n", peerID.String())
+	} else {
+		state = state.clone()
+	}
+
+	msg, err := state.encrypt(plaintext, messageAD(sm.localID, peerID))
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.saveSession(peerID, state); err != nil {
+		return nil, err
+	}
+	return json.Marshal(msg)
+}
+
+// Decrypt decrypts a message from peerID. If the message starts a new
+// session, it replaces whatever session we held for the peer.
+func (sm *SessionManager) Decrypt(ctx context.Context, peerID peer.ID, data []byte) ([]byte, error) {
+	var msg ratchetMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("failed to parse ratchet message: %w", err)
+	}
+	var header ratchetHeader
+	if err := json.Unmarshal(msg.Header, &header); err != nil {
+		return nil, fmt.Errorf("failed to parse ratchet header: %w", err)
+	}
+
+	// The peer's identity key is only needed to accept a new session
+	var peerIdentity *ecdsa.PublicKey
+	if header.Init != nil {
+		var err error
+		if peerIdentity, err = sm.keys.PeerPublicKey(ctx, peerID); err != nil {
+			return nil, fmt.Errorf("failed to get peer public key: %w", err)
+		}
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	state, err := sm.loadSession(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Init != nil && (state == nil || !bytes.Equal(state.PeerBaseKey, header.Init)) {
+		state, err = sm.respond(peerIdentity, header.Init)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Accepted new session from %s\n", peerID.String())
+	} else if state == nil {
+		return nil, ErrNoSession
+	} else {
+		state = state.clone()
+	}
+
+	plaintext, err := state.decrypt(&msg, &header, messageAD(peerID, sm.localID))
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.saveSession(peerID, state); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// ResetSession discards the session held for peerID. The next message to the
+// peer starts a fresh one.
+func (sm *SessionManager) ResetSession(peerID peer.ID) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	delete(sm.sessions, peerID)
+	return sm.db.Delete(sessionKey(peerID))
+}
+
+// initiate creates the initiator side of a new session with a peer whose
+// long-term key is remote.
+func (sm *SessionManager) initiate(remote *ecdsa.PublicKey) (*sessionState, error) {
+	remoteECDH, err := remote.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer public key: %w", err)
+	}
+	baseKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ratchet key: %w", err)
+	}
+
+	rootKey, err := sessionSecret(sm.keys.PrivateKey(), remote, baseKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	dhOut, err := baseKey.ECDH(remoteECDH)
+	if err != nil {
+		return nil, fmt.Errorf("ECDH failed: %w", err)
+	}
+	rootKey, sendChain, err := kdfRoot(rootKey, dhOut)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionState{
+		RootKey:    rootKey,
+		SendingKey: baseKey.Bytes(),
+		RemoteKey:  remoteECDH.Bytes(),
+		SendChain:  sendChain,
+		BaseKey:    baseKey.PublicKey().Bytes(),
+		CreatedAt:  time.Now().Unix(),
+	}, nil
+}
+
+// respond creates the responder side of a session started by a peer whose
+// long-term key is remote, using the base key from its first message.
+func (sm *SessionManager) respond(remote *ecdsa.PublicKey, peerBaseKey []byte) (*sessionState, error) {
+	identity, err := sm.keys.PrivateKey().ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity key: %w", err)
+	}
+	rootKey, err := sessionSecret(sm.keys.PrivateKey(), remote, peerBaseKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionState{
+		RootKey:     rootKey,
+		SendingKey:  identity.Bytes(),
+		PeerBaseKey: peerBaseKey,
+		CreatedAt:   time.Now().Unix(),
+	}, nil
+}
+
+func (sm *SessionManager) loadSession(peerID peer.ID) (*sessionState, error) {
+	if state, ok := sm.sessions[peerID]; ok {
+		return state, nil
+	}
+
+	exists, err := sm.db.Has(sessionKey(peerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	data, err := sm.db.Get(sessionKey(peerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+	var state sessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Discarding corrupt session for %s: %v\n", peerID.String(), err)
+		return nil, nil
+	}
+	sm.sessions[peerID] = &state
+	return &state, nil
+}
+
+func (sm *SessionManager) saveSession(peerID peer.ID, state *sessionState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+	if err := sm.db.Put(sessionKey(peerID), data); err != nil {
+		return fmt.Errorf("failed to store session: %w", err)
+	}
+	sm.sessions[peerID] = state
+	return nil
+}
+
+func (s *sessionState) clone() *sessionState {
+	data, _ := json.Marshal(s)
+	var c sessionState
+	json.Unmarshal(data, &c)
+	return &c
+}
+
+func (s *sessionState) encrypt(plaintext, ad []byte) (*ratchetMessage, error) {
+	if s.SendChain == nil {
+		return nil, ErrNoSession
+	}
+	sendingKey, err := ecdh.P256().NewPrivateKey(s.SendingKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ratchet key: %w", err)
+	}
+
+	header, err := json.Marshal(&ratchetHeader{
+		DH:   sendingKey.PublicKey().Bytes(),
+		PN:   s.PrevN,
+		N:    s.SendN,
+		Init: s.BaseKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ratchet header: %w", err)
+	}
+
+	var messageKey []byte
+	s.SendChain, messageKey = kdfChain(s.SendChain)
+	s.SendN++
+
+	ciphertext, err := cryptoLocal.Encrypt(messageKey, plaintext, append(ad, header...))
+	if err != nil {
+		return nil, err
+	}
+	return &ratchetMessage{Header: header, Ciphertext: ciphertext}, nil
+}
+
+func (s *sessionState) decrypt(msg *ratchetMessage, header *ratchetHeader, ad []byte) ([]byte, error) {
+	ad = append(ad, msg.Header...)
+
+	if messageKey := s.takeSkippedKey(header.DH, header.N); messageKey != nil {
+		return s.open(messageKey, msg.Ciphertext, ad)
+	}
+
+	if !bytes.Equal(header.DH, s.RemoteKey) {
+		if err := s.skipMessageKeys(header.PN); err != nil {
+			return nil, err
+		}
+		if err := s.dhRatchet(header.DH); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.skipMessageKeys(header.N); err != nil {
+		return nil, err
+	}
+
+	var messageKey []byte
+	s.RecvChain, messageKey = kdfChain(s.RecvChain)
+	s.RecvN++
+	return s.open(messageKey, msg.Ciphertext, ad)
+}
+
+func (s *sessionState) open(messageKey, ciphertext, ad []byte) ([]byte, error) {
+	plaintext, err := cryptoLocal.Decrypt(messageKey, ciphertext, ad)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	// Any message the peer sent within this session confirms it has our base key
+	s.BaseKey = nil
+	return plaintext, nil
+}
+
+// dhRatchet advances the root chain with the peer's new ratchet key.
+func (s *sessionState) dhRatchet(remoteKey []byte) error {
+	remote, err := ecdh.P256().NewPublicKey(remoteKey)
+	if err != nil {
+		return fmt.Errorf("invalid ratchet key in header: %w", err)
+	}
+	sendingKey, err := ecdh.P256().NewPrivateKey(s.SendingKey)
+	if err != nil {
+		return fmt.Errorf("invalid ratchet key: %w", err)
+	}
+
+	s.PrevN = s.SendN
+	s.SendN = 0
+	s.RecvN = 0
+	s.RemoteKey = remoteKey
+
+	dhOut, err := sendingKey.ECDH(remote)
+	if err != nil {
+		return fmt.Errorf("ECDH failed: %w", err)
+	}
+	if s.RootKey, s.RecvChain, err = kdfRoot(s.RootKey, dhOut); err != nil {
+		return err
+	}
+
+	newKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate ratchet key: %w", err)
+	}
+	s.SendingKey = newKey.Bytes()
+	if dhOut, err = newKey.ECDH(remote); err != nil {
+		return fmt.Errorf("ECDH failed: %w", err)
+	}
+	s.RootKey, s.SendChain, err = kdfRoot(s.RootKey, dhOut)
+	return err
+}
+
+// skipMessageKeys stores the keys of messages in the current receiving chain
+// up to (but not including) message number until, so they can be decrypted
+// if they arrive later.
+func (s *sessionState) skipMessageKeys(until uint32) error {
+	if s.RecvChain == nil {
+		return nil
+	}
+	if until > s.RecvN+maxSkip {
+		return fmt.Errorf("too many skipped messages")
+	}
+	for s.RecvN < until {
+		var messageKey []byte
+		s.RecvChain, messageKey = kdfChain(s.RecvChain)
+		s.Skipped = append(s.Skipped, skippedKey{DH: s.RemoteKey, N: s.RecvN, Key: messageKey})
+		s.RecvN++
+	}
+	if len(s.Skipped) > maxStoredSkippedKeys {
+		s.Skipped = s.Skipped[len(s.Skipped)-maxStoredSkippedKeys:]
+	}
+	return nil
+}
+
+func (s *sessionState) takeSkippedKey(dh []byte, n uint32) []byte {
+	for i, sk := range s.Skipped {
+		if sk.N == n && bytes.Equal(sk.DH, dh) {
+			s.Skipped = append(s.Skipped[:i], s.Skipped[i+1:]...)
+			return sk.Key
+		}
+	}
+	return nil
+}
+
+// sessionSecret derives the initial root key from both long-term keys and
+// the initiator's base key.
+func sessionSecret(identity *ecdsa.PrivateKey, remote *ecdsa.PublicKey, baseKey []byte) ([]byte, error) {
+	info := []byte("p2p-chat ratchet v1:" + hex.EncodeToString(baseKey))
+	return cryptoLocal.DeriveSharedKey(identity, remote, info)
+}
+
+// kdfRoot mixes a DH output into the root key, returning the new root key and a chain key.
+func kdfRoot(rootKey, dhOut []byte) ([]byte, []byte, error) {
+	out, err := cryptoLocal.DeriveKey(dhOut, rootKey, []byte("p2p-chat ratchet root"), 2*cryptoLocal.SharedKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:cryptoLocal.SharedKeySize], out[cryptoLocal.SharedKeySize:], nil
+}
+
+// kdfChain advances a chain key, returning the next chain key and a message key.
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	next := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	return next, mac.Sum(nil)
+}
+
+func sessionKey(peerID peer.ID) []byte {
+	return []byte(fmt.Sprintf("session/%s", peerID.String()))
+}
@@ -0,0 +1,223 @@
+package chat
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	cryptoLocal "p2p-chat/internal/crypto"
+	"p2p-chat/internal/db"
+	"testing"
+)
+
+// newTestStore opens a LevelDB store in a temporary directory.
+func newTestStore(t *testing.T) *db.LevelDBStore {
+	t.Helper()
+	store, err := db.NewLevelDBStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// newTestIdentity returns a libp2p identity and its peer ID.
+func newTestIdentity(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatalf("failed to generate identity: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("failed to derive peer ID: %v", err)
+	}
+	return priv, id
+}
+
+// sessionPeer is one side of a session in tests.
+type sessionPeer struct {
+	id       peer.ID
+	keys     *KeyManager
+	sessions *SessionManager
+}
+
+// newSessionPair returns two peers that know each other's encryption keys,
+// so sessions between them start without the key exchange protocol.
+func newSessionPair(t *testing.T) (*sessionPeer, *sessionPeer) {
+	t.Helper()
+	newPeer := func() *sessionPeer {
+		_, id := newTestIdentity(t)
+		priv, err := cryptoLocal.GenerateKeyPair()
+		if err != nil {
+			t.Fatalf("failed to generate encryption key: %v", err)
+		}
+		store := newTestStore(t)
+		keys := &KeyManager{db: store, privKey: priv, keys: make(map[peer.ID]*ecdsa.PublicKey)}
+		return &sessionPeer{id: id, keys: keys, sessions: NewSessionManager(store, keys, id)}
+	}
+	a, b := newPeer(), newPeer()
+	a.keys.keys[b.id] = &b.keys.privKey.PublicKey
+	b.keys.keys[a.id] = &a.keys.privKey.PublicKey
+	return a, b
+}
+
+func (p *sessionPeer) encrypt(t *testing.T, to *sessionPeer, plaintext string) []byte {
+	t.Helper()
+	data, err := p.sessions.Encrypt(context.Background(), to.id, []byte(plaintext))
+	if err != nil {
+		t.Fatalf("failed to encrypt %q: %v", plaintext, err)
+	}
+	return data
+}
+
+func (p *sessionPeer) decrypt(t *testing.T, from *sessionPeer, data []byte, want string) {
+	t.Helper()
+	plaintext, err := p.sessions.Decrypt(context.Background(), from.id, data)
+	if err != nil {
+		t.Fatalf("failed to decrypt %q: %v", want, err)
+	}
+	if string(plaintext) != want {
+		t.Fatalf("decrypted %q, want %q", plaintext, want)
+	}
+}
+
+func TestSessionOutOfOrder(t *testing.T) {
+	alice, bob := newSessionPair(t)
+
+	var sent [][]byte
+	for i := 0; i < 4; i++ {
+		sent = append(sent, alice.encrypt(t, bob, fmt.Sprintf("message %d", i)))
+	}
+	for _, i := range []int{2, 0, 3, 1} {
+		bob.decrypt(t, alice, sent[i], fmt.Sprintf("message %d", i))
+	}
+	if n := len(bob.sessions.sessions[alice.id].Skipped); n != 0 {
+		t.Fatalf("%d skipped keys left after all messages arrived", n)
+	}
+
+	// A replayed message no longer has a key
+	if _, err := bob.sessions.Decrypt(context.Background(), alice.id, sent[0]); !errors.Is(err, ErrNoSession) {
+		t.Fatalf("replayed message: got %v, want ErrNoSession", err)
+	}
+
+	// Replies ratchet both sides forward, and later messages need no base key
+	reply := bob.encrypt(t, alice, "reply")
+	alice.decrypt(t, bob, reply, "reply")
+	next := alice.encrypt(t, bob, "after reply")
+	var msg ratchetMessage
+	var header ratchetHeader
+	if err := json.Unmarshal(next, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(msg.Header, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Init != nil {
+		t.Fatal("base key still sent after the peer replied")
+	}
+	bob.decrypt(t, alice, next, "after reply")
+}
+
+func TestSessionSkipLimit(t *testing.T) {
+	alice, bob := newSessionPair(t)
+
+	var sent [][]byte
+	for i := 0; i <= maxSkip+1; i++ {
+		sent = append(sent, alice.encrypt(t, bob, fmt.Sprintf("message %d", i)))
+	}
+
+	if _, err := bob.sessions.Decrypt(context.Background(), alice.id, sent[maxSkip+1]); err == nil {
+		t.Fatal("decrypted a message beyond the skip limit")
+	}
+	if _, ok := bob.sessions.sessions[alice.id]; ok {
+		t.Fatal("session stored after a failed decryption")
+	}
+
+	bob.decrypt(t, alice, sent[maxSkip], fmt.Sprintf("message %d", maxSkip))
+	if n := len(bob.sessions.sessions[alice.id].Skipped); n != maxSkip {
+		t.Fatalf("%d skipped keys stored, want %d", n, maxSkip)
+	}
+	bob.decrypt(t, alice, sent[0], "message 0")
+	bob.decrypt(t, alice, sent[maxSkip+1], fmt.Sprintf("message %d", maxSkip+1))
+}
+
+func TestSessionSkippedKeysBounded(t *testing.T) {
+	s := &sessionState{RecvChain: make([]byte, cryptoLocal.SharedKeySize), RemoteKey: []byte("remote")}
+	for until := uint32(maxSkip); until <= 3*maxSkip; until += maxSkip {
+		if err := s.skipMessageKeys(until); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.Skipped) != maxStoredSkippedKeys {
+		t.Fatalf("%d skipped keys stored, want %d", len(s.Skipped), maxStoredSkippedKeys)
+	}
+	if s.Skipped[0].N != 3*maxSkip-maxStoredSkippedKeys {
+		t.Fatalf("oldest skipped key is %d, want the oldest ones dropped", s.Skipped[0].N)
+	}
+}
+
+func TestSessionReset(t *testing.T) {
+	alice, bob := newSessionPair(t)
+	bob.decrypt(t, alice, alice.encrypt(t, bob, "hello"), "hello")
+	alice.decrypt(t, bob, bob.encrypt(t, alice, "hi"), "hi")
+
+	if err := alice.sessions.ResetSession(bob.id); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := NewSessionManager(alice.sessions.db, alice.keys, alice.id).loadSession(bob.id); err != nil || state != nil {
+		t.Fatalf("session still stored after reset: %v", err)
+	}
+
+	// Bob still uses the old session, which Alice no longer has
+	stale := bob.encrypt(t, alice, "stale")
+	if _, err := alice.sessions.Decrypt(context.Background(), bob.id, stale); !errors.Is(err, ErrNoSession) {
+		t.Fatalf("message in a discarded session: got %v, want ErrNoSession", err)
+	}
+
+	// Alice's next message starts a new session, which replaces Bob's
+	bob.decrypt(t, alice, alice.encrypt(t, bob, "again"), "again")
+	alice.decrypt(t, bob, bob.encrypt(t, alice, "welcome back"), "welcome back")
+	bob.decrypt(t, alice, alice.encrypt(t, bob, "thanks"), "thanks")
+}
+
+func TestSessionTampered(t *testing.T) {
+	alice, bob := newSessionPair(t)
+	bob.decrypt(t, alice, alice.encrypt(t, bob, "hello"), "hello")
+
+	data := alice.encrypt(t, bob, "secret")
+	var msg ratchetMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	var header ratchetHeader
+	if err := json.Unmarshal(msg.Header, &header); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := append([]byte(nil), msg.Ciphertext...)
+	ciphertext[len(ciphertext)-1] ^= 1
+	header.PN++
+	tamperedHeader, err := json.Marshal(&header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tampered := range map[string]ratchetMessage{
+		"ciphertext": {Header: msg.Header, Ciphertext: ciphertext},
+		"header":     {Header: tamperedHeader, Ciphertext: msg.Ciphertext},
+	} {
+		data, err := json.Marshal(&tampered)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bob.sessions.Decrypt(context.Background(), alice.id, data); !errors.Is(err, ErrNoSession) {
+			t.Fatalf("tampered %s: got %v, want ErrNoSession", name, err)
+		}
+	}
+
+	// Failed attempts leave the session as it was
+	bob.decrypt(t, alice, data, "secret")
+}
@@ -0,0 +1,158 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"log"
+	"p2p-chat/internal/db"
+	"sort"
+)
+
+// GetThread returns the thread a message in the chat with a peer belongs to:
+// the message at its root and every reply to it, directly or through other
+// replies, oldest first.
+func (pcm *PrivateChatManager) GetThread(peerIDStr, messageID string) ([]*PrivateMessage, error) {
+	peerID, err := peer.Decode(peerIDStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID: %w", err)
+	}
+	values, err := readThread(pcm.db, messageID, func(id string) ([]byte, error) {
+		return pcm.messageKey(peerIDStr, id)
+	}, func(id string) string {
+		return privateReplyKey(peerIDStr, id, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	conversationID := privateConversationID(pcm.host.ID(), peerID)
+	thread := []*PrivateMessage{}
+	for _, value := range values {
+		var msg PrivateMessage
+		if err := json.Unmarshal(value, &msg); err != nil {
+			log.Printf("Failed to unmarshal message: %v", err)
+			continue
+		}
+		if msg.Reactions, err = pcm.reactions.get(conversationID, msg.ID); err != nil {
+			return nil, err
+		}
+		thread = append(thread, &msg)
+	}
+	return thread, nil
+}
+
+// GetGroupThread returns the thread a message in a group belongs to, like
+// GetThread does for private chats.
+func (gcm *GroupChatManager) GetGroupThread(groupID, messageID string) ([]*GroupMessage, error) {
+	values, err := readThread(gcm.db, messageID, func(id string) ([]byte, error) {
+		return gcm.messageKey(groupID, id)
+	}, func(id string) string {
+		return groupReplyKey(groupID, id, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	thread := []*GroupMessage{}
+	for _, value := range values {
+		var msg GroupMessage
+		if err := json.Unmarshal(value, &msg); err != nil {
+			log.Printf("Failed to unmarshal group message: %v", err)
+			continue
+		}
+		if msg.Reactions, err = gcm.reactions.get(groupID, msg.ID); err != nil {
+			return nil, err
+		}
+		thread = append(thread, &msg)
+	}
+	return thread, nil
+}
+
+// readThread reads the values of the messages in the thread of messageID,
+// oldest first. It walks up the reply_to links to the root, then down the
+// replies index, so it reads only the messages of the thread. messageKey
+// returns the key of a message by its ID, or ErrMessageNotFound, and
+// repliesPrefix the prefix of the index entries of the replies to a message.
+// A reply to a message that is not in the chat is the root of its thread.
+func readThread(store *db.LevelDBStore, messageID string, messageKey func(string) ([]byte, error), repliesPrefix func(string) string) ([][]byte, error) {
+	key, err := messageKey(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk up to the root, guarding against reply loops
+	root, rootKey := messageID, key
+	seen := map[string]bool{root: true}
+	for {
+		data, err := store.Get(rootKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get message: %w", err)
+		}
+		var msg struct {
+			ReplyTo string `json:"reply_to"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		if msg.ReplyTo == "" || seen[msg.ReplyTo] {
+			break
+		}
+		parentKey, err := messageKey(msg.ReplyTo)
+		if errors.Is(err, ErrMessageNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		seen[msg.ReplyTo] = true
+		root, rootKey = msg.ReplyTo, parentKey
+	}
+
+	members := map[string]bool{root: true}
+	keys := []string{string(rootKey)}
+	queue := []string{root}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		replies, err := readReplies(store, repliesPrefix(id))
+		if err != nil {
+			return nil, err
+		}
+		for reply, key := range replies {
+			if !members[reply] {
+				members[reply] = true
+				keys = append(keys, key)
+				queue = append(queue, reply)
+			}
+		}
+	}
+
+	// Message keys sort by HLC
+	sort.Strings(keys)
+	var values [][]byte
+	for _, key := range keys {
+		data, err := store.Get([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get message: %w", err)
+		}
+		values = append(values, data)
+	}
+	return values, nil
+}
+
+// readReplies maps the IDs of the replies indexed under prefix to their keys.
+func readReplies(store *db.LevelDBStore, prefix string) (map[string]string, error) {
+	iter := store.NewIteratorWithPrefix([]byte(prefix))
+	defer iter.Release()
+
+	replies := make(map[string]string)
+	for iter.Next() {
+		replies[string(iter.Key()[len(prefix):])] = string(iter.Value())
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to read replies: %w", err)
+	}
+	return replies, nil
+}
@@ -0,0 +1,142 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/spf13/cobra"
+	"p2p-chat/internal/db"
+	"p2p-chat/internal/p2p"
+)
+
+var aclCmd = &cobra.Command{
+	Use:   "acl",
+	Short: "Manage the peer block list and allow list",
+	Long: `Manage the peer block list and allow list enforced at the connection layer.
+
+The node must be stopped while these commands run, since they open its
+database. Use the /acl REST endpoints to change the lists of a running node.`,
+}
+
+var aclListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Show the block list, allow list and mode",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		withGater(cmd, func(gater *p2p.Gater) error {
+			if gater.AllowListOnly() {
+				fmt.Println("Mode: allow-list only")
+			} else {
+				fmt.Println("Mode: open (only blocked peers are refused)")
+			}
+			printACL("Blocked peers", gater.BlockList())
+			printACL("Allowed peers", gater.AllowList())
+			return nil
+		})
+	},
+}
+
+var aclModeCmd = &cobra.Command{
+	Use:   "mode open|allowlist",
+	Short: "Accept all peers but blocked ones, or only allowed peers and contacts",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var allowListOnly bool
+		switch args[0] {
+		case "open":
+		case "allowlist":
+			allowListOnly = true
+		default:
+			fmt.Printf("Error: unknown mode %q, use open or allowlist\n", args[0])
+			return
+		}
+		withGater(cmd, func(gater *p2p.Gater) error {
+			if err := gater.SetAllowListOnly(allowListOnly); err != nil {
+				return err
+			}
+			fmt.Printf("Access control mode set to %s.\n", args[0])
+			return nil
+		})
+	},
+}
+
+// newACLPeerCmd creates a subcommand that applies action to a single peer.
+func newACLPeerCmd(use, short, done string, action func(gater *p2p.Gater, peerID peer.ID, reason string) error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use + " <peer-id>",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			peerID, err := peer.Decode(args[0])
+			if err != nil {
+				fmt.Printf("Error: invalid peer ID: %v\n", err)
+				return
+			}
+			reason, _ := cmd.Flags().GetString("reason")
+			withGater(cmd, func(gater *p2p.Gater) error {
+				if err := action(gater, peerID, reason); err != nil {
+					return err
+				}
+				fmt.Printf("%s %s.\n", done, peerID.String())
+				return nil
+			})
+		},
+	}
+	return cmd
+}
+
+// withGater opens the database given by --db and runs fn on its access control lists.
+func withGater(cmd *cobra.Command, fn func(gater *p2p.Gater) error) {
+	dbPath, _ := cmd.Flags().GetString("db")
+	if dbPath == "" {
+		fmt.Println("Error: --db flag is required for database path.")
+		return
+	}
+
+	store, err := db.NewLevelDBStore(dbPath)
+	if err != nil {
+		fmt.Printf("Error opening database: %v\n", err)
+		return
+	}
+	defer store.Close()
+
+	gater, err := p2p.NewGater(store)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if err := fn(gater); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+func printACL(title string, entries []p2p.ACLEntry) {
+	fmt.Printf("%s (%d):\n", title, len(entries))
+	for _, entry := range entries {
+		if entry.Reason != "" {
+			fmt.Printf("  %s  %s\n", entry.PeerID, entry.Reason)
+		} else {
+			fmt.Printf("  %s\n", entry.PeerID)
+		}
+	}
+}
+
+func init() {
+	blockCmd := newACLPeerCmd("block", "Refuse all connections from a peer", "Blocked", func(gater *p2p.Gater, peerID peer.ID, reason string) error {
+		return gater.Block(peerID, reason)
+	})
+	blockCmd.Flags().String("reason", "", "Why the peer is blocked")
+	allowCmd := newACLPeerCmd("allow", "Add a peer to the allow list", "Allowed", func(gater *p2p.Gater, peerID peer.ID, reason string) error {
+		return gater.Allow(peerID, reason)
+	})
+	allowCmd.Flags().String("reason", "", "Note stored with the allow list entry")
+	unblockCmd := newACLPeerCmd("unblock", "Remove a peer from the block list", "Unblocked", func(gater *p2p.Gater, peerID peer.ID, reason string) error {
+		return gater.Unblock(peerID)
+	})
+	disallowCmd := newACLPeerCmd("disallow", "Remove a peer from the allow list", "Removed from the allow list:", func(gater *p2p.Gater, peerID peer.ID, reason string) error {
+		return gater.Disallow(peerID)
+	})
+
+	aclCmd.PersistentFlags().String("db", "", "Path to the LevelDB database")
+	aclCmd.AddCommand(aclListCmd, aclModeCmd, blockCmd, unblockCmd, allowCmd, disallowCmd)
+	RootCmd.AddCommand(aclCmd)
+}
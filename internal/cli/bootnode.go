@@ -2,9 +2,15 @@ package cli
 
 import (
 	"context"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/spf13/cobra"
 	"log"
+	"p2p-chat/internal/chat"
+	"p2p-chat/internal/db"
 	"p2p-chat/internal/p2p"
+	"strings"
 	"time"
 )
 
@@ -13,9 +19,79 @@ var bootnodeCmd = &cobra.Command{
 	Short: "Start a standalone bootstrap node",
 	Run: func(cmd *cobra.Command, args []string) {
 		port, _ := cmd.Flags().GetInt("port")
+		bootstrapPeers, _ := cmd.Flags().GetStringSlice("bootstrap-peer")
+		bootstrapFile, _ := cmd.Flags().GetString("bootstrap-file")
+		dbPath, _ := cmd.Flags().GetString("datadir")
+		keyFile, _ := cmd.Flags().GetString("key-file")
+		passphraseFile, _ := cmd.Flags().GetString("passphrase-file")
+		announceAddrs, _ := cmd.Flags().GetStringSlice("announce")
+		relayService, _ := cmd.Flags().GetBool("relay")
+		listenAddrs, _ := cmd.Flags().GetStringSlice("listen")
+		swarmKeyFile, _ := cmd.Flags().GetString("swarm-key")
+		protocolPrefix, _ := cmd.Flags().GetString("protocol-prefix")
+		mailboxService, _ := cmd.Flags().GetBool("mailbox-service")
+
+		// Load the pre-shared key of a private swarm
+		if !strings.HasPrefix(protocolPrefix, "/") {
+			log.Fatalf("Error: --protocol-prefix must start with /, e.g. %s", p2p.DHTProtocolPrefix)
+		}
+		swarmKey, err := loadSwarmKey(swarmKeyFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		if dbPath != "" && keyFile != "" {
+			log.Fatal("Error: --datadir and --key-file are mutually exclusive.")
+		}
+		if mailboxService && dbPath == "" {
+			log.Fatal("Error: --mailbox-service requires --datadir to store messages.")
+		}
+		mailboxCfg, err := mailboxConfig(cmd, nil)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if mailboxService && mailboxCfg.Allowed == nil {
+			log.Fatal("Error: --mailbox-service requires --mailbox-allow to name the peers it holds messages for.")
+		}
+
+		// Load a persistent identity so the peer ID survives restarts
+		var privKey crypto.PrivKey
+		switch {
+		case keyFile != "":
+			key, err := loadKeyFile(keyFile)
+			if err != nil {
+				log.Fatalf("Error loading key file: %v", err)
+			}
+			privKey = key
+		case dbPath != "":
+			key, err := loadBootnodeKey(dbPath, passphraseFile)
+			if err != nil {
+				log.Fatalf("Error loading bootstrap node identity: %v", err)
+			}
+			privKey = key
+		default:
+			log.Println("Warning: no --datadir or --key-file given, using a temporary identity. The peer ID will change on restart.")
+		}
+
+		// Load other bootstrap nodes to peer with
+		bootstrapAddrs, err := p2p.LoadBootstrapAddrs(bootstrapPeers, bootstrapFile)
+		if err != nil {
+			log.Fatalf("Error loading bootstrap peers: %v", err)
+		}
+		bootstrapper, err := p2p.NewBootstrapper(bootstrapAddrs, 1)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
 
 		// Create libp2p host for bootstrap node
-		host, err := p2p.NewHost(port)
+		host, err := p2p.NewHost(p2p.HostConfig{
+			ListenAddrs:   listenAddrs,
+			Port:          port,
+			PrivKey:       privKey,
+			AnnounceAddrs: announceAddrs,
+			RelayService:  relayService,
+			PSK:           swarmKey,
+		})
 		if err != nil {
 			log.Fatalf("Error creating libp2p host for bootstrap node: %v", err)
 		}
@@ -24,14 +100,33 @@ var bootnodeCmd = &cobra.Command{
 		// Setup DHT for bootstrap node
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		dht, err := p2p.SetupDHT(ctx, host, "")
+		dht, err := p2p.SetupDHT(ctx, host, bootstrapper, protocolPrefix)
 		if err != nil {
 			log.Fatalf("Error setting up DHT for bootstrap node: %v", err)
 		}
 		defer dht.Close()
 
-		log.Printf("Bootstrap node started on port %d\n", port)
-		log.Printf("Bootstrap node multiaddress: /ip4/127.0.0.1/tcp/%d/p2p/%s\n", port, host.ID().String())
+		// Hold messages for peers that use us as their mailbox. The identity
+		// has been loaded, so the database can stay open for the messages.
+		if mailboxService {
+			store, err := db.NewLevelDBStore(dbPath)
+			if err != nil {
+				log.Fatalf("Error opening database: %v", err)
+			}
+			defer store.Close()
+			mailbox, err := chat.NewMailboxService(store, mailboxCfg)
+			if err != nil {
+				log.Fatalf("Error loading mailbox: %v", err)
+			}
+			go mailbox.Run(ctx)
+			host.SetStreamHandler(chat.MailboxProtocol, mailbox.HandleMailboxStream)
+			log.Println("Mailbox service enabled")
+		}
+
+		log.Println("Bootstrap node started")
+		for _, addr := range p2p.PeerAddrs(host) {
+			log.Printf("Bootstrap node multiaddress: %s\n", addr)
+		}
 
 		// Keep the bootstrap node running
 		for {
@@ -42,8 +137,83 @@ var bootnodeCmd = &cobra.Command{
 	},
 }
 
+// loadBootnodeKey returns the libp2p identity stored in the database at
+// dbPath, generating one on first start.
+func loadBootnodeKey(dbPath, passphraseFile string) (crypto.PrivKey, error) {
+	store, err := db.NewLevelDBStore(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	exists, err := hasKeys(store)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := generateKeys(store, ""); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated new bootstrap node identity in %s\n", dbPath)
+	}
+
+	passphrase, err := unlockKeys(store, passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	return loadLibp2pKey(store, passphrase)
+}
+
+// mailboxConfig reads the mailbox service flags of cmd. The peers named with
+// --mailbox-allow may use the mailbox, and so may those isAllowed accepts if
+// it is not nil. Allowed is left nil if nobody may.
+func mailboxConfig(cmd *cobra.Command, isAllowed func(peer.ID) bool) (chat.MailboxConfig, error) {
+	quota, _ := cmd.Flags().GetInt("mailbox-quota")
+	senderQuota, _ := cmd.Flags().GetInt("mailbox-sender-quota")
+	maxPeers, _ := cmd.Flags().GetInt("mailbox-max-peers")
+	ttl, _ := cmd.Flags().GetDuration("mailbox-ttl")
+	allowPeers, _ := cmd.Flags().GetStringSlice("mailbox-allow")
+
+	cfg := chat.MailboxConfig{
+		Quota:         quota,
+		SenderQuota:   senderQuota,
+		MaxRecipients: maxPeers,
+		TTL:           ttl,
+	}
+	allowed := make(map[peer.ID]bool)
+	for _, s := range allowPeers {
+		peerID, err := peer.Decode(s)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid --mailbox-allow peer ID %s: %w", s, err)
+		}
+		allowed[peerID] = true
+	}
+	if len(allowed) > 0 || isAllowed != nil {
+		cfg.Allowed = func(peerID peer.ID) bool {
+			return allowed[peerID] || isAllowed != nil && isAllowed(peerID)
+		}
+	}
+	return cfg, nil
+}
+
 func init() {
 	bootnodeCmd.Flags().Int("port", 4001, "Port for the bootstrap node")
+	bootnodeCmd.Flags().String("datadir", "", "Path to a LevelDB database holding the node identity (created if missing)")
+	bootnodeCmd.Flags().String("key-file", "", "Path to a libp2p private key file holding the node identity (created if missing)")
+	bootnodeCmd.Flags().String("passphrase-file", "", "File holding the key passphrase, if the keys in --datadir are encrypted")
+	bootnodeCmd.Flags().StringSlice("listen", nil, "Multiaddress to listen on, e.g. /ip4/0.0.0.0/tcp/4002/ws (repeatable, overrides --port)")
+	bootnodeCmd.Flags().String("swarm-key", "", "Swarm key file; only nodes with the same key can connect (TCP and WebSocket only)")
+	bootnodeCmd.Flags().String("protocol-prefix", p2p.DHTProtocolPrefix, "DHT protocol prefix; must match the prefix used by the nodes it serves")
+	bootnodeCmd.Flags().Bool("relay", false, "Act as a circuit relay v2 for peers behind NAT")
+	bootnodeCmd.Flags().StringSlice("announce", nil, "Public multiaddress to advertise instead of the listen addresses (repeatable)")
+	bootnodeCmd.Flags().StringSlice("bootstrap-peer", nil, "Other bootstrap node multiaddress to peer with (repeatable)")
+	bootnodeCmd.Flags().String("bootstrap-file", "", "File listing other bootstrap node multiaddresses, one per line")
+	bootnodeCmd.Flags().Bool("mailbox-service", false, "Hold encrypted messages for peers that use this node as their mailbox (requires --datadir)")
+	bootnodeCmd.Flags().StringSlice("mailbox-allow", nil, "Peer ID the mailbox service holds messages for (repeatable)")
+	bootnodeCmd.Flags().Int("mailbox-quota", chat.DefaultMailboxQuota, "Maximum number of messages held per peer by the mailbox service")
+	bootnodeCmd.Flags().Int("mailbox-sender-quota", chat.DefaultMailboxSenderQuota, "Maximum number of messages held from one sender for one peer by the mailbox service")
+	bootnodeCmd.Flags().Int("mailbox-max-peers", chat.DefaultMailboxMaxRecipients, "Maximum number of peers registered with the mailbox service")
+	bootnodeCmd.Flags().Duration("mailbox-ttl", chat.DefaultMailboxTTL, "How long the mailbox service holds a message")
 	RootCmd.AddCommand(bootnodeCmd)
 }
 
@@ -3,7 +3,6 @@ package cli
 import (
 	"fmt"
 	"github.com/spf13/cobra"
-	cryptoLocal "p2p-chat/internal/crypto"
 	"p2p-chat/internal/db"
 )
 
@@ -12,6 +11,9 @@ var initCmd = &cobra.Command{
 	Short: "Initialize encryption keys and libp2p key",
 	Run: func(cmd *cobra.Command, args []string) {
 		dbPath, _ := cmd.Flags().GetString("db")
+		force, _ := cmd.Flags().GetBool("force")
+		encrypt, _ := cmd.Flags().GetBool("encrypt")
+		passphraseFile, _ := cmd.Flags().GetString("passphrase-file")
 		if dbPath == "" {
 			fmt.Println("Error: --db flag is required for database path.")
 			return
@@ -24,55 +26,42 @@ var initCmd = &cobra.Command{
 		}
 		defer store.Close()
 
-		// Generate ECDSA keys for encryption
-		privKeyECDSA, err := cryptoLocal.GenerateKeyPair()
+		// Refuse to silently replace an existing identity
+		exists, err := hasKeys(store)
 		if err != nil {
-			fmt.Printf("Error generating ECDSA keys: %v\n", err)
+			fmt.Printf("Error reading database: %v\n", err)
 			return
 		}
-		privKeyHex, err := cryptoLocal.EncodePrivateKey(privKeyECDSA)
-		if err != nil {
-			fmt.Printf("Error encoding ECDSA private key: %v\n", err)
-			return
-		}
-		pubKeyHex, err := cryptoLocal.EncodePublicKey(&privKeyECDSA.PublicKey)
-		if err != nil {
-			fmt.Printf("Error encoding ECDSA public key: %v\n", err)
+		if exists && !force {
+			fmt.Println("Error: keys already exist in this database. Use --force to replace them (this changes your peer ID).")
 			return
 		}
 
-		// Store ECDSA keys
-		store.Put([]byte("ecdsa_private_key"), []byte(privKeyHex))
-		store.Put([]byte("ecdsa_public_key"), []byte(pubKeyHex))
-		fmt.Println("ECDSA encryption keys generated and stored.")
-
-		// Generate libp2p keys
-		privKeyLibp2p, pubKeyLibp2p, err := cryptoLocal.GenerateKeyPairLibp2p()
-		if err != nil {
-			fmt.Printf("Error generating libp2p keys: %v\n", err)
-			return
-		}
-		privKeyLibp2pBytes, err := cryptoLocal.MarshalPrivateKeyLibp2p(privKeyLibp2p)
-		if err != nil {
-			fmt.Printf("Error marshaling libp2p private key: %v\n", err)
-			return
+		var passphrase string
+		if encrypt || passphraseFile != "" {
+			passphrase, err = readNewPassphrase(passphraseFile, true)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
 		}
-		pubKeyLibp2pBytes, err := cryptoLocal.MarshalPublicKeyLibp2p(pubKeyLibp2p)
-		if err != nil {
-			fmt.Printf("Error marshaling libp2p public key: %v\n", err)
+
+		if err := generateKeys(store, passphrase); err != nil {
+			fmt.Printf("Error: %v\n", err)
 			return
 		}
-
-		// Store libp2p keys
-		store.Put([]byte("libp2p_private_key"), privKeyLibp2pBytes)
-		store.Put([]byte("libp2p_public_key"), pubKeyLibp2pBytes)
+		fmt.Println("ECDSA encryption keys generated and stored.")
 		fmt.Println("Libp2p keys generated and stored.")
+		if passphrase != "" {
+			fmt.Println("Private keys are encrypted with your passphrase.")
+		}
 	},
 }
 
 func init() {
 	initCmd.Flags().String("db", "", "Path to the LevelDB database")
+	initCmd.Flags().Bool("force", false, "Overwrite existing keys")
+	initCmd.Flags().Bool("encrypt", false, "Protect the private keys with a passphrase")
+	initCmd.Flags().String("passphrase-file", "", "Read the passphrase from a file (implies --encrypt)")
 	RootCmd.AddCommand(initCmd)
 }
-
-
@@ -0,0 +1,213 @@
+package cli
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"os"
+	cryptoLocal "p2p-chat/internal/crypto"
+	"p2p-chat/internal/db"
+)
+
+const (
+	ecdsaPrivateKeyKey  = "ecdsa_private_key"
+	ecdsaPublicKeyKey   = "ecdsa_public_key"
+	libp2pPrivateKeyKey = "libp2p_private_key"
+	libp2pPublicKeyKey  = "libp2p_public_key"
+
+	// keyEncryptionKey records how the private keys are protected. It is only
+	// present when the keys are sealed under a passphrase.
+	keyEncryptionKey = "key_encryption"
+)
+
+// generateKeys creates a fresh ECDSA encryption key pair and libp2p identity
+// and stores them in the given database. If passphrase is not empty, the
+// private keys are sealed under it.
+func generateKeys(store *db.LevelDBStore, passphrase string) error {
+	// Generate ECDSA keys for encryption
+	privKeyECDSA, err := cryptoLocal.GenerateKeyPair()
+	if err != nil {
+		return fmt.Errorf("failed to generate ECDSA keys: %w", err)
+	}
+	privKeyHex, err := cryptoLocal.EncodePrivateKey(privKeyECDSA)
+	if err != nil {
+		return fmt.Errorf("failed to encode ECDSA private key: %w", err)
+	}
+	pubKeyHex, err := cryptoLocal.EncodePublicKey(&privKeyECDSA.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode ECDSA public key: %w", err)
+	}
+
+	// Generate libp2p keys
+	privKeyLibp2p, pubKeyLibp2p, err := cryptoLocal.GenerateKeyPairLibp2p()
+	if err != nil {
+		return fmt.Errorf("failed to generate libp2p keys: %w", err)
+	}
+	privKeyLibp2pBytes, err := cryptoLocal.MarshalPrivateKeyLibp2p(privKeyLibp2p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal libp2p private key: %w", err)
+	}
+	pubKeyLibp2pBytes, err := cryptoLocal.MarshalPublicKeyLibp2p(pubKeyLibp2p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal libp2p public key: %w", err)
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(ecdsaPublicKeyKey), []byte(pubKeyHex))
+	batch.Put([]byte(libp2pPublicKeyKey), pubKeyLibp2pBytes)
+	if err := putPrivateKeys(batch, []byte(privKeyHex), privKeyLibp2pBytes, passphrase); err != nil {
+		return err
+	}
+	if err := store.WriteBatch(batch); err != nil {
+		return fmt.Errorf("failed to store keys: %w", err)
+	}
+	return nil
+}
+
+// changePassphrase re-encrypts the private keys under newPassphrase, or
+// stores them unencrypted if newPassphrase is empty.
+func changePassphrase(store *db.LevelDBStore, oldPassphrase, newPassphrase string) error {
+	ecdsaKey, err := readPrivateKey(store, ecdsaPrivateKeyKey, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	libp2pKey, err := readPrivateKey(store, libp2pPrivateKeyKey, oldPassphrase)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	if err := putPrivateKeys(batch, ecdsaKey, libp2pKey, newPassphrase); err != nil {
+		return err
+	}
+	if err := store.WriteBatch(batch); err != nil {
+		return fmt.Errorf("failed to store keys: %w", err)
+	}
+	return nil
+}
+
+func putPrivateKeys(batch *leveldb.Batch, ecdsaKey, libp2pKey []byte, passphrase string) error {
+	if passphrase == "" {
+		batch.Put([]byte(ecdsaPrivateKeyKey), ecdsaKey)
+		batch.Put([]byte(libp2pPrivateKeyKey), libp2pKey)
+		batch.Delete([]byte(keyEncryptionKey))
+		return nil
+	}
+
+	sealedECDSA, err := cryptoLocal.SealWithPassphrase(ecdsaKey, passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt ECDSA private key: %w", err)
+	}
+	sealedLibp2p, err := cryptoLocal.SealWithPassphrase(libp2pKey, passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt libp2p private key: %w", err)
+	}
+	batch.Put([]byte(ecdsaPrivateKeyKey), sealedECDSA)
+	batch.Put([]byte(libp2pPrivateKeyKey), sealedLibp2p)
+	batch.Put([]byte(keyEncryptionKey), []byte("argon2id"))
+	return nil
+}
+
+// hasKeys reports whether the database already holds a libp2p identity.
+func hasKeys(store *db.LevelDBStore) (bool, error) {
+	return store.Has([]byte(libp2pPrivateKeyKey))
+}
+
+// keysEncrypted reports whether the private keys are sealed under a passphrase.
+func keysEncrypted(store *db.LevelDBStore) (bool, error) {
+	return store.Has([]byte(keyEncryptionKey))
+}
+
+// unlockKeys returns the passphrase protecting the private keys, or an empty
+// string if they are stored unencrypted.
+func unlockKeys(store *db.LevelDBStore, passphraseFile string) (string, error) {
+	encrypted, err := keysEncrypted(store)
+	if err != nil {
+		return "", fmt.Errorf("failed to read key encryption marker: %w", err)
+	}
+	if !encrypted {
+		return "", nil
+	}
+	return readPassphrase(passphraseFile, "Passphrase: ")
+}
+
+// readPrivateKey returns a stored private key, unsealing it with passphrase
+// if the keys are encrypted.
+func readPrivateKey(store *db.LevelDBStore, name, passphrase string) ([]byte, error) {
+	data, err := store.Get([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := keysEncrypted(store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key encryption marker: %w", err)
+	}
+	if !encrypted {
+		return data, nil
+	}
+	return cryptoLocal.OpenWithPassphrase(data, passphrase)
+}
+
+// loadLibp2pKey reads and decodes the libp2p identity stored by init.
+func loadLibp2pKey(store *db.LevelDBStore, passphrase string) (crypto.PrivKey, error) {
+	data, err := readPrivateKey(store, libp2pPrivateKeyKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := cryptoLocal.UnmarshalPrivateKeyLibp2p(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode libp2p private key: %w", err)
+	}
+	return privKey, nil
+}
+
+// loadECDSAKey reads and decodes the encryption key stored by init.
+func loadECDSAKey(store *db.LevelDBStore, passphrase string) (*ecdsa.PrivateKey, error) {
+	data, err := readPrivateKey(store, ecdsaPrivateKeyKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := cryptoLocal.DecodePrivateKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ECDSA private key: %w", err)
+	}
+	return privKey, nil
+}
+
+// loadKeyFile reads a libp2p private key from path, generating and saving a
+// new one if the file does not exist yet.
+func loadKeyFile(path string) (crypto.PrivKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		privKey, err := cryptoLocal.UnmarshalPrivateKeyLibp2p(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode libp2p private key: %w", err)
+		}
+		return privKey, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	privKey, _, err := cryptoLocal.GenerateKeyPairLibp2p()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate libp2p keys: %w", err)
+	}
+	data, err = cryptoLocal.MarshalPrivateKeyLibp2p(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal libp2p private key: %w", err)
+	}
+	// O_EXCL so two processes starting at once don't overwrite each other's key
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+	return privKey, nil
+}
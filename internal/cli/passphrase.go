@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// passphraseEnvVar names the environment variable that can hold the key passphrase.
+const passphraseEnvVar = "P2P_CHAT_PASSPHRASE"
+
+// readPassphrase returns the key passphrase from passphraseFile, the
+// P2P_CHAT_PASSPHRASE environment variable or an interactive prompt, in that order.
+func readPassphrase(passphraseFile, prompt string) (string, error) {
+	if passphraseFile != "" {
+		return readPassphraseFile(passphraseFile)
+	}
+	if passphrase, ok := os.LookupEnv(passphraseEnvVar); ok {
+		return passphrase, nil
+	}
+	return promptPassphrase(prompt)
+}
+
+// readNewPassphrase is like readPassphrase, but asks for confirmation when
+// prompting and rejects empty passphrases. The environment variable is only
+// consulted if useEnv is set.
+func readNewPassphrase(passphraseFile string, useEnv bool) (string, error) {
+	var passphrase string
+	var err error
+	env, hasEnv := os.LookupEnv(passphraseEnvVar)
+	switch {
+	case passphraseFile != "":
+		passphrase, err = readPassphraseFile(passphraseFile)
+	case useEnv && hasEnv:
+		passphrase = env
+	default:
+		passphrase, err = promptNewPassphrase()
+	}
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("passphrase must not be empty")
+	}
+	return passphrase, nil
+}
+
+func promptNewPassphrase() (string, error) {
+	passphrase, err := promptPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	confirm, err := promptPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if confirm != passphrase {
+		return "", errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+func readPassphraseFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func promptPassphrase(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("no passphrase provided: use --passphrase-file or set %s", passphraseEnvVar)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return string(passphrase), nil
+}
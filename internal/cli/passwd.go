@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"p2p-chat/internal/db"
+)
+
+var passwdCmd = &cobra.Command{
+	Use:   "passwd",
+	Short: "Change the passphrase protecting the node's private keys",
+	Run: func(cmd *cobra.Command, args []string) {
+		dbPath, _ := cmd.Flags().GetString("db")
+		passphraseFile, _ := cmd.Flags().GetString("passphrase-file")
+		newPassphraseFile, _ := cmd.Flags().GetString("new-passphrase-file")
+		remove, _ := cmd.Flags().GetBool("remove")
+		if dbPath == "" {
+			fmt.Println("Error: --db flag is required for database path.")
+			return
+		}
+
+		store, err := db.NewLevelDBStore(dbPath)
+		if err != nil {
+			fmt.Printf("Error opening database: %v\n", err)
+			return
+		}
+		defer store.Close()
+
+		exists, err := hasKeys(store)
+		if err != nil {
+			fmt.Printf("Error reading database: %v\n", err)
+			return
+		}
+		if !exists {
+			fmt.Printf("Error: no keys found. Run `p2p-chat init --db %s` first.\n", dbPath)
+			return
+		}
+
+		// Read the current passphrase, if any
+		var oldPassphrase string
+		encrypted, err := keysEncrypted(store)
+		if err != nil {
+			fmt.Printf("Error reading database: %v\n", err)
+			return
+		}
+		if encrypted {
+			oldPassphrase, err = readPassphrase(passphraseFile, "Current passphrase: ")
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+		}
+
+		var newPassphrase string
+		if !remove {
+			newPassphrase, err = readNewPassphrase(newPassphraseFile, false)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+		}
+
+		if err := changePassphrase(store, oldPassphrase, newPassphrase); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if remove {
+			fmt.Println("Passphrase removed; private keys are stored unencrypted.")
+		} else {
+			fmt.Println("Private keys re-encrypted with the new passphrase.")
+		}
+	},
+}
+
+func init() {
+	passwdCmd.Flags().String("db", "", "Path to the LevelDB database")
+	passwdCmd.Flags().String("passphrase-file", "", "Read the current passphrase from a file")
+	passwdCmd.Flags().String("new-passphrase-file", "", "Read the new passphrase from a file")
+	passwdCmd.Flags().Bool("remove", false, "Remove the passphrase and store the keys unencrypted")
+	RootCmd.AddCommand(passwdCmd)
+}
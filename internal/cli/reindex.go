@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"p2p-chat/internal/chat"
+	"p2p-chat/internal/db"
+)
+
+var reindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "Rebuild the full-text search index of the chat history",
+	Long: `Drop the full-text search index and build it again from the chat history.
+
+Nodes index new messages as they are stored, and index their history the first
+time they start with search support, so this is only needed if the index got
+out of sync. The node must be stopped while it runs.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbPath, _ := cmd.Flags().GetString("db")
+		if dbPath == "" {
+			fmt.Println("Error: --db flag is required for database path.")
+			return
+		}
+
+		store, err := db.NewLevelDBStore(dbPath)
+		if err != nil {
+			fmt.Printf("Error opening database: %v\n", err)
+			return
+		}
+		defer store.Close()
+
+		indexed, err := chat.RebuildSearchIndex(store)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Indexed %d messages.\n", indexed)
+	},
+}
+
+func init() {
+	reindexCmd.Flags().String("db", "", "Path to the LevelDB database")
+	RootCmd.AddCommand(reindexCmd)
+}
@@ -9,6 +9,7 @@ import (
 	"p2p-chat/internal/db"
 	"p2p-chat/internal/p2p"
 	"p2p-chat/assets"
+	"strings"
 )
 
 var serveCmd = &cobra.Command{
@@ -20,7 +21,19 @@ var serveCmd = &cobra.Command{
 		wsPort, _ := cmd.Flags().GetInt("ws-port")
 		libp2pPort, _ := cmd.Flags().GetInt("libp2p-port")
 		username, _ := cmd.Flags().GetString("username")
-		bootstrapPeer, _ := cmd.Flags().GetString("bootstrap-peer")
+		bootstrapPeers, _ := cmd.Flags().GetStringSlice("bootstrap-peer")
+		bootstrapFile, _ := cmd.Flags().GetString("bootstrap-file")
+		bootstrapMin, _ := cmd.Flags().GetInt("bootstrap-min")
+		generateKeysFlag, _ := cmd.Flags().GetBool("generate-keys")
+		passphraseFile, _ := cmd.Flags().GetString("passphrase-file")
+		republishInterval, _ := cmd.Flags().GetDuration("republish-interval")
+		announceAddrs, _ := cmd.Flags().GetStringSlice("announce")
+		listenAddrs, _ := cmd.Flags().GetStringSlice("listen")
+		swarmKeyFile, _ := cmd.Flags().GetString("swarm-key")
+		protocolPrefix, _ := cmd.Flags().GetString("protocol-prefix")
+		mdnsTag, _ := cmd.Flags().GetString("mdns-tag")
+		mailboxAddrs, _ := cmd.Flags().GetStringSlice("mailbox")
+		mailboxService, _ := cmd.Flags().GetBool("mailbox-service")
 
 		if dbPath == "" {
 			log.Fatal("Error: --datadir flag is required for database path.")
@@ -32,21 +45,87 @@ var serveCmd = &cobra.Command{
 		}
 		defer store.Close()
 
+		// Load bootstrap peers
+		bootstrapAddrs, err := p2p.LoadBootstrapAddrs(bootstrapPeers, bootstrapFile)
+		if err != nil {
+			log.Fatalf("Error loading bootstrap peers: %v", err)
+		}
+		bootstrapper, err := p2p.NewBootstrapper(bootstrapAddrs, bootstrapMin)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		// Make sure the node has been initialized
+		exists, err := hasKeys(store)
+		if err != nil {
+			log.Fatalf("Error reading database: %v", err)
+		}
+		if !exists {
+			if !generateKeysFlag {
+				log.Fatalf("Error: no keys found in %s. Run `p2p-chat init --db %s` first, or pass --generate-keys.", dbPath, dbPath)
+			}
+			if err := generateKeys(store, ""); err != nil {
+				log.Fatalf("Error generating keys: %v", err)
+			}
+			log.Println("Generated new encryption and libp2p keys.")
+		}
+
+		// Unlock the keys if they are protected by a passphrase
+		passphrase, err := unlockKeys(store, passphraseFile)
+		if err != nil {
+			log.Fatalf("Error reading passphrase: %v", err)
+		}
+
 		// Load libp2p private key
-		_, err = store.Get([]byte("libp2p_private_key"))
+		privKey, err := loadLibp2pKey(store, passphrase)
 		if err != nil {
 			log.Fatalf("Error loading libp2p private key: %v", err)
 		}
 
+		// Load ECDSA encryption key
+		encryptionKey, err := loadECDSAKey(store, passphrase)
+		if err != nil {
+			log.Fatalf("Error loading ECDSA private key: %v", err)
+		}
+
+		// Load the pre-shared key of a private swarm
+		if !strings.HasPrefix(protocolPrefix, "/") {
+			log.Fatalf("Error: --protocol-prefix must start with /, e.g. %s", p2p.DHTProtocolPrefix)
+		}
+		swarmKey, err := loadSwarmKey(swarmKeyFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		// Load the peer block and allow lists; bootstrap peers are always let in
+		gater, err := p2p.NewGater(store)
+		if err != nil {
+			log.Fatalf("Error loading access control lists: %v", err)
+		}
+		bootstrapInfos := bootstrapper.Resolve(context.Background())
+		for _, info := range bootstrapInfos {
+			gater.Trust(info.ID)
+		}
+
 		// Create libp2p host
-		host, err := p2p.NewHost(libp2pPort)
+		host, err := p2p.NewHost(p2p.HostConfig{
+			ListenAddrs:   listenAddrs,
+			Port:          libp2pPort,
+			PrivKey:       privKey,
+			AnnounceAddrs: announceAddrs,
+			// Bootstrap peers double as relays when we are behind NAT
+			Relays: bootstrapInfos,
+			Gater:  gater,
+			PSK:    swarmKey,
+		})
 		if err != nil {
 			log.Fatalf("Error creating libp2p host: %v", err)
 		}
 		defer host.Close()
+		gater.Attach(host)
 
 		// Setup mDNS discovery
-		err = p2p.SetupDiscovery(host)
+		err = p2p.SetupDiscovery(host, mdnsTag)
 		if err != nil {
 			log.Fatalf("Error setting up mDNS discovery: %v", err)
 		}
@@ -54,7 +133,7 @@ var serveCmd = &cobra.Command{
 		// Setup DHT
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		dht, err := p2p.SetupDHT(ctx, host, bootstrapPeer)
+		dht, err := p2p.SetupDHT(ctx, host, bootstrapper, protocolPrefix)
 		if err != nil {
 			log.Fatalf("Error setting up DHT: %v", err)
 		}
@@ -66,34 +145,88 @@ var serveCmd = &cobra.Command{
 			log.Printf("Generated username: %s\n", username)
 		}
 
-		// Publish username to DHT
-        err = p2p.PublishUsername(ctx, dht, host, username)
-        if err != nil {
-            log.Printf("Warning: Failed to publish username to DHT: %v\n", err)
-        }
+		// Keep our username published in the DHT
+		publisher := p2p.NewUsernamePublisher(host, dht, protocolPrefix, username, republishInterval)
+		publisher.Start(ctx)
+
+		// Track NAT reachability for the API
+		networkMonitor, err := p2p.NewNetworkMonitor(ctx, host)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
 
 		// Start WebSocket API server
-		wsAPI := api.NewWebSocketAPI(host, store, nil, nil, nil, bootstrapPeer)
+		wsAPI := api.NewWebSocketAPI(host, store, nil, nil, nil, publisher, networkMonitor, bootstrapper)
 		go wsAPI.StartWebSocketServer(wsPort)
 
 		// Setup chat managers
-		privateChatManager := chat.NewPrivateChatManager(host, store, wsAPI, dht)
-		groupChatManager := chat.NewGroupChatManager(host, store)
+		if err := chat.MigrateMessageKeys(store, host.ID()); err != nil {
+			log.Fatalf("Error migrating chat history: %v", err)
+		}
+		if err := chat.BuildSearchIndex(store); err != nil {
+			log.Fatalf("Error building search index: %v", err)
+		}
+		clock, err := chat.NewClock(store)
+		if err != nil {
+			log.Fatalf("Error loading clock: %v", err)
+		}
+		inbox, err := chat.NewInbox(store, wsAPI)
+		if err != nil {
+			log.Fatalf("Error loading inbox: %v", err)
+		}
+		keyManager, err := chat.NewKeyManager(host, store, encryptionKey, mailboxAddrs)
+		if err != nil {
+			log.Fatalf("Error setting up key manager: %v", err)
+		}
+		// Our mailboxes are always let in
+		for _, info := range keyManager.Mailboxes() {
+			gater.Trust(info.ID)
+		}
+		sessionManager := chat.NewSessionManager(store, keyManager, host.ID())
+		contactManager := chat.NewContactManager(host, store, wsAPI, gater, inbox)
+		gater.SetContactChecker(contactManager.IsContact)
+		privateChatManager := chat.NewPrivateChatManager(host, store, wsAPI, dht, sessionManager, contactManager, clock, inbox)
+		go privateChatManager.Outbox().Run(ctx)
+		go privateChatManager.RunMailboxes(ctx)
+		groupChatManager := chat.NewGroupChatManager(host, store, wsAPI, clock, inbox)
 		fileTransferManager := chat.NewFileTransferManager(host, store, "./downloads") // TODO: Make download dir configurable
+		// Delete disappearing messages and their files once they expire
+		go chat.NewPurger(store, wsAPI, inbox).Run(ctx)
 
 		// Set up stream handlers
-		host.SetStreamHandler(p2p.ChatProtocol, p2p.HandleChatStream)
-		host.SetStreamHandler(p2p.FileProtocol, p2p.HandleFileStream)
-		host.SetStreamHandler(chat.PrivateChatProtocol, privateChatManager.HandlePrivateChatStream)
-		host.SetStreamHandler(chat.GroupChatProtocol, groupChatManager.HandleGroupChatStream)
-		host.SetStreamHandler(chat.FileTransferProtocol, fileTransferManager.HandleFileTransferStream)
+		host.SetStreamHandler(p2p.ChatProtocol, gater.WrapHandler(p2p.HandleChatStream))
+		host.SetStreamHandler(p2p.FileProtocol, gater.WrapHandler(p2p.HandleFileStream))
+		host.SetStreamHandler(chat.KeyExchangeProtocol, gater.WrapHandler(keyManager.HandleKeyExchangeStream))
+		host.SetStreamHandler(chat.ContactProtocolV2, gater.WrapHandler(contactManager.HandleContactStream))
+		host.SetStreamHandler(chat.ContactProtocol, gater.WrapHandler(contactManager.HandleContactStream))
+		host.SetStreamHandler(chat.PrivateChatProtocolV2, gater.WrapHandler(privateChatManager.HandlePrivateChatStream))
+		host.SetStreamHandler(chat.PrivateChatProtocol, gater.WrapHandler(privateChatManager.HandlePrivateChatStream))
+		host.SetStreamHandler(chat.GroupChatProtocolV2, gater.WrapHandler(groupChatManager.HandleGroupChatStream))
+		host.SetStreamHandler(chat.GroupChatProtocol, gater.WrapHandler(groupChatManager.HandleGroupChatStream))
+		host.SetStreamHandler(chat.FileTransferProtocolV2, gater.WrapHandler(fileTransferManager.HandleFileTransferStream))
+		host.SetStreamHandler(chat.FileTransferProtocol, gater.WrapHandler(fileTransferManager.HandleFileTransferStream))
+
+		// Hold messages for our contacts and the peers we were told to
+		if mailboxService {
+			mailboxCfg, err := mailboxConfig(cmd, contactManager.IsContact)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			mailbox, err := chat.NewMailboxService(store, mailboxCfg)
+			if err != nil {
+				log.Fatalf("Error loading mailbox: %v", err)
+			}
+			go mailbox.Run(ctx)
+			host.SetStreamHandler(chat.MailboxProtocol, gater.WrapHandler(mailbox.HandleMailboxStream))
+			log.Println("Mailbox service enabled")
+		}
 
 		// Start REST API server
-		restAPI := api.NewAPI(host, store, privateChatManager, groupChatManager, fileTransferManager, restPort, wsPort, assets.StaticFiles)
+		restAPI := api.NewAPI(host, store, privateChatManager, groupChatManager, fileTransferManager, contactManager, publisher, networkMonitor, gater, restPort, wsPort, assets.StaticFiles)
 		go restAPI.StartRestServer(restPort)
 
 		// Assign managers to WebSocket API
-		wsAPI.SetManagers(privateChatManager, groupChatManager, fileTransferManager)
+		wsAPI.SetManagers(privateChatManager, groupChatManager, fileTransferManager, contactManager)
 
 		log.Println("P2P Chat Node started successfully!")
 
@@ -110,7 +243,24 @@ func init() {
 	serveCmd.Flags().Int("ws-port", 8081, "Port for the WebSocket API server")
 	serveCmd.Flags().Int("libp2p-port", 0, "Port for the libp2p host (0 for random)")
 	serveCmd.Flags().String("username", "", "Username for this node (generates random if not provided)")
-	serveCmd.Flags().String("bootstrap-peer", "", "Bootstrap peer multiaddress")
+	serveCmd.Flags().StringSlice("listen", nil, "Multiaddress to listen on, e.g. /ip4/0.0.0.0/udp/4001/quic-v1 (repeatable, overrides --libp2p-port)")
+	serveCmd.Flags().String("swarm-key", "", "Swarm key file; only nodes with the same key can connect (TCP and WebSocket only)")
+	serveCmd.Flags().String("protocol-prefix", p2p.DHTProtocolPrefix, "DHT protocol prefix; nodes only share a DHT with nodes using the same prefix")
+	serveCmd.Flags().String("mdns-tag", p2p.DiscoveryServiceTag, "mDNS service tag used to find nodes on the local network")
+	serveCmd.Flags().StringSlice("announce", nil, "Multiaddress to advertise instead of the listen addresses (repeatable)")
+	serveCmd.Flags().StringSlice("bootstrap-peer", nil, "Bootstrap peer multiaddress (repeatable, /dnsaddr/ supported)")
+	serveCmd.Flags().String("bootstrap-file", "", "File listing bootstrap peer multiaddresses, one per line")
+	serveCmd.Flags().Int("bootstrap-min", 1, "Minimum number of bootstrap peers to connect to before continuing startup")
+	serveCmd.Flags().Bool("generate-keys", false, "Generate and store keys if the datadir has not been initialized")
+	serveCmd.Flags().String("passphrase-file", "", "Read the key passphrase from a file")
+	serveCmd.Flags().Duration("republish-interval", p2p.DefaultRepublishInterval, "How often to republish the username record to the DHT")
+	serveCmd.Flags().StringSlice("mailbox", nil, "Multiaddress of a peer that holds our messages while we are offline (repeatable)")
+	serveCmd.Flags().Bool("mailbox-service", false, "Hold encrypted messages for peers that use this node as their mailbox")
+	serveCmd.Flags().StringSlice("mailbox-allow", nil, "Peer ID the mailbox service holds messages for besides our contacts (repeatable)")
+	serveCmd.Flags().Int("mailbox-quota", chat.DefaultMailboxQuota, "Maximum number of messages held per peer by the mailbox service")
+	serveCmd.Flags().Int("mailbox-sender-quota", chat.DefaultMailboxSenderQuota, "Maximum number of messages held from one sender for one peer by the mailbox service")
+	serveCmd.Flags().Int("mailbox-max-peers", chat.DefaultMailboxMaxRecipients, "Maximum number of peers registered with the mailbox service")
+	serveCmd.Flags().Duration("mailbox-ttl", chat.DefaultMailboxTTL, "How long the mailbox service holds a message")
 	RootCmd.AddCommand(serveCmd)
 }
 
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"p2p-chat/internal/p2p"
+)
+
+var swarmKeyCmd = &cobra.Command{
+	Use:   "swarm-key",
+	Short: "Generate a swarm key for a private network",
+	Long: `Generate a pre-shared swarm key for a private network. Hand the same key
+file to every node and bootnode with --swarm-key; nodes without it cannot connect.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		out, _ := cmd.Flags().GetString("out")
+
+		key, err := p2p.GenerateSwarmKey()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if out == "" {
+			fmt.Print(key)
+			return
+		}
+
+		f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			fmt.Printf("Error creating swarm key file: %v\n", err)
+			return
+		}
+		defer f.Close()
+		if _, err := f.WriteString(key); err != nil {
+			fmt.Printf("Error writing swarm key file: %v\n", err)
+			return
+		}
+		fmt.Printf("Swarm key written to %s\n", out)
+	},
+}
+
+// loadSwarmKey reads the swarm key at path, or returns nil if path is empty.
+func loadSwarmKey(path string) (pnet.PSK, error) {
+	if path == "" {
+		return nil, nil
+	}
+	psk, err := p2p.LoadSwarmKey(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Private network enabled; only nodes with the same swarm key can connect.")
+	return psk, nil
+}
+
+func init() {
+	swarmKeyCmd.Flags().String("out", "", "Write the key to this file instead of standard output")
+	RootCmd.AddCommand(swarmKeyCmd)
+}
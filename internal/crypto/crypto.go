@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"github.com/libp2p/go-libp2p/core/crypto"
 )
 
@@ -51,7 +52,11 @@ func DecodePublicKey(hexKey string) (*ecdsa.PublicKey, error) {
 	if err != nil {
 		return nil, err
 	}
-	return pub.(*ecdsa.PublicKey), nil
+	ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an ECDSA key")
+	}
+	return ecdsaPub, nil
 }
 
 
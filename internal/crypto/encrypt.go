@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// SharedKeySize is the size in bytes of keys produced by DeriveSharedKey.
+const SharedKeySize = 32
+
+// ErrDecrypt is returned when a ciphertext cannot be authenticated.
+var ErrDecrypt = errors.New("failed to decrypt message")
+
+// DeriveSharedKey performs an ECDH key agreement between priv and pub and
+// derives a symmetric key from the shared secret using HKDF-SHA256.
+// Both parties derive the same key when they use the same info string.
+func DeriveSharedKey(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey, info []byte) ([]byte, error) {
+	ecdhPriv, err := priv.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	ecdhPub, err := pub.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	secret, err := ecdhPriv.ECDH(ecdhPub)
+	if err != nil {
+		return nil, fmt.Errorf("ECDH failed: %w", err)
+	}
+	return DeriveKey(secret, nil, info, SharedKeySize)
+}
+
+// DeriveKey expands secret into a key of the given size using HKDF-SHA256.
+func DeriveKey(secret, salt, info []byte, size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), key); err != nil {
+		return nil, fmt.Errorf("key derivation failed: %w", err)
+	}
+	return key, nil
+}
+
+// Encrypt seals plaintext with AES-256-GCM under key. The random nonce is
+// prepended to the returned ciphertext. additionalData is authenticated but
+// not encrypted, and must be passed unchanged to Decrypt.
+func Encrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Decrypt opens a ciphertext produced by Encrypt.
+func Decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,75 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters used for newly sealed keys. They are stored alongside
+// each sealed key so they can be raised later without breaking old datadirs.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2SaltLen = 16
+)
+
+// ErrWrongPassphrase is returned when a sealed key cannot be opened.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// SealedKey is a secret encrypted under a key derived from a passphrase.
+type SealedKey struct {
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	Threads    uint8  `json:"threads"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// SealWithPassphrase encrypts secret with AES-256-GCM under a key derived
+// from passphrase with Argon2id, and returns the encoded SealedKey.
+func SealWithPassphrase(secret []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	sealed := SealedKey{
+		KDF:     "argon2id",
+		Salt:    salt,
+		Time:    argon2Time,
+		Memory:  argon2Memory,
+		Threads: argon2Threads,
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, sealed.Time, sealed.Memory, sealed.Threads, SharedKeySize)
+
+	ciphertext, err := Encrypt(key, secret, []byte(sealed.KDF))
+	if err != nil {
+		return nil, err
+	}
+	sealed.Ciphertext = ciphertext
+	return json.Marshal(&sealed)
+}
+
+// OpenWithPassphrase decrypts a SealedKey produced by SealWithPassphrase.
+func OpenWithPassphrase(data []byte, passphrase string) ([]byte, error) {
+	var sealed SealedKey
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, fmt.Errorf("failed to parse sealed key: %w", err)
+	}
+	if sealed.KDF != "argon2id" {
+		return nil, fmt.Errorf("unsupported key derivation function %q", sealed.KDF)
+	}
+
+	key := argon2.IDKey([]byte(passphrase), sealed.Salt, sealed.Time, sealed.Memory, sealed.Threads, SharedKeySize)
+	secret, err := Decrypt(key, sealed.Ciphertext, []byte(sealed.KDF))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return secret, nil
+}
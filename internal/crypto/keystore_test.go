@@ -0,0 +1,77 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestSealWithPassphrase(t *testing.T) {
+	secret := []byte("identity key")
+	data, err := SealWithPassphrase(secret, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, secret) {
+		t.Fatal("sealed key contains the secret")
+	}
+
+	opened, err := OpenWithPassphrase(data, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, secret) {
+		t.Fatalf("opened %q, want %q", opened, secret)
+	}
+
+	// Sealing again uses a new salt
+	again, err := SealWithPassphrase(secret, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, data) {
+		t.Fatal("sealing twice gave the same output")
+	}
+
+	if _, err := OpenWithPassphrase(data, "wrong horse"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("wrong passphrase gave %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestOpenWithPassphraseTampered(t *testing.T) {
+	data, err := SealWithPassphrase([]byte("identity key"), "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper := func(change func(*SealedKey)) []byte {
+		t.Helper()
+		var sealed SealedKey
+		if err := json.Unmarshal(data, &sealed); err != nil {
+			t.Fatal(err)
+		}
+		change(&sealed)
+		tampered, err := json.Marshal(&sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tampered
+	}
+
+	for name, tampered := range map[string][]byte{
+		"ciphertext": tamper(func(s *SealedKey) { s.Ciphertext[len(s.Ciphertext)-1] ^= 1 }),
+		"salt":       tamper(func(s *SealedKey) { s.Salt[0] ^= 1 }),
+		"parameters": tamper(func(s *SealedKey) { s.Time++ }),
+	} {
+		if _, err := OpenWithPassphrase(tampered, "passphrase"); !errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("key with tampered %s gave %v, want ErrWrongPassphrase", name, err)
+		}
+	}
+
+	if _, err := OpenWithPassphrase(tamper(func(s *SealedKey) { s.KDF = "scrypt" }), "passphrase"); err == nil {
+		t.Error("unsupported key derivation function accepted")
+	}
+	if _, err := OpenWithPassphrase([]byte("not json"), "passphrase"); err == nil {
+		t.Error("malformed sealed key accepted")
+	}
+}
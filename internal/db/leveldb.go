@@ -35,11 +35,21 @@ func (s *LevelDBStore) Get(key []byte) ([]byte, error) {
 	return data, nil
 }
 
+// Has reports whether the store contains the given key.
+func (s *LevelDBStore) Has(key []byte) (bool, error) {
+	return s.db.Has(key, nil)
+}
+
 // Delete removes a key-value pair from the store.
 func (s *LevelDBStore) Delete(key []byte) error {
 	return s.db.Delete(key, nil)
 }
 
+// WriteBatch applies all operations in batch atomically.
+func (s *LevelDBStore) WriteBatch(batch *leveldb.Batch) error {
+	return s.db.Write(batch, nil)
+}
+
 // NewIterator returns a new iterator over the store.
 func (s *LevelDBStore) NewIterator(slice *util.Range) iterator.Iterator {
 	return s.db.NewIterator(slice, nil)
@@ -0,0 +1,274 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	madns "github.com/multiformats/go-multiaddr-dns"
+)
+
+// BootstrapEnvVar names the environment variable holding extra bootstrap
+// peers, separated by commas or whitespace.
+const BootstrapEnvVar = "P2P_CHAT_BOOTSTRAP"
+
+// DefaultBootstrapPeers are used when no bootstrap peers are configured.
+var DefaultBootstrapPeers = []string{
+	"/ip4/148.251.35.204/tcp/30001/p2p/12D3KooWH4uEYewx2gwwzxQNeGkkTVm1V2dyfvUytcDzr6eh7HSd",
+}
+
+const (
+	bootstrapConnectTimeout = 30 * time.Second
+	bootstrapResolveTimeout = 10 * time.Second
+	minBootstrapRetry       = 30 * time.Second
+	maxBootstrapRetry       = 10 * time.Minute
+	maxDNSAddrDepth         = 4
+)
+
+// LoadBootstrapAddrs collects bootstrap multiaddrs from command line flags, a
+// bootstrap list file (one address per line, # starts a comment) and the
+// P2P_CHAT_BOOTSTRAP environment variable. If none are configured, the
+// default bootstrap peers are returned.
+func LoadBootstrapAddrs(flagAddrs []string, file string) ([]string, error) {
+	var addrs []string
+	addrs = append(addrs, flagAddrs...)
+
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open bootstrap file: %w", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				addrs = append(addrs, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read bootstrap file: %w", err)
+		}
+	}
+
+	addrs = append(addrs, strings.FieldsFunc(os.Getenv(BootstrapEnvVar), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})...)
+
+	if len(addrs) == 0 {
+		return DefaultBootstrapPeers, nil
+	}
+	return addrs, nil
+}
+
+// Bootstrapper connects to a set of bootstrap peers. Connection attempts run
+// in parallel, and peers that could not be reached are retried in the
+// background so bootnodes that come up later are still used.
+type Bootstrapper struct {
+	addrs    []multiaddr.Multiaddr
+	minPeers int
+	peers    map[peer.ID]peer.AddrInfo
+	mutex    sync.RWMutex
+}
+
+// NewBootstrapper parses the given bootstrap multiaddrs. Connect returns as
+// soon as minPeers of them are connected.
+func NewBootstrapper(addrs []string, minPeers int) (*Bootstrapper, error) {
+	b := &Bootstrapper{
+		minPeers: minPeers,
+		peers:    make(map[peer.ID]peer.AddrInfo),
+	}
+	for _, addrStr := range addrs {
+		addr, err := multiaddr.NewMultiaddr(addrStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bootstrap peer %s: %w", addrStr, err)
+		}
+		b.addrs = append(b.addrs, addr)
+	}
+	return b, nil
+}
+
+// Resolve resolves /dnsaddr/ entries and returns every bootstrap peer known
+// so far. Entries that fail to resolve are retried on the next call.
+func (b *Bootstrapper) Resolve(ctx context.Context) []peer.AddrInfo {
+	ctx, cancel := context.WithTimeout(ctx, bootstrapResolveTimeout)
+	defer cancel()
+
+	var resolved []multiaddr.Multiaddr
+	for _, addr := range b.addrs {
+		addrs, err := resolveDNSAddr(ctx, addr, maxDNSAddrDepth)
+		if err != nil {
+			log.Printf("Failed to resolve bootstrap peer %s: %v", addr, err)
+			continue
+		}
+		resolved = append(resolved, addrs...)
+	}
+
+	b.mutex.Lock()
+	for _, addr := range resolved {
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			log.Printf("Ignoring bootstrap address %s: %v", addr, err)
+			continue
+		}
+		known := b.peers[info.ID]
+		known.ID = info.ID
+		known.Addrs = multiaddr.Unique(append(known.Addrs, info.Addrs...))
+		b.peers[info.ID] = known
+	}
+	b.mutex.Unlock()
+
+	return b.Peers()
+}
+
+// Peers returns the resolved bootstrap peers.
+func (b *Bootstrapper) Peers() []peer.AddrInfo {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	peers := make([]peer.AddrInfo, 0, len(b.peers))
+	for _, info := range b.peers {
+		peers = append(peers, info)
+	}
+	return peers
+}
+
+// Connect dials all bootstrap peers in parallel. It returns the number of
+// peers connected once the minimum is reached or every attempt has finished;
+// the remaining attempts carry on in the background.
+func (b *Bootstrapper) Connect(ctx context.Context, h host.Host) int {
+	peers := b.remote(ctx, h)
+	if len(peers) == 0 {
+		return 0
+	}
+
+	results := make(chan bool, len(peers))
+	for _, info := range peers {
+		go func(info peer.AddrInfo) {
+			results <- b.connect(ctx, h, info)
+		}(info)
+	}
+
+	connected := 0
+	for i := 0; i < len(peers); i++ {
+		if <-results {
+			connected++
+		}
+		if b.minPeers > 0 && connected >= b.minPeers {
+			break
+		}
+	}
+
+	if connected < b.minPeers {
+		log.Printf("Warning: connected to %d bootstrap peers, wanted at least %d; retrying in the background", connected, b.minPeers)
+	}
+	return connected
+}
+
+// Start retries unreachable bootstrap peers with backoff until ctx is done.
+// onConnect is called whenever a bootstrap peer is (re)connected.
+func (b *Bootstrapper) Start(ctx context.Context, h host.Host, onConnect func()) {
+	go func() {
+		wait := minBootstrapRetry
+		backoff := minBootstrapRetry
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+
+			missing := 0
+			for _, info := range b.remote(ctx, h) {
+				if h.Network().Connectedness(info.ID) == network.Connected {
+					continue
+				}
+				if b.connect(ctx, h, info) {
+					if onConnect != nil {
+						onConnect()
+					}
+				} else {
+					missing++
+				}
+			}
+
+			// Check back rarely while everything is connected, and back off
+			// while some bootstrap peers stay unreachable
+			if missing == 0 {
+				wait = maxBootstrapRetry
+				backoff = minBootstrapRetry
+				continue
+			}
+			wait = backoff
+			backoff *= 2
+			if backoff > maxBootstrapRetry {
+				backoff = maxBootstrapRetry
+			}
+		}
+	}()
+}
+
+// remote resolves the bootstrap peers other than h itself, which a node
+// finds in its own bootstrap list when it serves as a bootnode too.
+func (b *Bootstrapper) remote(ctx context.Context, h host.Host) []peer.AddrInfo {
+	var peers []peer.AddrInfo
+	for _, info := range b.Resolve(ctx) {
+		if info.ID != h.ID() {
+			peers = append(peers, info)
+		}
+	}
+	return peers
+}
+
+func (b *Bootstrapper) connect(ctx context.Context, h host.Host, info peer.AddrInfo) bool {
+	ctx, cancel := context.WithTimeout(ctx, bootstrapConnectTimeout)
+	defer cancel()
+
+	if err := h.Connect(ctx, info); err != nil {
+		log.Printf("Failed to connect to bootstrap peer %s: %v", info.ID, err)
+		return false
+	}
+	log.Printf("Connected to bootstrap peer %s", info.ID)
+	return true
+}
+
+// resolveDNSAddr expands /dnsaddr/ multiaddrs, following nested entries up
+// to depth levels. Other addresses are returned unchanged.
+func resolveDNSAddr(ctx context.Context, addr multiaddr.Multiaddr, depth int) ([]multiaddr.Multiaddr, error) {
+	if _, err := addr.ValueForProtocol(multiaddr.P_DNSADDR); err != nil {
+		return []multiaddr.Multiaddr{addr}, nil
+	}
+	if depth == 0 {
+		return nil, fmt.Errorf("too many nested dnsaddr entries")
+	}
+
+	addrs, err := madns.DefaultResolver.Resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var out []multiaddr.Multiaddr
+	for _, a := range addrs {
+		nested, err := resolveDNSAddr(ctx, a, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, nested...)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no addresses found")
+	}
+	return out, nil
+}
@@ -0,0 +1,53 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+func newTestHost(t *testing.T, opts ...libp2p.Option) host.Host {
+	t.Helper()
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestBootstrapperSkipsSelf(t *testing.T) {
+	self := newTestHost(t, libp2p.NoListenAddrs)
+	bootnode := newTestHost(t, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+
+	addrs := []string{"/ip4/127.0.0.1/tcp/1/p2p/" + self.ID().String()}
+	for _, addr := range bootnode.Addrs() {
+		addrs = append(addrs, addr.String()+"/p2p/"+bootnode.ID().String())
+	}
+	b, err := NewBootstrapper(addrs, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	peers := b.remote(ctx, self)
+	if len(peers) != 1 || peers[0].ID != bootnode.ID() {
+		t.Fatalf("remote bootstrap peers are %v, want only the bootnode", peers)
+	}
+	if connected := b.Connect(ctx, self); connected != 1 {
+		t.Fatalf("connected to %d bootstrap peers, want 1", connected)
+	}
+
+	// A bootnode listing only itself has nothing to connect to
+	b, err = NewBootstrapper([]string{addrs[0]}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connected := b.Connect(ctx, self); connected != 0 {
+		t.Fatalf("connected to %d bootstrap peers, want 0", connected)
+	}
+}
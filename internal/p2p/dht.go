@@ -2,44 +2,40 @@ package p2p
 
 import (
 	"context"
+	"encoding/base32"
+	"encoding/json"
 	"fmt"
 	"log"
-	"sync"
 	"time"
 
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	record "github.com/libp2p/go-libp2p-record"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/routing"
-	"github.com/multiformats/go-multiaddr"
+	"google.golang.org/protobuf/proto"
 )
 
-// customValidator for usernames
-type customValidator struct{}
+// DHTProtocolPrefix is the default prefix of our DHT protocols. It keeps our
+// DHT from mixing with the public IPFS DHT; separate deployments can pick
+// their own prefix to keep their DHTs apart too.
+const DHTProtocolPrefix = "/p2p-chat"
 
-func (v customValidator) Validate(key string, value []byte) error {
-	// For this example, we allow any username record.
-	// In a real-world application, you might want to add validation logic here.
-	log.Printf("Validate key: %s", key)
-	return nil
-}
-
-func (v customValidator) Select(key string, values [][]byte) (int, error) {
-	// For this example, we always select the first record.
-	log.Printf("Select key: %s", key)
-	return 0, nil
-}
-
-// SetupDHT creates and bootstraps a DHT for peer discovery.
-// SetupDHT creates and bootstraps a DHT for peer discovery.
-func SetupDHT(ctx context.Context, h host.Host, bootstrapPeer string) (*dht.IpfsDHT, error) {
-	// Create a new DHT
+// SetupDHT creates and bootstraps a DHT for peer discovery. protocolPrefix
+// namespaces the DHT protocols, e.g. DHTProtocolPrefix.
+func SetupDHT(ctx context.Context, h host.Host, bootstrapper *Bootstrapper, protocolPrefix string) (*dht.IpfsDHT, error) {
+	// Create a new DHT, on a datastore the username validator can read
+	store := dssync.MutexWrap(ds.NewMapDatastore())
 	kademliaDHT, err := dht.New(ctx, h,
 		dht.Mode(dht.ModeServer),
-		dht.ProtocolPrefix("/p2p-chat"),
+		dht.ProtocolPrefix(protocol.ID(protocolPrefix)),
+		dht.Datastore(store),
 		dht.Validator(record.NamespacedValidator{
-			"username": customValidator{},
+			"username": usernameValidator{held: heldRecord(store)},
 		}),
 	)
 	if err != nil {
@@ -51,65 +47,21 @@ func SetupDHT(ctx context.Context, h host.Host, bootstrapPeer string) (*dht.Ipfs
 		return nil, fmt.Errorf("failed to bootstrap DHT: %w", err)
 	}
 
-	// Custom bootstrap peers
-	customBootstrapPeers := []string{
-		// "/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWDjdtJTB8hdvJgsh9MRvXdHQ6ThKnjF2pzhw8tXWVXhL4",
-		"/ip4/148.251.35.204/tcp/30001/p2p/12D3KooWH4uEYewx2gwwzxQNeGkkTVm1V2dyfvUytcDzr6eh7HSd",
-		// "/dnsaddr/sg1.bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
-		// "/dnsaddr/sv15.bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
-		// "/dnsaddr/am6.bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
-		// "/dnsaddr/ny5.bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
-	}
-
-	// Convert string addresses to multiaddr
-	var peers []multiaddr.Multiaddr
-	for _, addrStr := range customBootstrapPeers {
-		addr, err := multiaddr.NewMultiaddr(addrStr)
-		if err != nil {
-			log.Printf("Failed to parse bootstrap peer address %s: %v", addrStr, err)
-			continue
-		}
-		peers = append(peers, addr)
-	}
-
-	// If a specific bootstrap peer is provided, use it instead
-	if bootstrapPeer != "" {
-		addr, err := multiaddr.NewMultiaddr(bootstrapPeer)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse bootstrap peer: %w", err)
-		}
-		peers = []multiaddr.Multiaddr{addr}
-	}
-
-	// Connect to bootstrap peers
-	var wg sync.WaitGroup
-	for _, peerAddr := range peers {
-		peerinfo, err := peer.AddrInfoFromP2pAddr(peerAddr)
-		if err != nil {
-			log.Printf("Failed to parse peer address %s: %v", peerAddr, err)
-			continue
-		}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if err := h.Connect(ctx, *peerinfo); err != nil {
-				log.Printf("Failed to connect to bootstrap peer %s: %v", peerinfo.ID, err)
-			} else {
-				log.Printf("Connected to bootstrap peer %s", peerinfo.ID)
-			}
-		}()
-	}
-	wg.Wait()
+	// Connect to bootstrap peers, and keep retrying the unreachable ones
+	bootstrapper.Connect(ctx, h)
+	bootstrapper.Start(ctx, h, func() {
+		kademliaDHT.RefreshRoutingTable()
+	})
 
 	// Wait for the routing table to be populated
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 	for {
 		if len(kademliaDHT.RoutingTable().ListPeers()) > 0 {
 			break
 		}
 		select {
-		case <-ctx.Done():
+		case <-waitCtx.Done():
 			log.Println("Warning: DHT bootstrap timed out")
 			return kademliaDHT, nil
 		case <-time.After(100 * time.Millisecond):
@@ -119,39 +71,84 @@ func SetupDHT(ctx context.Context, h host.Host, bootstrapPeer string) (*dht.Ipfs
 	return kademliaDHT, nil
 }
 
-// PublishUsername publishes a username to the DHT.
-func PublishUsername(ctx context.Context, dht routing.Routing, h host.Host, username string) error {
-	key := fmt.Sprintf("/username/%s", username)
-	value := []byte(h.ID())
+// PublishUsername publishes a signed username record to the DHT and returns it.
+// claimed is the time we first claimed the username, or 0 for a new claim.
+func PublishUsername(ctx context.Context, dht routing.Routing, h host.Host, username string, claimed int64) (*UsernameRecord, error) {
+	privKey := h.Peerstore().PrivKey(h.ID())
+	if privKey == nil {
+		return nil, fmt.Errorf("host has no private key")
+	}
+	rec, err := NewUsernameRecord(username, privKey, claimed)
+	if err != nil {
+		return nil, err
+	}
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal username record: %w", err)
+	}
 
-	err := dht.PutValue(ctx, key, value)
+	err = dht.PutValue(ctx, usernameKey(username), value)
 	if err != nil {
-		return fmt.Errorf("failed to publish username: %w", err)
+		return nil, fmt.Errorf("failed to publish username: %w", err)
 	}
 
 	log.Printf("Published username %s to DHT for peer %s", username, h.ID())
-	return nil
+	return rec, nil
 }
 
 // FindPeerByUsername searches for a peer by username in the DHT.
 func FindPeerByUsername(ctx context.Context, dht routing.Routing, username string) (peer.AddrInfo, error) {
-	key := fmt.Sprintf("/username/%s", username)
-
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	value, err := dht.GetValue(ctx, key)
+	rec, err := getUsernameRecord(ctx, dht, username)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	if rec == nil {
+		return peer.AddrInfo{}, fmt.Errorf("user not found")
+	}
+	peerID, err := peer.Decode(rec.PeerID)
+	if err != nil {
+		return peer.AddrInfo{}, fmt.Errorf("invalid username record: %w", err)
+	}
+
+	return dht.FindPeer(ctx, peerID)
+}
+
+// getUsernameRecord returns the current record of username in the DHT, or
+// nil if there is none.
+func getUsernameRecord(ctx context.Context, dht routing.Routing, username string) (*UsernameRecord, error) {
+	value, err := dht.GetValue(ctx, usernameKey(username))
 	if err != nil {
 		if err == routing.ErrNotFound {
-			return peer.AddrInfo{}, fmt.Errorf("user not found")
+			return nil, nil
 		}
-		return peer.AddrInfo{}, fmt.Errorf("failed to search username: %w", err)
+		return nil, fmt.Errorf("failed to search username: %w", err)
 	}
 
-	peerID, err := peer.Decode(string(value))
+	// Verify the record ourselves rather than trusting whoever answered
+	rec, _, err := ParseUsernameRecord(username, value)
 	if err != nil {
-		return peer.AddrInfo{}, fmt.Errorf("failed to decode peer id: %w", err)
+		return nil, fmt.Errorf("invalid username record: %w", err)
 	}
+	return rec, nil
+}
 
-	return dht.FindPeer(ctx, peerID)
+// heldRecord returns a function that looks up the value of the record the
+// DHT stores under a key in store, or nil if it holds none. It reads the
+// datastore the way the DHT writes it: records are protobuf encoded under
+// the base32 encoding of their key.
+func heldRecord(store ds.Datastore) func(string) []byte {
+	return func(key string) []byte {
+		data, err := store.Get(context.Background(), ds.NewKey(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(key))))
+		if err != nil {
+			return nil
+		}
+		var rec recpb.Record
+		if err := proto.Unmarshal(data, &rec); err != nil || string(rec.GetKey()) != key {
+			return nil
+		}
+		return rec.GetValue()
+	}
 }
@@ -0,0 +1,322 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"p2p-chat/internal/db"
+)
+
+const (
+	aclBlockPrefix = "acl/block/"
+	aclAllowPrefix = "acl/allow/"
+	aclModeKey     = "acl/mode"
+
+	aclModeAllowList = "allowlist"
+)
+
+// ACLEntry is a peer on the block or allow list.
+type ACLEntry struct {
+	PeerID    string `json:"peer_id"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Gater is a libp2p ConnectionGater that enforces a block list and, in
+// allow-list only mode, an allow list. Both lists are stored in LevelDB.
+//
+// The block list applies to connections in both directions. The allow list
+// only applies to inbound connections and streams: in allow-list only mode a
+// peer is let in if it is on the allow list, is a trusted peer such as a
+// bootstrap node, or is accepted by the contact checker, while we still dial
+// any peer that is not blocked, as the DHT, relays and AutoNAT need to.
+type Gater struct {
+	db            *db.LevelDBStore
+	host          host.Host
+	blocked       map[peer.ID]ACLEntry
+	allowed       map[peer.ID]ACLEntry
+	trusted       map[peer.ID]bool
+	allowListOnly bool
+	isContact     func(peer.ID) bool
+	mutex         sync.RWMutex
+}
+
+// NewGater loads the block and allow lists from store.
+func NewGater(store *db.LevelDBStore) (*Gater, error) {
+	g := &Gater{
+		db:      store,
+		blocked: make(map[peer.ID]ACLEntry),
+		allowed: make(map[peer.ID]ACLEntry),
+		trusted: make(map[peer.ID]bool),
+	}
+	if err := g.load(aclBlockPrefix, g.blocked); err != nil {
+		return nil, err
+	}
+	if err := g.load(aclAllowPrefix, g.allowed); err != nil {
+		return nil, err
+	}
+	mode, err := store.Has([]byte(aclModeKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access control mode: %w", err)
+	}
+	g.allowListOnly = mode
+	return g, nil
+}
+
+func (g *Gater) load(prefix string, entries map[peer.ID]ACLEntry) error {
+	iter := g.db.NewIteratorWithPrefix([]byte(prefix))
+	defer iter.Release()
+
+	for iter.Next() {
+		var entry ACLEntry
+		if err := json.Unmarshal(iter.Value(), &entry); err != nil {
+			log.Printf("Failed to unmarshal access control entry: %v", err)
+			continue
+		}
+		peerID, err := peer.Decode(entry.PeerID)
+		if err != nil {
+			log.Printf("Invalid peer ID in access control entry: %v", err)
+			continue
+		}
+		entries[peerID] = entry
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("failed to load access control list: %w", err)
+	}
+	return nil
+}
+
+// Attach lets the gater close existing connections to peers it blocks.
+func (g *Gater) Attach(h host.Host) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.host = h
+}
+
+// SetContactChecker sets the function that tells whether a peer is a known
+// contact, for allow-list only mode.
+func (g *Gater) SetContactChecker(isContact func(peer.ID) bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.isContact = isContact
+}
+
+// Trust always lets the given peers in, even in allow-list only mode. It is
+// meant for infrastructure such as bootstrap nodes and is not persisted.
+func (g *Gater) Trust(peers ...peer.ID) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, p := range peers {
+		g.trusted[p] = true
+	}
+}
+
+// Block adds a peer to the block list and drops any open connections to it.
+func (g *Gater) Block(peerID peer.ID, reason string) error {
+	entry := ACLEntry{PeerID: peerID.String(), Reason: reason, CreatedAt: time.Now().Unix()}
+	if err := g.put(aclBlockPrefix, entry); err != nil {
+		return err
+	}
+
+	g.mutex.Lock()
+	g.blocked[peerID] = entry
+	h := g.host
+	g.mutex.Unlock()
+
+	log.Printf("Blocked peer %s\n", peerID.String())
+	if h != nil {
+		if err := h.Network().ClosePeer(peerID); err != nil {
+			log.Printf("Failed to close connections to blocked peer %s: %v\n", peerID.String(), err)
+		}
+	}
+	return nil
+}
+
+// Unblock removes a peer from the block list.
+func (g *Gater) Unblock(peerID peer.ID) error {
+	if err := g.db.Delete([]byte(aclBlockPrefix + peerID.String())); err != nil {
+		return fmt.Errorf("failed to delete block list entry: %w", err)
+	}
+	g.mutex.Lock()
+	delete(g.blocked, peerID)
+	g.mutex.Unlock()
+	log.Printf("Unblocked peer %s\n", peerID.String())
+	return nil
+}
+
+// Allow adds a peer to the allow list.
+func (g *Gater) Allow(peerID peer.ID, reason string) error {
+	entry := ACLEntry{PeerID: peerID.String(), Reason: reason, CreatedAt: time.Now().Unix()}
+	if err := g.put(aclAllowPrefix, entry); err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	g.allowed[peerID] = entry
+	g.mutex.Unlock()
+	return nil
+}
+
+// Disallow removes a peer from the allow list.
+func (g *Gater) Disallow(peerID peer.ID) error {
+	if err := g.db.Delete([]byte(aclAllowPrefix + peerID.String())); err != nil {
+		return fmt.Errorf("failed to delete allow list entry: %w", err)
+	}
+	g.mutex.Lock()
+	delete(g.allowed, peerID)
+	g.mutex.Unlock()
+	return nil
+}
+
+// SetAllowListOnly switches allow-list only mode on or off.
+func (g *Gater) SetAllowListOnly(enabled bool) error {
+	var err error
+	if enabled {
+		err = g.db.Put([]byte(aclModeKey), []byte(aclModeAllowList))
+	} else {
+		err = g.db.Delete([]byte(aclModeKey))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store access control mode: %w", err)
+	}
+	g.mutex.Lock()
+	g.allowListOnly = enabled
+	g.mutex.Unlock()
+	return nil
+}
+
+// AllowListOnly reports whether allow-list only mode is on.
+func (g *Gater) AllowListOnly() bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.allowListOnly
+}
+
+// BlockList returns the blocked peers.
+func (g *Gater) BlockList() []ACLEntry {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return sortedEntries(g.blocked)
+}
+
+// AllowList returns the peers on the allow list.
+func (g *Gater) AllowList() []ACLEntry {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return sortedEntries(g.allowed)
+}
+
+// IsAllowed reports whether we accept connections and streams from peerID.
+func (g *Gater) IsAllowed(peerID peer.ID) bool {
+	g.mutex.RLock()
+	_, blocked := g.blocked[peerID]
+	_, allowed := g.allowed[peerID]
+	allowListOnly := g.allowListOnly
+	trusted := g.trusted[peerID]
+	isContact := g.isContact
+	g.mutex.RUnlock()
+
+	switch {
+	case blocked:
+		return false
+	case !allowListOnly || allowed || trusted:
+		return true
+	case isContact != nil:
+		return isContact(peerID)
+	}
+	return false
+}
+
+// WrapHandler refuses streams from peers that are not allowed. Connections
+// are already gated, but this also covers peers blocked while connected.
+func (g *Gater) WrapHandler(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		remote := s.Conn().RemotePeer()
+		if !g.IsAllowed(remote) {
+			log.Printf("Refused %s stream from peer %s\n", s.Protocol(), remote.String())
+			s.Reset()
+			return
+		}
+		handler(s)
+	}
+}
+
+// IsBlocked reports whether peerID is on the block list.
+func (g *Gater) IsBlocked(peerID peer.ID) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	_, blocked := g.blocked[peerID]
+	return blocked
+}
+
+// InterceptPeerDial refuses to dial blocked peers.
+func (g *Gater) InterceptPeerDial(p peer.ID) bool {
+	if g.IsBlocked(p) {
+		log.Printf("Refused outbound connection to blocked peer %s\n", p.String())
+		return false
+	}
+	return true
+}
+
+// InterceptAddrDial allows every address of a peer that is not blocked.
+func (g *Gater) InterceptAddrDial(p peer.ID, addr multiaddr.Multiaddr) bool {
+	return !g.IsBlocked(p)
+}
+
+// InterceptAccept allows all inbound connections; the remote peer is only
+// known once the connection is secured.
+func (g *Gater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return true
+}
+
+// InterceptSecured refuses connections with blocked peers, and inbound
+// connections from peers that are not allowed.
+func (g *Gater) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	if dir == network.DirOutbound && !g.IsBlocked(p) {
+		return true
+	}
+	if !g.IsAllowed(p) {
+		if g.IsBlocked(p) {
+			log.Printf("Refused %s connection with blocked peer %s at %s\n", dir, p.String(), addrs.RemoteMultiaddr())
+		} else if dir == network.DirInbound {
+			log.Printf("Refused inbound connection from peer %s at %s: not on the allow list\n", p.String(), addrs.RemoteMultiaddr())
+		}
+		return false
+	}
+	return true
+}
+
+// InterceptUpgraded allows all upgraded connections.
+func (g *Gater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+func (g *Gater) put(prefix string, entry ACLEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal access control entry: %w", err)
+	}
+	if err := g.db.Put([]byte(prefix+entry.PeerID), data); err != nil {
+		return fmt.Errorf("failed to store access control entry: %w", err)
+	}
+	return nil
+}
+
+func sortedEntries(entries map[peer.ID]ACLEntry) []ACLEntry {
+	list := make([]ACLEntry, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].PeerID < list[j].PeerID
+	})
+	return list
+}
@@ -0,0 +1,137 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"p2p-chat/internal/db"
+)
+
+type testConnAddrs struct{}
+
+func (testConnAddrs) LocalMultiaddr() multiaddr.Multiaddr {
+	return multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")
+}
+
+func (testConnAddrs) RemoteMultiaddr() multiaddr.Multiaddr {
+	return multiaddr.StringCast("/ip4/127.0.0.1/tcp/4002")
+}
+
+func newTestGater(t *testing.T) (*Gater, *db.LevelDBStore) {
+	t.Helper()
+	store, err := db.NewLevelDBStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	g, err := NewGater(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, store
+}
+
+func newTestPeer(t *testing.T) peer.ID {
+	t.Helper()
+	id, err := peer.IDFromPrivateKey(newTestKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// gates reports whether g lets p in, and whether it lets us connect to p.
+func gates(g *Gater, p peer.ID) (inbound, outbound bool) {
+	addrs := testConnAddrs{}
+	inbound = g.InterceptSecured(network.DirInbound, p, addrs)
+	outbound = g.InterceptPeerDial(p) && g.InterceptAddrDial(p, addrs.RemoteMultiaddr()) && g.InterceptSecured(network.DirOutbound, p, addrs)
+	return inbound, outbound
+}
+
+func TestGaterBlockList(t *testing.T) {
+	g, store := newTestGater(t)
+	blocked := newTestPeer(t)
+	other := newTestPeer(t)
+
+	if err := g.Block(blocked, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	// A block also overrides the allow list and trust
+	if err := g.Allow(blocked, ""); err != nil {
+		t.Fatal(err)
+	}
+	g.Trust(blocked)
+	if in, out := gates(g, blocked); in || out {
+		t.Fatalf("blocked peer gated inbound=%v outbound=%v, want neither", in, out)
+	}
+	if in, out := gates(g, other); !in || !out {
+		t.Fatalf("other peer gated inbound=%v outbound=%v, want both", in, out)
+	}
+
+	// The block list is persisted
+	reloaded, err := NewGater(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.IsBlocked(blocked) || len(reloaded.BlockList()) != 1 || reloaded.BlockList()[0].Reason != "spam" {
+		t.Fatalf("block list after reload is %+v", reloaded.BlockList())
+	}
+
+	if err := g.Unblock(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if in, out := gates(g, blocked); !in || !out {
+		t.Fatalf("unblocked peer gated inbound=%v outbound=%v, want both", in, out)
+	}
+}
+
+func TestGaterAllowListOnly(t *testing.T) {
+	g, store := newTestGater(t)
+	allowed := newTestPeer(t)
+	trusted := newTestPeer(t)
+	contact := newTestPeer(t)
+	stranger := newTestPeer(t)
+
+	if err := g.SetAllowListOnly(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Allow(allowed, "friend"); err != nil {
+		t.Fatal(err)
+	}
+	g.Trust(trusted)
+	g.SetContactChecker(func(p peer.ID) bool { return p == contact })
+
+	for _, p := range []peer.ID{allowed, trusted, contact} {
+		if in, out := gates(g, p); !in || !out {
+			t.Fatalf("peer %s gated inbound=%v outbound=%v, want both", p, in, out)
+		}
+	}
+	// Strangers are kept out, but we still dial them
+	if in, out := gates(g, stranger); in || !out {
+		t.Fatalf("stranger gated inbound=%v outbound=%v, want outbound only", in, out)
+	}
+
+	// The mode and the allow list are persisted; trust is not
+	reloaded, err := NewGater(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.AllowListOnly() || !reloaded.IsAllowed(allowed) || reloaded.IsAllowed(trusted) {
+		t.Fatal("allow list not restored as stored")
+	}
+
+	if err := g.Disallow(allowed); err != nil {
+		t.Fatal(err)
+	}
+	if g.IsAllowed(allowed) {
+		t.Fatal("peer removed from the allow list still allowed")
+	}
+	if err := g.SetAllowListOnly(false); err != nil {
+		t.Fatal(err)
+	}
+	if !g.IsAllowed(stranger) {
+		t.Fatal("stranger refused with allow-list only mode off")
+	}
+}
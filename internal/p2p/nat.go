@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// NetworkStatus describes how reachable this node is from the outside.
+type NetworkStatus struct {
+	// Reachability is "public", "private" or "unknown", as detected by AutoNAT.
+	Reachability string   `json:"reachability"`
+	Addrs        []string `json:"addrs"`
+	RelayAddrs   []string `json:"relay_addrs"`
+}
+
+// NetworkMonitor tracks the reachability reported by AutoNAT.
+type NetworkMonitor struct {
+	host         host.Host
+	reachability network.Reachability
+	mutex        sync.RWMutex
+}
+
+// NewNetworkMonitor subscribes to reachability changes of h. The
+// subscription is closed when ctx is done.
+func NewNetworkMonitor(ctx context.Context, h host.Host) (*NetworkMonitor, error) {
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to reachability events: %w", err)
+	}
+
+	nm := &NetworkMonitor{host: h}
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-sub.Out():
+				if !ok {
+					return
+				}
+				reachability := e.(event.EvtLocalReachabilityChanged).Reachability
+				log.Printf("Node reachability changed to %s\n", reachabilityString(reachability))
+
+				nm.mutex.Lock()
+				nm.reachability = reachability
+				nm.mutex.Unlock()
+			}
+		}
+	}()
+	return nm, nil
+}
+
+// Status returns the current reachability and the addresses we advertise,
+// with relayed addresses listed separately.
+func (nm *NetworkMonitor) Status() NetworkStatus {
+	nm.mutex.RLock()
+	reachability := nm.reachability
+	nm.mutex.RUnlock()
+
+	status := NetworkStatus{
+		Reachability: reachabilityString(reachability),
+		Addrs:        []string{},
+		RelayAddrs:   []string{},
+	}
+	for _, addr := range PeerAddrs(nm.host) {
+		if isRelayAddr(addr) {
+			status.RelayAddrs = append(status.RelayAddrs, addr)
+		} else {
+			status.Addrs = append(status.Addrs, addr)
+		}
+	}
+	return status
+}
+
+func reachabilityString(r network.Reachability) string {
+	switch r {
+	case network.ReachabilityPublic:
+		return "public"
+	case network.ReachabilityPrivate:
+		return "private"
+	default:
+		return "unknown"
+	}
+}
+
+func isRelayAddr(addr string) bool {
+	maddr, err := multiaddr.NewMultiaddr(addr)
+	if err != nil {
+		return false
+	}
+	_, err = maddr.ValueForProtocol(multiaddr.P_CIRCUIT)
+	return err == nil
+}
@@ -2,36 +2,230 @@ package p2p
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
 	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
 	"github.com/multiformats/go-multiaddr"
 	"log"
+	"os"
 	"time"
 )
 
-// DiscoveryServiceTag is used to identify our service on the network.
+// DiscoveryServiceTag is the default mDNS service tag used to find other
+// nodes on the local network.
 const DiscoveryServiceTag = "p2p-chat-discovery"
 
-// NewHost creates a new libp2p host.
-func NewHost(port int) (host.Host, error) {
-	listenAddr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port))
-	if err != nil {
-		return nil, err
+// HostConfig holds the options for creating a libp2p host.
+type HostConfig struct {
+	// ListenAddrs are the multiaddrs to listen on, e.g. /ip4/0.0.0.0/tcp/4001,
+	// /ip4/0.0.0.0/udp/4001/quic-v1, /ip4/0.0.0.0/tcp/4002/ws or
+	// /ip6/::/tcp/4001. If empty, the host listens on TCP Port on all IPv4
+	// interfaces.
+	ListenAddrs []string
+	// Port is the port used for the default listen addresses (0 picks a
+	// random port).
+	Port int
+	// PrivKey is the host identity. If nil, a random identity is generated.
+	PrivKey crypto.PrivKey
+	// AnnounceAddrs replaces the listen addresses advertised to other peers,
+	// e.g. with the public address of a node behind port forwarding.
+	AnnounceAddrs []string
+	// Relays are candidate circuit relay v2 nodes. When AutoNAT finds that
+	// we are not publicly reachable, we reserve a slot on one of them.
+	Relays []peer.AddrInfo
+	// RelayService lets this node relay traffic for private peers.
+	RelayService bool
+	// Gater, if set, decides which peers may connect.
+	Gater connmgr.ConnectionGater
+	// PSK, if set, turns on private networking: only peers holding the same
+	// pre-shared key can connect. Private networks are limited to the TCP and
+	// WebSocket transports, as QUIC-based transports do not support them.
+	PSK pnet.PSK
+}
+
+// NewHost creates a new libp2p host from cfg. NAT traversal is always on:
+// the host maps ports via UPnP/NAT-PMP, runs AutoNAT to detect its
+// reachability (and answers AutoNAT probes from others), and upgrades relayed
+// connections to direct ones with DCUtR hole punching.
+func NewHost(cfg HostConfig) (host.Host, error) {
+	listen := cfg.ListenAddrs
+	if len(listen) == 0 {
+		listen = []string{fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", cfg.Port)}
+	}
+	var listenAddrs []multiaddr.Multiaddr
+	for _, addrStr := range listen {
+		addr, err := multiaddr.NewMultiaddr(addrStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %s: %w", addrStr, err)
+		}
+		listenAddrs = append(listenAddrs, addr)
+	}
+
+	opts := []libp2p.Option{
+		libp2p.ListenAddrs(listenAddrs...),
+		libp2p.NATPortMap(),
+		libp2p.EnableNATService(),
+		libp2p.EnableHolePunching(),
+	}
+	if len(cfg.Relays) > 0 {
+		opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(cfg.Relays))
+	}
+	if cfg.RelayService {
+		opts = append(opts, libp2p.EnableRelayService())
+	}
+	if cfg.PrivKey != nil {
+		opts = append(opts, libp2p.Identity(cfg.PrivKey))
+	}
+	if cfg.Gater != nil {
+		opts = append(opts, libp2p.ConnectionGater(cfg.Gater))
+	}
+	if len(cfg.PSK) > 0 {
+		for _, addr := range listenAddrs {
+			if !isPrivateNetworkAddr(addr) {
+				return nil, fmt.Errorf("listen address %s is not supported with a swarm key, use TCP or WebSocket", addr)
+			}
+		}
+		opts = append(opts,
+			libp2p.PrivateNetwork(cfg.PSK),
+			libp2p.Transport(tcp.NewTCPTransport),
+			libp2p.Transport(websocket.New),
+		)
+	}
+	if len(cfg.AnnounceAddrs) > 0 {
+		announce, err := parseAnnounceAddrs(cfg.AnnounceAddrs)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, libp2p.AddrsFactory(func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			// Keep the relay addresses AutoRelay adds when we are behind NAT
+			out := append([]multiaddr.Multiaddr(nil), announce...)
+			for _, addr := range addrs {
+				if _, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT); err == nil {
+					out = append(out, addr)
+				}
+			}
+			return out
+		}))
 	}
 
-	host, err := libp2p.New(libp2p.ListenAddrs(listenAddr))
+	host, err := libp2p.New(opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Printf("\n[*] Your Multiaddress: /ip4/127.0.0.1/tcp/%v/p2p/%s\n", port, host.ID().String())
+	fmt.Println()
+	for _, addr := range ListenPeerAddrs(host) {
+		fmt.Printf("[*] Listening on: %s\n", addr)
+	}
+	if len(cfg.AnnounceAddrs) > 0 {
+		for _, addr := range PeerAddrs(host) {
+			fmt.Printf("[*] Your Multiaddress: %s\n", addr)
+		}
+	}
 
 	return host, nil
 }
 
+// ListenPeerAddrs returns the addresses h actually listens on, with
+// unspecified addresses expanded to the interface addresses, as full
+// multiaddrs including the /p2p/ peer ID. The relay transport's
+// placeholder listener is left out.
+func ListenPeerAddrs(h host.Host) []string {
+	addrs, err := h.Network().InterfaceListenAddresses()
+	if err != nil {
+		return nil
+	}
+	var listening []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		if _, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT); err == nil {
+			continue
+		}
+		listening = append(listening, addr)
+	}
+	return p2pAddrStrings(peer.AddrInfo{ID: h.ID(), Addrs: listening})
+}
+
+// PeerAddrs returns the advertised addresses of h as full multiaddrs
+// including the /p2p/ peer ID, ready to be shared with other peers.
+func PeerAddrs(h host.Host) []string {
+	return p2pAddrStrings(peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+}
+
+func p2pAddrStrings(info peer.AddrInfo) []string {
+	addrs, err := peer.AddrInfoToP2pAddrs(&info)
+	if err != nil {
+		return nil
+	}
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, addr.String())
+	}
+	return out
+}
+
+func parseAnnounceAddrs(addrs []string) ([]multiaddr.Multiaddr, error) {
+	var out []multiaddr.Multiaddr
+	for _, addrStr := range addrs {
+		addr, err := multiaddr.NewMultiaddr(addrStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid announce address %s: %w", addrStr, err)
+		}
+		// Accept addresses copied together with their /p2p/ suffix
+		transport, _ := peer.SplitAddr(addr)
+		if transport == nil {
+			return nil, fmt.Errorf("invalid announce address %s", addrStr)
+		}
+		out = append(out, transport)
+	}
+	return out, nil
+}
+
+// LoadSwarmKey reads a pre-shared key for private networking from a swarm
+// key file in the format used by go-ipfs (/key/swarm/psk/1.0.0/).
+func LoadSwarmKey(path string) (pnet.PSK, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open swarm key: %w", err)
+	}
+	defer f.Close()
+
+	psk, err := pnet.DecodeV1PSK(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode swarm key: %w", err)
+	}
+	return psk, nil
+}
+
+// GenerateSwarmKey returns a new random swarm key file.
+func GenerateSwarmKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate swarm key: %w", err)
+	}
+	return "/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(key) + "\n", nil
+}
+
+// isPrivateNetworkAddr reports whether addr uses a transport that supports
+// private networks.
+func isPrivateNetworkAddr(addr multiaddr.Multiaddr) bool {
+	for _, p := range addr.Protocols() {
+		switch p.Code {
+		case multiaddr.P_UDP, multiaddr.P_QUIC_V1, multiaddr.P_WEBTRANSPORT, multiaddr.P_WEBRTC_DIRECT:
+			return false
+		}
+	}
+	return true
+}
+
 // discoveryNotifee gets notified when new peers are found
 type discoveryNotifee struct {
 	host host.Host
@@ -46,9 +240,10 @@ func (n *discoveryNotifee) HandlePeerFound(peerInfo peer.AddrInfo) {
 	}
 }
 
-// SetupDiscovery creates an mDNS discovery service and attaches it to the libp2p Host.
-func SetupDiscovery(h host.Host) error {
-	service := mdns.NewMdnsService(h, DiscoveryServiceTag, &discoveryNotifee{host: h})
+// SetupDiscovery creates an mDNS discovery service advertising serviceTag
+// and attaches it to the libp2p Host.
+func SetupDiscovery(h host.Host, serviceTag string) error {
+	service := mdns.NewMdnsService(h, serviceTag, &discoveryNotifee{host: h})
 	return service.Start()
 }
 
@@ -0,0 +1,230 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	dhtpb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-msgio/pbio"
+)
+
+const (
+	// DefaultRepublishInterval is how often the username record is republished.
+	DefaultRepublishInterval = time.Hour
+
+	minRepublishBackoff = 5 * time.Second
+	maxRepublishBackoff = 5 * time.Minute
+)
+
+// PublishStatus describes the state of the username republisher.
+// Times are Unix timestamps; zero means "never".
+type PublishStatus struct {
+	Username    string `json:"username"`
+	LastAttempt int64  `json:"last_attempt"`
+	LastPublish int64  `json:"last_publish"`
+	LastError   string `json:"last_error,omitempty"`
+	Peers       int    `json:"peers"`
+	NextPublish int64  `json:"next_publish"`
+}
+
+// UsernamePublisher keeps our username record alive in the DHT by
+// republishing it periodically, retrying with backoff when publishing fails.
+type UsernamePublisher struct {
+	host       host.Host
+	dht        *dht.IpfsDHT
+	username   string
+	interval   time.Duration
+	protocolID protocol.ID
+	// claimed is the time we first claimed the username, once known.
+	claimed int64
+	status  PublishStatus
+	mutex   sync.RWMutex
+}
+
+// NewUsernamePublisher creates a publisher for username on a DHT using
+// protocolPrefix. The interval is capped so records are refreshed well
+// before they expire.
+func NewUsernamePublisher(h host.Host, d *dht.IpfsDHT, protocolPrefix, username string, interval time.Duration) *UsernamePublisher {
+	if interval <= 0 {
+		interval = DefaultRepublishInterval
+	}
+	if interval > UsernameRecordTTL/2 {
+		log.Printf("Republish interval %s is too long for a %s record TTL, using %s", interval, UsernameRecordTTL, UsernameRecordTTL/2)
+		interval = UsernameRecordTTL / 2
+	}
+
+	return &UsernamePublisher{
+		host:       h,
+		dht:        d,
+		username:   username,
+		interval:   interval,
+		protocolID: protocol.ID(protocolPrefix + "/kad/1.0.0"),
+		status:     PublishStatus{Username: username},
+	}
+}
+
+// Start publishes the username immediately and keeps republishing it in the
+// background until ctx is cancelled.
+func (up *UsernamePublisher) Start(ctx context.Context) {
+	go up.run(ctx)
+}
+
+// Status returns the result of the most recent publish attempt.
+func (up *UsernamePublisher) Status() PublishStatus {
+	up.mutex.RLock()
+	defer up.mutex.RUnlock()
+	return up.status
+}
+
+func (up *UsernamePublisher) run(ctx context.Context) {
+	backoff := minRepublishBackoff
+	for {
+		peers, err := up.publish(ctx)
+
+		wait := up.interval
+		if err != nil {
+			log.Printf("Warning: Failed to publish username %s: %v (retrying in %s)", up.username, err, backoff)
+			wait = backoff
+			backoff *= 2
+			if backoff > maxRepublishBackoff {
+				backoff = maxRepublishBackoff
+			}
+		} else {
+			log.Printf("Published username %s, record held by %d peers", up.username, peers)
+			backoff = minRepublishBackoff
+		}
+
+		up.mutex.Lock()
+		up.status.NextPublish = time.Now().Add(wait).Unix()
+		up.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// publish puts a fresh record into the DHT and counts how many of the
+// closest peers now hold it.
+func (up *UsernamePublisher) publish(ctx context.Context) (int, error) {
+	now := time.Now().Unix()
+	var rec *UsernameRecord
+	err := up.loadClaim(ctx)
+	if err == nil {
+		rec, err = PublishUsername(ctx, up.dht, up.host, up.username, up.claimed)
+	}
+
+	peers := 0
+	if err == nil {
+		up.claimed = rec.Claimed
+		peers, err = up.countHolders(ctx, rec)
+		if err == nil && peers == 0 {
+			err = errors.New("record was not stored by any peer")
+		}
+	}
+
+	up.mutex.Lock()
+	defer up.mutex.Unlock()
+	up.status.LastAttempt = now
+	up.status.Peers = peers
+	if err != nil {
+		up.status.LastError = err.Error()
+	} else {
+		up.status.LastError = ""
+		up.status.LastPublish = now
+	}
+	return peers, err
+}
+
+// loadClaim looks up when we claimed the username, so records published
+// after a restart keep the original claim. It fails while another peer
+// holds the username, as the DHT would not take our record.
+func (up *UsernamePublisher) loadClaim(ctx context.Context) error {
+	if up.claimed != 0 {
+		return nil
+	}
+	rec, err := getUsernameRecord(ctx, up.dht, up.username)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return nil
+	}
+	if rec.PeerID != up.host.ID().String() {
+		return fmt.Errorf("username %s is taken by peer %s", up.username, rec.PeerID)
+	}
+	up.claimed = rec.Claimed
+	return nil
+}
+
+// countHolders asks the peers closest to the record key whether they hold
+// rec or a newer record of ours.
+func (up *UsernamePublisher) countHolders(ctx context.Context, rec *UsernameRecord) (int, error) {
+	key := usernameKey(rec.Username)
+	peers, err := up.dht.GetClosestPeers(ctx, key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find closest peers: %w", err)
+	}
+
+	var count int
+	var countMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			value, err := up.fetchRecord(ctx, p, key)
+			if err != nil || value == nil {
+				return
+			}
+			held, _, err := ParseUsernameRecord(rec.Username, value)
+			if err != nil || held.PeerID != rec.PeerID || held.Seq < rec.Seq {
+				return
+			}
+			countMutex.Lock()
+			count++
+			countMutex.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	return count, nil
+}
+
+// fetchRecord asks a single DHT peer for the value it stores under key.
+func (up *UsernamePublisher) fetchRecord(ctx context.Context, p peer.ID, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	s, err := up.host.NewStream(ctx, p, up.protocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	req := dhtpb.NewMessage(dhtpb.Message_GET_VALUE, []byte(key), 0)
+	if err := pbio.NewDelimitedWriter(s).WriteMsg(req); err != nil {
+		return nil, err
+	}
+	var resp dhtpb.Message
+	if err := pbio.NewDelimitedReader(s, network.MessageSizeMax).ReadMsg(&resp); err != nil {
+		return nil, err
+	}
+	if rec := resp.GetRecord(); rec != nil {
+		return rec.GetValue(), nil
+	}
+	return nil, nil
+}
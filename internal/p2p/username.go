@@ -0,0 +1,183 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// UsernameRecordTTL is how long a published username record stays valid.
+const UsernameRecordTTL = 24 * time.Hour
+
+// usernameClockSkew is how far ahead of our clock the times in a username
+// record may be. Records claiming later times are rejected, so nobody can
+// hold a username beyond a TTL without republishing it.
+const usernameClockSkew = 5 * time.Minute
+
+const usernameSignaturePrefix = "p2p-chat-username:"
+
+// UsernameRecord maps a username to the peer that owns it. Records are
+// signed by the owner's libp2p key, so only the owner can publish them.
+type UsernameRecord struct {
+	Username string `json:"username"`
+	PeerID   string `json:"peer_id"`
+	Seq      uint64 `json:"seq"`
+	// Claimed is the Unix time at which the owner first published the
+	// username. It stays the same across republishes. It is informational
+	// only: the owner signs it itself, so it does not decide ownership.
+	Claimed   int64  `json:"claimed"`
+	Expires   int64  `json:"expires"`
+	Signature []byte `json:"signature"`
+}
+
+func (r *UsernameRecord) signingBytes() []byte {
+	return []byte(fmt.Sprintf("%s%s:%s:%d:%d:%d", usernameSignaturePrefix, r.Username, r.PeerID, r.Seq, r.Claimed, r.Expires))
+}
+
+// supersedes reports whether r wins over other. Records of the same peer
+// replace its earlier ones. Between different peers, only the record of
+// holder, the owner of the record this node stores, wins: the username
+// stays with the peer whose record reached the node first for as long as
+// that peer keeps it alive.
+func (r *UsernameRecord) supersedes(other *UsernameRecord, holder string) bool {
+	if r.PeerID == other.PeerID {
+		return r.Seq > other.Seq
+	}
+	return r.PeerID == holder
+}
+
+// NewUsernameRecord creates a username record for the owner of privKey and
+// signs it. The sequence number is derived from the current time, so records
+// published later supersede earlier ones of the same owner. claimed is the
+// time the owner first claimed the username, or 0 for a new claim.
+func NewUsernameRecord(username string, privKey crypto.PrivKey, claimed int64) (*UsernameRecord, error) {
+	peerID, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive peer ID: %w", err)
+	}
+
+	now := time.Now()
+	if claimed == 0 {
+		claimed = now.Unix()
+	}
+	rec := &UsernameRecord{
+		Username: username,
+		PeerID:   peerID.String(),
+		Seq:      uint64(now.UnixNano()),
+		Claimed:  claimed,
+		Expires:  now.Add(UsernameRecordTTL).Unix(),
+	}
+	rec.Signature, err = privKey.Sign(rec.signingBytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign username record: %w", err)
+	}
+	return rec, nil
+}
+
+// ParseUsernameRecord decodes a record and checks that it is signed by the
+// peer it names, is for the expected username and has not expired.
+func ParseUsernameRecord(username string, value []byte) (*UsernameRecord, peer.ID, error) {
+	var rec UsernameRecord
+	if err := json.Unmarshal(value, &rec); err != nil {
+		return nil, "", fmt.Errorf("malformed username record: %w", err)
+	}
+	if rec.Username != username {
+		return nil, "", fmt.Errorf("record is for username %q, expected %q", rec.Username, username)
+	}
+	now := time.Now()
+	if now.Unix() >= rec.Expires {
+		return nil, "", errors.New("username record has expired")
+	}
+	if rec.Expires > now.Add(UsernameRecordTTL+usernameClockSkew).Unix() {
+		return nil, "", errors.New("username record expires too far in the future")
+	}
+	if rec.Claimed <= 0 || rec.Claimed > now.Add(usernameClockSkew).Unix() {
+		return nil, "", errors.New("invalid claim time in username record")
+	}
+
+	peerID, err := peer.Decode(rec.PeerID)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid peer ID in username record: %w", err)
+	}
+	pubKey, err := peerID.ExtractPublicKey()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to extract public key from peer ID: %w", err)
+	}
+	ok, err := pubKey.Verify(rec.signingBytes(), rec.Signature)
+	if err != nil || !ok {
+		return nil, "", errors.New("invalid username record signature")
+	}
+	return &rec, peerID, nil
+}
+
+// usernameValidator validates signed username records in the DHT.
+type usernameValidator struct {
+	// held returns the value of the record this node stores under a key,
+	// or nil.
+	held func(key string) []byte
+}
+
+// Validate rejects records that are malformed, forged or expired.
+func (v usernameValidator) Validate(key string, value []byte) error {
+	username, err := usernameFromKey(key)
+	if err != nil {
+		return err
+	}
+	_, _, err = ParseUsernameRecord(username, value)
+	return err
+}
+
+// Select picks the valid record with the highest sequence number of the
+// peer whose record this node stores. Without one, the first valid record
+// decides the owner. The DHT only replaces a stored record with the one
+// Select picks, so a record of another peer never takes over a username
+// while its owner keeps it alive, whatever times it claims.
+func (v usernameValidator) Select(key string, values [][]byte) (int, error) {
+	username, err := usernameFromKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var holder string
+	if v.held != nil {
+		if value := v.held(key); value != nil {
+			if rec, _, err := ParseUsernameRecord(username, value); err == nil {
+				holder = rec.PeerID
+			}
+		}
+	}
+
+	best := -1
+	var bestRec *UsernameRecord
+	for i, value := range values {
+		rec, _, err := ParseUsernameRecord(username, value)
+		if err != nil {
+			continue
+		}
+		if best == -1 || rec.supersedes(bestRec, holder) {
+			best = i
+			bestRec = rec
+		}
+	}
+	if best == -1 {
+		return 0, errors.New("no valid username record")
+	}
+	return best, nil
+}
+
+func usernameKey(username string) string {
+	return fmt.Sprintf("/username/%s", username)
+}
+
+func usernameFromKey(key string) (string, error) {
+	username := strings.TrimPrefix(key, "/username/")
+	if username == key || username == "" {
+		return "", fmt.Errorf("invalid username key %q", key)
+	}
+	return username, nil
+}
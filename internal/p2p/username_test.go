@@ -0,0 +1,190 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newTestKey(t *testing.T) crypto.PrivKey {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+// signedRecord signs a record with arbitrary fields, as a malicious peer can.
+func signedRecord(t *testing.T, priv crypto.PrivKey, username string, seq uint64, claimed, expires int64) []byte {
+	t.Helper()
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &UsernameRecord{Username: username, PeerID: id.String(), Seq: seq, Claimed: claimed, Expires: expires}
+	if rec.Signature, err = priv.Sign(rec.signingBytes()); err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// newRecord returns a record created the way the owner publishes it.
+func newRecord(t *testing.T, priv crypto.PrivKey, username string) []byte {
+	t.Helper()
+	rec, err := NewUsernameRecord(username, priv, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestUsernameValidatorRejectsInvalidTimes(t *testing.T) {
+	v := usernameValidator{}
+	key := usernameKey("alice")
+	priv := newTestKey(t)
+	now := time.Now()
+
+	if err := v.Validate(key, newRecord(t, priv, "alice")); err != nil {
+		t.Fatalf("valid record rejected: %v", err)
+	}
+	tests := map[string][]byte{
+		"expired":              signedRecord(t, priv, "alice", 1, now.Add(-2*time.Hour).Unix(), now.Add(-time.Hour).Unix()),
+		"never expiring":       signedRecord(t, priv, "alice", 1, 1, math.MaxInt64),
+		"expiring after a TTL": signedRecord(t, priv, "alice", 1, now.Unix(), now.Add(UsernameRecordTTL+time.Hour).Unix()),
+		"claimed in future":    signedRecord(t, priv, "alice", 1, now.Add(time.Hour).Unix(), now.Add(UsernameRecordTTL).Unix()),
+		"never claimed":        signedRecord(t, priv, "alice", 1, 0, now.Add(UsernameRecordTTL).Unix()),
+		"other username":       newRecord(t, priv, "bob"),
+	}
+	for name, value := range tests {
+		if err := v.Validate(key, value); err == nil {
+			t.Errorf("%s record accepted", name)
+		}
+	}
+
+	// Expired records are never selected
+	fresh := newRecord(t, priv, "alice")
+	i, err := v.Select(key, [][]byte{tests["expired"], fresh})
+	if err != nil || i != 1 {
+		t.Fatalf("Select picked %d, %v; want the unexpired record", i, err)
+	}
+}
+
+func TestUsernameValidatorSamePeerSeq(t *testing.T) {
+	v := usernameValidator{}
+	key := usernameKey("alice")
+	priv := newTestKey(t)
+	now := time.Now()
+	older := signedRecord(t, priv, "alice", 1, now.Unix(), now.Add(time.Hour).Unix())
+	newer := signedRecord(t, priv, "alice", 2, now.Unix(), now.Add(time.Hour).Unix())
+
+	for _, values := range [][][]byte{{older, newer}, {newer, older}} {
+		i, err := v.Select(key, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(values[i]) != string(newer) {
+			t.Fatal("Select picked the record with the lower sequence number")
+		}
+	}
+}
+
+func TestUsernameValidatorHijack(t *testing.T) {
+	key := usernameKey("alice")
+	owner := newRecord(t, newTestKey(t), "alice")
+	attacker := newTestKey(t)
+	now := time.Now()
+
+	// A backdated claim with the highest sequence number is still valid...
+	hijack := signedRecord(t, attacker, "alice", math.MaxUint64, 1, now.Add(UsernameRecordTTL).Unix())
+	if err := (usernameValidator{}).Validate(key, hijack); err != nil {
+		t.Fatalf("record rejected: %v", err)
+	}
+
+	// ...but does not replace the owner's record on nodes that hold it, in
+	// the order the DHT asks for puts ([new, existing]) or searches ([best,
+	// new])
+	v := usernameValidator{held: func(string) []byte { return owner }}
+	for _, values := range [][][]byte{{hijack, owner}, {owner, hijack}} {
+		i, err := v.Select(key, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(values[i]) != string(owner) {
+			t.Fatal("record of another peer replaced the owner's")
+		}
+	}
+
+	// Nodes that hold the attacker's record keep it in turn
+	v = usernameValidator{held: func(string) []byte { return hijack }}
+	if i, _ := v.Select(key, [][]byte{owner, hijack}); i != 1 {
+		t.Fatal("held record replaced by another peer's")
+	}
+
+	// A held record that expired decides nothing
+	expired := signedRecord(t, attacker, "alice", 1, now.Add(-2*time.Hour).Unix(), now.Add(-time.Hour).Unix())
+	v = usernameValidator{held: func(string) []byte { return expired }}
+	if i, _ := v.Select(key, [][]byte{owner, hijack}); i != 0 {
+		t.Fatal("Select did not keep the first record without a held one")
+	}
+}
+
+func TestHeldRecordReadsDHTDatastore(t *testing.T) {
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	store := dssync.MutexWrap(ds.NewMapDatastore())
+	kademliaDHT, err := dht.New(ctx, h,
+		dht.Mode(dht.ModeServer),
+		dht.ProtocolPrefix(DHTProtocolPrefix),
+		dht.Datastore(store),
+		dht.Validator(record.NamespacedValidator{
+			"username": usernameValidator{held: heldRecord(store)},
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kademliaDHT.Close()
+
+	key := usernameKey("alice")
+	value := newRecord(t, h.Peerstore().PrivKey(h.ID()), "alice")
+	// The DHT stores the record locally before it looks for peers, of which
+	// there are none
+	kademliaDHT.PutValue(ctx, key, value)
+	if got := heldRecord(store)(key); string(got) != string(value) {
+		t.Fatalf("held record is %q, want %q", got, value)
+	}
+
+	// Our record is kept against another peer's
+	other := newRecord(t, newTestKey(t), "alice")
+	if err := kademliaDHT.PutValue(ctx, key, other); err == nil {
+		t.Fatal("record of another peer replaced the held one")
+	}
+	if got := heldRecord(store)(key); string(got) != string(value) {
+		t.Fatal("held record changed")
+	}
+}